@@ -8,10 +8,20 @@ var orderData = {
   currency: "usd"
 };
 
+// The ID of the signed in user, the server uses it to find the user's Customer.
+// In a real application it comes from your session, here a random ID is kept
+// in localStorage.
+var userID = localStorage.getItem("userID");
+if (!userID) {
+  userID = "user_" + Math.random().toString(36).slice(2);
+  localStorage.setItem("userID", userID);
+}
+
 fetch("/create-setup-intent", {
   method: "POST",
   headers: {
-    "Content-Type": "application/json"
+    "Content-Type": "application/json",
+    "X-User-ID": userID
   },
   body: JSON.stringify(orderData)
 })
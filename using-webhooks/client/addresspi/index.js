@@ -6,7 +6,8 @@ document.addEventListener('DOMContentLoaded', async (e) => {
   const { clientSecret } = await fetch("/create-payment-intent", {
     method: "POST",
     headers: {
-      "Content-Type": "application/json"
+      "Content-Type": "application/json",
+      "X-User-ID": getUserID()
     }
   }).then(res => res.json());
 
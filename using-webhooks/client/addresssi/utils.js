@@ -15,3 +15,15 @@ const addDashboardLinks = (message) => {
     `<a href="${piDashboardBase}/$1" target="_blank">$1</a>`
   );
 };
+
+// Returns the ID of the signed in user, the server uses it to find the user's
+// Customer. In a real application it comes from your session, here a random
+// ID is kept in localStorage.
+const getUserID = () => {
+  let userID = localStorage.getItem('userID');
+  if (!userID) {
+    userID = `user_${Math.random().toString(36).slice(2)}`;
+    localStorage.setItem('userID', userID);
+  }
+  return userID;
+};
@@ -1,21 +1,42 @@
 // A reference to Stripe.js
 var stripe;
 
+// The last request sent and its Idempotency-Key. A retry of the same request,
+// after an error, sends the same key so the server processes it only once;
+// any other request gets a key of its own.
+var lastSubmission = { body: null, key: null };
+
+var idempotencyKeyFor = function (body) {
+    if (lastSubmission.body !== body) {
+        lastSubmission = { body: body, key: crypto.randomUUID() };
+    }
+    return lastSubmission.key;
+};
+
 document.querySelector("#cancel").addEventListener("click", function(evt) {
     evt.preventDefault();
     changeLoadingState(true);
     var piID = document.querySelector("#payment-id").value;
+    var body = JSON.stringify({
+        "paymentIntentID": piID
+    });
     // Initiate payment
-    fetch("/cancel-payment-intent", {
+    var token = document.querySelector("#operator-token").value;
+    fetch("/admin/payments/cancel", {
         method: "POST",
         headers: {
-            "Content-Type": "application/json"
+            "Content-Type": "application/json",
+            "Idempotency-Key": idempotencyKeyFor(body),
+            // payments are operated on by the back office only
+            "Authorization": "Bearer " + token
         },
-        body: JSON.stringify({
-            "paymentIntentID": piID
-        })
+        body: body
     })
         .then(function (result) {
+            if (result.status < 500) {
+                // processed: sending the same request again is a new one
+                lastSubmission.body = null;
+            }
             return result.json();
         })
         .then(function (result) {
@@ -28,10 +49,16 @@ document.querySelector("#cancel").addEventListener("click", function(evt) {
                 view.classList.remove("hidden");
             });
             document.querySelector(".status").textContent =
+                // amounts above the threshold wait for a second operator
+                result.approval ? "awaits approval" :
                 result.status === "succeeded" ? "succeeded" : "did not complete";
             document.querySelector("pre").textContent = paymentIntentJson;
 
         })
+        .catch(function () {
+            // not sent or not answered, the same request can be retried
+            changeLoadingState(false);
+        });
 });
 
 /* ------- Post-payment helpers ------- */
@@ -1,23 +1,47 @@
 // A reference to Stripe.js
 var stripe;
 
+// The last request sent and its Idempotency-Key. A retry of the same request,
+// after an error, sends the same key so the server processes it only once;
+// any other request gets a key of its own.
+var lastSubmission = { body: null, key: null };
+
+var idempotencyKeyFor = function (body) {
+    if (lastSubmission.body !== body) {
+        lastSubmission = { body: body, key: crypto.randomUUID() };
+    }
+    return lastSubmission.key;
+};
+
 document.querySelector("#capture").addEventListener("click", function(evt) {
     evt.preventDefault();
     changeLoadingState(true);
     var piID = document.querySelector("#payment-id").value;
     var piAmount = document.querySelector("#payment-amount").value;
+    var partial = document.querySelector("#partial-capture").checked;
+    var body = JSON.stringify({
+        "paymentIntentID": piID,
+        // the whole capturable amount is captured when omitted
+        "amount": piAmount === "" ? undefined : Math.round(piAmount*100),
+        "finalCapture": !partial,
+    });
     // Initiate payment
-    fetch("/capture-payment-intent", {
+    var token = document.querySelector("#operator-token").value;
+    fetch("/admin/payments/capture", {
         method: "POST",
         headers: {
-            "Content-Type": "application/json"
+            "Content-Type": "application/json",
+            "Idempotency-Key": idempotencyKeyFor(body),
+            // payments are operated on by the back office only
+            "Authorization": "Bearer " + token
         },
-        body: JSON.stringify({
-            "paymentIntentID": piID,
-            "amount": piAmount*100,
-        })
+        body: body
     })
         .then(function (result) {
+            if (result.status < 500) {
+                // processed: sending the same request again is a new one
+                lastSubmission.body = null;
+            }
             return result.json();
         })
         .then(function (result) {
@@ -30,10 +54,17 @@ document.querySelector("#capture").addEventListener("click", function(evt) {
                 view.classList.remove("hidden");
             });
             document.querySelector(".status").textContent =
-                result.status === "succeeded" ? "succeeded" : "did not complete";
+                // amounts above the threshold wait for a second operator
+                result.approval ? "awaits approval" :
+                result.status === "succeeded" ? "succeeded" :
+                result.status === "requires_capture" ? "partially captured" : "did not complete";
             document.querySelector("pre").textContent = paymentIntentJson;
 
         })
+        .catch(function () {
+            // not sent or not answered, the same request can be retried
+            changeLoadingState(false);
+        });
 });
 
 /* ------- Post-payment helpers ------- */
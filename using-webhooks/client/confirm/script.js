@@ -8,7 +8,9 @@ document.querySelector("#confirm").addEventListener("click", function(evt) {
     fetch("/confirm-payment-intent", {
         method: "POST",
         headers: {
-            "Content-Type": "application/json"
+            "Content-Type": "application/json",
+            // only the payments of the signed in user can be acted on
+            "X-User-ID": localStorage.getItem("userID") || ""
         },
         body: JSON.stringify({
             "paymentIntentID": piID
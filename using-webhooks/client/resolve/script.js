@@ -9,24 +9,30 @@ var stripe;
 // Used on the server to calculate order total
 
 
+document.querySelector("#user-id").value = localStorage.getItem("userID") || "";
+
 document.querySelector("#resolve").addEventListener("click", function(evt) {
   evt.preventDefault();
-  var cID = document.querySelector("#customer-id").value;
-  // Initiate payment
+  var userID = document.querySelector("#user-id").value;
+  // Resume the last payment of the user
   fetch("/resolve-last-payment-intent", {
     method: "POST",
     headers: {
-      "Content-Type": "application/json"
+      "Content-Type": "application/json",
+      "X-User-ID": userID
     },
-    body: JSON.stringify({
-      "customerID": cID
-    })
+    body: JSON.stringify({})
   })
       .then(function (result) {
-        return result.json();
+        return result.json().then(function (data) {
+          if (!result.ok) {
+            throw new Error(data.error.message);
+          }
+          return data;
+        });
       })
       .then(function (data) {
-        var cID = document.querySelector("#amount-info").textContent = "Amount: " + data.amount;
+        document.querySelector("#amount-info").textContent = "Amount: " + data.amount;
         return setupElements(data);
       })
       .then(function(stripeData) {
@@ -35,6 +41,9 @@ document.querySelector("#resolve").addEventListener("click", function(evt) {
           // Initiate payment
           confirm(stripeData.stripe, stripeData.card, stripeData.clientSecret, stripeData.elements);
         });
+      })
+      .catch(function (err) {
+        document.querySelector("#payment-errors").textContent = err.message;
       });
 });
 
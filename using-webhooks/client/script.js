@@ -8,10 +8,29 @@ var orderData = {
   currency: "usd"
 };
 
+// The ID of the signed in user, the server uses it to find the user's Customer.
+// In a real application it comes from your session, here a random ID is kept
+// in localStorage.
+var userID = localStorage.getItem("userID");
+if (!userID) {
+  userID = "user_" + Math.random().toString(36).slice(2);
+  localStorage.setItem("userID", userID);
+}
+
+// The Idempotency-Key of this checkout, kept until the payment is complete so
+// reloading the page returns the same payment intent instead of a new one.
+var checkoutKey = sessionStorage.getItem("checkoutKey");
+if (!checkoutKey) {
+  checkoutKey = crypto.randomUUID();
+  sessionStorage.setItem("checkoutKey", checkoutKey);
+}
+
 fetch("/create-payment-intent", {
   method: "POST",
   headers: {
-    "Content-Type": "application/json"
+    "Content-Type": "application/json",
+    "Idempotency-Key": checkoutKey,
+    "X-User-ID": userID
   },
   body: JSON.stringify(orderData)
 })
@@ -110,6 +129,8 @@ var pay = function(stripe, card, clientSecret) {
 
 // Shows a success / error message when the payment is complete
 var orderComplete = function(clientSecret) {
+  // the next checkout is a new payment
+  sessionStorage.removeItem("checkoutKey");
   stripe.retrievePaymentIntent(clientSecret).then(function(result) {
     var paymentIntent = result.paymentIntent;
     var paymentIntentJson = JSON.stringify(paymentIntent, null, 2);
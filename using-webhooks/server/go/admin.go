@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/events"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+)
+
+// Role is the role of a back-office operator, it grants the permissions
+// listed in rolePermissions.
+type Role string
+
+const (
+	// RoleViewer only reads.
+	RoleViewer Role = "viewer"
+	// RoleOperator also captures and cancels payments and replays webhook
+	// events.
+	RoleOperator Role = "operator"
+	// RoleFinanceAdmin also refunds payments and charges customers.
+	RoleFinanceAdmin Role = "finance-admin"
+)
+
+// Action is an operation of the /admin endpoints.
+type Action string
+
+const (
+	ActionView    Action = "view"
+	ActionReplay  Action = "replay"
+	ActionCapture Action = "capture"
+	ActionCancel  Action = "cancel"
+	ActionRefund  Action = "refund"
+	ActionCharge  Action = "charge"
+)
+
+// rolePermissions lists the actions permitted to each role.
+var rolePermissions = map[Role]map[Action]bool{
+	RoleViewer: {ActionView: true},
+	RoleOperator: {
+		ActionView: true, ActionReplay: true, ActionCapture: true, ActionCancel: true,
+	},
+	RoleFinanceAdmin: {
+		ActionView: true, ActionReplay: true, ActionCapture: true, ActionCancel: true,
+		ActionRefund: true, ActionCharge: true,
+	},
+}
+
+// Operator is a back-office user of the /admin endpoints.
+type Operator struct {
+	// Name identifies the operator in the approvals.
+	Name string
+	Role Role
+	// Token authenticates the operator as a bearer token.
+	Token string
+}
+
+// Can reports whether the role of the operator permits the action.
+func (op Operator) Can(action Action) bool {
+	return rolePermissions[op.Role][action]
+}
+
+type operatorContextKey struct{}
+
+// operatorFrom returns the operator making the request, if any.
+func operatorFrom(ctx context.Context) (Operator, bool) {
+	op, ok := ctx.Value(operatorContextKey{}).(Operator)
+	return op, ok
+}
+
+// requireRole only lets through the requests of the operators whose role
+// permits the action. The operator is passed on in the request context, as
+// the back-office caller of the request.
+func (s *Server) requireRole(action Action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, ok := s.requestOperator(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		if !op.Can(action) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("role %s cannot %s", op.Role, action))
+			return
+		}
+		ctx := context.WithValue(r.Context(), operatorContextKey{}, op)
+		ctx = auth.NewContext(ctx, auth.Principal{KeyName: op.Name})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// requestOperator returns the operator whose token is the bearer token of
+// the request.
+func (s *Server) requestOperator(r *http.Request) (Operator, bool) {
+	token, hasToken := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hasToken || token == "" {
+		return Operator{}, false
+	}
+	// every token is compared, in constant time, so the time taken does
+	// not tell how close the token is to one of them
+	sum := sha256.Sum256([]byte(token))
+	var found Operator
+	ok := false
+	for _, op := range s.operators {
+		opSum := sha256.Sum256([]byte(op.Token))
+		if subtle.ConstantTimeCompare(sum[:], opSum[:]) == 1 {
+			found, ok = op, true
+		}
+	}
+	return found, ok
+}
+
+// DeadLetter is a webhook event that could not be processed.
+type DeadLetter struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError"`
+	Received  int64  `json:"received"`
+}
+
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	dead, err := s.inbox.DeadLetters(r.Context())
+	if err != nil {
+		writeFailure(w, "inbox.DeadLetters", err)
+		return
+	}
+
+	letters := make([]DeadLetter, 0, len(dead))
+	for _, e := range dead {
+		letters = append(letters, DeadLetter{
+			ID:        e.ID,
+			Type:      e.Type,
+			Attempts:  e.Attempts,
+			LastError: e.LastError,
+			Received:  e.Received,
+		})
+	}
+	writeJSON(w, struct {
+		DeadLetters []DeadLetter `json:"deadLetters"`
+	}{
+		DeadLetters: letters,
+	})
+}
+
+// ReplayRequestParams names the dead-lettered event to replay.
+type ReplayRequestParams struct {
+	EventID string `json:"eventID"`
+}
+
+func (req *ReplayRequestParams) validate(v *validator) {
+	v.requiredID("eventID", req.EventID)
+}
+
+func (s *Server) handleReplayWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	req := ReplayRequestParams{}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	err := s.inbox.Replay(r.Context(), req.EventID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, http.StatusNotFound, "unknown event")
+		return
+	case errors.Is(err, events.ErrNotDeadLetter):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeFailure(w, "inbox.Replay", err)
+		return
+	}
+
+	writeJSON(w, struct {
+		Status string `json:"status"`
+	}{
+		Status: "queued",
+	})
+}
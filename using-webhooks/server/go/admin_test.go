@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/audit"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// Tokens of the operators of withOperators.
+const (
+	viewerToken  = "viewer-token-0123456789"
+	bobToken     = "operator-token-bob-0123"
+	aliceToken   = "finance-token-alice-0123"
+	carolToken   = "finance-token-carol-0123"
+	unknownToken = "unknown-token-0123456789"
+)
+
+// withOperators configures a viewer, the operator bob and the finance
+// admins alice and carol, and the approval threshold of usd, none when
+// zero.
+func withOperators(threshold int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.Operators = []Operator{
+			{Name: "vic", Role: RoleViewer, Token: viewerToken},
+			{Name: "bob", Role: RoleOperator, Token: bobToken},
+			{Name: "alice", Role: RoleFinanceAdmin, Token: aliceToken},
+			{Name: "carol", Role: RoleFinanceAdmin, Token: carolToken},
+		}
+		if threshold > 0 {
+			cfg.ApprovalThresholds = map[string]int64{"usd": threshold}
+		}
+	}
+}
+
+func adminRequest(t *testing.T, s *Server, token, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+// adminCharge charges through the admin API with the Idempotency-Key the
+// endpoint requires.
+func adminCharge(t *testing.T, s *Server, token, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/admin/payments/charge", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func approvalOf(t *testing.T, w *httptest.ResponseRecorder) ApprovalRecord {
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var resp struct {
+		Approval ApprovalRecord `json:"approval"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Approval
+}
+
+func TestAdminRoles(t *testing.T) {
+	s, fake := newTestServer(t, withOperators(0))
+	pi := authorizedOrder(t, s, fake)
+	body := `{"paymentIntentID": "` + pi.ID + `"}`
+
+	w := adminRequest(t, s, unknownToken, http.MethodGet, "/admin/approvals", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	w = adminRequest(t, s, viewerToken, http.MethodGet, "/admin/approvals", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = adminRequest(t, s, viewerToken, http.MethodPost, "/admin/payments/capture", body)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Equal(t, "role viewer cannot capture", errorOf(t, w).Message)
+	w = adminRequest(t, s, bobToken, http.MethodPost, "/admin/payments/capture", body)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = adminRequest(t, s, bobToken, http.MethodPost, "/admin/payments/refund", body)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	w = adminRequest(t, s, aliceToken, http.MethodPost, "/admin/payments/refund", body)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// the operator actions are not served outside of /admin anymore
+	for _, path := range []string{"/capture-payment-intent", "/cancel-payment-intent", "/refund", "/charge-saved-payment-method"} {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set(userIDHeader, "user_1")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	t.Run("a second operator approves the request", func(t *testing.T) {
+		s, fake := newTestServer(t, withOperators(1000))
+		pi := authorizedOrder(t, s, fake)
+
+		// below the threshold
+		w := adminRequest(t, s, bobToken, http.MethodPost, "/admin/payments/capture",
+			`{"paymentIntentID": "`+pi.ID+`", "amount": 300, "finalCapture": false}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = adminRequest(t, s, bobToken, http.MethodPost, "/admin/payments/capture", `{"paymentIntentID": "`+pi.ID+`"}`)
+		approval := approvalOf(t, w)
+		require.Equal(t, "capture", approval.Action)
+		require.Equal(t, int64(1100), approval.Amount)
+		require.Equal(t, "bob", approval.RequestedBy)
+		require.Equal(t, "pending", approval.Status)
+		require.Equal(t, int64(300), fakeIntent(t, fake, pi.ID).AmountReceived)
+
+		decide := `{"approvalID": "` + approval.ID + `"}`
+		w = adminRequest(t, s, bobToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		require.Equal(t, "approval must come from a second operator", errorOf(t, w).Message)
+		w = adminRequest(t, s, viewerToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		w = adminRequest(t, s, aliceToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var record CaptureRecord
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &record))
+		require.Equal(t, "succeeded", record.Status)
+		require.Equal(t, int64(1400), fakeIntent(t, fake, pi.ID).AmountReceived)
+
+		w = adminRequest(t, s, carolToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusConflict, w.Code)
+
+		w = adminRequest(t, s, viewerToken, http.MethodGet, "/admin/approvals?status=approved", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var list struct {
+			Approvals []ApprovalRecord `json:"approvals"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Approvals, 1)
+		require.Equal(t, "alice", list.Approvals[0].DecidedBy)
+	})
+
+	t.Run("the approver needs the permission of the action", func(t *testing.T) {
+		s, fake := newTestServer(t, withOperators(1000))
+		pi := authorizedOrder(t, s, fake)
+		w := postJSON(t, s.handleCapturePaymentIntent, "", `{"paymentIntentID": "`+pi.ID+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = adminRequest(t, s, aliceToken, http.MethodPost, "/admin/payments/refund", `{"paymentIntentID": "`+pi.ID+`"}`)
+		decide := `{"approvalID": "` + approvalOf(t, w).ID + `"}`
+		w = adminRequest(t, s, bobToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		require.Equal(t, "role operator cannot refund", errorOf(t, w).Message)
+
+		w = adminRequest(t, s, carolToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, int64(1400), listRefunds(t, s, pi.ID).AmountRefunded)
+	})
+
+	t.Run("a rejected request is not made", func(t *testing.T) {
+		s, fake := newTestServer(t, withOperators(1000))
+		customerID := customerOf(t, s, "user_1")
+		pm := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		fake.SetDefaultPaymentMethod(customerID, pm.ID)
+
+		w := adminCharge(t, s, aliceToken, "key_1", `{"userID": "user_1", "amount": 5000}`)
+		decide := `{"approvalID": "` + approvalOf(t, w).ID + `"}`
+		w = adminRequest(t, s, carolToken, http.MethodPost, "/admin/approvals/reject", decide)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var approval ApprovalRecord
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &approval))
+		require.Equal(t, "rejected", approval.Status)
+
+		w = adminRequest(t, s, carolToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusConflict, w.Code)
+		pis, err := fake.ListPaymentIntents(nil)
+		require.NoError(t, err)
+		require.Empty(t, pis)
+	})
+
+	t.Run("currencies without a threshold always wait", func(t *testing.T) {
+		s, fake := newTestServer(t, withOperators(1000))
+		customerID := customerOf(t, s, "user_1")
+		pm := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		fake.SetDefaultPaymentMethod(customerID, pm.ID)
+
+		w := adminCharge(t, s, aliceToken, "key_1", `{"userID": "user_1", "amount": 500, "currency": "usd"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		approval := approvalOf(t, adminCharge(t, s, aliceToken, "key_2", `{"userID": "user_1", "amount": 500, "currency": "eur"}`))
+		require.Equal(t, "eur", approval.Currency)
+	})
+
+	t.Run("a failed request can be approved again", func(t *testing.T) {
+		gw := &failingRefunds{Fake: gateway.NewFake(), fail: true}
+		s, _ := newTestServer(t, withOperators(1000), func(cfg *Config) { cfg.Gateway = gw })
+		pi := authorizedOrder(t, s, gw.Fake)
+		w := postJSON(t, s.handleCapturePaymentIntent, "", `{"paymentIntentID": "`+pi.ID+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = adminRequest(t, s, aliceToken, http.MethodPost, "/admin/payments/refund", `{"paymentIntentID": "`+pi.ID+`"}`)
+		decide := `{"approvalID": "` + approvalOf(t, w).ID + `"}`
+		w = adminRequest(t, s, carolToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+		w = adminRequest(t, s, viewerToken, http.MethodGet, "/admin/approvals?status=failed", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var list struct {
+			Approvals []ApprovalRecord `json:"approvals"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Approvals, 1)
+		require.Equal(t, "carol", list.Approvals[0].DecidedBy)
+		require.Contains(t, string(list.Approvals[0].Result), "charge_disputed")
+		require.Zero(t, listRefunds(t, s, pi.ID).AmountRefunded)
+
+		gw.fail = false
+		w = adminRequest(t, s, carolToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, int64(1400), listRefunds(t, s, pi.ID).AmountRefunded)
+		w = adminRequest(t, s, carolToken, http.MethodPost, "/admin/approvals/approve", decide)
+		require.Equal(t, http.StatusConflict, w.Code)
+	})
+}
+
+// failingRefunds is a fake gateway refusing the refunds while fail is set.
+type failingRefunds struct {
+	*gateway.Fake
+	fail bool
+}
+
+func (g *failingRefunds) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	if g.fail {
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeChargeDisputed,
+			Msg:            "The charge is disputed.",
+			HTTPStatusCode: http.StatusBadRequest,
+		}
+	}
+	return g.Fake.NewRefund(params)
+}
+
+func fakeIntent(t *testing.T, fake *gateway.Fake, id string) *stripe.PaymentIntent {
+	pi, err := fake.GetPaymentIntent(id, nil)
+	require.NoError(t, err)
+	return pi
+}
+
+func TestAuditTrail(t *testing.T) {
+	trail := audit.NewMemory()
+	s, fake := newTestServer(t, withOperators(1000), func(cfg *Config) { cfg.Audit = trail })
+	pi := authorizedOrder(t, s, fake)
+
+	w := adminRequest(t, s, bobToken, http.MethodPost, "/admin/payments/capture",
+		`{"paymentIntentID": "`+pi.ID+`", "amount": 300, "finalCapture": false}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = adminRequest(t, s, bobToken, http.MethodPost, "/admin/payments/capture", `{"paymentIntentID": "`+pi.ID+`"}`)
+	decide := `{"approvalID": "` + approvalOf(t, w).ID + `"}`
+	w = adminRequest(t, s, aliceToken, http.MethodPost, "/admin/approvals/approve", decide)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	// the intent is captured already, Stripe refuses to cancel it
+	w = adminRequest(t, s, bobToken, http.MethodPost, "/admin/payments/cancel", `{"paymentIntentID": "`+pi.ID+`"}`)
+	require.NotEqual(t, http.StatusOK, w.Code)
+
+	w = adminRequest(t, s, viewerToken, http.MethodGet, "/admin/audit?paymentIntentID="+pi.ID, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Entries []audit.Entry `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Entries, 4)
+
+	canceled, approved, held, captured := resp.Entries[0], resp.Entries[1], resp.Entries[2], resp.Entries[3]
+	require.Equal(t, "cancel", canceled.Action)
+	require.Equal(t, audit.OutcomeFailed, canceled.Outcome)
+	require.Equal(t, "payment_intent_unexpected_state", canceled.Error)
+	require.NotEmpty(t, canceled.StripeRequestID)
+
+	require.Equal(t, "key:alice", approved.Actor)
+	require.Equal(t, int64(1100), approved.Amount)
+	require.Equal(t, audit.OutcomeSucceeded, approved.Outcome)
+	require.Equal(t, held.ApprovalID, approved.ApprovalID)
+
+	require.Equal(t, "key:bob", held.Actor)
+	require.Equal(t, audit.OutcomeHeld, held.Outcome)
+	require.Empty(t, held.StripeRequestID)
+
+	require.Equal(t, audit.Entry{
+		Created:         captured.Created,
+		Actor:           "key:bob",
+		Action:          "capture",
+		PaymentIntentID: pi.ID,
+		Amount:          300,
+		Currency:        "usd",
+		StripeRequestID: captured.StripeRequestID,
+		Outcome:         audit.OutcomeSucceeded,
+	}, captured)
+	require.NotEmpty(t, captured.StripeRequestID)
+
+	w = adminRequest(t, s, viewerToken, http.MethodGet, "/admin/audit?actor=key:alice&limit=1", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var byActor struct {
+		Entries []audit.Entry `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &byActor))
+	require.Equal(t, []audit.Entry{approved}, byActor.Entries)
+
+	w = adminRequest(t, s, viewerToken, http.MethodGet, "/admin/audit?action=delete&limit=0", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Len(t, errorOf(t, w).Fields, 2)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/audit"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+)
+
+// approvalStatuses are the statuses of the approvals.
+var approvalStatuses = map[string]bool{
+	store.ApprovalPending:  true,
+	store.ApprovalApproved: true,
+	store.ApprovalRejected: true,
+	store.ApprovalFailed:   true,
+}
+
+type approvalContextKey struct{}
+
+// ApprovalRecord is a back-office request held until a second operator
+// approves or rejects it.
+type ApprovalRecord struct {
+	ID              string          `json:"id"`
+	Action          string          `json:"action"`
+	PaymentIntentID string          `json:"paymentIntentID,omitempty"`
+	Amount          int64           `json:"amount"`
+	Currency        string          `json:"currency"`
+	Request         json.RawMessage `json:"request"`
+	RequestedBy     string          `json:"requestedBy"`
+	DecidedBy       string          `json:"decidedBy,omitempty"`
+	Status          string          `json:"status"`
+	Created         int64           `json:"created"`
+	Decided         int64           `json:"decided,omitempty"`
+	// Result is the response to the last request made once approved.
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// ApprovalRequestParams names the approval to decide.
+type ApprovalRequestParams struct {
+	ApprovalID string `json:"approvalID"`
+}
+
+func (req *ApprovalRequestParams) validate(v *validator) {
+	v.requiredID("approvalID", req.ApprovalID)
+}
+
+func newApprovalRecord(a store.Approval) ApprovalRecord {
+	return ApprovalRecord{
+		ID:              a.ID,
+		Action:          a.Action,
+		PaymentIntentID: a.PaymentIntentID,
+		Amount:          a.Amount,
+		Currency:        a.Currency,
+		Request:         a.Body,
+		RequestedBy:     a.RequestedBy,
+		DecidedBy:       a.DecidedBy,
+		Status:          a.Status,
+		Created:         a.Created,
+		Decided:         a.Decided,
+		Result:          a.Result,
+	}
+}
+
+// holdForApproval holds the request req of an operator when its amount is
+// above the approval threshold of its currency, so the Stripe call is only
+// made once a second operator approves it, and reports whether it did. The
+// request is answered with a 202 and the pending approval when it is held.
+func (s *Server) holdForApproval(w http.ResponseWriter, r *http.Request, action Action, req interface{}, paymentIntentID string, amount int64, currency string) bool {
+	op, ok := operatorFrom(r.Context())
+	if !ok || !s.needsApproval(amount, currency) {
+		return false
+	}
+	if _, approved := r.Context().Value(approvalContextKey{}).(string); approved {
+		return false
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		writeFailure(w, "json.Marshal", err)
+		return true
+	}
+	a := store.Approval{
+		ID:              "apr_" + rand.Text(),
+		Action:          string(action),
+		PaymentIntentID: paymentIntentID,
+		Amount:          amount,
+		Currency:        currency,
+		Body:            body,
+		RequestedBy:     op.Name,
+		Status:          store.ApprovalPending,
+		Created:         time.Now().Unix(),
+	}
+	if err := s.store.SaveApproval(r.Context(), a); err != nil {
+		writeFailure(w, "store.SaveApproval", err)
+		return true
+	}
+	slog.InfoContext(r.Context(), "request awaits approval", "action", action, logging.PaymentIntentID(paymentIntentID),
+		"amount", amount, "currency", currency, "operator", op.Name, "approval_id", a.ID)
+	s.auditAction(r.Context(), audit.Entry{
+		Action:          string(action),
+		PaymentIntentID: paymentIntentID,
+		Amount:          amount,
+		Currency:        currency,
+		Outcome:         audit.OutcomeHeld,
+		ApprovalID:      a.ID,
+	})
+	writeJSONStatus(w, http.StatusAccepted, struct {
+		Approval ApprovalRecord `json:"approval"`
+	}{
+		Approval: newApprovalRecord(a),
+	})
+	return true
+}
+
+// needsApproval reports whether an amount in the currency is above its
+// approval threshold. Currencies without a threshold always need approval,
+// unless there are no thresholds at all.
+func (s *Server) needsApproval(amount int64, currency string) bool {
+	if len(s.cfg.ApprovalThresholds) == 0 {
+		return false
+	}
+	threshold, ok := s.cfg.ApprovalThresholds[strings.ToLower(currency)]
+	return !ok || amount > threshold
+}
+
+// approvalHandler returns the handler making the requests of the action.
+func (s *Server) approvalHandler(action Action) http.HandlerFunc {
+	switch action {
+	case ActionCapture:
+		return s.handleCapturePaymentIntent
+	case ActionRefund:
+		return s.handleRefund
+	case ActionCharge:
+		return s.handleChargeSavedPaymentMethod
+	}
+	return nil
+}
+
+// handleApprovals lists the approvals, the pending ones unless the status
+// query parameter asks for others.
+func (s *Server) handleApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = store.ApprovalPending
+	}
+	v := &validator{}
+	v.oneOf("status", status, approvalStatuses)
+	if len(v.errs) > 0 {
+		writeFieldErrors(w, v.errs)
+		return
+	}
+
+	approvals, err := s.store.Approvals(r.Context(), status)
+	if err != nil {
+		writeFailure(w, "store.Approvals", err)
+		return
+	}
+	records := make([]ApprovalRecord, 0, len(approvals))
+	for _, a := range approvals {
+		records = append(records, newApprovalRecord(a))
+	}
+	writeJSON(w, struct {
+		Approvals []ApprovalRecord `json:"approvals"`
+	}{
+		Approvals: records,
+	})
+}
+
+// handleApprove approves a pending request and makes it, the response is
+// the one of the request. The approval is saved once the request is made,
+// with its response: failed requests can be approved again.
+func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
+	s.approvalsMu.Lock()
+	defer s.approvalsMu.Unlock()
+	a, ok := s.decideApproval(w, r, store.ApprovalApproved)
+	if !ok {
+		return
+	}
+
+	// the request is made on behalf of the approver, retries of the Stripe
+	// calls use keys of their own
+	ctx := context.WithValue(r.Context(), approvalContextKey{}, a.ID)
+	ctx = context.WithValue(ctx, idempotencyKeyContextKey{}, hashOf("approval", a.ID, strconv.Itoa(a.Attempts)))
+	approved := r.Clone(ctx)
+	approved.Body = io.NopCloser(bytes.NewReader(a.Body))
+	approved.ContentLength = int64(len(a.Body))
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.approvalHandler(Action(a.Action))(rec, approved)
+
+	a.Result = rec.body.Bytes()
+	switch {
+	case rec.status >= http.StatusInternalServerError:
+		// the outcome is unknown, approving again retries with the same keys
+		a.Status = store.ApprovalFailed
+	case rec.status >= http.StatusBadRequest:
+		a.Status = store.ApprovalFailed
+		a.Attempts++
+	}
+	if err := s.store.SaveApproval(r.Context(), a); err != nil {
+		// the response to the request is sent already
+		slog.ErrorContext(r.Context(), "store.SaveApproval failed", "approval_id", a.ID, logging.Err(err))
+		return
+	}
+	logDecision(r.Context(), a)
+}
+
+// handleReject rejects a pending request.
+func (s *Server) handleReject(w http.ResponseWriter, r *http.Request) {
+	s.approvalsMu.Lock()
+	defer s.approvalsMu.Unlock()
+	a, ok := s.decideApproval(w, r, store.ApprovalRejected)
+	if !ok {
+		return
+	}
+	if err := s.store.SaveApproval(r.Context(), a); err != nil {
+		writeFailure(w, "store.SaveApproval", err)
+		return
+	}
+	logDecision(r.Context(), a)
+	s.auditAction(r.Context(), audit.Entry{
+		Action:          a.Action,
+		PaymentIntentID: a.PaymentIntentID,
+		Amount:          a.Amount,
+		Currency:        a.Currency,
+		Outcome:         audit.OutcomeRejected,
+		ApprovalID:      a.ID,
+	})
+	writeJSON(w, newApprovalRecord(a))
+}
+
+// decideApproval reads the approval named by the request and sets its
+// decision, status, for the caller to save while holding approvalsMu. The
+// approval must be pending, or failed, and the operator deciding must not
+// be the one who made the request and must be permitted its action. The
+// error response is written when it fails.
+func (s *Server) decideApproval(w http.ResponseWriter, r *http.Request, status string) (store.Approval, bool) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return store.Approval{}, false
+	}
+	req := ApprovalRequestParams{}
+	if !decodeRequest(w, r, &req) {
+		return store.Approval{}, false
+	}
+	op, ok := operatorFrom(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return store.Approval{}, false
+	}
+
+	a, err := s.store.Approval(r.Context(), req.ApprovalID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, http.StatusNotFound, "unknown approval")
+		return a, false
+	case err != nil:
+		writeFailure(w, "store.Approval", err)
+		return a, false
+	case a.Status != store.ApprovalPending && a.Status != store.ApprovalFailed:
+		writeError(w, http.StatusConflict, "approval is "+a.Status+" already")
+		return a, false
+	case a.RequestedBy == op.Name:
+		writeError(w, http.StatusForbidden, "approval must come from a second operator")
+		return a, false
+	case !op.Can(Action(a.Action)):
+		writeError(w, http.StatusForbidden, fmt.Sprintf("role %s cannot %s", op.Role, a.Action))
+		return a, false
+	}
+
+	a.Status = status
+	a.DecidedBy = op.Name
+	a.Decided = time.Now().Unix()
+	return a, true
+}
+
+// logDecision logs the saved decision on a.
+func logDecision(ctx context.Context, a store.Approval) {
+	slog.InfoContext(ctx, "approval decided", "approval_id", a.ID, "action", a.Action,
+		logging.PaymentIntentID(a.PaymentIntentID), "status", a.Status, "operator", a.DecidedBy)
+}
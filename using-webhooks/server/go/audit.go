@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/audit"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// auditedActions are the actions recorded in the audit trail.
+var auditedActions = map[string]bool{
+	string(ActionCapture): true,
+	string(ActionCancel):  true,
+	string(ActionRefund):  true,
+	string(ActionCharge):  true,
+}
+
+// maxAuditEntries is the number of entries returned by /admin/audit at
+// most, and by default.
+const maxAuditEntries = 100
+
+// auditAction appends e, an action of the request of ctx, to the audit
+// trail. The actor is the caller of the request, and the approval the one
+// the request was approved by, if any. Failures are only logged, the
+// action was already taken.
+func (s *Server) auditAction(ctx context.Context, e audit.Entry) {
+	e.Created = time.Now().Unix()
+	if p, ok := auth.FromContext(ctx); ok {
+		e.Actor = p.String()
+	}
+	if id, ok := ctx.Value(approvalContextKey{}).(string); ok && e.ApprovalID == "" {
+		e.ApprovalID = id
+	}
+	if err := s.trail.Append(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "audit.Append failed", logging.PaymentIntentID(e.PaymentIntentID), logging.Err(err))
+	}
+}
+
+// auditPaymentIntent audits the action on pi, of amount, made by the
+// Stripe request which returned result or failed with err.
+func (s *Server) auditPaymentIntent(ctx context.Context, action Action, pi *stripe.PaymentIntent, amount int64, result *stripe.PaymentIntent, err error) {
+	e := audit.Entry{
+		Action:          string(action),
+		PaymentIntentID: pi.ID,
+		Amount:          amount,
+		Currency:        string(pi.Currency),
+	}
+	var resp *stripe.APIResponse
+	if result != nil {
+		resp = result.LastResponse
+	}
+	e.SetResult(resp, err)
+	s.auditAction(ctx, e)
+}
+
+// handleAudit lists the entries of the audit trail, most recent first,
+// selected by the paymentIntentID, actor and action query parameters.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	query := r.URL.Query()
+	q := audit.Query{
+		PaymentIntentID: query.Get("paymentIntentID"),
+		Actor:           query.Get("actor"),
+		Action:          query.Get("action"),
+		Limit:           maxAuditEntries,
+	}
+	v := &validator{}
+	v.id("paymentIntentID", q.PaymentIntentID)
+	v.oneOf("action", q.Action, auditedActions)
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		v.check(err == nil && n > 0 && n <= maxAuditEntries, "limit", "must be between 1 and %d", maxAuditEntries)
+		q.Limit = n
+	}
+	if len(v.errs) > 0 {
+		writeFieldErrors(w, v.errs)
+		return
+	}
+
+	entries, err := s.trail.Entries(r.Context(), q)
+	if err != nil {
+		writeFailure(w, "audit.Entries", err)
+		return
+	}
+	writeJSON(w, struct {
+		Entries []audit.Entry `json:"entries"`
+	}{
+		Entries: entries,
+	})
+}
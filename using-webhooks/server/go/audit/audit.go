@@ -0,0 +1,133 @@
+// Package audit keeps the append-only trail of the actions moving money:
+// who captured, canceled, charged or refunded which payment intent, for
+// what amount, and how Stripe answered.
+package audit
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/stripe/stripe-go/v80"
+)
+
+// Outcome is how an audited action ended.
+type Outcome string
+
+const (
+	// OutcomeSucceeded means Stripe accepted the request.
+	OutcomeSucceeded Outcome = "succeeded"
+	// OutcomeFailed means Stripe, or the server before reaching it,
+	// refused the request.
+	OutcomeFailed Outcome = "failed"
+	// OutcomeHeld means the request waits for the approval of a second
+	// operator, nothing was sent to Stripe.
+	OutcomeHeld Outcome = "held"
+	// OutcomeRejected means the approval of the request was refused,
+	// nothing was sent to Stripe.
+	OutcomeRejected Outcome = "rejected"
+)
+
+// Entry is one action of the trail. Entries never carry the Stripe objects
+// themselves, only the fields identifying the action.
+type Entry struct {
+	Created int64 `json:"created"`
+	// Actor is who asked for the action, a user:, key: or system: name.
+	Actor           string  `json:"actor"`
+	Action          string  `json:"action"`
+	PaymentIntentID string  `json:"paymentIntentID,omitempty"`
+	Amount          int64   `json:"amount"`
+	Currency        string  `json:"currency,omitempty"`
+	StripeRequestID string  `json:"stripeRequestID,omitempty"`
+	Outcome         Outcome `json:"outcome"`
+	// Error is the Stripe error code, or the error message when there is
+	// none, of a failed action.
+	Error      string `json:"error,omitempty"`
+	ApprovalID string `json:"approvalID,omitempty"`
+}
+
+// SetResult sets the outcome of e, and the ID of the Stripe request, from
+// the response or the error of the Stripe request made for the action.
+func (e *Entry) SetResult(resp *stripe.APIResponse, err error) {
+	var stripeErr *stripe.Error
+	switch {
+	case errors.As(err, &stripeErr):
+		e.Outcome = OutcomeFailed
+		e.StripeRequestID = stripeErr.RequestID
+		e.Error = string(stripeErr.Code)
+		if e.Error == "" {
+			e.Error = stripeErr.Msg
+		}
+	case err != nil:
+		e.Outcome = OutcomeFailed
+		e.Error = err.Error()
+	default:
+		e.Outcome = OutcomeSucceeded
+		if resp != nil {
+			e.StripeRequestID = resp.RequestID
+		}
+	}
+}
+
+// Query selects entries, the empty fields match every entry.
+type Query struct {
+	PaymentIntentID string
+	Actor           string
+	Action          string
+	// Limit is the maximum number of entries returned, all of them when
+	// zero.
+	Limit int
+}
+
+// Match reports whether e is selected by q.
+func (q Query) Match(e Entry) bool {
+	return (q.PaymentIntentID == "" || q.PaymentIntentID == e.PaymentIntentID) &&
+		(q.Actor == "" || q.Actor == e.Actor) &&
+		(q.Action == "" || q.Action == e.Action)
+}
+
+// Sink stores the trail. Entries are only ever appended.
+type Sink interface {
+	Append(ctx context.Context, e Entry) error
+	// Entries returns the entries selected by q, most recent first.
+	Entries(ctx context.Context, q Query) ([]Entry, error)
+}
+
+// Memory is a Sink keeping the trail in memory, for tests and embedding.
+type Memory struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// NewMemory returns an empty Memory sink.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Append(_ context.Context, e Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func (m *Memory) Entries(_ context.Context, q Query) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return selectEntries(m.entries, q), nil
+}
+
+// selectEntries returns the entries of trail, in the order they were
+// appended, selected by q, most recent first.
+func selectEntries(trail []Entry, q Query) []Entry {
+	entries := []Entry{}
+	for i := len(trail) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(entries) == q.Limit {
+			break
+		}
+		if q.Match(trail[i]) {
+			entries = append(entries, trail[i])
+		}
+	}
+	return entries
+}
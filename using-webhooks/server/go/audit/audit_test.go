@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v80"
+)
+
+func TestSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	file, err := NewFile(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { file.Close() })
+
+	for name, sink := range map[string]Sink{"memory": NewMemory(), "file": file} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			entries := []Entry{
+				{Created: 1, Actor: "key:alice", Action: "capture", PaymentIntentID: "pi_1", Amount: 1400, Outcome: OutcomeSucceeded},
+				{Created: 2, Actor: "key:bob", Action: "refund", PaymentIntentID: "pi_1", Amount: 400, Outcome: OutcomeHeld},
+				{Created: 3, Actor: "key:alice", Action: "cancel", PaymentIntentID: "pi_2", Outcome: OutcomeFailed},
+			}
+			for _, e := range entries {
+				require.NoError(t, sink.Append(ctx, e))
+			}
+
+			got, err := sink.Entries(ctx, Query{})
+			require.NoError(t, err)
+			require.Equal(t, []Entry{entries[2], entries[1], entries[0]}, got)
+
+			got, err = sink.Entries(ctx, Query{PaymentIntentID: "pi_1"})
+			require.NoError(t, err)
+			require.Equal(t, []Entry{entries[1], entries[0]}, got)
+
+			got, err = sink.Entries(ctx, Query{Actor: "key:alice", Limit: 1})
+			require.NoError(t, err)
+			require.Equal(t, []Entry{entries[2]}, got)
+
+			got, err = sink.Entries(ctx, Query{Action: "charge"})
+			require.NoError(t, err)
+			require.Empty(t, got)
+		})
+	}
+
+	// the trail outlives the sink
+	require.NoError(t, file.Close())
+	file, err = NewFile(path)
+	require.NoError(t, err)
+	require.NoError(t, file.Append(context.Background(), Entry{Created: 4, Action: "charge"}))
+	got, err := file.Entries(context.Background(), Query{})
+	require.NoError(t, err)
+	require.Len(t, got, 4)
+	require.Equal(t, "charge", got[0].Action)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestSetResult(t *testing.T) {
+	var e Entry
+	e.SetResult(&stripe.APIResponse{RequestID: "req_1"}, nil)
+	require.Equal(t, Entry{Outcome: OutcomeSucceeded, StripeRequestID: "req_1"}, e)
+
+	e = Entry{}
+	e.SetResult(nil, &stripe.Error{Code: stripe.ErrorCodeCardDeclined, Msg: "Your card was declined.", RequestID: "req_2"})
+	require.Equal(t, Entry{Outcome: OutcomeFailed, StripeRequestID: "req_2", Error: "card_declined"}, e)
+
+	e = Entry{}
+	e.SetResult(nil, errors.New("connection reset"))
+	require.Equal(t, Entry{Outcome: OutcomeFailed, Error: "connection reset"}, e)
+}
@@ -0,0 +1,83 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File is a Sink appending the trail to a JSON Lines file, one entry per
+// line. The file is only ever opened for appending, so the entries already
+// written are never rewritten.
+type File struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFile returns a File sink appending to the file at path, created when
+// missing.
+func NewFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit: open %s: %w", path, err)
+	}
+	return &File{path: path, f: f}, nil
+}
+
+func (s *File) Append(_ context.Context, e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("audit: marshal: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a single write, so concurrent writers do not interleave lines
+	if _, err := s.f.Write(line); err != nil {
+		return fmt.Errorf("audit: append to %s: %w", s.path, err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("audit: sync %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *File) Entries(_ context.Context, q Query) ([]Entry, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("audit: open %s: %w", s.path, err)
+	}
+	defer f.Close()
+
+	var trail []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("audit: %s line %d: %w", s.path, line, err)
+		}
+		trail = append(trail, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("audit: read %s: %w", s.path, err)
+	}
+	return selectEntries(trail, q), nil
+}
+
+// Close closes the file.
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.f.Sync(), s.f.Close())
+}
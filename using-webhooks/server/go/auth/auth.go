@@ -0,0 +1,126 @@
+// Package auth authenticates the callers of the payment endpoints: the users
+// of the application, with a signed session token, and the back office,
+// with an API key. Authenticators can be chained so several kinds of
+// credentials are accepted by the same endpoints.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials is returned when a request carries none of the
+	// credentials checked by an authenticator.
+	ErrNoCredentials = errors.New("auth: no credentials")
+	// ErrInvalidCredentials is returned for credentials which are
+	// malformed, expired or do not match.
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+)
+
+// UserIDHeader carries the ID of the user trusted by UserHeader.
+const UserIDHeader = "X-User-ID"
+
+// APIKeyHeader carries the API key of back-office callers.
+const APIKeyHeader = "X-API-Key"
+
+// Principal is the authenticated caller of a request, either a user of the
+// application or a back-office caller.
+type Principal struct {
+	// UserID is the ID of the user, empty for back-office callers.
+	UserID string
+	// KeyName names the API key of a back-office caller.
+	KeyName string
+}
+
+// IsBackOffice reports whether the caller is the back office, allowed to
+// act on behalf of every user.
+func (p Principal) IsBackOffice() bool {
+	return p.UserID == ""
+}
+
+// String identifies the caller, for logs and for scoping per-caller data.
+func (p Principal) String() string {
+	if p.IsBackOffice() {
+		return "key:" + p.KeyName
+	}
+	return "user:" + p.UserID
+}
+
+// Authenticator finds the caller of a request.
+type Authenticator interface {
+	// Authenticate returns the caller of r, or ErrNoCredentials when r
+	// carries none of the credentials it checks.
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// Chain tries each authenticator in turn, until one finds credentials.
+type Chain []Authenticator
+
+// Authenticate returns the caller found by the first authenticator of the
+// chain which finds credentials in r, even if they are invalid.
+func (c Chain) Authenticate(r *http.Request) (Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if !errors.Is(err, ErrNoCredentials) {
+			return p, err
+		}
+	}
+	return Principal{}, ErrNoCredentials
+}
+
+// APIKeys authenticates back-office callers with the key sent in the
+// X-API-Key header. It maps the keys to their names.
+type APIKeys map[string]string
+
+// Authenticate returns the back-office caller holding the key.
+func (keys APIKeys) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	// every key is compared, in constant time, so the time taken does not
+	// tell how close the key is to one of them
+	sum := sha256.Sum256([]byte(key))
+	name, found := "", false
+	for k, n := range keys {
+		kSum := sha256.Sum256([]byte(k))
+		if subtle.ConstantTimeCompare(sum[:], kSum[:]) == 1 {
+			name, found = n, true
+		}
+	}
+	if !found {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{KeyName: name}, nil
+}
+
+// UserHeader trusts the user ID sent in the X-User-ID header. Anyone can
+// claim to be any user with it: it is a stand-in for demos and for servers
+// behind a proxy which authenticates the users and sets the header.
+type UserHeader struct{}
+
+// Authenticate returns the user named by the header.
+func (UserHeader) Authenticate(r *http.Request) (Principal, error) {
+	userID := r.Header.Get(UserIDHeader)
+	if userID == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	return Principal{UserID: userID}, nil
+}
+
+type principalContextKey struct{}
+
+// NewContext returns a copy of ctx carrying the caller.
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// FromContext returns the caller carried by ctx, if any.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(Principal)
+	return p, ok
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	sessions := Sessions{Secret: []byte(strings.Repeat("s", MinSecretLength)), Issuer: "shop", Now: func() time.Time { return now }}
+	token, err := sessions.Issue("user_1", time.Hour)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	p, err := sessions.Authenticate(r)
+	require.NoError(t, err)
+	require.Equal(t, Principal{UserID: "user_1"}, p)
+	require.False(t, p.IsBackOffice())
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: token})
+	p, err = sessions.Authenticate(r)
+	require.NoError(t, err)
+	require.Equal(t, "user_1", p.UserID)
+
+	_, err = sessions.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+	require.ErrorIs(t, err, ErrNoCredentials)
+
+	parts := strings.Split(token, ".")
+	other := Sessions{Secret: []byte(strings.Repeat("o", MinSecretLength)), Issuer: "shop", Now: sessions.Now}
+	forged, err := other.Issue("user_2", time.Hour)
+	require.NoError(t, err)
+	expired := sessions
+	expired.Now = func() time.Time { return now.Add(2 * time.Hour) }
+	otherIssuer := sessions
+	otherIssuer.Issuer = "admin"
+
+	tests := []struct {
+		name     string
+		sessions Sessions
+		token    string
+	}{
+		{"other secret", sessions, forged},
+		{"payload swapped", sessions, parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]},
+		{"unsigned", sessions, base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + "."},
+		{"expired", expired, token},
+		{"other issuer", otherIssuer, token},
+		{"garbage", sessions, "not-a-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			_, err := tt.sessions.Authenticate(r)
+			require.ErrorIs(t, err, ErrInvalidCredentials)
+		})
+	}
+
+	_, err = Sessions{Secret: []byte("short")}.Issue("user_1", time.Hour)
+	require.Error(t, err)
+}
+
+func TestChain(t *testing.T) {
+	chain := Chain{APIKeys{"key_0123456789abcdef": "fulfillment"}, UserHeader{}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(APIKeyHeader, "key_0123456789abcdef")
+	p, err := chain.Authenticate(r)
+	require.NoError(t, err)
+	require.True(t, p.IsBackOffice())
+	require.Equal(t, "key:fulfillment", p.String())
+
+	// an invalid key is not overridden by the next authenticator
+	r.Header.Set(APIKeyHeader, "key_wrong")
+	r.Header.Set(UserIDHeader, "user_1")
+	_, err = chain.Authenticate(r)
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	r.Header.Del(APIKeyHeader)
+	p, err = chain.Authenticate(r)
+	require.NoError(t, err)
+	require.Equal(t, "user:user_1", p.String())
+
+	_, err = chain.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+	require.ErrorIs(t, err, ErrNoCredentials)
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultCookieName is the cookie holding the session token when Sessions
+// does not name another one.
+const DefaultCookieName = "session"
+
+// MinSecretLength is the length of the shortest secret accepted by
+// Sessions, the size of the HMAC-SHA256 output.
+const MinSecretLength = 32
+
+// Sessions authenticates users with session tokens: JWTs signed with
+// HMAC-SHA256 (HS256) whose subject is the user ID. The token is sent as a
+// bearer token in the Authorization header, or in the session cookie.
+// https://datatracker.ietf.org/doc/html/rfc7519
+type Sessions struct {
+	// Secret signs the tokens, at least MinSecretLength bytes.
+	Secret []byte
+	// Issuer is the iss claim of the issued tokens, checked when set.
+	Issuer string
+	// CookieName is the cookie holding the token, DefaultCookieName by
+	// default.
+	CookieName string
+	// Now returns the current time, time.Now by default.
+	Now func() time.Time
+}
+
+// claims are the JWT claims used by Sessions.
+type claims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Expires   int64  `json:"exp"`
+}
+
+// header is the only JWT header accepted, the algorithm is never taken from
+// the token.
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Issue returns a token authenticating the user for ttl.
+func (s Sessions) Issue(userID string, ttl time.Duration) (string, error) {
+	if len(s.Secret) < MinSecretLength {
+		return "", fmt.Errorf("auth: session secret must be at least %d bytes", MinSecretLength)
+	}
+	if userID == "" {
+		return "", errors.New("auth: user ID is required")
+	}
+	now := s.now()
+	payload, err := json.Marshal(claims{
+		Subject:  userID,
+		Issuer:   s.Issuer,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + s.sign(signed), nil
+}
+
+// Authenticate returns the user of the session token sent with r.
+func (s Sessions) Authenticate(r *http.Request) (Principal, error) {
+	token := s.token(r)
+	if token == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	c, err := s.verify(token)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return Principal{UserID: c.Subject}, nil
+}
+
+// token returns the token of the Authorization header or, without it, of
+// the session cookie.
+func (s Sessions) token(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	name := s.CookieName
+	if name == "" {
+		name = DefaultCookieName
+	}
+	if cookie, err := r.Cookie(name); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func (s Sessions) verify(token string) (claims, error) {
+	var c claims
+	if len(s.Secret) < MinSecretLength {
+		return c, errors.New("session secret is too short")
+	}
+	h, rest, ok := strings.Cut(token, ".")
+	if !ok || h != header {
+		return c, errors.New("unsupported token header")
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(h+"."+payload))) {
+		return c, errors.New("bad signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return c, fmt.Errorf("payload: %w", err)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("payload: %w", err)
+	}
+
+	now := s.now().Unix()
+	switch {
+	case c.Subject == "":
+		return c, errors.New("no subject")
+	case c.Expires == 0 || now >= c.Expires:
+		return c, errors.New("expired")
+	case now < c.NotBefore:
+		return c, errors.New("not valid yet")
+	case s.Issuer != "" && c.Issuer != s.Issuer:
+		return c, errors.New("unknown issuer")
+	}
+	return c, nil
+}
+
+func (s Sessions) sign(signed string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s Sessions) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
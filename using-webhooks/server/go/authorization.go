@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+var (
+	errUnauthenticated = errors.New("authentication required")
+	errForeignUser     = errors.New("userID must be the signed in user")
+)
+
+// authenticate only lets through the requests whose caller is found by the
+// configured authenticator, and passes the caller on in their context.
+func (s *Server) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.authenticator.Authenticate(r)
+		if err != nil {
+			message := errUnauthenticated.Error()
+			if errors.Is(err, auth.ErrInvalidCredentials) {
+				message = "invalid credentials"
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, message)
+			return
+		}
+		next(w, r.WithContext(auth.NewContext(r.Context(), p)))
+	}
+}
+
+// requestUserID resolves the user the request is made on behalf of: the
+// signed in user, or for the back office the user named in the request.
+// Users cannot name another user than themselves.
+func requestUserID(r *http.Request, requestedUserID string) (string, error) {
+	p, ok := auth.FromContext(r.Context())
+	switch {
+	case !ok:
+		return "", errUnauthenticated
+	case p.IsBackOffice():
+		if requestedUserID == "" {
+			return "", errMissingUserID
+		}
+		return requestedUserID, nil
+	case requestedUserID != "" && requestedUserID != p.UserID:
+		return "", errForeignUser
+	}
+	return p.UserID, nil
+}
+
+// ownsCustomer reports whether the caller may act on the objects of the
+// Stripe Customer: the back office on those of every customer, users only
+// on those of their own.
+func (s *Server) ownsCustomer(ctx context.Context, customerID string) (bool, error) {
+	p, ok := auth.FromContext(ctx)
+	switch {
+	case !ok || customerID == "":
+		return false, nil
+	case p.IsBackOffice():
+		return true, nil
+	}
+	c, err := s.store.CustomerByUserID(ctx, p.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return c.ID == customerID, nil
+}
+
+// requestPaymentIntent reads the payment intent the request acts on. The
+// payment intents of other customers are answered with a 404, like unknown
+// ones, so their IDs cannot be probed. The error response is written when
+// it fails.
+func (s *Server) requestPaymentIntent(w http.ResponseWriter, r *http.Request, id string) (*stripe.PaymentIntent, bool) {
+	pi, err := s.gatewayFor(r.Context()).GetPaymentIntent(id, nil)
+	if isResourceMissing(err) {
+		writeUnknownPaymentIntent(w)
+		return nil, false
+	}
+	if err != nil {
+		writeFailure(w, "paymentintent.Get", err)
+		return nil, false
+	}
+	var customerID string
+	if pi.Customer != nil {
+		customerID = pi.Customer.ID
+	}
+	owned, err := s.ownsCustomer(r.Context(), customerID)
+	if err != nil {
+		writeFailure(w, "ownsCustomer", err)
+		return nil, false
+	}
+	if !owned {
+		writeUnknownPaymentIntent(w)
+		return nil, false
+	}
+	return pi, true
+}
+
+// writeUnknownPaymentIntent answers a request naming a payment intent the
+// caller cannot see, whether it does not exist or belongs to another
+// customer.
+func writeUnknownPaymentIntent(w http.ResponseWriter) {
+	writeAPIError(w, http.StatusNotFound, APIError{
+		Code:    string(stripe.ErrorCodeResourceMissing),
+		Message: "unknown payment intent",
+		Param:   "paymentIntentID",
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+)
+
+const testAPIKey = "key_test_0123456789"
+
+// withSessions makes the test server accept session tokens and the API key
+// of the back office instead of trusting the X-User-ID header.
+func withSessions(sessions auth.Sessions) func(*Config) {
+	return func(cfg *Config) {
+		cfg.Authenticator = auth.Chain{auth.APIKeys{testAPIKey: "back-office"}, sessions}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	sessions := auth.Sessions{Secret: []byte(strings.Repeat("s", auth.MinSecretLength))}
+	s, fake := newTestServer(t, withSessions(sessions))
+	pi := authorizedOrder(t, s, fake)
+
+	send := func(path string, header http.Header, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v[0])
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+	token := func(userID string) http.Header {
+		token, err := sessions.Issue(userID, time.Hour)
+		require.NoError(t, err)
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+	confirm := `{"paymentIntentID": "` + pi.ID + `"}`
+
+	w := send("/confirm-payment-intent", nil, confirm)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	// the header is not trusted anymore
+	w = send("/confirm-payment-intent", http.Header{userIDHeader: {"user_1"}}, confirm)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = send("/confirm-payment-intent", http.Header{"Authorization": {"Bearer forged"}}, confirm)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, "invalid credentials", errorOf(t, w).Message)
+
+	// the intents of other customers look unknown
+	w = send("/confirm-payment-intent", token("user_2"), confirm)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	foreign := w.Body.String()
+	w = send("/confirm-payment-intent", token("user_2"), `{"paymentIntentID": "pi_unknown"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, foreign, w.Body.String())
+
+	w = send("/create-payment-intent", token("user_2"), `{"userID": "user_1"}`)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = send("/confirm-payment-intent", token("user_1"), confirm)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// the back office acts on behalf of every user, naming them
+	apiKey := http.Header{auth.APIKeyHeader: {testAPIKey}}
+	w = send("/confirm-payment-intent", apiKey, confirm)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = send("/create-setup-intent", apiKey, `{}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = send("/create-setup-intent", apiKey, `{"userID": "user_1"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestListRefundsOfOtherCustomer(t *testing.T) {
+	s, fake := newTestServer(t)
+	pi := authorizedOrder(t, s, fake)
+
+	r := httptest.NewRequest(http.MethodGet, "/refunds?paymentIntentID="+pi.ID, nil)
+	w := httptest.NewRecorder()
+	s.handleListRefunds(w, asCaller(r, "user_2"))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	s.handleListRefunds(w, asCaller(r, "user_1"))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// CaptureRequestParams represents the structure of the request from the
+// client. Amount defaults to the whole capturable amount, FinalCapture to
+// true. A capture which is not final keeps the rest of the authorization
+// capturable, it requires multicapture, requested for order holds.
+type CaptureRequestParams struct {
+	PaymentIntentID string `json:"paymentIntentID"`
+	Amount          *int64 `json:"amount"`
+	FinalCapture    *bool  `json:"finalCapture"`
+}
+
+func (req *CaptureRequestParams) validate(v *validator) {
+	v.requiredID("paymentIntentID", req.PaymentIntentID)
+	v.positive("amount", req.Amount)
+}
+
+// PartialCapture is one of the captures made against a payment intent.
+type PartialCapture struct {
+	Amount  int64 `json:"amount"`
+	Final   bool  `json:"final"`
+	Created int64 `json:"created"`
+}
+
+// CaptureRecord is the state of a payment intent after a capture, with all
+// the captures made against it.
+type CaptureRecord struct {
+	PaymentIntentID  string           `json:"paymentIntentID"`
+	Status           string           `json:"status"`
+	Currency         string           `json:"currency"`
+	Amount           int64            `json:"amount"`
+	AmountCaptured   int64            `json:"amountCaptured"`
+	AmountCapturable int64            `json:"amountCapturable"`
+	Captures         []PartialCapture `json:"captures"`
+}
+
+// errNotCapturable is returned when a payment intent cannot be captured in
+// its current state.
+var errNotCapturable = errors.New("payment intent cannot be captured")
+
+// validateCapture returns the amount to capture from pi.
+func validateCapture(pi *stripe.PaymentIntent, req CaptureRequestParams) (int64, error) {
+	if pi.Status != stripe.PaymentIntentStatusRequiresCapture {
+		return 0, fmt.Errorf("%w: its status is %s", errNotCapturable, pi.Status)
+	}
+	if req.Amount == nil {
+		return pi.AmountCapturable, nil
+	}
+	if *req.Amount > pi.AmountCapturable {
+		return 0, fmt.Errorf("amount must be at most the capturable amount %d", pi.AmountCapturable)
+	}
+	return *req.Amount, nil
+}
+
+// handleCapturePaymentIntent captures the amount of a payment intent placed
+// on hold.
+// https://docs.stripe.com/payments/place-a-hold-on-a-payment-method#capture-funds
+// https://docs.stripe.com/payments/multicapture
+func (s *Server) handleCapturePaymentIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	// Decode the incoming request
+	req := CaptureRequestParams{}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	final := req.FinalCapture == nil || *req.FinalCapture
+
+	pi, ok := s.requestPaymentIntent(w, r, req.PaymentIntentID)
+	if !ok {
+		return
+	}
+	amount, err := validateCapture(pi, req)
+	if errors.Is(err, errNotCapturable) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the approved request captures the amount approved
+	req.Amount = &amount
+	if s.holdForApproval(w, r, ActionCapture, req, pi.ID, amount, string(pi.Currency)) {
+		return
+	}
+
+	params := &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: stripe.Int64(amount),
+	}
+	if !final {
+		params.FinalCapture = stripe.Bool(false)
+	}
+	// a double click reads the same state, the capture is made once
+	params.SetIdempotencyKey(fmt.Sprintf("capture-%s-%d-%d-%t", pi.ID, pi.AmountReceived, amount, final))
+	captured, err := s.gatewayFor(r.Context()).CapturePaymentIntent(req.PaymentIntentID, params)
+	s.auditPaymentIntent(r.Context(), ActionCapture, pi, amount, captured, err)
+	if err != nil {
+		writeFailure(w, "paymentintent.Capture", err)
+		return
+	}
+	pi = captured
+	s.recordPaymentIntent(r.Context(), pi)
+	if err := s.holds.Settled(r.Context(), pi); err != nil {
+		slog.ErrorContext(r.Context(), "holds.Settled failed", logging.PaymentIntentID(pi.ID), logging.Err(err))
+	}
+
+	_, err = s.store.AddCapture(r.Context(), store.Capture{
+		PaymentIntentID: pi.ID,
+		Amount:          amount,
+		Final:           final,
+		Created:         time.Now().Unix(),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "store.AddCapture failed", logging.PaymentIntentID(pi.ID), logging.Err(err))
+	}
+	captures, err := s.store.Captures(r.Context(), pi.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "store.Captures failed", logging.PaymentIntentID(pi.ID), logging.Err(err))
+	}
+
+	writeJSON(w, newCaptureRecord(pi, captures))
+}
+
+func newCaptureRecord(pi *stripe.PaymentIntent, captures []store.Capture) CaptureRecord {
+	record := CaptureRecord{
+		PaymentIntentID:  pi.ID,
+		Status:           string(pi.Status),
+		Currency:         string(pi.Currency),
+		Amount:           pi.Amount,
+		AmountCaptured:   pi.AmountReceived,
+		AmountCapturable: pi.AmountCapturable,
+		Captures:         make([]PartialCapture, 0, len(captures)),
+	}
+	for _, c := range captures {
+		record.Captures = append(record.Captures, PartialCapture{Amount: c.Amount, Final: c.Final, Created: c.Created})
+	}
+	return record
+}
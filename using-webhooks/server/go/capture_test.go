@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// authorizedOrder places an order hold of 1400 and authorizes it with a card.
+func authorizedOrder(t *testing.T, s *Server, fake *gateway.Fake) *stripe.PaymentIntent {
+	w := postJSON(t, s.handleCreatePaymentIntent, "user_1", `{"currency": "usd", "items": [{"id": "photo-subscription"}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp intentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	pi, err := fake.GetPaymentIntent(resp.ID, nil)
+	require.NoError(t, err)
+	pm := fake.AddPaymentMethod(pi.Customer.ID, gateway.CardSucceeds)
+	pi, err = fake.ConfirmPaymentIntent(pi.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: stripe.String(pm.ID)})
+	require.NoError(t, err)
+	return pi
+}
+
+func capture(t *testing.T, s *Server, body string) (*CaptureRecord, int) {
+	w := postJSON(t, s.handleCapturePaymentIntent, "", body)
+	if w.Code != http.StatusOK {
+		return nil, w.Code
+	}
+	var record CaptureRecord
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &record))
+	return &record, w.Code
+}
+
+func TestCapture(t *testing.T) {
+	t.Run("captures the whole amount when omitted", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		pi := authorizedOrder(t, s, fake)
+
+		record, code := capture(t, s, `{"paymentIntentID": "`+pi.ID+`"}`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "succeeded", record.Status)
+		require.Equal(t, int64(1400), record.AmountCaptured)
+		require.Zero(t, record.AmountCapturable)
+		require.Len(t, record.Captures, 1)
+		require.Equal(t, int64(1400), record.Captures[0].Amount)
+		require.True(t, record.Captures[0].Final)
+	})
+
+	t.Run("validates the amount", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		pi := authorizedOrder(t, s, fake)
+
+		for _, body := range []string{
+			`{"paymentIntentID": "` + pi.ID + `", "amount": 0}`,
+			`{"paymentIntentID": "` + pi.ID + `", "amount": -5}`,
+			`{"paymentIntentID": "` + pi.ID + `", "amount": 1401}`,
+			`{"amount": 100}`,
+			`not json`,
+		} {
+			_, code := capture(t, s, body)
+			require.Equal(t, http.StatusBadRequest, code, body)
+		}
+
+		got, err := fake.GetPaymentIntent(pi.ID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusRequiresCapture, got.Status)
+		require.Zero(t, got.AmountReceived)
+	})
+
+	t.Run("captures several times with multicapture", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		pi := authorizedOrder(t, s, fake)
+
+		record, code := capture(t, s, `{"paymentIntentID": "`+pi.ID+`", "amount": 600, "finalCapture": false}`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "requires_capture", record.Status)
+		require.Equal(t, int64(600), record.AmountCaptured)
+		require.Equal(t, int64(800), record.AmountCapturable)
+
+		record, code = capture(t, s, `{"paymentIntentID": "`+pi.ID+`", "amount": 500, "finalCapture": false}`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, int64(300), record.AmountCapturable)
+
+		// the final capture takes the rest
+		record, code = capture(t, s, `{"paymentIntentID": "`+pi.ID+`"}`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "succeeded", record.Status)
+		require.Equal(t, int64(1400), record.AmountCaptured)
+		require.Equal(t, []PartialCapture{
+			{Amount: 600, Final: false, Created: record.Captures[0].Created},
+			{Amount: 500, Final: false, Created: record.Captures[1].Created},
+			{Amount: 300, Final: true, Created: record.Captures[2].Created},
+		}, record.Captures)
+
+		_, code = capture(t, s, `{"paymentIntentID": "`+pi.ID+`"}`)
+		require.Equal(t, http.StatusConflict, code, "a captured intent cannot be captured again")
+	})
+}
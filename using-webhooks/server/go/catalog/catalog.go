@@ -0,0 +1,176 @@
+// Package catalog prices orders on the server, so the client cannot change
+// the amount it is charged.
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrUnknownProduct is returned for items that are not in the catalog.
+	ErrUnknownProduct = errors.New("unknown product")
+	// ErrUnsupportedCurrency is returned when a product has no price in the
+	// requested currency.
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	// ErrInvalidQuantity is returned for negative quantities or quantities
+	// above the product's limit.
+	ErrInvalidQuantity = errors.New("invalid quantity")
+	// ErrEmptyOrder is returned when an order has no items.
+	ErrEmptyOrder = errors.New("order has no items")
+	// ErrAmountTooLarge is returned when the total of an order does not fit
+	// in an int64.
+	ErrAmountTooLarge = errors.New("order amount is too large")
+)
+
+const (
+	// DefaultMaxQuantity is the limit of the products which do not set
+	// their own.
+	DefaultMaxQuantity = 100
+	// QuantityLimit bounds the MaxQuantity of every product, and so the
+	// quantity of any item.
+	QuantityLimit = 10000
+)
+
+// Product is a product that can be ordered.
+type Product struct {
+	ID   string `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+	// Prices maps lower case ISO currency codes to the unit price in the
+	// smallest currency unit, e.g. cents.
+	Prices map[string]int64 `json:"prices" yaml:"prices"`
+	// TaxRate is the tax applied to the product, e.g. 0.2 for 20%.
+	TaxRate float64 `json:"taxRate" yaml:"taxRate"`
+	// TaxInclusive reports whether the prices already include the tax.
+	// Otherwise the tax is added on top of them.
+	TaxInclusive bool `json:"taxInclusive" yaml:"taxInclusive"`
+	// MaxQuantity limits how many units can be ordered at once, zero means
+	// DefaultMaxQuantity. It cannot exceed QuantityLimit.
+	MaxQuantity int64 `json:"maxQuantity" yaml:"maxQuantity"`
+}
+
+// Item is an ordered product.
+type Item struct {
+	ProductID string
+	// Quantity defaults to one when zero.
+	Quantity int64
+}
+
+// Catalog is a set of products indexed by ID.
+type Catalog struct {
+	products map[string]Product
+}
+
+// New returns a catalog of products.
+func New(products []Product) (*Catalog, error) {
+	c := &Catalog{products: make(map[string]Product, len(products))}
+	for _, p := range products {
+		if p.ID == "" {
+			return nil, errors.New("catalog: product without id")
+		}
+		if _, ok := c.products[p.ID]; ok {
+			return nil, fmt.Errorf("catalog: duplicate product %q", p.ID)
+		}
+		if p.TaxRate < 0 {
+			return nil, fmt.Errorf("catalog: negative tax rate for product %q", p.ID)
+		}
+		switch {
+		case p.MaxQuantity < 0 || p.MaxQuantity > QuantityLimit:
+			return nil, fmt.Errorf("catalog: max quantity of product %q is not between 0 and %d", p.ID, QuantityLimit)
+		case p.MaxQuantity == 0:
+			p.MaxQuantity = DefaultMaxQuantity
+		}
+		prices := make(map[string]int64, len(p.Prices))
+		for currency, price := range p.Prices {
+			if price < 0 {
+				return nil, fmt.Errorf("catalog: negative %s price for product %q", currency, p.ID)
+			}
+			prices[strings.ToLower(currency)] = price
+		}
+		p.Prices = prices
+		c.products[p.ID] = p
+	}
+	return c, nil
+}
+
+// Load reads a catalog from a JSON or YAML file, the format is picked by the
+// file extension. The file holds an object with a "products" list.
+func Load(path string) (*Catalog, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: %w", err)
+	}
+	var file struct {
+		Products []Product `json:"products" yaml:"products"`
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &file)
+	default:
+		err = json.Unmarshal(b, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("catalog: parse %s: %w", path, err)
+	}
+	return New(file.Products)
+}
+
+// Product returns the product with the given ID.
+func (c *Catalog) Product(id string) (Product, bool) {
+	p, ok := c.products[id]
+	return p, ok
+}
+
+// Amount returns the total of the order in the smallest unit of currency,
+// taxes included. Tax is rounded per item.
+func (c *Catalog) Amount(items []Item, currency string) (int64, error) {
+	if len(items) == 0 {
+		return 0, ErrEmptyOrder
+	}
+	currency = strings.ToLower(currency)
+
+	var total int64
+	for _, item := range items {
+		p, ok := c.products[item.ProductID]
+		if !ok {
+			return 0, fmt.Errorf("%w: %q", ErrUnknownProduct, item.ProductID)
+		}
+		price, ok := p.Prices[currency]
+		if !ok {
+			return 0, fmt.Errorf("%w: %q is not sold in %s", ErrUnsupportedCurrency, p.ID, currency)
+		}
+		quantity := item.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		if quantity < 0 || quantity > p.MaxQuantity {
+			return 0, fmt.Errorf("%w: %d of %q", ErrInvalidQuantity, quantity, p.ID)
+		}
+
+		// the quantity is bounded but not the prices, every step is checked
+		// so a large order cannot wrap around to a small amount
+		if price > math.MaxInt64/quantity {
+			return 0, fmt.Errorf("%w: %d of %q", ErrAmountTooLarge, quantity, p.ID)
+		}
+		subtotal := price * quantity
+		if !p.TaxInclusive {
+			tax := math.Round(float64(subtotal) * p.TaxRate)
+			if tax >= float64(math.MaxInt64-subtotal) {
+				return 0, fmt.Errorf("%w: %d of %q", ErrAmountTooLarge, quantity, p.ID)
+			}
+			subtotal += int64(tax)
+		}
+		if subtotal > math.MaxInt64-total {
+			return 0, ErrAmountTooLarge
+		}
+		total += subtotal
+	}
+	return total, nil
+}
@@ -0,0 +1,83 @@
+package catalog
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAmount(t *testing.T) {
+	c, err := New([]Product{
+		{ID: "photo-subscription", Prices: map[string]int64{"USD": 1400, "eur": 1300}, TaxRate: 0.2, TaxInclusive: true},
+		{ID: "print", Prices: map[string]int64{"usd": 250}, TaxRate: 0.075, MaxQuantity: 10},
+		{ID: "yacht", Prices: map[string]int64{"usd": math.MaxInt64 / 2}, TaxRate: 0.1, MaxQuantity: QuantityLimit},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		items    []Item
+		currency string
+		amount   int64
+		err      error
+	}{
+		{name: "tax inclusive", items: []Item{{ProductID: "photo-subscription"}}, currency: "usd", amount: 1400},
+		{name: "currency is case insensitive", items: []Item{{ProductID: "photo-subscription"}}, currency: "EUR", amount: 1300},
+		{name: "tax exclusive is added and rounded", items: []Item{{ProductID: "print", Quantity: 3}}, currency: "usd", amount: 806},
+		{name: "several items", items: []Item{{ProductID: "photo-subscription", Quantity: 2}, {ProductID: "print"}}, currency: "usd", amount: 3069},
+		{name: "unknown product", items: []Item{{ProductID: "boat"}}, currency: "usd", err: ErrUnknownProduct},
+		{name: "unsupported currency", items: []Item{{ProductID: "print"}}, currency: "eur", err: ErrUnsupportedCurrency},
+		{name: "negative quantity", items: []Item{{ProductID: "print", Quantity: -1}}, currency: "usd", err: ErrInvalidQuantity},
+		{name: "quantity above limit", items: []Item{{ProductID: "print", Quantity: 11}}, currency: "usd", err: ErrInvalidQuantity},
+		{name: "quantity above default limit", items: []Item{{ProductID: "photo-subscription", Quantity: DefaultMaxQuantity + 1}}, currency: "usd", err: ErrInvalidQuantity},
+		{name: "huge quantity does not wrap around", items: []Item{{ProductID: "photo-subscription", Quantity: 1<<61 + 1}}, currency: "usd", err: ErrInvalidQuantity},
+		{name: "price times quantity overflows", items: []Item{{ProductID: "yacht", Quantity: 3}}, currency: "usd", err: ErrAmountTooLarge},
+		{name: "tax overflows", items: []Item{{ProductID: "yacht", Quantity: 2}}, currency: "usd", err: ErrAmountTooLarge},
+		{name: "total overflows", items: []Item{{ProductID: "yacht"}, {ProductID: "print"}, {ProductID: "yacht"}}, currency: "usd", err: ErrAmountTooLarge},
+		{name: "empty order", currency: "usd", err: ErrEmptyOrder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount, err := c.Amount(tt.items, tt.currency)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.amount, amount)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"products.json": `{"products": [{"id": "print", "prices": {"usd": 250}, "taxRate": 0.1}]}`,
+		"products.yaml": "products:\n  - id: print\n    prices:\n      usd: 250\n    taxRate: 0.1\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+			c, err := Load(path)
+			require.NoError(t, err)
+			amount, err := c.Amount([]Item{{ProductID: "print"}}, "usd")
+			require.NoError(t, err)
+			require.Equal(t, int64(275), amount)
+		})
+	}
+}
+
+func TestNewRejectsDuplicates(t *testing.T) {
+	_, err := New([]Product{{ID: "print"}, {ID: "print"}})
+	require.Error(t, err)
+}
+
+func TestNewRejectsUnboundedQuantities(t *testing.T) {
+	_, err := New([]Product{{ID: "print", MaxQuantity: QuantityLimit + 1}})
+	require.Error(t, err)
+}
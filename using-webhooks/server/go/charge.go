@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/audit"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// ChargeStatus is the outcome of charging a saved payment method.
+type ChargeStatus string
+
+const (
+	// ChargeSucceeded means the payment went through without the customer.
+	ChargeSucceeded ChargeStatus = "succeeded"
+	// ChargeRequiresAction means the bank asked for authentication, the
+	// client has to finish the payment with the returned client secret.
+	ChargeRequiresAction ChargeStatus = "requires_action"
+	// ChargeNeedsNewPaymentMethod means none of the saved payment methods
+	// could be charged, the client has to collect new payment details for
+	// the returned blank payment intent.
+	ChargeNeedsNewPaymentMethod ChargeStatus = "needs_new_payment_method"
+)
+
+// ChargeParams describes a charge of a customer's saved payment method.
+type ChargeParams struct {
+	CustomerID  string
+	Amount      int64
+	Currency    string
+	Description string
+}
+
+// ChargeResult is the structured outcome of chargeSavedPaymentMethod.
+type ChargeResult struct {
+	Status          ChargeStatus `json:"status"`
+	PaymentIntentID string       `json:"paymentIntentID"`
+	PaymentMethodID string       `json:"paymentMethodID,omitempty"`
+	ClientSecret    string       `json:"clientSecret,omitempty"`
+}
+
+// chargeSavedPaymentMethod charges the customer while they are not in the
+// application, following the fallback chain:
+//
+//  1. charge the default payment method off-session;
+//  2. if the bank requires authentication, confirm it on-session so the
+//     client can authenticate;
+//  3. if the charge failed, repeat with the payment method of the last
+//     successful payment;
+//  4. if that failed too, create a blank payment intent for the client to
+//     collect new payment details.
+//
+// Card errors move the chain forward, any other error is returned.
+// https://docs.stripe.com/payments/save-during-payment?platform=web#charge-saved-payment-method
+func (s *Server) chargeSavedPaymentMethod(ctx context.Context, params ChargeParams) (*ChargeResult, error) {
+	c, err := s.gatewayFor(ctx).GetCustomer(params.CustomerID, &stripe.CustomerParams{
+		Expand: []*string{stripe.String("invoice_settings.default_payment_method")},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("customer.Get: %w", err)
+	}
+
+	// default payment method is in invoice_settings.default_payment_method, or in default_source
+	// we use invoice_settings.default_payment_method set from UI
+	var defaultPaymentMethod *stripe.PaymentMethod
+	if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil {
+		defaultPaymentMethod = c.InvoiceSettings.DefaultPaymentMethod
+		result, err := s.chargePaymentMethod(ctx, params, defaultPaymentMethod)
+		if err != nil || result != nil {
+			return result, err
+		}
+	}
+
+	lastSuccessful, err := s.lastSuccessfulPaymentMethod(ctx, params.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	if lastSuccessful != nil && (defaultPaymentMethod == nil || defaultPaymentMethod.ID != lastSuccessful.ID) {
+		result, err := s.chargePaymentMethod(ctx, params, lastSuccessful)
+		if err != nil || result != nil {
+			return result, err
+		}
+	}
+
+	piParams := &stripe.PaymentIntentParams{
+		Amount:                    stripe.Int64(params.Amount),
+		Currency:                  stripe.String(params.Currency),
+		Customer:                  stripe.String(params.CustomerID),
+		SetupFutureUsage:          stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
+		StatementDescriptor:       stripe.String(s.cfg.StatementDescriptor),
+		StatementDescriptorSuffix: stripe.String(s.cfg.ChargeStatementDescriptorSuffix),
+		Description:               stripe.String(params.Description),
+		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		},
+	}
+	setRequestIdempotencyKey(ctx, &piParams.Params, "create")
+	pi, err := s.gatewayFor(ctx).NewPaymentIntent(piParams)
+	if err != nil {
+		return nil, fmt.Errorf("paymentintent.New: %w", err)
+	}
+	s.recordPaymentIntent(ctx, pi)
+	return &ChargeResult{
+		Status:          ChargeNeedsNewPaymentMethod,
+		PaymentIntentID: pi.ID,
+		ClientSecret:    pi.ClientSecret,
+	}, nil
+}
+
+// chargePaymentMethod charges pm off-session and falls back to an on-session
+// confirmation when the bank requires authentication. A nil result with a
+// nil error means the payment method was declined.
+func (s *Server) chargePaymentMethod(ctx context.Context, params ChargeParams, pm *stripe.PaymentMethod) (*ChargeResult, error) {
+	piParams := &stripe.PaymentIntentParams{
+		Amount:                    stripe.Int64(params.Amount),
+		Currency:                  stripe.String(params.Currency),
+		Customer:                  stripe.String(params.CustomerID),
+		PaymentMethod:             stripe.String(pm.ID),
+		PaymentMethodTypes:        []*string{stripe.String(string(pm.Type))},
+		Confirm:                   stripe.Bool(true),
+		StatementDescriptor:       stripe.String(s.cfg.StatementDescriptor),
+		StatementDescriptorSuffix: stripe.String(s.cfg.ChargeStatementDescriptorSuffix),
+		Description:               stripe.String(params.Description),
+		//https://docs.stripe.com/payments/payment-intents/asynchronous-capture
+		CaptureMethod: stripe.String("automatic_async"),
+		OffSession:    stripe.Bool(true),
+	}
+	setRequestIdempotencyKey(ctx, &piParams.Params, "charge-"+pm.ID)
+	pi, err := s.gatewayFor(ctx).NewPaymentIntent(piParams)
+	s.auditCharge(ctx, params, pi, err)
+	if err == nil {
+		s.recordPaymentIntent(ctx, pi)
+		return chargeResult(pi, pm), nil
+	}
+
+	var sErr *stripe.Error
+	if !errors.As(err, &sErr) || sErr.Type != stripe.ErrorTypeCard {
+		return nil, fmt.Errorf("paymentintent.New: %w", err)
+	}
+	if sErr.PaymentIntent != nil {
+		s.recordPaymentIntent(ctx, sErr.PaymentIntent)
+	}
+	if sErr.Code != stripe.ErrorCodeAuthenticationRequired || sErr.PaymentIntent == nil {
+		slog.InfoContext(ctx, "payment method declined", logging.CustomerID(params.CustomerID), "payment_method_id", pm.ID, "code", sErr.Code)
+		s.cancelDeclined(ctx, sErr.PaymentIntent)
+		return nil, nil
+	}
+
+	// create on session payment intent
+	confirmParams := &stripe.PaymentIntentConfirmParams{
+		PaymentMethod:      stripe.String(pm.ID),
+		PaymentMethodTypes: []*string{stripe.String(string(pm.Type))},
+		//https://docs.stripe.com/payments/payment-intents/asynchronous-capture
+		CaptureMethod: stripe.String("automatic_async"),
+		OffSession:    stripe.Bool(false),
+	}
+	setRequestIdempotencyKey(ctx, &confirmParams.Params, "confirm-"+pm.ID)
+	declined := sErr.PaymentIntent
+	pi, err = s.gatewayFor(ctx).ConfirmPaymentIntent(declined.ID, confirmParams)
+	s.auditCharge(ctx, params, pi, err)
+	if err != nil {
+		if errors.As(err, &sErr) && sErr.Type == stripe.ErrorTypeCard {
+			slog.InfoContext(ctx, "payment method declined on-session", logging.CustomerID(params.CustomerID), "payment_method_id", pm.ID, "code", sErr.Code)
+			s.cancelDeclined(ctx, declined)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("paymentintent.Confirm: %w", err)
+	}
+	s.recordPaymentIntent(ctx, pi)
+	return chargeResult(pi, pm), nil
+}
+
+// cancelDeclined cancels the payment intent left requiring a payment method
+// by a declined charge, the next step of the fallback chain creates its own.
+// Failures are only logged, the intent cannot be charged without the
+// customer anyway.
+func (s *Server) cancelDeclined(ctx context.Context, pi *stripe.PaymentIntent) {
+	if pi == nil {
+		return
+	}
+	params := &stripe.PaymentIntentCancelParams{
+		CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonAbandoned)),
+	}
+	params.SetIdempotencyKey(gateway.CancelIdempotencyKey(pi.ID, *params.CancellationReason))
+	canceled, err := s.gatewayFor(ctx).CancelPaymentIntent(pi.ID, params)
+	s.auditPaymentIntent(ctx, ActionCancel, pi, pi.Amount, canceled, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "paymentintent.Cancel failed", logging.PaymentIntentID(pi.ID), logging.Err(err))
+		return
+	}
+	s.recordPaymentIntent(ctx, canceled)
+}
+
+// auditCharge audits an attempt to charge a payment method, made by the
+// Stripe request which returned pi or failed with err. Declined attempts
+// name the payment intent of the card error.
+func (s *Server) auditCharge(ctx context.Context, params ChargeParams, pi *stripe.PaymentIntent, err error) {
+	e := audit.Entry{
+		Action:   string(ActionCharge),
+		Amount:   params.Amount,
+		Currency: params.Currency,
+	}
+	var resp *stripe.APIResponse
+	var sErr *stripe.Error
+	switch {
+	case err == nil:
+		e.PaymentIntentID = pi.ID
+		resp = pi.LastResponse
+	case errors.As(err, &sErr) && sErr.PaymentIntent != nil:
+		e.PaymentIntentID = sErr.PaymentIntent.ID
+	}
+	e.SetResult(resp, err)
+	s.auditAction(ctx, e)
+}
+
+// chargeResult maps the status of a confirmed payment intent to the outcome
+// of the charge. A nil result means the payment method was declined.
+func chargeResult(pi *stripe.PaymentIntent, pm *stripe.PaymentMethod) *ChargeResult {
+	result := &ChargeResult{
+		PaymentIntentID: pi.ID,
+		PaymentMethodID: pm.ID,
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded, stripe.PaymentIntentStatusProcessing, stripe.PaymentIntentStatusRequiresCapture:
+		result.Status = ChargeSucceeded
+	case stripe.PaymentIntentStatusRequiresAction, stripe.PaymentIntentStatusRequiresConfirmation:
+		result.Status = ChargeRequiresAction
+		result.ClientSecret = pi.ClientSecret
+	default:
+		return nil
+	}
+	return result
+}
+
+// lastSuccessfulPaymentMethod returns the payment method of the most recent
+// successful payment of the customer, or nil if there is none.
+func (s *Server) lastSuccessfulPaymentMethod(ctx context.Context, customerID string) (*stripe.PaymentMethod, error) {
+	pis, err := s.store.PaymentIntents(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("store.PaymentIntents: %w", err)
+	}
+	for _, pi := range pis {
+		if pi.Status != string(stripe.PaymentIntentStatusSucceeded) || pi.PaymentMethodID == "" {
+			continue
+		}
+		pm, err := s.gatewayFor(ctx).GetPaymentMethod(pi.PaymentMethodID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("paymentmethod.Get: %w", err)
+		}
+		// the payment method may have been detached since
+		if pm.Customer == nil || pm.Customer.ID != customerID {
+			continue
+		}
+		return pm, nil
+	}
+	return nil, nil
+}
+
+// ChargeRequestParams represents the structure of the request from the
+// client. Currency defaults to the default currency of the server.
+type ChargeRequestParams struct {
+	UserID      string `json:"userID"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Description string `json:"description"`
+}
+
+func (req *ChargeRequestParams) validate(v *validator) {
+	v.check(req.Amount > 0, "amount", "must be positive")
+	v.currency("currency", req.Currency)
+}
+
+// handleChargeSavedPaymentMethod charges the saved payment method of the
+// user, see chargeSavedPaymentMethod. The request must carry an
+// Idempotency-Key, so a retry never charges twice.
+func (s *Server) handleChargeSavedPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	// Decode the incoming request
+	req := ChargeRequestParams{}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if !requireIdempotencyKey(w, r) {
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = s.cfg.DefaultCurrency
+	}
+
+	customerID, ok := s.requestCustomer(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	if s.holdForApproval(w, r, ActionCharge, req, "", req.Amount, req.Currency) {
+		return
+	}
+
+	result, err := s.chargeSavedPaymentMethod(r.Context(), ChargeParams{
+		CustomerID:  customerID,
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+		Description: req.Description,
+	})
+	if err != nil {
+		writeFailure(w, "chargeSavedPaymentMethod", err)
+		return
+	}
+
+	writeJSON(w, result)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe/stripe-go/v80"
+)
+
+func TestChargeSavedPaymentMethod(t *testing.T) {
+	ctx := context.Background()
+
+	// newCustomer returns a server and a customer with a default payment
+	// method behaving like card.
+	newCustomer := func(t *testing.T, card gateway.Card) (*Server, *gateway.Fake, string) {
+		s, fake := newTestServer(t)
+		customerID, err := s.customers.lookupOrCreate(ctx, "user_1")
+		require.NoError(t, err)
+		pm := fake.AddPaymentMethod(customerID, card)
+		fake.SetDefaultPaymentMethod(customerID, pm.ID)
+		return s, fake, customerID
+	}
+
+	t.Run("default payment method off-session", func(t *testing.T) {
+		s, fake, customerID := newCustomer(t, gateway.CardSucceeds)
+
+		result, err := s.chargeSavedPaymentMethod(ctx, ChargeParams{CustomerID: customerID, Amount: 310, Currency: "usd"})
+		require.NoError(t, err)
+		require.Equal(t, ChargeSucceeded, result.Status)
+		require.Empty(t, result.ClientSecret)
+
+		pi, err := fake.GetPaymentIntent(result.PaymentIntentID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusSucceeded, pi.Status)
+		require.Equal(t, int64(310), pi.AmountReceived)
+	})
+
+	t.Run("authentication required falls back to on-session", func(t *testing.T) {
+		s, fake, customerID := newCustomer(t, gateway.CardRequiresAuthentication)
+
+		result, err := s.chargeSavedPaymentMethod(ctx, ChargeParams{CustomerID: customerID, Amount: 310, Currency: "usd"})
+		require.NoError(t, err)
+		require.Equal(t, ChargeRequiresAction, result.Status)
+		require.NotEmpty(t, result.ClientSecret)
+
+		pi, err := fake.Authenticate(result.PaymentIntentID)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusSucceeded, pi.Status)
+	})
+
+	t.Run("declined default falls back to last successful payment method", func(t *testing.T) {
+		s, fake, customerID := newCustomer(t, gateway.CardSucceeds)
+		first, err := s.chargeSavedPaymentMethod(ctx, ChargeParams{CustomerID: customerID, Amount: 100, Currency: "usd"})
+		require.NoError(t, err)
+		require.Equal(t, ChargeSucceeded, first.Status)
+
+		declined := fake.AddPaymentMethod(customerID, gateway.CardDeclined)
+		fake.SetDefaultPaymentMethod(customerID, declined.ID)
+
+		result, err := s.chargeSavedPaymentMethod(ctx, ChargeParams{CustomerID: customerID, Amount: 310, Currency: "usd"})
+		require.NoError(t, err)
+		require.Equal(t, ChargeSucceeded, result.Status)
+		require.Equal(t, first.PaymentMethodID, result.PaymentMethodID)
+
+		// the declined attempt is not left behind
+		pis, err := fake.ListPaymentIntents(&stripe.PaymentIntentListParams{Customer: stripe.String(customerID)})
+		require.NoError(t, err)
+		require.Len(t, pis, 3)
+		require.Equal(t, stripe.PaymentIntentStatusCanceled, pis[1].Status)
+		require.Equal(t, declined.ID, pis[1].PaymentMethod.ID)
+	})
+
+	t.Run("declined everywhere needs a new payment method", func(t *testing.T) {
+		s, fake, customerID := newCustomer(t, gateway.CardDeclined)
+
+		result, err := s.chargeSavedPaymentMethod(ctx, ChargeParams{CustomerID: customerID, Amount: 310, Currency: "usd"})
+		require.NoError(t, err)
+		require.Equal(t, ChargeNeedsNewPaymentMethod, result.Status)
+		require.NotEmpty(t, result.ClientSecret)
+
+		pi, err := fake.GetPaymentIntent(result.PaymentIntentID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusRequiresPaymentMethod, pi.Status)
+		require.Nil(t, pi.PaymentMethod)
+
+		// only the blank intent awaits a payment method
+		pis, err := fake.ListPaymentIntents(&stripe.PaymentIntentListParams{Customer: stripe.String(customerID)})
+		require.NoError(t, err)
+		require.Len(t, pis, 2)
+		require.Equal(t, stripe.PaymentIntentStatusCanceled, pis[1].Status)
+		require.Equal(t, stripe.PaymentIntentCancellationReasonAbandoned, pis[1].CancellationReason)
+	})
+
+	t.Run("no saved payment method needs a new payment method", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		customerID, err := s.customers.lookupOrCreate(ctx, "user_1")
+		require.NoError(t, err)
+
+		result, err := s.chargeSavedPaymentMethod(ctx, ChargeParams{CustomerID: customerID, Amount: 310, Currency: "usd"})
+		require.NoError(t, err)
+		require.Equal(t, ChargeNeedsNewPaymentMethod, result.Status)
+	})
+}
@@ -0,0 +1,372 @@
+// Package config loads the server settings from the environment, a .env
+// file and an optional configuration file, and validates them.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server settings. Every field is read from the variable
+// named in its comment.
+type Config struct {
+	// Addr is read from ADDR, localhost:4242 by default.
+	Addr string
+	// StaticDir is read from STATIC_DIR.
+	StaticDir string
+
+	// SecretKey is read from STRIPE_SECRET_KEY, a secret (sk_) or
+	// restricted (rk_) key.
+	SecretKey string
+	// PublishableKey is read from STRIPE_PUBLISHABLE_KEY.
+	PublishableKey string
+	// WebhookSecret is read from STRIPE_WEBHOOK_SECRET.
+	WebhookSecret string
+
+	// DefaultCurrency is read from DEFAULT_CURRENCY, usd by default.
+	DefaultCurrency string
+	// StatementDescriptor is read from STATEMENT_DESCRIPTOR.
+	StatementDescriptor string
+	// HoldStatementDescriptorSuffix is read from HOLD_STATEMENT_DESCRIPTOR_SUFFIX.
+	HoldStatementDescriptorSuffix string
+	// ChargeStatementDescriptorSuffix is read from CHARGE_STATEMENT_DESCRIPTOR_SUFFIX.
+	ChargeStatementDescriptorSuffix string
+
+	// DatabaseDriver is read from DATABASE_DRIVER.
+	DatabaseDriver string
+	// DatabaseURL is read from DATABASE_URL.
+	DatabaseURL string
+	// CatalogFile is read from CATALOG_FILE, products.json by default.
+	CatalogFile string
+	// AuditLogFile is read from AUDIT_LOG_FILE, audit.jsonl by default.
+	AuditLogFile string
+	// LogFormat is read from LOG_FORMAT, text (default) or json.
+	LogFormat string
+	// TracingEndpoint is read from OTEL_EXPORTER_OTLP_ENDPOINT, the URL of
+	// the OTLP/HTTP collector receiving the traces. Nothing is traced when
+	// empty.
+	TracingEndpoint string
+
+	// AdminToken is read from ADMIN_TOKEN.
+	AdminToken string
+	// Operators is read from ADMIN_OPERATORS, a comma-separated list of
+	// name:role:token entries.
+	Operators []Operator
+	// ApprovalThresholds is read from ADMIN_APPROVAL_THRESHOLD, a
+	// comma-separated list of currency:amount entries.
+	ApprovalThresholds map[string]int64
+	// APIKey is read from API_KEY.
+	APIKey string
+	// SessionSecret is read from SESSION_SECRET.
+	SessionSecret string
+	// TrustUserHeader is read from TRUST_USER_HEADER, a boolean false by
+	// default. It trusts the user ID sent in the X-User-ID header, anyone
+	// can then act as any user: it is only meant for local development in
+	// test mode.
+	TrustUserHeader bool
+	// HoldExpiryAction is read from HOLD_EXPIRY_ACTION, one of warn
+	// (default), capture or cancel.
+	HoldExpiryAction string
+}
+
+// Operator is a back-office user of the /admin endpoints.
+type Operator struct {
+	Name  string
+	Role  string
+	Token string
+}
+
+// operatorRoles are the roles of the operators.
+var operatorRoles = map[string]bool{"viewer": true, "operator": true, "finance-admin": true}
+
+// Mode is the Stripe mode a key belongs to.
+type Mode string
+
+const (
+	ModeTest Mode = "test"
+	ModeLive Mode = "live"
+)
+
+// Load reads the settings from, in increasing order of precedence, the
+// .env file of the working directory, the optional file and the
+// environment. A missing .env file is not an error. The file is parsed as
+// JSON or YAML depending on its extension and as a .env file otherwise, it
+// holds the same variables as the environment.
+//
+// All invalid settings are reported together in the returned error.
+func Load(file string) (*Config, error) {
+	values, err := godotenv.Read()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("config: read .env: %w", err)
+		}
+		values = map[string]string{}
+	}
+
+	if file != "" {
+		fileValues, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		merge(values, fileValues)
+	}
+
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok && v != "" {
+			values[k] = v
+		}
+	}
+	return Parse(values)
+}
+
+// Parse builds the settings from variables and validates them.
+func Parse(values map[string]string) (*Config, error) {
+	get := func(key, def string) string {
+		if v := strings.TrimSpace(values[key]); v != "" {
+			return v
+		}
+		return def
+	}
+	cfg := &Config{
+		Addr:                            get("ADDR", "localhost:4242"),
+		StaticDir:                       get("STATIC_DIR", ""),
+		SecretKey:                       get("STRIPE_SECRET_KEY", ""),
+		PublishableKey:                  get("STRIPE_PUBLISHABLE_KEY", ""),
+		WebhookSecret:                   get("STRIPE_WEBHOOK_SECRET", ""),
+		DefaultCurrency:                 strings.ToLower(get("DEFAULT_CURRENCY", "usd")),
+		StatementDescriptor:             get("STATEMENT_DESCRIPTOR", ""),
+		HoldStatementDescriptorSuffix:   get("HOLD_STATEMENT_DESCRIPTOR_SUFFIX", ""),
+		ChargeStatementDescriptorSuffix: get("CHARGE_STATEMENT_DESCRIPTOR_SUFFIX", ""),
+		DatabaseDriver:                  get("DATABASE_DRIVER", ""),
+		DatabaseURL:                     get("DATABASE_URL", ""),
+		CatalogFile:                     get("CATALOG_FILE", "products.json"),
+		AuditLogFile:                    get("AUDIT_LOG_FILE", "audit.jsonl"),
+		LogFormat:                       strings.ToLower(get("LOG_FORMAT", "text")),
+		TracingEndpoint:                 get("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		AdminToken:                      get("ADMIN_TOKEN", ""),
+		Operators:                       parseOperators(get("ADMIN_OPERATORS", "")),
+		ApprovalThresholds:              parseApprovalThresholds(get("ADMIN_APPROVAL_THRESHOLD", "")),
+		APIKey:                          get("API_KEY", ""),
+		SessionSecret:                   get("SESSION_SECRET", ""),
+		HoldExpiryAction:                strings.ToLower(get("HOLD_EXPIRY_ACTION", "warn")),
+	}
+	// Validate cannot tell an invalid boolean from false
+	var invalid error
+	trust, err := strconv.ParseBool(get("TRUST_USER_HEADER", "false"))
+	if err != nil {
+		invalid = fmt.Errorf("TRUST_USER_HEADER must be true or false, got %q", get("TRUST_USER_HEADER", ""))
+	}
+	cfg.TrustUserHeader = trust
+	if err := errors.Join(invalid, cfg.Validate()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseOperators parses the name:role:token entries of ADMIN_OPERATORS. The
+// malformed entries are kept with an empty name, rejected by Validate.
+func parseOperators(value string) []Operator {
+	var operators []Operator
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			operators = append(operators, Operator{})
+			continue
+		}
+		operators = append(operators, Operator{Name: parts[0], Role: parts[1], Token: parts[2]})
+	}
+	return operators
+}
+
+// parseApprovalThresholds parses the currency:amount entries of
+// ADMIN_APPROVAL_THRESHOLD. The malformed entries are kept with a negative
+// amount, rejected by Validate.
+func parseApprovalThresholds(value string) map[string]int64 {
+	thresholds := map[string]int64{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		currency, amount, _ := strings.Cut(entry, ":")
+		threshold, err := strconv.ParseInt(amount, 10, 64)
+		if err != nil {
+			threshold = -1
+		}
+		thresholds[strings.ToLower(currency)] = threshold
+	}
+	return thresholds
+}
+
+// Validate reports every invalid setting.
+func (cfg *Config) Validate() error {
+	var problems []error
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	secretMode, ok := keyMode(cfg.SecretKey, "sk_", "rk_")
+	switch {
+	case cfg.SecretKey == "":
+		add("STRIPE_SECRET_KEY is required")
+	case !ok:
+		add("STRIPE_SECRET_KEY must start with sk_test_, sk_live_, rk_test_ or rk_live_")
+	}
+
+	publishableMode, ok := keyMode(cfg.PublishableKey, "pk_")
+	switch {
+	case cfg.PublishableKey == "":
+		add("STRIPE_PUBLISHABLE_KEY is required")
+	case !ok:
+		add("STRIPE_PUBLISHABLE_KEY must start with pk_test_ or pk_live_")
+	}
+
+	if secretMode != "" && publishableMode != "" && secretMode != publishableMode {
+		add("STRIPE_SECRET_KEY is a %s mode key but STRIPE_PUBLISHABLE_KEY is a %s mode key", secretMode, publishableMode)
+	}
+
+	switch {
+	case cfg.WebhookSecret == "":
+		add("STRIPE_WEBHOOK_SECRET is required to verify the webhook events")
+	case !strings.HasPrefix(cfg.WebhookSecret, "whsec_"):
+		add("STRIPE_WEBHOOK_SECRET must start with whsec_")
+	}
+
+	if len(cfg.DefaultCurrency) != 3 {
+		add("DEFAULT_CURRENCY must be a three-letter ISO currency code, got %q", cfg.DefaultCurrency)
+	}
+	// https://docs.stripe.com/get-started/account/statement-descriptors#requirements
+	if len(cfg.StatementDescriptor) > 22 {
+		add("STATEMENT_DESCRIPTOR must be at most 22 characters long")
+	}
+	for key, suffix := range map[string]string{
+		"HOLD_STATEMENT_DESCRIPTOR_SUFFIX":   cfg.HoldStatementDescriptorSuffix,
+		"CHARGE_STATEMENT_DESCRIPTOR_SUFFIX": cfg.ChargeStatementDescriptorSuffix,
+	} {
+		if len(suffix) > 22 {
+			add("%s must be at most 22 characters long", key)
+		}
+	}
+
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		add("LOG_FORMAT must be text or json, got %q", cfg.LogFormat)
+	}
+	if cfg.TracingEndpoint != "" {
+		u, err := url.Parse(cfg.TracingEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("OTEL_EXPORTER_OTLP_ENDPOINT must be an http or https URL, got %q", cfg.TracingEndpoint)
+		}
+	}
+	switch cfg.HoldExpiryAction {
+	case "warn", "capture", "cancel":
+	default:
+		add("HOLD_EXPIRY_ACTION must be warn, capture or cancel, got %q", cfg.HoldExpiryAction)
+	}
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < 16 {
+		add("ADMIN_TOKEN must be at least 16 characters long")
+	}
+	names := map[string]bool{}
+	for i, op := range cfg.Operators {
+		switch {
+		case op.Name == "":
+			add("ADMIN_OPERATORS entry %d must be name:role:token", i+1)
+			continue
+		case names[op.Name] || (op.Name == "admin" && cfg.AdminToken != ""):
+			add("ADMIN_OPERATORS names operator %q twice", op.Name)
+		case !operatorRoles[op.Role]:
+			add("ADMIN_OPERATORS role of %q must be viewer, operator or finance-admin, got %q", op.Name, op.Role)
+		case len(op.Token) < 16:
+			add("ADMIN_OPERATORS token of %q must be at least 16 characters long", op.Name)
+		}
+		names[op.Name] = true
+	}
+	currencies := make([]string, 0, len(cfg.ApprovalThresholds))
+	for currency := range cfg.ApprovalThresholds {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		if len(currency) != 3 || cfg.ApprovalThresholds[currency] < 0 {
+			add("ADMIN_APPROVAL_THRESHOLD entry %q must be currency:amount, a non-negative amount in the smallest currency unit", currency)
+		}
+	}
+	if cfg.APIKey != "" && len(cfg.APIKey) < 16 {
+		add("API_KEY must be at least 16 characters long")
+	}
+	if cfg.SessionSecret != "" && len(cfg.SessionSecret) < 32 {
+		add("SESSION_SECRET must be at least 32 characters long")
+	}
+	switch {
+	case cfg.SessionSecret == "" && cfg.APIKey == "" && !cfg.TrustUserHeader:
+		add("SESSION_SECRET or API_KEY is required to authenticate the callers, TRUST_USER_HEADER=true trusts the X-User-ID header for local development")
+	case cfg.TrustUserHeader && secretMode == ModeLive:
+		add("TRUST_USER_HEADER must not be set with a live mode key")
+	}
+
+	return errors.Join(problems...)
+}
+
+// Mode returns the Stripe mode of the configured secret key.
+func (cfg *Config) Mode() Mode {
+	mode, _ := keyMode(cfg.SecretKey, "sk_", "rk_")
+	return mode
+}
+
+// keyMode returns the mode of a key starting with one of the prefixes
+// followed by test_ or live_.
+func keyMode(key string, prefixes ...string) (Mode, bool) {
+	for _, prefix := range prefixes {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(rest, "test_"):
+			return ModeTest, true
+		case strings.HasPrefix(rest, "live_"):
+			return ModeLive, true
+		}
+	}
+	return "", false
+}
+
+func readFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yaml", ".yml":
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+		// YAML is a superset of JSON
+		if err := yaml.Unmarshal(b, &values); err != nil {
+			return nil, fmt.Errorf("config: parse %s: %w", path, err)
+		}
+	default:
+		var err error
+		values, err = godotenv.Read(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+	}
+	return values, nil
+}
+
+func merge(dst, src map[string]string) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
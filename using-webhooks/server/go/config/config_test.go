@@ -0,0 +1,140 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse(map[string]string{
+		"STRIPE_SECRET_KEY":      "rk_test_123",
+		"STRIPE_PUBLISHABLE_KEY": "pk_test_123",
+		"STRIPE_WEBHOOK_SECRET":  "whsec_123",
+		"DEFAULT_CURRENCY":       "EUR",
+		"TRUST_USER_HEADER":      "true",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "localhost:4242", cfg.Addr)
+	require.Equal(t, "eur", cfg.DefaultCurrency)
+	require.Equal(t, "products.json", cfg.CatalogFile)
+	require.Equal(t, "audit.jsonl", cfg.AuditLogFile)
+	require.Equal(t, "text", cfg.LogFormat)
+	require.Equal(t, ModeTest, cfg.Mode())
+	require.Empty(t, cfg.Operators)
+	require.True(t, cfg.TrustUserHeader)
+}
+
+func TestParseOperators(t *testing.T) {
+	cfg, err := Parse(map[string]string{
+		"STRIPE_SECRET_KEY":        "sk_test_123",
+		"STRIPE_PUBLISHABLE_KEY":   "pk_test_123",
+		"ADMIN_OPERATORS":          "alice:finance-admin:0123456789abcdef,bob:operator:fedcba9876543210:x",
+		"STRIPE_WEBHOOK_SECRET":    "whsec_123",
+		"ADMIN_APPROVAL_THRESHOLD": "usd:50000, EUR:45000",
+		"API_KEY":                  "0123456789abcdef",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Operator{
+		{Name: "alice", Role: "finance-admin", Token: "0123456789abcdef"},
+		{Name: "bob", Role: "operator", Token: "fedcba9876543210:x"},
+	}, cfg.Operators)
+	require.Equal(t, map[string]int64{"usd": 50000, "eur": 45000}, cfg.ApprovalThresholds)
+}
+
+func TestParseReportsAllProblems(t *testing.T) {
+	_, err := Parse(map[string]string{
+		"STRIPE_SECRET_KEY":           "sk_live_123",
+		"STRIPE_PUBLISHABLE_KEY":      "pk_test_123",
+		"STRIPE_WEBHOOK_SECRET":       "secret",
+		"DEFAULT_CURRENCY":            "dollar",
+		"STATEMENT_DESCRIPTOR":        "a statement descriptor that is too long",
+		"SESSION_SECRET":              "short",
+		"ADMIN_OPERATORS":             "alice:finance-admin:0123456789abcdef, bob:cashier:0123456789abcdef, alice:viewer:0123456789abcdef, carol",
+		"LOG_FORMAT":                  "xml",
+		"OTEL_EXPORTER_OTLP_ENDPOINT": "localhost:4318",
+		"ADMIN_APPROVAL_THRESHOLD":    "usd:-1,50000",
+		"TRUST_USER_HEADER":           "yes",
+	})
+	require.Error(t, err)
+	for _, problem := range []string{
+		"STRIPE_SECRET_KEY is a live mode key but STRIPE_PUBLISHABLE_KEY is a test mode key",
+		"STRIPE_WEBHOOK_SECRET must start with whsec_",
+		"DEFAULT_CURRENCY must be a three-letter ISO currency code",
+		"STATEMENT_DESCRIPTOR must be at most 22 characters long",
+		"SESSION_SECRET must be at least 32 characters long",
+		`ADMIN_OPERATORS role of "bob" must be viewer, operator or finance-admin, got "cashier"`,
+		`ADMIN_OPERATORS names operator "alice" twice`,
+		"ADMIN_OPERATORS entry 4 must be name:role:token",
+		`LOG_FORMAT must be text or json, got "xml"`,
+		`OTEL_EXPORTER_OTLP_ENDPOINT must be an http or https URL, got "localhost:4318"`,
+		`ADMIN_APPROVAL_THRESHOLD entry "50000" must be currency:amount`,
+		`ADMIN_APPROVAL_THRESHOLD entry "usd" must be currency:amount`,
+		`TRUST_USER_HEADER must be true or false, got "yes"`,
+	} {
+		require.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestParseRejectsInvalidKeys(t *testing.T) {
+	_, err := Parse(map[string]string{
+		"STRIPE_SECRET_KEY":      "pk_test_123",
+		"STRIPE_PUBLISHABLE_KEY": "",
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "STRIPE_SECRET_KEY must start with")
+	require.Contains(t, err.Error(), "STRIPE_PUBLISHABLE_KEY is required")
+	require.Contains(t, err.Error(), "STRIPE_WEBHOOK_SECRET is required")
+}
+
+func TestParseRequiresAuthentication(t *testing.T) {
+	_, err := Parse(map[string]string{
+		"STRIPE_SECRET_KEY":      "sk_test_123",
+		"STRIPE_PUBLISHABLE_KEY": "pk_test_123",
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SESSION_SECRET or API_KEY is required")
+
+	_, err = Parse(map[string]string{
+		"STRIPE_SECRET_KEY":      "sk_live_123",
+		"STRIPE_PUBLISHABLE_KEY": "pk_live_123",
+		"TRUST_USER_HEADER":      "true",
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TRUST_USER_HEADER must not be set with a live mode key")
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(
+		"STRIPE_SECRET_KEY: sk_test_file\nSTRIPE_PUBLISHABLE_KEY: pk_test_file\nSTATIC_DIR: file\nTRUST_USER_HEADER: \"1\"\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".env"), []byte(
+		"STRIPE_PUBLISHABLE_KEY=pk_test_dotenv\nSTRIPE_WEBHOOK_SECRET=whsec_dotenv\nSTATIC_DIR=dotenv\nADDR=dotenv:1\n"), 0600))
+	t.Setenv("STATIC_DIR", "env")
+
+	cfg, err := Load(file)
+	require.NoError(t, err)
+	require.Equal(t, "sk_test_file", cfg.SecretKey)
+	require.Equal(t, "pk_test_file", cfg.PublishableKey)
+	require.Equal(t, "whsec_dotenv", cfg.WebhookSecret)
+	require.Equal(t, "env", cfg.StaticDir)
+	require.Equal(t, "dotenv:1", cfg.Addr)
+	require.True(t, cfg.TrustUserHeader)
+}
+
+func TestLoadWithoutDotenv(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test_env")
+	t.Setenv("STRIPE_PUBLISHABLE_KEY", "pk_test_env")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_env")
+	t.Setenv("SESSION_SECRET", "0123456789abcdef0123456789abcdef")
+
+	cfg, err := Load("")
+	require.NoError(t, err)
+	require.Equal(t, "sk_test_env", cfg.SecretKey)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// userIDHeader carries the ID of the signed in user of your application
+// when the server trusts it, see auth.UserHeader.
+const userIDHeader = auth.UserIDHeader
+
+// userIDMetadataKey is the Customer metadata key that links a Stripe
+// Customer back to the user of your application.
+const userIDMetadataKey = "user_id"
+
+var errMissingUserID = errors.New("user id is required")
+
+// customerRegistry keeps one Stripe Customer per application user, so saved
+// payment methods are never shared between users. The mapping is persisted
+// in the store so it survives restarts.
+type customerRegistry struct {
+	gateway gateway.PaymentGateway
+	store   store.Store
+
+	// locks serializes the provisioning of the Customer of each user, so
+	// concurrent requests of a user create a single one while the other
+	// users are not kept waiting.
+	locksMu sync.Mutex
+	locks   map[string]*userLock
+}
+
+// userLock is the lock of a user, shared by the requests holding or
+// waiting for it.
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newCustomerRegistry(gw gateway.PaymentGateway, st store.Store) *customerRegistry {
+	return &customerRegistry{gateway: gw, store: st, locks: map[string]*userLock{}}
+}
+
+// lock locks the provisioning of the Customer of the user and returns the
+// function unlocking it. The lock is forgotten once nobody uses it.
+func (cr *customerRegistry) lock(userID string) (unlock func()) {
+	cr.locksMu.Lock()
+	l, ok := cr.locks[userID]
+	if !ok {
+		l = &userLock{}
+		cr.locks[userID] = l
+	}
+	l.refs++
+	cr.locksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		cr.locksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(cr.locks, userID)
+		}
+		cr.locksMu.Unlock()
+	}
+}
+
+// lookupOrCreate returns the Stripe Customer ID of the user. When the user
+// is not known locally, Stripe is searched by metadata first, so a lost
+// mapping does not lead to a duplicate customer, and only then a new
+// Customer is created.
+func (cr *customerRegistry) lookupOrCreate(ctx context.Context, userID string) (string, error) {
+	if userID == "" {
+		return "", errMissingUserID
+	}
+
+	// known users do not wait for the lock
+	customerID, err := cr.storedCustomerID(ctx, userID)
+	if err != nil || customerID != "" {
+		return customerID, err
+	}
+
+	unlock := cr.lock(userID)
+	defer unlock()
+
+	// provisioned by a concurrent request while waiting for the lock
+	customerID, err = cr.storedCustomerID(ctx, userID)
+	if err != nil || customerID != "" {
+		return customerID, err
+	}
+
+	customerID, err = cr.findCustomerByUserID(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if customerID == "" {
+		c, err := gateway.WithContext(ctx, cr.gateway).NewCustomer(&stripe.CustomerParams{
+			Metadata: map[string]string{userIDMetadataKey: userID},
+		})
+		if err != nil {
+			return "", fmt.Errorf("customer.New: %w", err)
+		}
+		customerID = c.ID
+	}
+
+	if err := cr.store.SaveCustomer(ctx, store.Customer{ID: customerID, UserID: userID}); err != nil {
+		return "", fmt.Errorf("store.SaveCustomer: %w", err)
+	}
+	return customerID, nil
+}
+
+// storedCustomerID returns the ID of the Customer of the user recorded in
+// the store, or an empty string if there is none.
+func (cr *customerRegistry) storedCustomerID(ctx context.Context, userID string) (string, error) {
+	c, err := cr.store.CustomerByUserID(ctx, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("store.CustomerByUserID: %w", err)
+	}
+	return c.ID, nil
+}
+
+// searchQuoter escapes the backslashes and the quotes of a value of a
+// search query, in a single pass so the escapes are not escaped again.
+// https://docs.stripe.com/search#search-query-language
+var searchQuoter = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// findCustomerByUserID returns the ID of the Customer tagged with userID,
+// or an empty string if there is none.
+func (cr *customerRegistry) findCustomerByUserID(ctx context.Context, userID string) (string, error) {
+	params := &stripe.CustomerSearchParams{}
+	params.Query = fmt.Sprintf("metadata['%s']:'%s'", userIDMetadataKey, searchQuoter.Replace(userID))
+	params.Limit = stripe.Int64(1)
+	found, err := gateway.WithContext(ctx, cr.gateway).SearchCustomers(params)
+	if err != nil {
+		return "", fmt.Errorf("customer.Search: %w", err)
+	}
+	if len(found) == 0 {
+		return "", nil
+	}
+	return found[0].ID, nil
+}
+
+// requestCustomer returns the Stripe Customer ID of the user the request is
+// made on behalf of, see requestUserID. The error response is written when
+// it fails.
+func (s *Server) requestCustomer(w http.ResponseWriter, r *http.Request, bodyUserID string) (string, bool) {
+	userID, err := requestUserID(r, bodyUserID)
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return "", false
+	case errors.Is(err, errForeignUser):
+		writeError(w, http.StatusForbidden, err.Error())
+		return "", false
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	customerID, err := s.customers.lookupOrCreate(r.Context(), userID)
+	if err != nil {
+		writeFailure(w, "customers.lookupOrCreate", err)
+		return "", false
+	}
+	return customerID, true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// blockingSearch is a fake gateway whose searches of the customer of
+// blockedUser wait until release is closed.
+type blockingSearch struct {
+	*gateway.Fake
+	blockedUser string
+	searching   chan struct{}
+	release     chan struct{}
+}
+
+func (g *blockingSearch) SearchCustomers(params *stripe.CustomerSearchParams) ([]*stripe.Customer, error) {
+	if strings.Contains(params.Query, g.blockedUser) {
+		g.searching <- struct{}{}
+		<-g.release
+	}
+	return g.Fake.SearchCustomers(params)
+}
+
+func TestLookupOrCreate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("creates one customer per user", func(t *testing.T) {
+		fake := gateway.NewFake()
+		cr := newCustomerRegistry(fake, store.NewMemory())
+
+		var wg sync.WaitGroup
+		ids := make([]string, 10)
+		for i := range ids {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				id, err := cr.lookupOrCreate(ctx, "user_1")
+				require.NoError(t, err)
+				ids[i] = id
+			}()
+		}
+		wg.Wait()
+		for _, id := range ids {
+			require.Equal(t, ids[0], id)
+		}
+
+		other, err := cr.lookupOrCreate(ctx, "user_2")
+		require.NoError(t, err)
+		require.NotEqual(t, ids[0], other)
+		require.Empty(t, cr.locks)
+	})
+
+	t.Run("finds the customer of a lost mapping", func(t *testing.T) {
+		fake := gateway.NewFake()
+		for _, userID := range []string{`o'brien`, `back\slash`, `trailing\`, `both\'`} {
+			id, err := newCustomerRegistry(fake, store.NewMemory()).lookupOrCreate(ctx, userID)
+			require.NoError(t, err)
+
+			// another store does not know the user, Stripe does
+			found, err := newCustomerRegistry(fake, store.NewMemory()).lookupOrCreate(ctx, userID)
+			require.NoError(t, err)
+			require.Equal(t, id, found, userID)
+		}
+	})
+
+	t.Run("does not keep other users waiting", func(t *testing.T) {
+		gw := &blockingSearch{Fake: gateway.NewFake(), blockedUser: "user_1", searching: make(chan struct{}), release: make(chan struct{})}
+		cr := newCustomerRegistry(gw, store.NewMemory())
+
+		done := make(chan string)
+		go func() {
+			id, err := cr.lookupOrCreate(ctx, "user_1")
+			require.NoError(t, err)
+			done <- id
+		}()
+		<-gw.searching
+
+		// user_1 is still being searched on Stripe
+		other := make(chan string)
+		go func() {
+			id, err := cr.lookupOrCreate(ctx, "user_2")
+			require.NoError(t, err)
+			other <- id
+		}()
+		select {
+		case id := <-other:
+			require.NotEmpty(t, id)
+		case <-time.After(time.Second):
+			t.Fatal("user_2 waited for user_1")
+		}
+
+		close(gw.release)
+		require.NotEmpty(t, <-done)
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// setDefaultPaymentMethod makes the payment method the default one of the
+// customer, in invoice_settings.default_payment_method, or unsets it when
+// paymentMethodID is empty.
+func (s *Server) setDefaultPaymentMethod(ctx context.Context, customerID, paymentMethodID string) error {
+	_, err := s.gatewayFor(ctx).UpdateCustomer(customerID, &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(paymentMethodID),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("customer.Update: %w", err)
+	}
+	return nil
+}
+
+// promoteDefaultPaymentMethod makes the newly saved payment method the
+// default one of the customer when the customer has none. Payment methods
+// detached and customers deleted in the meantime are ignored.
+func (s *Server) promoteDefaultPaymentMethod(ctx context.Context, customerID, paymentMethodID string) error {
+	s.defaultMu.Lock()
+	defer s.defaultMu.Unlock()
+
+	defaultID, err := s.defaultPaymentMethodID(ctx, customerID)
+	if isResourceMissing(err) {
+		return nil
+	}
+	if err != nil || defaultID != "" {
+		return err
+	}
+	if _, err := s.customerPaymentMethod(ctx, customerID, paymentMethodID); err != nil {
+		if errors.Is(err, errPaymentMethodNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := s.setDefaultPaymentMethod(ctx, customerID, paymentMethodID); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "default payment method set", logging.CustomerID(customerID), "payment_method_id", paymentMethodID)
+	return nil
+}
+
+// reassignDefaultPaymentMethod makes the most recent payment method saved to
+// the customer the default one, when the detached payment method was the
+// default. Stripe unsets the default of the customer on detach.
+func (s *Server) reassignDefaultPaymentMethod(ctx context.Context, customerID, detachedID string) error {
+	s.defaultMu.Lock()
+	defer s.defaultMu.Unlock()
+
+	defaultID, err := s.defaultPaymentMethodID(ctx, customerID)
+	if isResourceMissing(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if defaultID != "" && defaultID != detachedID {
+		return nil
+	}
+	pms, err := s.gatewayFor(ctx).ListPaymentMethods(&stripe.CustomerListPaymentMethodsParams{Customer: stripe.String(customerID)})
+	if err != nil {
+		return fmt.Errorf("customer.ListPaymentMethods: %w", err)
+	}
+	for _, pm := range pms {
+		if pm.ID == detachedID {
+			continue
+		}
+		if err := s.setDefaultPaymentMethod(ctx, customerID, pm.ID); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "default payment method replaced", logging.CustomerID(customerID),
+			"payment_method_id", pm.ID, "detached_payment_method_id", detachedID)
+		return nil
+	}
+	return nil
+}
+
+// handleDefaultPaymentMethod returns the default payment method of the user
+// on GET, null when there is none, and sets it to one of the saved payment
+// methods on POST.
+func (s *Server) handleDefaultPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		customerID, ok := s.requestCustomer(w, r, r.URL.Query().Get("userID"))
+		if !ok {
+			return
+		}
+		s.writeDefaultPaymentMethod(r.Context(), w, customerID)
+	case "POST":
+		req, customerID, ok := s.decodePaymentMethodRequest(w, r)
+		if !ok {
+			return
+		}
+		if _, err := s.customerPaymentMethod(r.Context(), customerID, req.PaymentMethodID); err != nil {
+			writePaymentMethodError(w, err)
+			return
+		}
+		s.defaultMu.Lock()
+		err := s.setDefaultPaymentMethod(r.Context(), customerID, req.PaymentMethodID)
+		s.defaultMu.Unlock()
+		if err != nil {
+			writeFailure(w, "setDefaultPaymentMethod", err)
+			return
+		}
+		s.writeDefaultPaymentMethod(r.Context(), w, customerID)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
+
+func (s *Server) writeDefaultPaymentMethod(ctx context.Context, w http.ResponseWriter, customerID string) {
+	c, err := s.gatewayFor(ctx).GetCustomer(customerID, &stripe.CustomerParams{
+		Expand: []*string{stripe.String("invoice_settings.default_payment_method")},
+	})
+	if err != nil {
+		writeFailure(w, "customer.Get", err)
+		return
+	}
+	resp := struct {
+		PaymentMethod *SavedPaymentMethod `json:"paymentMethod"`
+	}{}
+	if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil {
+		pm := newSavedPaymentMethod(c.InvoiceSettings.DefaultPaymentMethod, c.InvoiceSettings.DefaultPaymentMethod.ID)
+		resp.PaymentMethod = &pm
+	}
+	writeJSON(w, resp)
+}
+
+// detachedCustomerID returns the customer a detached payment method was
+// saved to. The payment_method.detached event carries it in the previous
+// attributes, the local copy of the payment method has it too.
+func (s *Server) detachedCustomerID(ctx context.Context, event *stripe.Event, pm *stripe.PaymentMethod) string {
+	if customerID := event.GetPreviousValue("customer"); customerID != "" {
+		return customerID
+	}
+	if rec, err := s.store.PaymentMethod(ctx, pm.ID); err == nil {
+		return rec.CustomerID
+	}
+	return ""
+}
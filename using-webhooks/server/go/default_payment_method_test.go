@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// defaultOf returns the ID of the default payment method of the customer.
+func defaultOf(t *testing.T, fake *gateway.Fake, customerID string) string {
+	c, err := fake.GetCustomer(customerID, nil)
+	require.NoError(t, err)
+	if c.InvoiceSettings.DefaultPaymentMethod == nil {
+		return ""
+	}
+	return c.InvoiceSettings.DefaultPaymentMethod.ID
+}
+
+func TestDefaultPaymentMethod(t *testing.T) {
+	t.Run("sets and gets the default", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		customerID := customerOf(t, s, "user_1")
+		first := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		second := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		other := fake.AddPaymentMethod(customerOf(t, s, "user_2"), gateway.CardSucceeds)
+
+		get := func() *SavedPaymentMethod {
+			r := httptest.NewRequest(http.MethodGet, "/default-payment-method", nil)
+			w := httptest.NewRecorder()
+			s.handleDefaultPaymentMethod(w, asCaller(r, "user_1"))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			var resp struct {
+				PaymentMethod *SavedPaymentMethod `json:"paymentMethod"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			return resp.PaymentMethod
+		}
+		require.Nil(t, get())
+
+		w := postJSON(t, s.handleDefaultPaymentMethod, "user_1", `{"paymentMethodID": "`+second.ID+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		pm := get()
+		require.NotNil(t, pm)
+		require.Equal(t, second.ID, pm.ID)
+		require.Equal(t, second.Card.Last4, pm.Last4)
+		require.True(t, pm.Default)
+
+		w = postJSON(t, s.handleDefaultPaymentMethod, "user_1", `{"paymentMethodID": "`+other.ID+`"}`)
+		require.Equal(t, http.StatusNotFound, w.Code)
+		require.Equal(t, second.ID, defaultOf(t, fake, customerID))
+
+		// detaching the default reassigns it
+		w = postJSON(t, s.handleDetachPaymentMethod, "user_1", `{"paymentMethodID": "`+second.ID+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, first.ID, defaultOf(t, fake, customerID))
+	})
+
+	t.Run("promotes the first saved payment method", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		customerID := customerOf(t, s, "user_1")
+		first := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		second := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+
+		postEvent(t, s, "evt_1", stripe.EventTypeSetupIntentSucceeded, map[string]interface{}{
+			"id": "seti_1", "object": "setup_intent", "status": "succeeded", "customer": customerID, "payment_method": first.ID,
+		})
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_1").Result)
+		require.Equal(t, first.ID, defaultOf(t, fake, customerID))
+
+		// the customer has a default already
+		postEvent(t, s, "evt_2", stripe.EventTypePaymentMethodAttached, second)
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_2").Result)
+		require.Equal(t, first.ID, defaultOf(t, fake, customerID))
+	})
+
+	t.Run("reassigns the default when it is detached", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		customerID := customerOf(t, s, "user_1")
+		first := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		second := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		postEvent(t, s, "evt_1", stripe.EventTypePaymentMethodAttached, first)
+		postEvent(t, s, "evt_2", stripe.EventTypePaymentMethodAttached, second)
+		require.Equal(t, first.ID, defaultOf(t, fake, customerID))
+
+		// detached from the Dashboard, the event no longer has the customer
+		detached, err := fake.DetachPaymentMethod(first.ID, nil)
+		require.NoError(t, err)
+		require.Empty(t, defaultOf(t, fake, customerID))
+		postEvent(t, s, "evt_3", stripe.EventTypePaymentMethodDetached, detached)
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_3").Result)
+		require.Equal(t, second.ID, defaultOf(t, fake, customerID))
+	})
+}
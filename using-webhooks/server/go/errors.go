@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// Error types of APIError. The types of the errors returned by Stripe are
+// reused where they match.
+const (
+	errorTypeInvalidRequest = string(stripe.ErrorTypeInvalidRequest)
+	errorTypeCard           = string(stripe.ErrorTypeCard)
+	errorTypeIdempotency    = string(stripe.ErrorTypeIdempotency)
+	errorTypeInvalidState   = "invalid_state_error"
+	errorTypeAuthentication = "authentication_error"
+	errorTypeAPI            = string(stripe.ErrorTypeAPI)
+)
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError tells the client what went wrong. The messages of internal
+// failures are not sent, they are only logged.
+type APIError struct {
+	Type        string `json:"type"`
+	Code        string `json:"code,omitempty"`
+	DeclineCode string `json:"declineCode,omitempty"`
+	Message     string `json:"message"`
+	Param       string `json:"param,omitempty"`
+	// RequestID is the ID of the Stripe request which failed, to look it
+	// up in the Dashboard.
+	RequestID string `json:"requestID,omitempty"`
+	// Fields lists the problems of the fields of an invalid request.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// stateErrorCodes are the codes of the Stripe errors telling that the object
+// is not in a state allowing the request.
+var stateErrorCodes = map[stripe.ErrorCode]bool{
+	stripe.ErrorCodePaymentIntentUnexpectedState: true,
+	stripe.ErrorCodeSetupIntentUnexpectedState:   true,
+	stripe.ErrorCodeChargeAlreadyCaptured:        true,
+	stripe.ErrorCodeChargeAlreadyRefunded:        true,
+	stripe.ErrorCodeChargeExpiredForCapture:      true,
+}
+
+// writeError writes an error response with the message, its type follows
+// from the status.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeAPIError(w, status, APIError{Message: message})
+}
+
+// writeAPIError writes an error response, the type of e defaults to the
+// one following from the status.
+func writeAPIError(w http.ResponseWriter, status int, e APIError) {
+	if e.Type == "" {
+		e.Type = errorType(status)
+	}
+	body, err := json.Marshal(ErrorResponse{Error: e})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		slog.Error("json.Marshal failed", logging.Err(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		slog.Error("ResponseWriter.Write failed", logging.Err(err))
+	}
+}
+
+// writeFailure writes the error response for err, returned by op. The
+// errors returned by Stripe are mapped to the matching status: 402 for card
+// errors, 400 for invalid requests, 404 for unknown objects, 409 for
+// objects in the wrong state and 502 for everything else. Other errors are
+// internal failures, answered with a 500, or a 502 when Stripe could not be
+// reached. Failures on the server side are logged.
+func writeFailure(w http.ResponseWriter, op string, err error) {
+	status, e := failure(err)
+	if status >= http.StatusInternalServerError {
+		// the request ID was set on the response by withRequestID
+		slog.Error(op+" failed", slog.String(logging.RequestIDKey, w.Header().Get(requestIDHeader)), logging.Err(err))
+	}
+	writeAPIError(w, status, e)
+}
+
+func failure(err error) (int, APIError) {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return http.StatusBadGateway, APIError{Type: errorTypeAPI, Message: "The payment provider could not be reached."}
+		}
+		return http.StatusInternalServerError, APIError{Type: errorTypeAPI, Message: "An internal error occurred."}
+	}
+
+	e := APIError{
+		Type:      string(stripeErr.Type),
+		Code:      string(stripeErr.Code),
+		Message:   stripeErr.Msg,
+		Param:     stripeErr.Param,
+		RequestID: stripeErr.RequestID,
+	}
+	switch {
+	case stripeErr.Type == stripe.ErrorTypeCard:
+		e.DeclineCode = string(stripeErr.DeclineCode)
+		return http.StatusPaymentRequired, e
+	case stripeErr.Type == stripe.ErrorTypeInvalidRequest && stripeErr.Code == stripe.ErrorCodeResourceMissing:
+		return http.StatusNotFound, e
+	case stripeErr.Type == stripe.ErrorTypeInvalidRequest && stateErrorCodes[stripeErr.Code]:
+		e.Type = errorTypeInvalidState
+		return http.StatusConflict, e
+	case stripeErr.Type == stripe.ErrorTypeInvalidRequest && stripeErr.HTTPStatusCode == http.StatusBadRequest:
+		return http.StatusBadRequest, e
+	}
+	// authentication, permission, rate limit and Stripe errors are not
+	// the client's doing, they are not described
+	return http.StatusBadGateway, APIError{
+		Type:      errorTypeAPI,
+		Message:   "The payment provider could not process the request.",
+		RequestID: stripeErr.RequestID,
+	}
+}
+
+func errorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errorTypeAuthentication
+	case status == http.StatusPaymentRequired:
+		return errorTypeCard
+	case status == http.StatusConflict:
+		return errorTypeInvalidState
+	case status >= http.StatusInternalServerError:
+		return errorTypeAPI
+	}
+	return errorTypeInvalidRequest
+}
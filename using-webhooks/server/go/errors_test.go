@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// errorOf decodes the error response.
+func errorOf(t *testing.T, w *httptest.ResponseRecorder) APIError {
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Error
+}
+
+func TestWriteFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   APIError
+	}{
+		{
+			name: "card error",
+			err: fmt.Errorf("paymentintent.New: %w", &stripe.Error{
+				Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeCardDeclined, DeclineCode: stripe.DeclineCodeInsufficientFunds,
+				Msg: "Your card has insufficient funds.", HTTPStatusCode: 402, RequestID: "req_1",
+				PaymentIntent: &stripe.PaymentIntent{ClientSecret: "pi_1_secret_1"},
+			}),
+			status: http.StatusPaymentRequired,
+			want: APIError{
+				Type: "card_error", Code: "card_declined", DeclineCode: "insufficient_funds",
+				Message: "Your card has insufficient funds.", RequestID: "req_1",
+			},
+		},
+		{
+			name: "invalid parameter",
+			err: &stripe.Error{
+				Type: stripe.ErrorTypeInvalidRequest, Msg: "Amount must be at least 1", Param: "amount",
+				HTTPStatusCode: 400, RequestID: "req_2",
+			},
+			status: http.StatusBadRequest,
+			want:   APIError{Type: "invalid_request_error", Message: "Amount must be at least 1", Param: "amount", RequestID: "req_2"},
+		},
+		{
+			name: "unknown object",
+			err: &stripe.Error{
+				Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing, Msg: "No such payment_intent: 'pi_1'",
+				Param: "id", HTTPStatusCode: 404, RequestID: "req_3",
+			},
+			status: http.StatusNotFound,
+			want: APIError{
+				Type: "invalid_request_error", Code: "resource_missing", Message: "No such payment_intent: 'pi_1'",
+				Param: "id", RequestID: "req_3",
+			},
+		},
+		{
+			name: "unexpected state",
+			err: &stripe.Error{
+				Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodePaymentIntentUnexpectedState,
+				Msg: "This PaymentIntent's status is canceled.", HTTPStatusCode: 400, RequestID: "req_4",
+			},
+			status: http.StatusConflict,
+			want: APIError{
+				Type: "invalid_state_error", Code: "payment_intent_unexpected_state",
+				Message: "This PaymentIntent's status is canceled.", RequestID: "req_4",
+			},
+		},
+		{
+			name: "bad API key",
+			err: &stripe.Error{
+				Type: stripe.ErrorTypeInvalidRequest, Msg: "Invalid API Key provided: sk_test_****1234",
+				HTTPStatusCode: 401, RequestID: "req_5",
+			},
+			status: http.StatusBadGateway,
+			want:   APIError{Type: "api_error", Message: "The payment provider could not process the request.", RequestID: "req_5"},
+		},
+		{
+			name:   "network failure",
+			err:    &url.Error{Op: "Post", URL: "https://api.stripe.com/v1/payment_intents", Err: errors.New("connection refused")},
+			status: http.StatusBadGateway,
+			want:   APIError{Type: "api_error", Message: "The payment provider could not be reached."},
+		},
+		{
+			name:   "internal failure",
+			err:    errors.New("store: database is locked"),
+			status: http.StatusInternalServerError,
+			want:   APIError{Type: "api_error", Message: "An internal error occurred."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeFailure(w, "test", tt.err)
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, tt.want, errorOf(t, w))
+			require.NotContains(t, w.Body.String(), "secret")
+		})
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	w := postJSON(t, s.handleCreateSetupIntent, "user_1", `{"userID": `)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "invalid_request_error", errorOf(t, w).Type)
+
+	w = postJSON(t, s.handleCapturePaymentIntent, "", `{"paymentIntentID": "pi_unknown"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, "resource_missing", errorOf(t, w).Code)
+
+	w = postJSON(t, s.handleCreatePaymentIntent, "user_1", `{}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created intentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	w = postJSON(t, s.handleCapturePaymentIntent, "", `{"paymentIntentID": "`+created.ID+`"}`)
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.Equal(t, "invalid_state_error", errorOf(t, w).Type)
+}
@@ -0,0 +1,210 @@
+// Package events dispatches Stripe webhook events to the handlers registered
+// for their type. Stripe delivers an event at least once, a Ledger records
+// the events already processed so their handlers run only once.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/stripe/stripe-go/v80"
+)
+
+// ErrInvalidPayload is returned by Dispatch when the event object cannot be
+// decoded into the type expected by a handler. Retrying such an event does
+// not help.
+var ErrInvalidPayload = errors.New("events: invalid event payload")
+
+// Result tells what Dispatch did with an event.
+type Result int
+
+const (
+	// Ignored events have no handler.
+	Ignored Result = iota
+	// Handled events were processed by their handlers.
+	Handled
+	// Duplicate events were already processed, no handler ran.
+	Duplicate
+)
+
+func (r Result) String() string {
+	switch r {
+	case Handled:
+		return "handled"
+	case Duplicate:
+		return "duplicate"
+	default:
+		return "ignored"
+	}
+}
+
+// Ledger records the IDs of the processed events. store.Store implements it.
+type Ledger interface {
+	EventProcessed(ctx context.Context, id string) (bool, error)
+	MarkEventProcessed(ctx context.Context, id string) error
+}
+
+// Handler handles an event whose object was decoded into T.
+type Handler[T any] func(ctx context.Context, event *stripe.Event, object *T) error
+
+// DispatchFunc dispatches an event, see Dispatcher.Dispatch.
+type DispatchFunc func(ctx context.Context, event *stripe.Event) (Result, error)
+
+// Middleware wraps the dispatch of every event, to measure it for
+// instance.
+type Middleware func(next DispatchFunc) DispatchFunc
+
+type registration struct {
+	pattern string
+	handle  func(ctx context.Context, event *stripe.Event) error
+}
+
+// Dispatcher runs the handlers registered for the type of an event.
+type Dispatcher struct {
+	ledger Ledger
+
+	mu            sync.RWMutex
+	registrations []registration
+	middlewares   []Middleware
+
+	// inflight serializes the concurrent deliveries of an event.
+	inflightMu sync.Mutex
+	inflight   map[string]*inflightEvent
+}
+
+type inflightEvent struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// New returns a Dispatcher without handlers. Events are deduplicated with
+// ledger, every delivery is processed when it is nil.
+func New(ledger Ledger) *Dispatcher {
+	return &Dispatcher{ledger: ledger, inflight: map[string]*inflightEvent{}}
+}
+
+// On registers h for the events of the given type. The type may end with
+// ".*" to match every event of a resource, like "payment_intent.*". The
+// event object is decoded into a new T before h is called.
+func On[T any](d *Dispatcher, eventType stripe.EventType, h Handler[T]) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.registrations = append(d.registrations, registration{
+		pattern: string(eventType),
+		handle: func(ctx context.Context, event *stripe.Event) error {
+			object := new(T)
+			if event.Data == nil {
+				return fmt.Errorf("%w: %s has no data", ErrInvalidPayload, event.Type)
+			}
+			if err := json.Unmarshal(event.Data.Raw, object); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidPayload, event.Type, err)
+			}
+			return h(ctx, event, object)
+		},
+	})
+}
+
+// Handles reports whether a handler is registered for eventType.
+func (d *Dispatcher) Handles(eventType stripe.EventType) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, reg := range d.registrations {
+		if matches(reg.pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Use wraps the dispatch of every event in mw. The middleware added first
+// is the outermost one.
+func (d *Dispatcher) Use(mw Middleware) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.middlewares = append(d.middlewares, mw)
+}
+
+// Dispatch runs the handlers matching the type of event in registration
+// order and stops at the first error. Events already in the ledger are not
+// dispatched again, the event is added to the ledger once its handlers
+// succeeded. The middlewares see every delivery, duplicates included.
+func (d *Dispatcher) Dispatch(ctx context.Context, event *stripe.Event) (Result, error) {
+	d.mu.RLock()
+	dispatch := d.dispatch
+	for i := len(d.middlewares) - 1; i >= 0; i-- {
+		dispatch = d.middlewares[i](dispatch)
+	}
+	d.mu.RUnlock()
+	return dispatch(ctx, event)
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, event *stripe.Event) (Result, error) {
+	unlock := d.lock(event.ID)
+	defer unlock()
+
+	if d.ledger != nil {
+		processed, err := d.ledger.EventProcessed(ctx, event.ID)
+		if err != nil {
+			return Ignored, fmt.Errorf("events: ledger: %w", err)
+		}
+		if processed {
+			return Duplicate, nil
+		}
+	}
+
+	d.mu.RLock()
+	registrations := d.registrations
+	d.mu.RUnlock()
+
+	result := Ignored
+	for _, reg := range registrations {
+		if !matches(reg.pattern, event.Type) {
+			continue
+		}
+		result = Handled
+		if err := reg.handle(ctx, event); err != nil {
+			return result, err
+		}
+	}
+
+	if d.ledger != nil {
+		if err := d.ledger.MarkEventProcessed(ctx, event.ID); err != nil {
+			return result, fmt.Errorf("events: ledger: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// lock waits until no other delivery of the event is being dispatched.
+func (d *Dispatcher) lock(id string) (unlock func()) {
+	d.inflightMu.Lock()
+	e, ok := d.inflight[id]
+	if !ok {
+		e = &inflightEvent{}
+		d.inflight[id] = e
+	}
+	e.refs++
+	d.inflightMu.Unlock()
+
+	e.mu.Lock()
+	return func() {
+		e.mu.Unlock()
+		d.inflightMu.Lock()
+		e.refs--
+		if e.refs == 0 {
+			delete(d.inflight, id)
+		}
+		d.inflightMu.Unlock()
+	}
+}
+
+func matches(pattern string, eventType stripe.EventType) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(string(eventType), prefix)
+	}
+	return pattern == string(eventType)
+}
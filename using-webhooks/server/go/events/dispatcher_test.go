@@ -0,0 +1,125 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+func newEvent(t *testing.T, eventType stripe.EventType, object interface{}) *stripe.Event {
+	raw, err := json.Marshal(object)
+	require.NoError(t, err)
+	return &stripe.Event{ID: "evt_1", Type: eventType, Data: &stripe.EventData{Raw: raw}}
+}
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+	d := New(nil)
+	var calls []string
+	On(d, "payment_intent.*", func(_ context.Context, _ *stripe.Event, pi *stripe.PaymentIntent) error {
+		calls = append(calls, "any:"+pi.ID)
+		return nil
+	})
+	On(d, stripe.EventTypePaymentIntentSucceeded, func(_ context.Context, _ *stripe.Event, pi *stripe.PaymentIntent) error {
+		calls = append(calls, "succeeded:"+pi.ID)
+		return nil
+	})
+
+	result, err := d.Dispatch(ctx, newEvent(t, stripe.EventTypePaymentIntentSucceeded, map[string]string{"id": "pi_1"}))
+	require.NoError(t, err)
+	require.Equal(t, Handled, result)
+	require.Equal(t, []string{"any:pi_1", "succeeded:pi_1"}, calls)
+
+	calls = nil
+	result, err = d.Dispatch(ctx, newEvent(t, stripe.EventTypePaymentIntentCanceled, map[string]string{"id": "pi_2"}))
+	require.NoError(t, err)
+	require.Equal(t, Handled, result)
+	require.Equal(t, []string{"any:pi_2"}, calls)
+
+	calls = nil
+	result, err = d.Dispatch(ctx, newEvent(t, stripe.EventTypeChargeRefunded, map[string]string{"id": "ch_1"}))
+	require.NoError(t, err)
+	require.Equal(t, Ignored, result)
+	require.Empty(t, calls)
+	require.False(t, d.Handles(stripe.EventTypeChargeRefunded))
+	require.True(t, d.Handles(stripe.EventTypePaymentIntentCreated))
+}
+
+func TestDispatchErrors(t *testing.T) {
+	ctx := context.Background()
+	d := New(nil)
+	errBoom := errors.New("boom")
+	ran := false
+	On(d, stripe.EventTypeSetupIntentSucceeded, func(context.Context, *stripe.Event, *stripe.SetupIntent) error {
+		return errBoom
+	})
+	On(d, stripe.EventTypeSetupIntentSucceeded, func(context.Context, *stripe.Event, *stripe.SetupIntent) error {
+		ran = true
+		return nil
+	})
+
+	_, err := d.Dispatch(ctx, newEvent(t, stripe.EventTypeSetupIntentSucceeded, map[string]string{"id": "seti_1"}))
+	require.ErrorIs(t, err, errBoom)
+	require.False(t, ran, "handlers after a failure must not run")
+
+	_, err = d.Dispatch(ctx, newEvent(t, stripe.EventTypeSetupIntentSucceeded, []string{"not", "an", "object"}))
+	require.ErrorIs(t, err, ErrInvalidPayload)
+}
+
+func TestDispatchDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	d := New(store.NewMemory())
+	calls := 0
+	fail := true
+	On(d, stripe.EventTypePaymentIntentSucceeded, func(context.Context, *stripe.Event, *stripe.PaymentIntent) error {
+		calls++
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	event := newEvent(t, stripe.EventTypePaymentIntentSucceeded, map[string]string{"id": "pi_1"})
+
+	// a failed delivery is not recorded, the retry runs the handlers again
+	_, err := d.Dispatch(ctx, event)
+	require.Error(t, err)
+	fail = false
+	result, err := d.Dispatch(ctx, event)
+	require.NoError(t, err)
+	require.Equal(t, Handled, result)
+
+	result, err = d.Dispatch(ctx, event)
+	require.NoError(t, err)
+	require.Equal(t, Duplicate, result)
+	require.Equal(t, 2, calls)
+}
+
+func TestDispatchMiddleware(t *testing.T) {
+	ctx := context.Background()
+	d := New(store.NewMemory())
+	On(d, stripe.EventTypePaymentIntentSucceeded, func(context.Context, *stripe.Event, *stripe.PaymentIntent) error {
+		return nil
+	})
+	var calls []string
+	for _, name := range []string{"outer", "inner"} {
+		d.Use(func(next DispatchFunc) DispatchFunc {
+			return func(ctx context.Context, event *stripe.Event) (Result, error) {
+				result, err := next(ctx, event)
+				calls = append(calls, name+":"+result.String())
+				return result, err
+			}
+		})
+	}
+
+	event := newEvent(t, stripe.EventTypePaymentIntentSucceeded, map[string]string{"id": "pi_1"})
+	_, err := d.Dispatch(ctx, event)
+	require.NoError(t, err)
+	_, err = d.Dispatch(ctx, event)
+	require.NoError(t, err)
+	require.Equal(t, []string{"inner:handled", "outer:handled", "inner:duplicate", "outer:duplicate"}, calls)
+}
@@ -0,0 +1,280 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// ErrNotDeadLetter is returned by Replay for an event that is not in the
+// dead-letter list.
+var ErrNotDeadLetter = errors.New("events: not a dead letter")
+
+// Inbox persists the received events until they are processed.
+// store.Store implements it.
+type Inbox interface {
+	AddInboxEvent(ctx context.Context, e store.InboxEvent) (bool, error)
+	SaveInboxEvent(ctx context.Context, e store.InboxEvent) error
+	InboxEvent(ctx context.Context, id string) (store.InboxEvent, error)
+	InboxEvents(ctx context.Context, filter store.InboxFilter) ([]store.InboxEvent, error)
+}
+
+// QueueOptions configures a Queue. Zero values are replaced by the defaults
+// documented on each field.
+type QueueOptions struct {
+	// Workers is the number of events processed concurrently, 4 by default.
+	Workers int
+	// MaxAttempts is the number of times an event is processed before it
+	// is moved to the dead-letter list, 8 by default.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry, 1s by default. The
+	// delay doubles after every failed attempt.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts, 1h by default.
+	MaxBackoff time.Duration
+	// PollInterval is how often Run looks for due events, 1s by default.
+	PollInterval time.Duration
+	// Now returns the current time, time.Now by default.
+	Now func() time.Time
+}
+
+// Queue processes the events of an inbox with a Dispatcher. Events are
+// acknowledged to Stripe once enqueued, failed events are retried with an
+// exponential backoff and end up in the dead-letter list after
+// MaxAttempts attempts.
+type Queue struct {
+	inbox      Inbox
+	dispatcher *Dispatcher
+	opts       QueueOptions
+	wake       chan struct{}
+}
+
+// NewQueue returns a Queue dispatching the events of inbox to d.
+func NewQueue(inbox Inbox, d *Dispatcher, opts QueueOptions) *Queue {
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 8
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Hour
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Queue{inbox: inbox, dispatcher: d, opts: opts, wake: make(chan struct{}, 1)}
+}
+
+// Enqueue adds the verified event to the inbox, payload is the request body
+// it was read from. It reports false when the event is already in the
+// inbox.
+func (q *Queue) Enqueue(ctx context.Context, event *stripe.Event, payload []byte) (bool, error) {
+	now := q.opts.Now().Unix()
+	added, err := q.inbox.AddInboxEvent(ctx, store.InboxEvent{
+		ID:          event.ID,
+		Type:        string(event.Type),
+		Payload:     payload,
+		Status:      store.InboxPending,
+		NextAttempt: now,
+		Received:    now,
+	})
+	if err != nil {
+		return false, fmt.Errorf("events: enqueue %s: %w", event.ID, err)
+	}
+	if added {
+		q.notify()
+	}
+	return added, nil
+}
+
+// Run processes the due events with the configured number of workers until
+// ctx is done. Events left processing by a previous run are retried.
+func (q *Queue) Run(ctx context.Context) error {
+	if err := q.requeueInterrupted(ctx); err != nil {
+		return err
+	}
+
+	jobs := make(chan store.InboxEvent)
+	var wg sync.WaitGroup
+	for i := 0; i < q.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				q.process(ctx, e)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(q.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		due, err := q.claimDue(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "events.Queue: claiming due events failed", logging.Err(err))
+		}
+		for _, e := range due {
+			select {
+			case jobs <- e:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// ProcessDue processes the due events one after the other and returns how
+// many were processed. It is meant for tests and one-off jobs, Run is the
+// long-running alternative.
+func (q *Queue) ProcessDue(ctx context.Context) (int, error) {
+	due, err := q.claimDue(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range due {
+		q.process(ctx, e)
+	}
+	return len(due), nil
+}
+
+// DeadLetters lists the events that failed MaxAttempts times, or could not
+// be decoded.
+func (q *Queue) DeadLetters(ctx context.Context) ([]store.InboxEvent, error) {
+	return q.inbox.InboxEvents(ctx, store.InboxFilter{Status: store.InboxDead})
+}
+
+// Replay moves a dead letter back to the queue with a fresh set of attempts.
+func (q *Queue) Replay(ctx context.Context, id string) error {
+	e, err := q.inbox.InboxEvent(ctx, id)
+	if err != nil {
+		return err
+	}
+	if e.Status != store.InboxDead {
+		return fmt.Errorf("%w: %s is %s", ErrNotDeadLetter, id, e.Status)
+	}
+	e.Status = store.InboxPending
+	e.Attempts = 0
+	e.NextAttempt = q.opts.Now().Unix()
+	if err := q.inbox.SaveInboxEvent(ctx, e); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// claimDue marks the due events as processing and returns them.
+func (q *Queue) claimDue(ctx context.Context) ([]store.InboxEvent, error) {
+	due, err := q.inbox.InboxEvents(ctx, store.InboxFilter{
+		Status: store.InboxPending,
+		DueBy:  q.opts.Now().Unix(),
+		Limit:  q.opts.Workers * 4,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list due events: %w", err)
+	}
+	claimed := due[:0]
+	for _, e := range due {
+		e.Status = store.InboxProcessing
+		if err := q.inbox.SaveInboxEvent(ctx, e); err != nil {
+			return claimed, fmt.Errorf("claim %s: %w", e.ID, err)
+		}
+		claimed = append(claimed, e)
+	}
+	return claimed, nil
+}
+
+func (q *Queue) requeueInterrupted(ctx context.Context) error {
+	interrupted, err := q.inbox.InboxEvents(ctx, store.InboxFilter{Status: store.InboxProcessing})
+	if err != nil {
+		return fmt.Errorf("events: list interrupted events: %w", err)
+	}
+	for _, e := range interrupted {
+		e.Status = store.InboxPending
+		if err := q.inbox.SaveInboxEvent(ctx, e); err != nil {
+			return fmt.Errorf("events: requeue %s: %w", e.ID, err)
+		}
+	}
+	return nil
+}
+
+// process dispatches a claimed event and records the outcome.
+func (q *Queue) process(ctx context.Context, e store.InboxEvent) {
+	e.Attempts++
+	ctx = logging.With(ctx, logging.EventID(e.ID))
+
+	var result Result
+	var event stripe.Event
+	err := json.Unmarshal(e.Payload, &event)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	} else {
+		ctx = logging.With(ctx, slog.String("event_type", string(event.Type)))
+		result, err = q.dispatcher.Dispatch(ctx, &event)
+	}
+
+	switch {
+	case err == nil:
+		e.Status = store.InboxDone
+		e.Result = result.String()
+		e.LastError = ""
+	case errors.Is(err, ErrInvalidPayload) || e.Attempts >= q.opts.MaxAttempts:
+		e.Status = store.InboxDead
+		e.LastError = err.Error()
+		slog.ErrorContext(ctx, "events.Queue: event moved to the dead-letter list", "attempts", e.Attempts, logging.Err(err))
+	default:
+		e.Status = store.InboxPending
+		e.NextAttempt = q.opts.Now().Add(q.backoff(e.Attempts)).Unix()
+		e.LastError = err.Error()
+		slog.WarnContext(ctx, "events.Queue: event attempt failed", "attempt", e.Attempts, logging.Err(err))
+	}
+
+	// the event must not stay processing even if ctx was canceled
+	if err := q.inbox.SaveInboxEvent(context.WithoutCancel(ctx), e); err != nil {
+		slog.ErrorContext(ctx, "events.Queue: saving the event failed", logging.Err(err))
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.opts.MinBackoff
+	for i := 1; i < attempts && d < q.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.opts.MaxBackoff {
+		d = q.opts.MaxBackoff
+	}
+	return d
+}
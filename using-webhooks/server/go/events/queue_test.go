@@ -0,0 +1,106 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+func enqueue(t *testing.T, q *Queue, id string, eventType stripe.EventType) {
+	event := newEvent(t, eventType, map[string]string{"id": "pi_1"})
+	event.ID = id
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":   id,
+		"type": eventType,
+		"data": map[string]json.RawMessage{"object": event.Data.Raw},
+	})
+	require.NoError(t, err)
+	added, err := q.Enqueue(context.Background(), event, payload)
+	require.NoError(t, err)
+	require.True(t, added)
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := NewQueue(store.NewMemory(), New(nil), QueueOptions{MinBackoff: time.Second, MaxBackoff: 10 * time.Second})
+	var got []time.Duration
+	for attempts := 1; attempts <= 6; attempts++ {
+		got = append(got, q.backoff(attempts))
+	}
+	require.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second,
+	}, got)
+}
+
+func TestQueueRetries(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	inbox := store.NewMemory()
+	d := New(inbox)
+	failures := 2
+	On(d, stripe.EventTypePaymentIntentSucceeded, func(context.Context, *stripe.Event, *stripe.PaymentIntent) error {
+		if failures > 0 {
+			failures--
+			return errors.New("boom")
+		}
+		return nil
+	})
+	q := NewQueue(inbox, d, QueueOptions{Now: func() time.Time { return now }})
+
+	enqueue(t, q, "evt_1", stripe.EventTypePaymentIntentSucceeded)
+	added, err := q.Enqueue(ctx, &stripe.Event{ID: "evt_1"}, []byte(`{}`))
+	require.NoError(t, err)
+	require.False(t, added)
+
+	for _, wait := range []time.Duration{0, time.Second, 2 * time.Second} {
+		now = now.Add(wait)
+		n, err := q.ProcessDue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+	e, err := inbox.InboxEvent(ctx, "evt_1")
+	require.NoError(t, err)
+	require.Equal(t, store.InboxDone, e.Status)
+	require.Equal(t, Handled.String(), e.Result)
+	require.Equal(t, 3, e.Attempts)
+	require.Empty(t, e.LastError)
+}
+
+func TestQueueRun(t *testing.T) {
+	inbox := store.NewMemory()
+	d := New(inbox)
+	processed := make(chan string, 2)
+	On(d, "payment_intent.*", func(_ context.Context, event *stripe.Event, _ *stripe.PaymentIntent) error {
+		processed <- event.ID
+		return nil
+	})
+	q := NewQueue(inbox, d, QueueOptions{Workers: 2, PollInterval: time.Hour})
+
+	// left processing by a previous run
+	interrupted := store.InboxEvent{ID: "evt_0", Status: store.InboxProcessing, Payload: []byte(`{"id":"evt_0","type":"payment_intent.created","data":{"object":{"id":"pi_0"}}}`)}
+	require.NoError(t, inbox.SaveInboxEvent(context.Background(), interrupted))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- q.Run(ctx) }()
+
+	enqueue(t, q, "evt_1", stripe.EventTypePaymentIntentSucceeded)
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case id := <-processed:
+			got[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("events not processed, got %v", got)
+		}
+	}
+	require.Equal(t, map[string]bool{"evt_0": true, "evt_1": true}, got)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,823 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/stripe/stripe-go/v80"
+)
+
+// Card tells the Fake how a payment method behaves when it is charged,
+// mirroring the Stripe test cards.
+type Card int
+
+const (
+	// CardSucceeds is always authorized, like 4242 4242 4242 4242.
+	CardSucceeds Card = iota
+	// CardRequiresAuthentication requires authentication for every
+	// off-session payment, like 4000 0027 6000 3184.
+	CardRequiresAuthentication
+	// CardDeclined is always declined, like 4000 0000 0000 0002.
+	CardDeclined
+)
+
+// fakeEpoch is the creation time of the first object made by a Fake. Every
+// new object is created one second later than the previous one, so ordering
+// by creation time is deterministic.
+const fakeEpoch = 1700000000
+
+// Fake is an in-memory PaymentGateway simulating the state transitions of
+// payment and setup intents. It is meant for tests.
+type Fake struct {
+	mu             sync.Mutex
+	seq            int64
+	customers      map[string]*stripe.Customer
+	paymentMethods map[string]*stripe.PaymentMethod
+	cards          map[string]Card
+	paymentIntents map[string]*stripe.PaymentIntent
+	setupIntents   map[string]*stripe.SetupIntent
+	refunds        map[string]*stripe.Refund
+	// idempotent holds the responses to the requests made with an
+	// idempotency key.
+	idempotent map[string]fakeResponse
+}
+
+// fakeResponse is the response to a request made with an idempotency key,
+// returned again when the key is reused.
+type fakeResponse struct {
+	v   interface{}
+	err error
+}
+
+// NewFake returns a Fake with no objects.
+func NewFake() *Fake {
+	return &Fake{
+		customers:      map[string]*stripe.Customer{},
+		paymentMethods: map[string]*stripe.PaymentMethod{},
+		cards:          map[string]Card{},
+		paymentIntents: map[string]*stripe.PaymentIntent{},
+		setupIntents:   map[string]*stripe.SetupIntent{},
+		refunds:        map[string]*stripe.Refund{},
+		idempotent:     map[string]fakeResponse{},
+	}
+}
+
+// next returns a new object ID with the given prefix and its creation time.
+// Callers must hold f.mu.
+func (f *Fake) next(prefix string) (string, int64) {
+	f.seq++
+	return fmt.Sprintf("%s_fake%d", prefix, f.seq), fakeEpoch + f.seq
+}
+
+// AddPaymentMethod attaches a new card payment method to the customer.
+func (f *Fake) AddPaymentMethod(customerID string, card Card) *stripe.PaymentMethod {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, created := f.next("pm")
+	pm := &stripe.PaymentMethod{
+		ID:       id,
+		Object:   "payment_method",
+		Type:     stripe.PaymentMethodTypeCard,
+		Created:  created,
+		Customer: &stripe.Customer{ID: customerID},
+		Card: &stripe.PaymentMethodCard{
+			Brand:    stripe.PaymentMethodCardBrandVisa,
+			Last4:    fmt.Sprintf("%04d", f.seq%10000),
+			ExpMonth: 12,
+			ExpYear:  2034,
+		},
+		AllowRedisplay: stripe.PaymentMethodAllowRedisplayAlways,
+	}
+	f.paymentMethods[id] = pm
+	f.cards[id] = card
+	cp := *pm
+	return &cp
+}
+
+// SetDefaultPaymentMethod makes the payment method the default one of the
+// customer, as if it was set in invoice_settings.default_payment_method.
+func (f *Fake) SetDefaultPaymentMethod(customerID, paymentMethodID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.customers[customerID].InvoiceSettings.DefaultPaymentMethod = &stripe.PaymentMethod{ID: paymentMethodID}
+}
+
+// Authenticate simulates the customer completing the authentication
+// requested by a payment intent in the requires_action status.
+func (f *Fake) Authenticate(paymentIntentID string) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.paymentIntents[paymentIntentID]
+	if !ok {
+		return nil, f.errNotFound("payment_intent", paymentIntentID)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresAction {
+		return nil, f.errUnexpectedState(pi)
+	}
+	pi.NextAction = nil
+	authorize(pi)
+	return copyPaymentIntent(pi), nil
+}
+
+func (f *Fake) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, created := f.next("cus")
+	c := &stripe.Customer{
+		ID:              id,
+		Object:          "customer",
+		Created:         created,
+		Metadata:        map[string]string{},
+		InvoiceSettings: &stripe.CustomerInvoiceSettings{},
+	}
+	if params != nil {
+		for k, v := range params.Metadata {
+			c.Metadata[k] = v
+		}
+		if params.Email != nil {
+			c.Email = *params.Email
+		}
+	}
+	f.customers[id] = c
+	return f.copyCustomer(c), nil
+}
+
+func (f *Fake) GetCustomer(id string, _ *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.customers[id]
+	if !ok {
+		return nil, f.errNotFound("customer", id)
+	}
+	return f.copyCustomer(c), nil
+}
+
+// UpdateCustomer supports setting and unsetting the default payment method,
+// which must be attached to the customer.
+func (f *Fake) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.customers[id]
+	if !ok {
+		return nil, f.errNotFound("customer", id)
+	}
+	if params != nil && params.InvoiceSettings != nil && params.InvoiceSettings.DefaultPaymentMethod != nil {
+		pmID := *params.InvoiceSettings.DefaultPaymentMethod
+		if pmID == "" {
+			c.InvoiceSettings.DefaultPaymentMethod = nil
+			return f.copyCustomer(c), nil
+		}
+		pm, ok := f.paymentMethods[pmID]
+		if !ok || pm.Customer == nil || pm.Customer.ID != id {
+			return nil, f.errInvalid("invoice_settings[default_payment_method]",
+				fmt.Sprintf("No such PaymentMethod: '%s'; It may not be attached to this customer.", pmID))
+		}
+		c.InvoiceSettings.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pmID}
+	}
+	return f.copyCustomer(c), nil
+}
+
+// metadataQuery matches the only search query supported by the Fake:
+// metadata['key']:'value'.
+var metadataQuery = regexp.MustCompile(`^metadata\['([^']+)'\]:'((?:\\.|[^'\\])*)'$`)
+
+// queryEscape matches the escaped characters of a search query value.
+var queryEscape = regexp.MustCompile(`\\(.)`)
+
+func (f *Fake) SearchCustomers(params *stripe.CustomerSearchParams) ([]*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m := metadataQuery.FindStringSubmatch(params.Query)
+	if m == nil {
+		return nil, f.errInvalid("query", fmt.Sprintf("unsupported query: %s", params.Query))
+	}
+	key, value := m[1], queryEscape.ReplaceAllString(m[2], "$1")
+
+	var customers []*stripe.Customer
+	for _, c := range f.customers {
+		if c.Metadata[key] == value {
+			customers = append(customers, f.copyCustomer(c))
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i].Created > customers[j].Created })
+	return customers, nil
+}
+
+func (f *Fake) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return idempotent(f, params.IdempotencyKey, copyPaymentIntent, func() (*stripe.PaymentIntent, error) {
+		return f.newPaymentIntent(params)
+	})
+}
+
+// newPaymentIntent creates the payment intent. Callers must hold f.mu.
+func (f *Fake) newPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	if params.Amount == nil || *params.Amount <= 0 {
+		return nil, f.errInvalid("amount", "Amount must be at least 1")
+	}
+	if params.Currency == nil || *params.Currency == "" {
+		return nil, f.errInvalid("currency", "Missing required param: currency.")
+	}
+	if params.Customer != nil {
+		if _, ok := f.customers[*params.Customer]; !ok {
+			return nil, f.errNotFound("customer", *params.Customer)
+		}
+	}
+
+	id, created := f.next("pi")
+	pi := &stripe.PaymentIntent{
+		ID:            id,
+		Object:        "payment_intent",
+		Created:       created,
+		ClientSecret:  id + "_secret_fake",
+		Amount:        *params.Amount,
+		Currency:      stripe.Currency(strings.ToLower(*params.Currency)),
+		Status:        stripe.PaymentIntentStatusRequiresPaymentMethod,
+		CaptureMethod: stripe.PaymentIntentCaptureMethodAutomatic,
+		Metadata:      map[string]string{},
+	}
+	if params.Customer != nil {
+		pi.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+	if params.CaptureMethod != nil {
+		pi.CaptureMethod = stripe.PaymentIntentCaptureMethod(*params.CaptureMethod)
+	}
+	if params.Description != nil {
+		pi.Description = *params.Description
+	}
+	if params.SetupFutureUsage != nil {
+		pi.SetupFutureUsage = stripe.PaymentIntentSetupFutureUsage(*params.SetupFutureUsage)
+	}
+	if params.StatementDescriptor != nil {
+		pi.StatementDescriptor = *params.StatementDescriptor
+	}
+	if params.StatementDescriptorSuffix != nil {
+		pi.StatementDescriptorSuffix = *params.StatementDescriptorSuffix
+	}
+	if params.ReceiptEmail != nil {
+		pi.ReceiptEmail = *params.ReceiptEmail
+	}
+	for k, v := range params.Metadata {
+		pi.Metadata[k] = v
+	}
+	if params.PaymentMethodOptions != nil && params.PaymentMethodOptions.Card != nil && params.PaymentMethodOptions.Card.RequestMulticapture != nil {
+		pi.PaymentMethodOptions = &stripe.PaymentIntentPaymentMethodOptions{
+			Card: &stripe.PaymentIntentPaymentMethodOptionsCard{
+				RequestMulticapture: stripe.PaymentIntentPaymentMethodOptionsCardRequestMulticapture(*params.PaymentMethodOptions.Card.RequestMulticapture),
+			},
+		}
+	}
+	f.paymentIntents[id] = pi
+
+	if params.PaymentMethod == nil {
+		return copyPaymentIntent(pi), nil
+	}
+	pi.Status = stripe.PaymentIntentStatusRequiresConfirmation
+	if params.Confirm == nil || !*params.Confirm {
+		pi.PaymentMethod = &stripe.PaymentMethod{ID: *params.PaymentMethod}
+		return copyPaymentIntent(pi), nil
+	}
+	offSession := params.OffSession != nil && *params.OffSession
+	if err := f.confirm(pi, *params.PaymentMethod, offSession); err != nil {
+		return nil, err
+	}
+	return copyPaymentIntent(pi), nil
+}
+
+func (f *Fake) GetPaymentIntent(id string, _ *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.paymentIntents[id]
+	if !ok {
+		return nil, f.errNotFound("payment_intent", id)
+	}
+	return copyPaymentIntent(pi), nil
+}
+
+func (f *Fake) ConfirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var key *string
+	if params != nil {
+		key = params.IdempotencyKey
+	}
+	return idempotent(f, key, copyPaymentIntent, func() (*stripe.PaymentIntent, error) {
+		return f.confirmPaymentIntent(id, params)
+	})
+}
+
+// confirmPaymentIntent confirms the payment intent. Callers must hold f.mu.
+func (f *Fake) confirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	pi, ok := f.paymentIntents[id]
+	if !ok {
+		return nil, f.errNotFound("payment_intent", id)
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod,
+		stripe.PaymentIntentStatusRequiresConfirmation,
+		stripe.PaymentIntentStatusRequiresAction:
+	default:
+		return nil, f.errUnexpectedState(pi)
+	}
+
+	paymentMethodID := ""
+	if pi.PaymentMethod != nil {
+		paymentMethodID = pi.PaymentMethod.ID
+	}
+	offSession := false
+	if params != nil {
+		if params.PaymentMethod != nil {
+			paymentMethodID = *params.PaymentMethod
+		}
+		if params.CaptureMethod != nil {
+			pi.CaptureMethod = stripe.PaymentIntentCaptureMethod(*params.CaptureMethod)
+		}
+		offSession = params.OffSession != nil && *params.OffSession
+	}
+	if paymentMethodID == "" {
+		return nil, f.errInvalid("payment_method", "You cannot confirm this PaymentIntent because it's missing a payment method.")
+	}
+	if err := f.confirm(pi, paymentMethodID, offSession); err != nil {
+		return nil, err
+	}
+	return copyPaymentIntent(pi), nil
+}
+
+// confirm charges the payment method according to its Card behavior.
+// Callers must hold f.mu.
+func (f *Fake) confirm(pi *stripe.PaymentIntent, paymentMethodID string, offSession bool) error {
+	pm, ok := f.paymentMethods[paymentMethodID]
+	if !ok {
+		return f.errNotFound("payment_method", paymentMethodID)
+	}
+	cp := *pm
+	pi.PaymentMethod = &cp
+	pi.LastPaymentError = nil
+
+	switch f.cards[paymentMethodID] {
+	case CardRequiresAuthentication:
+		if offSession {
+			return f.decline(pi, stripe.ErrorCodeAuthenticationRequired, "",
+				"Your card was declined. This transaction requires authentication.")
+		}
+		pi.Status = stripe.PaymentIntentStatusRequiresAction
+		pi.NextAction = &stripe.PaymentIntentNextAction{Type: stripe.PaymentIntentNextActionTypeUseStripeSDK}
+	case CardDeclined:
+		return f.decline(pi, stripe.ErrorCodeCardDeclined, stripe.DeclineCodeGenericDecline, "Your card was declined.")
+	default:
+		authorize(pi)
+	}
+	return nil
+}
+
+// decline moves the payment intent back to requires_payment_method and
+// returns the card error Stripe would return. Callers must hold f.mu.
+func (f *Fake) decline(pi *stripe.PaymentIntent, code stripe.ErrorCode, declineCode stripe.DeclineCode, msg string) error {
+	requestID, _ := f.next("req")
+	err := &stripe.Error{
+		Type:           stripe.ErrorTypeCard,
+		Code:           code,
+		DeclineCode:    declineCode,
+		Msg:            msg,
+		HTTPStatusCode: 402,
+		RequestID:      requestID,
+	}
+	pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+	pi.LastPaymentError = err
+	err.PaymentIntent = copyPaymentIntent(pi)
+	return err
+}
+
+// authorize moves a confirmed payment intent to requires_capture or
+// succeeded depending on its capture method.
+func authorize(pi *stripe.PaymentIntent) {
+	if pi.CaptureMethod == stripe.PaymentIntentCaptureMethodManual {
+		pi.Status = stripe.PaymentIntentStatusRequiresCapture
+		pi.AmountCapturable = pi.Amount
+		return
+	}
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountReceived = pi.Amount
+}
+
+func (f *Fake) CapturePaymentIntent(id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var key *string
+	if params != nil {
+		key = params.IdempotencyKey
+	}
+	return idempotent(f, key, copyPaymentIntent, func() (*stripe.PaymentIntent, error) {
+		return f.capturePaymentIntent(id, params)
+	})
+}
+
+// capturePaymentIntent captures the payment intent. Callers must hold f.mu.
+func (f *Fake) capturePaymentIntent(id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error) {
+	pi, ok := f.paymentIntents[id]
+	if !ok {
+		return nil, f.errNotFound("payment_intent", id)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresCapture {
+		return nil, f.errUnexpectedState(pi)
+	}
+	amount := pi.AmountCapturable
+	final := true
+	if params != nil && params.AmountToCapture != nil {
+		amount = *params.AmountToCapture
+	}
+	if params != nil && params.FinalCapture != nil {
+		final = *params.FinalCapture
+	}
+	if amount > pi.AmountCapturable {
+		return nil, f.errInvalid("amount_to_capture", "The amount to capture must be less than or equal to the amount capturable.")
+	}
+	if !final && !multicapture(pi) {
+		return nil, f.errInvalid("final_capture", "Multicapture is not available for this PaymentIntent.")
+	}
+	pi.AmountReceived += amount
+	if !final {
+		// the rest of the authorization stays capturable
+		pi.AmountCapturable -= amount
+		return copyPaymentIntent(pi), nil
+	}
+	pi.AmountCapturable = 0
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	return copyPaymentIntent(pi), nil
+}
+
+// multicapture reports whether multicapture was requested for pi. The Fake
+// makes it available on every card.
+func multicapture(pi *stripe.PaymentIntent) bool {
+	return pi.PaymentMethodOptions != nil && pi.PaymentMethodOptions.Card != nil &&
+		pi.PaymentMethodOptions.Card.RequestMulticapture == stripe.PaymentIntentPaymentMethodOptionsCardRequestMulticaptureIfAvailable
+}
+
+func (f *Fake) CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var key *string
+	if params != nil {
+		key = params.IdempotencyKey
+	}
+	return idempotent(f, key, copyPaymentIntent, func() (*stripe.PaymentIntent, error) {
+		return f.cancelPaymentIntent(id, params)
+	})
+}
+
+// cancelPaymentIntent cancels the payment intent. Callers must hold f.mu.
+func (f *Fake) cancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	pi, ok := f.paymentIntents[id]
+	if !ok {
+		return nil, f.errNotFound("payment_intent", id)
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded, stripe.PaymentIntentStatusCanceled:
+		return nil, f.errUnexpectedState(pi)
+	}
+	pi.Status = stripe.PaymentIntentStatusCanceled
+	pi.AmountCapturable = 0
+	pi.NextAction = nil
+	if params != nil && params.CancellationReason != nil {
+		pi.CancellationReason = stripe.PaymentIntentCancellationReason(*params.CancellationReason)
+	}
+	return copyPaymentIntent(pi), nil
+}
+
+func (f *Fake) ListPaymentIntents(params *stripe.PaymentIntentListParams) ([]*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var pis []*stripe.PaymentIntent
+	for _, pi := range f.paymentIntents {
+		if params != nil && params.Customer != nil && (pi.Customer == nil || pi.Customer.ID != *params.Customer) {
+			continue
+		}
+		pis = append(pis, copyPaymentIntent(pi))
+	}
+	sort.Slice(pis, func(i, j int) bool { return pis[i].Created > pis[j].Created })
+	if params != nil && params.Limit != nil && int64(len(pis)) > *params.Limit {
+		pis = pis[:*params.Limit]
+	}
+	return pis, nil
+}
+
+func (f *Fake) NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return idempotent(f, params.IdempotencyKey, copySetupIntent, func() (*stripe.SetupIntent, error) {
+		return f.newSetupIntent(params)
+	})
+}
+
+// newSetupIntent creates the setup intent. Callers must hold f.mu.
+func (f *Fake) newSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	if params.Customer != nil {
+		if _, ok := f.customers[*params.Customer]; !ok {
+			return nil, f.errNotFound("customer", *params.Customer)
+		}
+	}
+	id, created := f.next("seti")
+	si := &stripe.SetupIntent{
+		ID:           id,
+		Object:       "setup_intent",
+		Created:      created,
+		ClientSecret: id + "_secret_fake",
+		Status:       stripe.SetupIntentStatusRequiresPaymentMethod,
+	}
+	if params.Customer != nil {
+		si.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+	if params.Description != nil {
+		si.Description = *params.Description
+	}
+	f.setupIntents[id] = si
+	cp := *si
+	return &cp, nil
+}
+
+// NewRefund refunds a payment intent, the Fake does not support refunding
+// charges by ID. Refunds succeed right away.
+func (f *Fake) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return idempotent(f, params.IdempotencyKey, copyRefund, func() (*stripe.Refund, error) {
+		return f.newRefund(params)
+	})
+}
+
+// newRefund creates the refund. Callers must hold f.mu.
+func (f *Fake) newRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	if params.PaymentIntent == nil {
+		return nil, f.errInvalid("payment_intent", "Missing required param: payment_intent.")
+	}
+	pi, ok := f.paymentIntents[*params.PaymentIntent]
+	if !ok {
+		return nil, f.errNotFound("payment_intent", *params.PaymentIntent)
+	}
+	if pi.AmountReceived == 0 {
+		return nil, f.errUnexpectedState(pi)
+	}
+	remaining := pi.AmountReceived
+	for _, r := range f.refunds {
+		if r.PaymentIntent.ID == pi.ID && r.Status != stripe.RefundStatusFailed && r.Status != stripe.RefundStatusCanceled {
+			remaining -= r.Amount
+		}
+	}
+	if remaining == 0 {
+		requestID, _ := f.next("req")
+		return nil, &stripe.Error{
+			Type:           stripe.ErrorTypeInvalidRequest,
+			Code:           stripe.ErrorCodeChargeAlreadyRefunded,
+			Msg:            fmt.Sprintf("Charge for %s has already been refunded.", pi.ID),
+			HTTPStatusCode: 400,
+			RequestID:      requestID,
+		}
+	}
+	amount := remaining
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
+	if amount <= 0 || amount > remaining {
+		return nil, f.errInvalid("amount", fmt.Sprintf("Refund amount (%d) is greater than unrefunded amount on charge (%d)", amount, remaining))
+	}
+
+	id, created := f.next("re")
+	r := &stripe.Refund{
+		ID:            id,
+		Object:        "refund",
+		Created:       created,
+		Amount:        amount,
+		Currency:      pi.Currency,
+		PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+		Status:        stripe.RefundStatusSucceeded,
+		Metadata:      map[string]string{},
+	}
+	if params.Reason != nil {
+		r.Reason = stripe.RefundReason(*params.Reason)
+	}
+	for k, v := range params.Metadata {
+		r.Metadata[k] = v
+	}
+	f.refunds[id] = r
+	cp := *r
+	return &cp, nil
+}
+
+func (f *Fake) ListRefunds(params *stripe.RefundListParams) ([]*stripe.Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var refunds []*stripe.Refund
+	for _, r := range f.refunds {
+		if params != nil && params.PaymentIntent != nil && r.PaymentIntent.ID != *params.PaymentIntent {
+			continue
+		}
+		cp := *r
+		refunds = append(refunds, &cp)
+	}
+	sort.Slice(refunds, func(i, j int) bool { return refunds[i].Created > refunds[j].Created })
+	return refunds, nil
+}
+
+func (f *Fake) GetPaymentMethod(id string, _ *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm, ok := f.paymentMethods[id]
+	if !ok {
+		return nil, f.errNotFound("payment_method", id)
+	}
+	cp := *pm
+	return &cp, nil
+}
+
+func (f *Fake) UpdatePaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm, ok := f.paymentMethods[id]
+	if !ok {
+		return nil, f.errNotFound("payment_method", id)
+	}
+	if params != nil && params.AllowRedisplay != nil {
+		pm.AllowRedisplay = stripe.PaymentMethodAllowRedisplay(*params.AllowRedisplay)
+	}
+	cp := *pm
+	return &cp, nil
+}
+
+// DetachPaymentMethod detaches the payment method from its customer, and
+// unsets it as the default payment method of the customer, as Stripe does.
+func (f *Fake) DetachPaymentMethod(id string, _ *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm, ok := f.paymentMethods[id]
+	if !ok {
+		return nil, f.errNotFound("payment_method", id)
+	}
+	if pm.Customer == nil {
+		return nil, f.errInvalid("payment_method", "The payment method you provided is not attached to a customer so detachment is impossible.")
+	}
+	if c, ok := f.customers[pm.Customer.ID]; ok {
+		if def := c.InvoiceSettings.DefaultPaymentMethod; def != nil && def.ID == id {
+			c.InvoiceSettings.DefaultPaymentMethod = nil
+		}
+	}
+	pm.Customer = nil
+	cp := *pm
+	return &cp, nil
+}
+
+func (f *Fake) ListPaymentMethods(params *stripe.CustomerListPaymentMethodsParams) ([]*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if params.Customer == nil {
+		return nil, f.errInvalid("customer", "Missing required param: customer.")
+	}
+	if _, ok := f.customers[*params.Customer]; !ok {
+		return nil, f.errNotFound("customer", *params.Customer)
+	}
+	var pms []*stripe.PaymentMethod
+	for _, pm := range f.paymentMethods {
+		if pm.Customer == nil || pm.Customer.ID != *params.Customer {
+			continue
+		}
+		if params.Type != nil && string(pm.Type) != *params.Type {
+			continue
+		}
+		cp := *pm
+		pms = append(pms, &cp)
+	}
+	sort.Slice(pms, func(i, j int) bool { return pms[i].Created > pms[j].Created })
+	return pms, nil
+}
+
+// copyCustomer returns a copy of the customer with the default payment
+// method expanded. Callers must hold f.mu.
+func (f *Fake) copyCustomer(c *stripe.Customer) *stripe.Customer {
+	cp := *c
+	settings := *c.InvoiceSettings
+	if settings.DefaultPaymentMethod != nil {
+		if pm, ok := f.paymentMethods[settings.DefaultPaymentMethod.ID]; ok {
+			pmCopy := *pm
+			settings.DefaultPaymentMethod = &pmCopy
+		}
+	}
+	cp.InvoiceSettings = &settings
+	return &cp
+}
+
+// idempotent runs request, or returns the response to the previous request
+// made with the same idempotency key. Like Stripe, only the requests which
+// were executed are saved: successes and card errors. Callers must hold f.mu.
+func idempotent[T stripe.LastResponseSetter](f *Fake, key *string, cp func(T) T, request func() (T, error)) (T, error) {
+	if key == nil {
+		v, err := request()
+		return respond(f, v, err)
+	}
+	if resp, ok := f.idempotent[*key]; ok {
+		if resp.err != nil {
+			var zero T
+			return zero, resp.err
+		}
+		return respond(f, cp(resp.v.(T)), nil)
+	}
+	v, err := request()
+	var stripeErr *stripe.Error
+	switch {
+	case err == nil:
+		f.idempotent[*key] = fakeResponse{v: cp(v)}
+	case errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard:
+		f.idempotent[*key] = fakeResponse{err: err}
+	}
+	return respond(f, v, err)
+}
+
+// respond sets the API response of a successful request, with a request ID
+// of its own like every Stripe request. Callers must hold f.mu.
+func respond[T stripe.LastResponseSetter](f *Fake, v T, err error) (T, error) {
+	if err != nil {
+		return v, err
+	}
+	requestID, _ := f.next("req")
+	v.SetLastResponse(&stripe.APIResponse{RequestID: requestID, StatusCode: http.StatusOK})
+	return v, nil
+}
+
+func copySetupIntent(si *stripe.SetupIntent) *stripe.SetupIntent {
+	cp := *si
+	return &cp
+}
+
+func copyRefund(r *stripe.Refund) *stripe.Refund {
+	cp := *r
+	return &cp
+}
+
+func copyPaymentIntent(pi *stripe.PaymentIntent) *stripe.PaymentIntent {
+	cp := *pi
+	return &cp
+}
+
+// errNotFound returns the error Stripe returns for unknown IDs. Callers
+// must hold f.mu.
+func (f *Fake) errNotFound(object, id string) error {
+	requestID, _ := f.next("req")
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		Msg:            fmt.Sprintf("No such %s: '%s'", object, id),
+		Param:          "id",
+		HTTPStatusCode: 404,
+		RequestID:      requestID,
+	}
+}
+
+// errUnexpectedState returns the error Stripe returns for operations that
+// are not allowed in the current status of the intent. Callers must hold f.mu.
+func (f *Fake) errUnexpectedState(pi *stripe.PaymentIntent) error {
+	requestID, _ := f.next("req")
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodePaymentIntentUnexpectedState,
+		Msg:            fmt.Sprintf("This PaymentIntent's status is %s.", pi.Status),
+		HTTPStatusCode: 400,
+		RequestID:      requestID,
+		PaymentIntent:  copyPaymentIntent(pi),
+	}
+}
+
+// errInvalid returns an invalid request error for param. Callers must hold
+// f.mu.
+func (f *Fake) errInvalid(param, msg string) error {
+	requestID, _ := f.next("req")
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Msg:            msg,
+		Param:          param,
+		HTTPStatusCode: 400,
+		RequestID:      requestID,
+	}
+}
@@ -0,0 +1,152 @@
+// Package gateway abstracts the Stripe API calls made by the server, so the
+// handlers can be tested without network access or Stripe credentials.
+package gateway
+
+import (
+	"github.com/stripe/stripe-go/v80"
+	"github.com/stripe/stripe-go/v80/client"
+)
+
+// CancelIdempotencyKey identifies the cancellation of a payment intent for
+// the reason. Every cancellation of the server uses it, so the handlers and
+// the holds manager canceling the same intent make a single request.
+func CancelIdempotencyKey(paymentIntentID, reason string) string {
+	return "cancel-" + paymentIntentID + "-" + reason
+}
+
+// PaymentGateway is the subset of the Stripe API used by the server. The
+// methods take and return the stripe-go types, errors returned by the
+// payment provider are *stripe.Error.
+type PaymentGateway interface {
+	NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error)
+	GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	// SearchCustomers returns the customers matching the search query.
+	SearchCustomers(params *stripe.CustomerSearchParams) ([]*stripe.Customer, error)
+
+	NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	GetPaymentIntent(id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	ConfirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error)
+	CapturePaymentIntent(id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error)
+	CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error)
+	// ListPaymentIntents returns the payment intents matching params, most
+	// recent first. At most params.Limit intents are returned when it is set.
+	ListPaymentIntents(params *stripe.PaymentIntentListParams) ([]*stripe.PaymentIntent, error)
+
+	NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error)
+
+	NewRefund(params *stripe.RefundParams) (*stripe.Refund, error)
+	// ListRefunds returns the refunds matching params, most recent first.
+	ListRefunds(params *stripe.RefundListParams) ([]*stripe.Refund, error)
+
+	GetPaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error)
+	UpdatePaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error)
+	DetachPaymentMethod(id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error)
+	// ListPaymentMethods returns the payment methods attached to
+	// params.Customer, most recent first.
+	ListPaymentMethods(params *stripe.CustomerListPaymentMethodsParams) ([]*stripe.PaymentMethod, error)
+}
+
+// Stripe is the PaymentGateway calling the Stripe API.
+type Stripe struct {
+	api *client.API
+}
+
+// NewStripe returns a gateway authenticating with the given secret key.
+func NewStripe(key string) *Stripe {
+	return &Stripe{api: client.New(key, nil)}
+}
+
+func (s *Stripe) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return s.api.Customers.New(params)
+}
+
+func (s *Stripe) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return s.api.Customers.Get(id, params)
+}
+
+func (s *Stripe) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return s.api.Customers.Update(id, params)
+}
+
+func (s *Stripe) SearchCustomers(params *stripe.CustomerSearchParams) ([]*stripe.Customer, error) {
+	var customers []*stripe.Customer
+	iter := s.api.Customers.Search(params)
+	for iter.Next() {
+		customers = append(customers, iter.Customer())
+		if params != nil && params.Limit != nil && int64(len(customers)) >= *params.Limit {
+			break
+		}
+	}
+	return customers, iter.Err()
+}
+
+func (s *Stripe) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return s.api.PaymentIntents.New(params)
+}
+
+func (s *Stripe) GetPaymentIntent(id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return s.api.PaymentIntents.Get(id, params)
+}
+
+func (s *Stripe) ConfirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	return s.api.PaymentIntents.Confirm(id, params)
+}
+
+func (s *Stripe) CapturePaymentIntent(id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error) {
+	return s.api.PaymentIntents.Capture(id, params)
+}
+
+func (s *Stripe) CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	return s.api.PaymentIntents.Cancel(id, params)
+}
+
+func (s *Stripe) ListPaymentIntents(params *stripe.PaymentIntentListParams) ([]*stripe.PaymentIntent, error) {
+	var pis []*stripe.PaymentIntent
+	iter := s.api.PaymentIntents.List(params)
+	for iter.Next() {
+		pis = append(pis, iter.PaymentIntent())
+		if params != nil && params.Limit != nil && int64(len(pis)) >= *params.Limit {
+			break
+		}
+	}
+	return pis, iter.Err()
+}
+
+func (s *Stripe) NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	return s.api.SetupIntents.New(params)
+}
+
+func (s *Stripe) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	return s.api.Refunds.New(params)
+}
+
+func (s *Stripe) ListRefunds(params *stripe.RefundListParams) ([]*stripe.Refund, error) {
+	var refunds []*stripe.Refund
+	iter := s.api.Refunds.List(params)
+	for iter.Next() {
+		refunds = append(refunds, iter.Refund())
+	}
+	return refunds, iter.Err()
+}
+
+func (s *Stripe) GetPaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	return s.api.PaymentMethods.Get(id, params)
+}
+
+func (s *Stripe) UpdatePaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	return s.api.PaymentMethods.Update(id, params)
+}
+
+func (s *Stripe) DetachPaymentMethod(id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	return s.api.PaymentMethods.Detach(id, params)
+}
+
+func (s *Stripe) ListPaymentMethods(params *stripe.CustomerListPaymentMethodsParams) ([]*stripe.PaymentMethod, error) {
+	var pms []*stripe.PaymentMethod
+	iter := s.api.Customers.ListPaymentMethods(params)
+	for iter.Next() {
+		pms = append(pms, iter.PaymentMethod())
+	}
+	return pms, iter.Err()
+}
@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v80"
+)
+
+// ObserveFunc is called after every request made through an Observed
+// gateway with the name of the operation, like "paymentintent.Capture", how
+// long the request took and the error it returned.
+type ObserveFunc func(op string, d time.Duration, err error)
+
+// Observed is a PaymentGateway reporting the duration and the error of the
+// requests of the gateway it wraps, to measure the latency of Stripe.
+type Observed struct {
+	next    PaymentGateway
+	observe ObserveFunc
+}
+
+// NewObserved returns a gateway making the requests with next and reporting
+// them to observe.
+func NewObserved(next PaymentGateway, observe ObserveFunc) *Observed {
+	return &Observed{next: next, observe: observe}
+}
+
+// observed calls request and reports it as op.
+func observed[T any](o *Observed, op string, request func() (T, error)) (T, error) {
+	start := time.Now()
+	v, err := request()
+	o.observe(op, time.Since(start), err)
+	return v, err
+}
+
+func (o *Observed) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return observed(o, "customer.New", func() (*stripe.Customer, error) { return o.next.NewCustomer(params) })
+}
+
+func (o *Observed) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return observed(o, "customer.Get", func() (*stripe.Customer, error) { return o.next.GetCustomer(id, params) })
+}
+
+func (o *Observed) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return observed(o, "customer.Update", func() (*stripe.Customer, error) { return o.next.UpdateCustomer(id, params) })
+}
+
+func (o *Observed) SearchCustomers(params *stripe.CustomerSearchParams) ([]*stripe.Customer, error) {
+	return observed(o, "customer.Search", func() ([]*stripe.Customer, error) { return o.next.SearchCustomers(params) })
+}
+
+func (o *Observed) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return observed(o, "paymentintent.New", func() (*stripe.PaymentIntent, error) { return o.next.NewPaymentIntent(params) })
+}
+
+func (o *Observed) GetPaymentIntent(id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return observed(o, "paymentintent.Get", func() (*stripe.PaymentIntent, error) { return o.next.GetPaymentIntent(id, params) })
+}
+
+func (o *Observed) ConfirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	return observed(o, "paymentintent.Confirm", func() (*stripe.PaymentIntent, error) { return o.next.ConfirmPaymentIntent(id, params) })
+}
+
+func (o *Observed) CapturePaymentIntent(id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error) {
+	return observed(o, "paymentintent.Capture", func() (*stripe.PaymentIntent, error) { return o.next.CapturePaymentIntent(id, params) })
+}
+
+func (o *Observed) CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	return observed(o, "paymentintent.Cancel", func() (*stripe.PaymentIntent, error) { return o.next.CancelPaymentIntent(id, params) })
+}
+
+func (o *Observed) ListPaymentIntents(params *stripe.PaymentIntentListParams) ([]*stripe.PaymentIntent, error) {
+	return observed(o, "paymentintent.List", func() ([]*stripe.PaymentIntent, error) { return o.next.ListPaymentIntents(params) })
+}
+
+func (o *Observed) NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	return observed(o, "setupintent.New", func() (*stripe.SetupIntent, error) { return o.next.NewSetupIntent(params) })
+}
+
+func (o *Observed) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	return observed(o, "refund.New", func() (*stripe.Refund, error) { return o.next.NewRefund(params) })
+}
+
+func (o *Observed) ListRefunds(params *stripe.RefundListParams) ([]*stripe.Refund, error) {
+	return observed(o, "refund.List", func() ([]*stripe.Refund, error) { return o.next.ListRefunds(params) })
+}
+
+func (o *Observed) GetPaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	return observed(o, "paymentmethod.Get", func() (*stripe.PaymentMethod, error) { return o.next.GetPaymentMethod(id, params) })
+}
+
+func (o *Observed) UpdatePaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	return observed(o, "paymentmethod.Update", func() (*stripe.PaymentMethod, error) { return o.next.UpdatePaymentMethod(id, params) })
+}
+
+func (o *Observed) DetachPaymentMethod(id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	return observed(o, "paymentmethod.Detach", func() (*stripe.PaymentMethod, error) { return o.next.DetachPaymentMethod(id, params) })
+}
+
+func (o *Observed) ListPaymentMethods(params *stripe.CustomerListPaymentMethodsParams) ([]*stripe.PaymentMethod, error) {
+	return observed(o, "customer.ListPaymentMethods", func() ([]*stripe.PaymentMethod, error) { return o.next.ListPaymentMethods(params) })
+}
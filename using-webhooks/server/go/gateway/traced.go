@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"context"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/tracing"
+	"github.com/stripe/stripe-go/v80"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Traced is a PaymentGateway tracing the requests of the gateway it wraps
+// as spans of the context it is bound to. The payment and setup intents it
+// creates carry the trace context in their metadata, see
+// tracing.MetadataKey, so the webhook events about them link back to the
+// request which created them. Those created with an idempotency key carry
+// its correlation ID instead, see tracing.CorrelationID.
+type Traced struct {
+	ctx  context.Context
+	next PaymentGateway
+}
+
+// WithContext returns a gateway making the requests of ctx with next.
+func WithContext(ctx context.Context, next PaymentGateway) *Traced {
+	return &Traced{ctx: ctx, next: next}
+}
+
+// traced calls request in a span named after op, with the attributes.
+// lastResponse returns the response of the request, if any, to tag the
+// span with the ID Stripe gave the request.
+func traced[T any](t *Traced, op string, request func() (T, error), lastResponse func(T) *stripe.APIResponse, attrs ...attribute.KeyValue) (T, error) {
+	_, span := tracing.Tracer().Start(t.ctx, "stripe "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.StripeOperationKey.String(op)),
+		trace.WithAttributes(attrs...),
+	)
+	defer span.End()
+
+	v, err := request()
+	if err != nil {
+		tracing.SetError(span, err)
+		return v, err
+	}
+	if resp := lastResponse(v); resp != nil && resp.RequestID != "" {
+		span.SetAttributes(tracing.StripeRequestIDKey.String(resp.RequestID))
+	}
+	return v, err
+}
+
+// intentMetadata returns the metadata entry linking a new intent to the
+// request of t, an empty value when there is nothing to link, and the
+// attributes tagging the span of the request alike. Requests with an
+// idempotency key get the correlation ID of the key rather than the trace
+// context: the key may be reused by a later request, with another trace
+// context, and Stripe rejects a key reused with other parameters.
+func (t *Traced) intentMetadata(params *stripe.Params) (key, value string, attrs []attribute.KeyValue) {
+	if params.IdempotencyKey != nil {
+		id := tracing.CorrelationID(*params.IdempotencyKey)
+		return tracing.CorrelationMetadataKey, id, []attribute.KeyValue{tracing.CorrelationIDKey.String(id)}
+	}
+	return tracing.MetadataKey, tracing.Traceparent(t.ctx), nil
+}
+
+func customerResponse(c *stripe.Customer) *stripe.APIResponse            { return c.LastResponse }
+func paymentIntentResponse(pi *stripe.PaymentIntent) *stripe.APIResponse { return pi.LastResponse }
+func setupIntentResponse(si *stripe.SetupIntent) *stripe.APIResponse     { return si.LastResponse }
+func refundResponse(re *stripe.Refund) *stripe.APIResponse               { return re.LastResponse }
+func paymentMethodResponse(pm *stripe.PaymentMethod) *stripe.APIResponse { return pm.LastResponse }
+
+// listResponse is the response of the list requests, which span several
+// pages.
+func listResponse[T any](T) *stripe.APIResponse { return nil }
+
+func (t *Traced) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return traced(t, "customer.New", func() (*stripe.Customer, error) { return t.next.NewCustomer(params) }, customerResponse)
+}
+
+func (t *Traced) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return traced(t, "customer.Get", func() (*stripe.Customer, error) { return t.next.GetCustomer(id, params) }, customerResponse)
+}
+
+func (t *Traced) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return traced(t, "customer.Update", func() (*stripe.Customer, error) { return t.next.UpdateCustomer(id, params) }, customerResponse)
+}
+
+func (t *Traced) SearchCustomers(params *stripe.CustomerSearchParams) ([]*stripe.Customer, error) {
+	return traced(t, "customer.Search", func() ([]*stripe.Customer, error) { return t.next.SearchCustomers(params) }, listResponse)
+}
+
+func (t *Traced) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	key, value, attrs := t.intentMetadata(&params.Params)
+	if value != "" {
+		params.AddMetadata(key, value)
+	}
+	return traced(t, "paymentintent.New", func() (*stripe.PaymentIntent, error) { return t.next.NewPaymentIntent(params) }, paymentIntentResponse, attrs...)
+}
+
+func (t *Traced) GetPaymentIntent(id string, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return traced(t, "paymentintent.Get", func() (*stripe.PaymentIntent, error) { return t.next.GetPaymentIntent(id, params) }, paymentIntentResponse)
+}
+
+func (t *Traced) ConfirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	return traced(t, "paymentintent.Confirm", func() (*stripe.PaymentIntent, error) { return t.next.ConfirmPaymentIntent(id, params) }, paymentIntentResponse)
+}
+
+func (t *Traced) CapturePaymentIntent(id string, params *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error) {
+	return traced(t, "paymentintent.Capture", func() (*stripe.PaymentIntent, error) { return t.next.CapturePaymentIntent(id, params) }, paymentIntentResponse)
+}
+
+func (t *Traced) CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	return traced(t, "paymentintent.Cancel", func() (*stripe.PaymentIntent, error) { return t.next.CancelPaymentIntent(id, params) }, paymentIntentResponse)
+}
+
+func (t *Traced) ListPaymentIntents(params *stripe.PaymentIntentListParams) ([]*stripe.PaymentIntent, error) {
+	return traced(t, "paymentintent.List", func() ([]*stripe.PaymentIntent, error) { return t.next.ListPaymentIntents(params) }, listResponse)
+}
+
+func (t *Traced) NewSetupIntent(params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	key, value, attrs := t.intentMetadata(&params.Params)
+	if value != "" {
+		params.AddMetadata(key, value)
+	}
+	return traced(t, "setupintent.New", func() (*stripe.SetupIntent, error) { return t.next.NewSetupIntent(params) }, setupIntentResponse, attrs...)
+}
+
+func (t *Traced) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	return traced(t, "refund.New", func() (*stripe.Refund, error) { return t.next.NewRefund(params) }, refundResponse)
+}
+
+func (t *Traced) ListRefunds(params *stripe.RefundListParams) ([]*stripe.Refund, error) {
+	return traced(t, "refund.List", func() ([]*stripe.Refund, error) { return t.next.ListRefunds(params) }, listResponse)
+}
+
+func (t *Traced) GetPaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	return traced(t, "paymentmethod.Get", func() (*stripe.PaymentMethod, error) { return t.next.GetPaymentMethod(id, params) }, paymentMethodResponse)
+}
+
+func (t *Traced) UpdatePaymentMethod(id string, params *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	return traced(t, "paymentmethod.Update", func() (*stripe.PaymentMethod, error) { return t.next.UpdatePaymentMethod(id, params) }, paymentMethodResponse)
+}
+
+func (t *Traced) DetachPaymentMethod(id string, params *stripe.PaymentMethodDetachParams) (*stripe.PaymentMethod, error) {
+	return traced(t, "paymentmethod.Detach", func() (*stripe.PaymentMethod, error) { return t.next.DetachPaymentMethod(id, params) }, paymentMethodResponse)
+}
+
+func (t *Traced) ListPaymentMethods(params *stripe.CustomerListPaymentMethodsParams) ([]*stripe.PaymentMethod, error) {
+	return traced(t, "customer.ListPaymentMethods", func() ([]*stripe.PaymentMethod, error) { return t.next.ListPaymentMethods(params) }, listResponse)
+}
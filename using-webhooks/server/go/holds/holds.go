@@ -0,0 +1,321 @@
+// Package holds manages the authorizations placed with manual-capture
+// payment intents: verification holds are released as soon as the card is
+// authorized, order holds are watched until they are captured or canceled
+// so they do not silently lapse.
+package holds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/audit"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// Actor is the actor of the captures and cancellations made by the Manager
+// in the audit trail.
+const Actor = "system:holds"
+
+// PurposeMetadataKey is the payment intent metadata key holding the purpose
+// of the hold, so webhooks can be handled for holds missing from the store.
+const PurposeMetadataKey = "hold_purpose"
+
+// ExpiryAction is what the Manager does with an order hold about to expire.
+type ExpiryAction string
+
+const (
+	// ExpiryWarn only logs a warning.
+	ExpiryWarn ExpiryAction = "warn"
+	// ExpiryCapture captures the full authorized amount.
+	ExpiryCapture ExpiryAction = "capture"
+	// ExpiryCancel releases the authorization.
+	ExpiryCancel ExpiryAction = "cancel"
+)
+
+// Options configures a Manager. Zero values are replaced by the defaults
+// documented on each field.
+type Options struct {
+	// Validity is how long a card authorization lasts, 7 days by default.
+	// https://docs.stripe.com/payments/place-a-hold-on-a-payment-method#auth-and-capture-limits
+	Validity time.Duration
+	// WarnBefore is how long before the expiry a warning is logged, 24h by
+	// default.
+	WarnBefore time.Duration
+	// ActBefore is how long before the expiry the Action is taken, 2h by
+	// default.
+	ActBefore time.Duration
+	// Action is taken ActBefore the expiry, ExpiryWarn by default.
+	Action ExpiryAction
+	// Now returns the current time, time.Now by default.
+	Now func() time.Time
+	// Audit records the captures and cancellations made by the Manager,
+	// nothing is recorded by default.
+	Audit audit.Sink
+}
+
+// Manager records the holds and acts on their lifecycle.
+type Manager struct {
+	gateway gateway.PaymentGateway
+	store   store.Store
+	opts    Options
+}
+
+// New returns a Manager.
+func New(gw gateway.PaymentGateway, st store.Store, opts Options) *Manager {
+	if opts.Validity <= 0 {
+		opts.Validity = 7 * 24 * time.Hour
+	}
+	if opts.WarnBefore <= 0 {
+		opts.WarnBefore = 24 * time.Hour
+	}
+	if opts.ActBefore <= 0 {
+		opts.ActBefore = 2 * time.Hour
+	}
+	if opts.Action == "" {
+		opts.Action = ExpiryWarn
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Manager{gateway: gw, store: st, opts: opts}
+}
+
+// Track records the hold placed by a newly created manual-capture payment
+// intent.
+func (m *Manager) Track(ctx context.Context, pi *stripe.PaymentIntent, purpose string) error {
+	h := store.Hold{
+		PaymentIntentID: pi.ID,
+		Purpose:         purpose,
+		Status:          store.HoldPending,
+		Amount:          pi.Amount,
+		Currency:        string(pi.Currency),
+		Created:         pi.Created,
+	}
+	if pi.Customer != nil {
+		h.CustomerID = pi.Customer.ID
+	}
+	if err := m.store.SaveHold(ctx, h); err != nil {
+		return fmt.Errorf("holds: track %s: %w", pi.ID, err)
+	}
+	return nil
+}
+
+// Authorized records that the card of the hold was authorized at the given
+// time, as reported by payment_intent.amount_capturable_updated: the time
+// is the creation of the event, not its processing which may come much
+// later. The expiry is the capture_before of the charge when pi carries
+// it, Validity after the authorization otherwise. Verification holds are
+// canceled right away.
+func (m *Manager) Authorized(ctx context.Context, pi *stripe.PaymentIntent, authorizedAt time.Time) error {
+	h, err := m.hold(ctx, pi)
+	if err != nil || h.Status == "" {
+		return err
+	}
+
+	if h.Status == store.HoldPending {
+		h.Status = store.HoldAuthorized
+		h.Amount = pi.AmountCapturable
+		h.AuthorizedAt = authorizedAt.Unix()
+		h.ExpiresAt = authorizedAt.Add(m.opts.Validity).Unix()
+		if captureBefore := chargeCaptureBefore(pi); captureBefore > 0 {
+			h.ExpiresAt = captureBefore
+		}
+		if err := m.store.SaveHold(ctx, h); err != nil {
+			return fmt.Errorf("holds: save %s: %w", pi.ID, err)
+		}
+	}
+
+	// also retried when a previous cancellation failed
+	if h.Purpose == store.HoldVerification && h.Status == store.HoldAuthorized {
+		slog.InfoContext(ctx, "card verified, releasing the hold", logging.PaymentIntentID(pi.ID), logging.CustomerID(h.CustomerID))
+		return m.cancel(ctx, h)
+	}
+	return nil
+}
+
+// Settled records that the payment intent of the hold was captured or
+// canceled.
+func (m *Manager) Settled(ctx context.Context, pi *stripe.PaymentIntent) error {
+	h, err := m.store.Hold(ctx, pi.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("holds: get %s: %w", pi.ID, err)
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		h.Status = store.HoldCaptured
+	case stripe.PaymentIntentStatusCanceled:
+		h.Status = store.HoldCanceled
+	default:
+		return nil
+	}
+	if err := m.store.SaveHold(ctx, h); err != nil {
+		return fmt.Errorf("holds: save %s: %w", pi.ID, err)
+	}
+	return nil
+}
+
+// CheckExpiring warns about the authorized order holds expiring within
+// WarnBefore and takes the configured action on the ones expiring within
+// ActBefore. Verification holds still authorized, whose cancellation
+// failed, are canceled again: they are never captured. All holds are
+// checked even if some fail.
+func (m *Manager) CheckExpiring(ctx context.Context) error {
+	var errs []error
+	stale, err := m.store.Holds(ctx, store.HoldFilter{
+		Status:  store.HoldAuthorized,
+		Purpose: store.HoldVerification,
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("holds: list verification holds: %w", err))
+	}
+	for _, h := range stale {
+		slog.InfoContext(ctx, "retrying the release of a verification hold", logging.PaymentIntentID(h.PaymentIntentID), logging.CustomerID(h.CustomerID))
+		errs = append(errs, m.cancel(ctx, h))
+	}
+
+	now := m.opts.Now()
+	expiring, err := m.store.Holds(ctx, store.HoldFilter{
+		Status:    store.HoldAuthorized,
+		Purpose:   store.HoldOrder,
+		ExpiresBy: now.Add(m.opts.WarnBefore).Unix(),
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("holds: list expiring: %w", err))
+	}
+	for _, h := range expiring {
+		expiresAt := time.Unix(h.ExpiresAt, 0)
+		if !h.Warned {
+			slog.WarnContext(ctx, "⚠️ hold expires soon", logging.PaymentIntentID(h.PaymentIntentID), logging.CustomerID(h.CustomerID),
+				"amount", h.Amount, "currency", h.Currency, "expires_at", expiresAt)
+			h.Warned = true
+			if err := m.store.SaveHold(ctx, h); err != nil {
+				errs = append(errs, fmt.Errorf("holds: save %s: %w", h.PaymentIntentID, err))
+				continue
+			}
+		}
+		if now.Before(expiresAt.Add(-m.opts.ActBefore)) {
+			continue
+		}
+		switch m.opts.Action {
+		case ExpiryCapture:
+			errs = append(errs, m.capture(ctx, h))
+		case ExpiryCancel:
+			errs = append(errs, m.cancel(ctx, h))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run calls CheckExpiring every interval until ctx is done.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.CheckExpiring(ctx); err != nil {
+			slog.ErrorContext(ctx, "holds.CheckExpiring failed", logging.Err(err))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// hold returns the recorded hold of pi, or a hold built from its metadata
+// when it was not recorded. Payment intents which are not holds are
+// reported with an empty status.
+func (m *Manager) hold(ctx context.Context, pi *stripe.PaymentIntent) (store.Hold, error) {
+	h, err := m.store.Hold(ctx, pi.ID)
+	if err == nil {
+		return h, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return store.Hold{}, fmt.Errorf("holds: get %s: %w", pi.ID, err)
+	}
+	purpose := pi.Metadata[PurposeMetadataKey]
+	if pi.CaptureMethod != stripe.PaymentIntentCaptureMethodManual || purpose == "" {
+		return store.Hold{}, nil
+	}
+	h = store.Hold{
+		PaymentIntentID: pi.ID,
+		Purpose:         purpose,
+		Status:          store.HoldPending,
+		Amount:          pi.Amount,
+		Currency:        string(pi.Currency),
+		Created:         pi.Created,
+	}
+	if pi.Customer != nil {
+		h.CustomerID = pi.Customer.ID
+	}
+	return h, nil
+}
+
+// chargeCaptureBefore returns the time, in Unix time, Stripe refunds the
+// authorization of pi if it is not captured, or zero when the latest
+// charge of pi is not expanded.
+func chargeCaptureBefore(pi *stripe.PaymentIntent) int64 {
+	c := pi.LatestCharge
+	if c == nil || c.PaymentMethodDetails == nil || c.PaymentMethodDetails.Card == nil {
+		return 0
+	}
+	return c.PaymentMethodDetails.Card.CaptureBefore
+}
+
+func (m *Manager) cancel(ctx context.Context, h store.Hold) error {
+	params := &stripe.PaymentIntentCancelParams{
+		CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonAbandoned)),
+	}
+	params.SetIdempotencyKey(gateway.CancelIdempotencyKey(h.PaymentIntentID, *params.CancellationReason))
+	pi, err := gateway.WithContext(ctx, m.gateway).CancelPaymentIntent(h.PaymentIntentID, params)
+	m.audit(ctx, "cancel", h, pi, err)
+	if err != nil {
+		return fmt.Errorf("holds: cancel %s: %w", h.PaymentIntentID, err)
+	}
+	return m.Settled(ctx, pi)
+}
+
+func (m *Manager) capture(ctx context.Context, h store.Hold) error {
+	params := &stripe.PaymentIntentCaptureParams{}
+	params.SetIdempotencyKey("capture-" + h.PaymentIntentID + "-expiry")
+	pi, err := gateway.WithContext(ctx, m.gateway).CapturePaymentIntent(h.PaymentIntentID, params)
+	m.audit(ctx, "capture", h, pi, err)
+	if err != nil {
+		return fmt.Errorf("holds: capture %s: %w", h.PaymentIntentID, err)
+	}
+	slog.InfoContext(ctx, "captured the hold before it expired", logging.PaymentIntentID(h.PaymentIntentID), logging.CustomerID(h.CustomerID))
+	return m.Settled(ctx, pi)
+}
+
+// audit appends the capture or cancellation of the hold to the audit
+// trail. Failures are only logged, the request was already made.
+func (m *Manager) audit(ctx context.Context, action string, h store.Hold, pi *stripe.PaymentIntent, err error) {
+	if m.opts.Audit == nil {
+		return
+	}
+	e := audit.Entry{
+		Created:         m.opts.Now().Unix(),
+		Actor:           Actor,
+		Action:          action,
+		PaymentIntentID: h.PaymentIntentID,
+		Amount:          h.Amount,
+		Currency:        h.Currency,
+	}
+	var resp *stripe.APIResponse
+	if pi != nil {
+		resp = pi.LastResponse
+	}
+	e.SetResult(resp, err)
+	if err := m.opts.Audit.Append(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "audit.Append failed", logging.PaymentIntentID(h.PaymentIntentID), logging.Err(err))
+	}
+}
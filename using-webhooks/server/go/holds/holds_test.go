@@ -0,0 +1,262 @@
+package holds
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/audit"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// authorizedHold places a hold for purpose and authorizes it with a card.
+func authorizedHold(t *testing.T, fake *gateway.Fake, m *Manager, st store.Store, purpose string) *stripe.PaymentIntent {
+	ctx := context.Background()
+	c, err := fake.NewCustomer(&stripe.CustomerParams{})
+	require.NoError(t, err)
+	pm := fake.AddPaymentMethod(c.ID, gateway.CardSucceeds)
+
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(1400),
+		Currency:      stripe.String("usd"),
+		Customer:      stripe.String(c.ID),
+		CaptureMethod: stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
+	}
+	params.AddMetadata(PurposeMetadataKey, purpose)
+	pi, err := fake.NewPaymentIntent(params)
+	require.NoError(t, err)
+	require.NoError(t, m.Track(ctx, pi, purpose))
+
+	pi, err = fake.ConfirmPaymentIntent(pi.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: stripe.String(pm.ID)})
+	require.NoError(t, err)
+	require.Equal(t, stripe.PaymentIntentStatusRequiresCapture, pi.Status)
+	require.NoError(t, m.Authorized(ctx, pi, m.opts.Now()))
+	return pi
+}
+
+// failingCancel is a fake gateway whose cancellations fail while fail is
+// set.
+type failingCancel struct {
+	*gateway.Fake
+	fail bool
+}
+
+func (g *failingCancel) CancelPaymentIntent(id string, params *stripe.PaymentIntentCancelParams) (*stripe.PaymentIntent, error) {
+	if g.fail {
+		return nil, &stripe.Error{Type: stripe.ErrorTypeAPI, Msg: "unavailable"}
+	}
+	return g.Fake.CancelPaymentIntent(id, params)
+}
+
+func TestVerificationHoldIsReleased(t *testing.T) {
+	ctx := context.Background()
+	fake := gateway.NewFake()
+	st := store.NewMemory()
+	m := New(fake, st, Options{})
+
+	pi := authorizedHold(t, fake, m, st, store.HoldVerification)
+
+	got, err := fake.GetPaymentIntent(pi.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, stripe.PaymentIntentStatusCanceled, got.Status)
+	h, err := st.Hold(ctx, pi.ID)
+	require.NoError(t, err)
+	require.Equal(t, store.HoldCanceled, h.Status)
+
+	// a redelivered event does nothing more
+	require.NoError(t, m.Authorized(ctx, pi, time.Now()))
+}
+
+func TestVerificationHoldFromMetadata(t *testing.T) {
+	ctx := context.Background()
+	fake := gateway.NewFake()
+	st := store.NewMemory()
+	m := New(fake, st, Options{})
+
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(100),
+		Currency:      stripe.String("usd"),
+		CaptureMethod: stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
+	}
+	params.AddMetadata(PurposeMetadataKey, store.HoldVerification)
+	pi, err := fake.NewPaymentIntent(params)
+	require.NoError(t, err)
+	pi.Status = stripe.PaymentIntentStatusRequiresCapture
+	pi.AmountCapturable = 100
+
+	// not tracked by this store
+	require.NoError(t, m.Authorized(ctx, pi, time.Now()))
+	h, err := st.Hold(ctx, pi.ID)
+	require.NoError(t, err)
+	require.Equal(t, store.HoldCanceled, h.Status)
+}
+
+func TestOrderHoldExpiry(t *testing.T) {
+	ctx := context.Background()
+	authorizedAt := time.Unix(1700000000, 0)
+
+	for _, tt := range []struct {
+		action ExpiryAction
+		want   stripe.PaymentIntentStatus
+		status string
+	}{
+		{ExpiryWarn, stripe.PaymentIntentStatusRequiresCapture, store.HoldAuthorized},
+		{ExpiryCapture, stripe.PaymentIntentStatusSucceeded, store.HoldCaptured},
+		{ExpiryCancel, stripe.PaymentIntentStatusCanceled, store.HoldCanceled},
+	} {
+		t.Run(string(tt.action), func(t *testing.T) {
+			now := authorizedAt
+			fake := gateway.NewFake()
+			st := store.NewMemory()
+			trail := audit.NewMemory()
+			m := New(fake, st, Options{Action: tt.action, Now: func() time.Time { return now }, Audit: trail})
+			pi := authorizedHold(t, fake, m, st, store.HoldOrder)
+
+			h, err := st.Hold(ctx, pi.ID)
+			require.NoError(t, err)
+			require.Equal(t, store.HoldAuthorized, h.Status)
+			require.Equal(t, authorizedAt.Add(7*24*time.Hour).Unix(), h.ExpiresAt)
+
+			// nothing to do yet
+			now = authorizedAt.Add(5 * 24 * time.Hour)
+			require.NoError(t, m.CheckExpiring(ctx))
+			h, err = st.Hold(ctx, pi.ID)
+			require.NoError(t, err)
+			require.False(t, h.Warned)
+
+			// within WarnBefore
+			now = authorizedAt.Add(6*24*time.Hour + time.Hour)
+			require.NoError(t, m.CheckExpiring(ctx))
+			h, err = st.Hold(ctx, pi.ID)
+			require.NoError(t, err)
+			require.True(t, h.Warned)
+			require.Equal(t, store.HoldAuthorized, h.Status)
+
+			// within ActBefore
+			now = authorizedAt.Add(7*24*time.Hour - time.Hour)
+			require.NoError(t, m.CheckExpiring(ctx))
+			h, err = st.Hold(ctx, pi.ID)
+			require.NoError(t, err)
+			require.Equal(t, tt.status, h.Status)
+			got, err := fake.GetPaymentIntent(pi.ID, nil)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.Status)
+
+			entries, err := trail.Entries(ctx, audit.Query{})
+			require.NoError(t, err)
+			if tt.action == ExpiryWarn {
+				require.Empty(t, entries)
+				return
+			}
+			require.Len(t, entries, 1)
+			require.Equal(t, Actor, entries[0].Actor)
+			require.Equal(t, string(tt.action), entries[0].Action)
+			require.Equal(t, int64(1400), entries[0].Amount)
+			require.Equal(t, audit.OutcomeSucceeded, entries[0].Outcome)
+			require.NotEmpty(t, entries[0].StripeRequestID)
+		})
+	}
+}
+
+func TestVerificationHoldIsNeverCaptured(t *testing.T) {
+	ctx := context.Background()
+	authorizedAt := time.Unix(1700000000, 0)
+	now := authorizedAt
+	gw := &failingCancel{Fake: gateway.NewFake(), fail: true}
+	st := store.NewMemory()
+	m := New(gw, st, Options{Action: ExpiryCapture, Now: func() time.Time { return now }})
+
+	c, err := gw.NewCustomer(&stripe.CustomerParams{})
+	require.NoError(t, err)
+	pm := gw.AddPaymentMethod(c.ID, gateway.CardSucceeds)
+	pi, err := gw.NewPaymentIntent(&stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(100),
+		Currency:      stripe.String("usd"),
+		Customer:      stripe.String(c.ID),
+		CaptureMethod: stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
+	})
+	require.NoError(t, err)
+	require.NoError(t, m.Track(ctx, pi, store.HoldVerification))
+	pi, err = gw.ConfirmPaymentIntent(pi.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: stripe.String(pm.ID)})
+	require.NoError(t, err)
+	require.Error(t, m.Authorized(ctx, pi, authorizedAt))
+
+	// still authorized when the capture window closes
+	now = authorizedAt.Add(7*24*time.Hour - time.Hour)
+	require.Error(t, m.CheckExpiring(ctx))
+	got, err := gw.GetPaymentIntent(pi.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, stripe.PaymentIntentStatusRequiresCapture, got.Status)
+
+	gw.fail = false
+	require.NoError(t, m.CheckExpiring(ctx))
+	got, err = gw.GetPaymentIntent(pi.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, stripe.PaymentIntentStatusCanceled, got.Status)
+	h, err := st.Hold(ctx, pi.ID)
+	require.NoError(t, err)
+	require.Equal(t, store.HoldCanceled, h.Status)
+}
+
+func TestExpiryFollowsAuthorization(t *testing.T) {
+	ctx := context.Background()
+	authorizedAt := time.Unix(1700000000, 0)
+	fake := gateway.NewFake()
+	st := store.NewMemory()
+	// the event is processed long after the card was authorized
+	m := New(fake, st, Options{Now: func() time.Time { return authorizedAt.Add(3 * 24 * time.Hour) }})
+
+	for _, tt := range []struct {
+		name          string
+		captureBefore int64
+		want          int64
+	}{
+		{name: "validity after the authorization", want: authorizedAt.Add(7 * 24 * time.Hour).Unix()},
+		{name: "capture_before of the charge", captureBefore: authorizedAt.Add(5 * 24 * time.Hour).Unix(), want: authorizedAt.Add(5 * 24 * time.Hour).Unix()},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pi, err := fake.NewPaymentIntent(&stripe.PaymentIntentParams{
+				Amount:        stripe.Int64(1400),
+				Currency:      stripe.String("usd"),
+				CaptureMethod: stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
+			})
+			require.NoError(t, err)
+			require.NoError(t, m.Track(ctx, pi, store.HoldOrder))
+			pi.Status = stripe.PaymentIntentStatusRequiresCapture
+			pi.AmountCapturable = 1400
+			if tt.captureBefore > 0 {
+				pi.LatestCharge = &stripe.Charge{PaymentMethodDetails: &stripe.ChargePaymentMethodDetails{
+					Card: &stripe.ChargePaymentMethodDetailsCard{CaptureBefore: tt.captureBefore},
+				}}
+			}
+
+			require.NoError(t, m.Authorized(ctx, pi, authorizedAt))
+			h, err := st.Hold(ctx, pi.ID)
+			require.NoError(t, err)
+			require.Equal(t, authorizedAt.Unix(), h.AuthorizedAt)
+			require.Equal(t, tt.want, h.ExpiresAt)
+		})
+	}
+}
+
+func TestSettled(t *testing.T) {
+	ctx := context.Background()
+	fake := gateway.NewFake()
+	st := store.NewMemory()
+	m := New(fake, st, Options{})
+	pi := authorizedHold(t, fake, m, st, store.HoldOrder)
+
+	pi, err := fake.CapturePaymentIntent(pi.ID, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Settled(ctx, pi))
+
+	h, err := st.Hold(ctx, pi.ID)
+	require.NoError(t, err)
+	require.Equal(t, store.HoldCaptured, h.Status)
+
+	// payment intents which are not holds are ignored
+	require.NoError(t, m.Settled(ctx, &stripe.PaymentIntent{ID: "pi_other", Status: stripe.PaymentIntentStatusSucceeded}))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// idempotencyKeyHeader carries the key picked by the client for a request,
+// as in the Stripe API. A request sent again with the same key gets the
+// response to the first one instead of being processed twice.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the longest key accepted from the client.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyTTL is how long responses are replayed, as long as Stripe
+// keeps the idempotency keys of the calls made while serving them.
+const idempotencyTTL = 24 * time.Hour
+
+type idempotencyKeyContextKey struct{}
+
+// idempotent replays the saved response to a POST request sent again with
+// the same Idempotency-Key. Keys are scoped to the path and the caller: a key
+// reused for another request is rejected with a 422, and a retry arriving
+// while the first request is still being served with a 409. Server errors
+// are not saved, so the request can be retried.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != "POST" || key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		p, _ := auth.FromContext(r.Context())
+		scopedKey := hashOf(r.URL.Path, p.String(), key)
+		requestHash := hashOf(string(body))
+		if !s.beginRequest(scopedKey) {
+			writeAPIError(w, http.StatusConflict, APIError{
+				Type:    errorTypeIdempotency,
+				Message: "A request with this " + idempotencyKeyHeader + " is in progress.",
+			})
+			return
+		}
+		defer s.endRequest(scopedKey)
+
+		saved, err := s.store.IdempotentResponse(r.Context(), scopedKey)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+		case err != nil:
+			writeFailure(w, "store.IdempotentResponse", err)
+			return
+		case saved.Created < time.Now().Add(-idempotencyTTL).Unix():
+			// expired, the request is served again
+		case saved.RequestHash != requestHash:
+			writeAPIError(w, http.StatusUnprocessableEntity, APIError{
+				Type:    errorTypeIdempotency,
+				Message: idempotencyKeyHeader + " was already used for another request.",
+			})
+			return
+		default:
+			replayResponse(w, saved)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(context.WithValue(r.Context(), idempotencyKeyContextKey{}, scopedKey)))
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+		err = s.store.SaveIdempotentResponse(r.Context(), store.IdempotentResponse{
+			Key:         scopedKey,
+			RequestHash: requestHash,
+			Status:      rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+			Created:     time.Now().Unix(),
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "store.SaveIdempotentResponse failed", logging.Err(err))
+		}
+	}
+}
+
+// beginRequest marks the request with the scoped key as being served, and
+// reports false if it already was.
+func (s *Server) beginRequest(scopedKey string) bool {
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	if s.inFlight[scopedKey] {
+		return false
+	}
+	s.inFlight[scopedKey] = true
+	return true
+}
+
+func (s *Server) endRequest(scopedKey string) {
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	delete(s.inFlight, scopedKey)
+}
+
+// pruneIdempotentResponses deletes the responses which are not replayed
+// anymore.
+func (s *Server) pruneIdempotentResponses(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := s.store.DeleteIdempotentResponses(ctx, time.Now().Add(-idempotencyTTL).Unix()); err != nil {
+				slog.ErrorContext(ctx, "store.DeleteIdempotentResponses failed", logging.Err(err))
+			}
+		}
+	}
+}
+
+// setRequestIdempotencyKey sets the idempotency key of a Stripe call made
+// while serving a request sent with an Idempotency-Key, op tells apart the
+// calls made by the request. Stripe then returns the result of the first
+// call when the request is retried, even if its response was never saved.
+func setRequestIdempotencyKey(ctx context.Context, params *stripe.Params, op string) {
+	if key, ok := ctx.Value(idempotencyKeyContextKey{}).(string); ok {
+		params.SetIdempotencyKey(key + "-" + op)
+	}
+}
+
+// requireIdempotencyKey reports whether the request was sent with an
+// Idempotency-Key, or is an approved request replayed with a key of its own.
+// Requests without a key are answered with a 400: the calls they make to
+// Stripe have no state to derive a key from.
+func requireIdempotencyKey(w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := r.Context().Value(idempotencyKeyContextKey{}).(string); ok {
+		return true
+	}
+	writeError(w, http.StatusBadRequest, idempotencyKeyHeader+" is required")
+	return false
+}
+
+// hashOf returns the hex SHA-256 of the parts.
+func hashOf(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func replayResponse(w http.ResponseWriter, saved store.IdempotentResponse) {
+	if saved.ContentType != "" {
+		w.Header().Set("Content-Type", saved.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(saved.Status)
+	if _, err := w.Write(saved.Body); err != nil {
+		slog.Error("ResponseWriter.Write failed", logging.Err(err))
+	}
+}
+
+// responseRecorder copies the response written to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
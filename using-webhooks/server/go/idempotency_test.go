@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// postIdempotent posts body to path with the idempotency key, through the
+// routes of the server.
+func postIdempotent(t *testing.T, s *Server, path, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(userIDHeader, "user_1")
+	if key != "" {
+		r.Header.Set(idempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotency(t *testing.T) {
+	const order = `{"currency": "usd", "items": [{"id": "photo-subscription"}]}`
+
+	t.Run("replays the response", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		first := postIdempotent(t, s, "/create-payment-intent", "key_1", order)
+		require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+		require.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+		again := postIdempotent(t, s, "/create-payment-intent", "key_1", order)
+		require.Equal(t, http.StatusOK, again.Code)
+		require.Equal(t, "true", again.Header().Get("Idempotent-Replayed"))
+		require.Equal(t, "application/json", again.Header().Get("Content-Type"))
+		require.JSONEq(t, first.Body.String(), again.Body.String())
+
+		other := postIdempotent(t, s, "/create-payment-intent", "key_2", order)
+		require.Equal(t, http.StatusOK, other.Code)
+		require.NotEqual(t, first.Body.String(), other.Body.String())
+
+		pis, err := fake.ListPaymentIntents(nil)
+		require.NoError(t, err)
+		require.Len(t, pis, 2)
+	})
+
+	t.Run("rejects a key reused for another request", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		w := postIdempotent(t, s, "/create-payment-intent", "key_1", order)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = postIdempotent(t, s, "/create-payment-intent", "key_1", `{"currency": "usd"}`)
+		require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+		// keys are scoped to the path
+		w = postIdempotent(t, s, "/create-setup-intent", "key_1", `{}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("passes the key to Stripe", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		first := postIdempotent(t, s, "/create-payment-intent", "key_1", order)
+		require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+
+		// the response was lost, Stripe still returns the same intent
+		require.NoError(t, s.store.DeleteIdempotentResponses(context.Background(), time.Now().Add(time.Hour).Unix()))
+		again := postIdempotent(t, s, "/create-payment-intent", "key_1", order)
+		require.Equal(t, http.StatusOK, again.Code)
+		require.Empty(t, again.Header().Get("Idempotent-Replayed"))
+		require.JSONEq(t, first.Body.String(), again.Body.String())
+
+		pis, err := fake.ListPaymentIntents(nil)
+		require.NoError(t, err)
+		require.Len(t, pis, 1)
+	})
+
+	t.Run("cancels once without a key", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		w := postIdempotent(t, s, "/create-payment-intent", "", order)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var created intentResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+		for range 2 {
+			w = postJSON(t, s.handleCancelPaymentIntent, "", `{"paymentIntentID": "`+created.ID+`"}`)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			var pi stripe.PaymentIntent
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pi))
+			require.Equal(t, stripe.PaymentIntentStatusCanceled, pi.Status)
+		}
+	})
+
+	t.Run("charges only with a key", func(t *testing.T) {
+		s, fake := newTestServer(t, withOperators(0))
+		customerID := customerOf(t, s, "user_1")
+		pm := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		fake.SetDefaultPaymentMethod(customerID, pm.ID)
+		const charge = `{"userID": "user_1", "amount": 310}`
+
+		w := adminRequest(t, s, aliceToken, http.MethodPost, "/admin/payments/charge", charge)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Equal(t, "Idempotency-Key is required", errorOf(t, w).Message)
+
+		for range 2 {
+			w = adminCharge(t, s, aliceToken, "key_1", charge)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+		pis, err := fake.ListPaymentIntents(nil)
+		require.NoError(t, err)
+		require.Len(t, pis, 1)
+	})
+}
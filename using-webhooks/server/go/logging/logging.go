@@ -0,0 +1,109 @@
+// Package logging sets up the structured logs of the server: a slog.Handler
+// adding the request or event ID and the trace of the context to every
+// record and redacting the client secrets, API keys, emails, addresses and
+// card fingerprints before anything is written.
+package logging
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The keys of the attributes identifying the objects a record is about.
+const (
+	RequestIDKey       = "request_id"
+	PaymentIntentIDKey = "payment_intent_id"
+	CustomerIDKey      = "customer_id"
+	EventIDKey         = "event_id"
+	ErrorKey           = "err"
+	TraceIDKey         = "trace_id"
+	SpanIDKey          = "span_id"
+)
+
+// PaymentIntentID returns the attribute of the payment intent a record is
+// about.
+func PaymentIntentID(id string) slog.Attr {
+	return slog.String(PaymentIntentIDKey, id)
+}
+
+// CustomerID returns the attribute of the Customer a record is about.
+func CustomerID(id string) slog.Attr {
+	return slog.String(CustomerIDKey, id)
+}
+
+// EventID returns the attribute of the webhook event a record is about.
+func EventID(id string) slog.Attr {
+	return slog.String(EventIDKey, id)
+}
+
+// Err returns the attribute of the error a record reports.
+func Err(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
+
+type attrsContextKey struct{}
+
+// With returns a copy of ctx whose records also carry attrs, the ID of the
+// request or of the webhook event being handled for instance.
+func With(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev := attrsFrom(ctx)
+	all := make([]slog.Attr, 0, len(prev)+len(attrs))
+	all = append(append(all, prev...), attrs...)
+	return context.WithValue(ctx, attrsContextKey{}, all)
+}
+
+// WithRequestID returns a copy of ctx whose records carry the ID of the
+// request it serves.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return With(ctx, slog.String(RequestIDKey, id))
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(attrsContextKey{}).([]slog.Attr)
+	return attrs
+}
+
+// Handler is a slog.Handler adding the attributes of the context, see With,
+// and the IDs of its trace span to the records and redacting them, see
+// Redact, before handing them to the next handler.
+type Handler struct {
+	next slog.Handler
+}
+
+// NewHandler returns a Handler writing to next.
+func NewHandler(next slog.Handler) *Handler {
+	return &Handler{next: next}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, RedactString(r.Message), r.PC)
+	for _, a := range attrsFrom(ctx) {
+		redacted.AddAttrs(Redact(a))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		redacted.AddAttrs(slog.String(TraceIDKey, sc.TraceID().String()), slog.String(SpanIDKey, sc.SpanID().String()))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(Redact(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, Redact(a))
+	}
+	return &Handler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// record logs msg with args through a Handler and returns the JSON record.
+func record(t *testing.T, ctx context.Context, msg string, args ...interface{}) map[string]interface{} {
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil)))
+	logger.InfoContext(ctx, msg, args...)
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	return got
+}
+
+func TestHandler(t *testing.T) {
+	ctx := WithRequestID(context.Background(), "req_1")
+	pi := &stripe.PaymentIntent{
+		ID:           "pi_123",
+		ClientSecret: "pi_123_secret_abc",
+		ReceiptEmail: "jenny@example.com",
+		Customer:     &stripe.Customer{ID: "cus_1", Email: "jenny@example.com"},
+		PaymentMethod: &stripe.PaymentMethod{
+			BillingDetails: &stripe.PaymentMethodBillingDetails{
+				Address: &stripe.Address{Line1: "510 Townsend St"},
+			},
+			Card: &stripe.PaymentMethodCard{Fingerprint: "fp_1", Last4: "4242"},
+		},
+	}
+
+	got := record(t, ctx, "Intent pi_123_secret_abc of jenny@example.com",
+		PaymentIntentID(pi.ID), CustomerID("cus_1"), slog.Any("pi", pi),
+		slog.String("client_secret", pi.ClientSecret), slog.String("key", "sk_test_123"))
+	require.Equal(t, "Intent [REDACTED] of [REDACTED]", got["msg"])
+	require.Equal(t, "req_1", got[RequestIDKey])
+	require.Equal(t, "pi_123", got[PaymentIntentIDKey])
+	require.Equal(t, "cus_1", got[CustomerIDKey])
+	require.Equal(t, Redacted, got["client_secret"])
+	require.Equal(t, Redacted, got["key"])
+
+	logged := got["pi"].(map[string]interface{})
+	require.Equal(t, "pi_123", logged["id"])
+	require.Equal(t, Redacted, logged["client_secret"])
+	require.Equal(t, Redacted, logged["receipt_email"])
+	require.Equal(t, Redacted, logged["customer"].(map[string]interface{})["email"])
+	pm := logged["payment_method"].(map[string]interface{})
+	require.Equal(t, Redacted, pm["billing_details"].(map[string]interface{})["address"])
+	require.Equal(t, Redacted, pm["card"].(map[string]interface{})["fingerprint"])
+	require.Equal(t, "4242", pm["card"].(map[string]interface{})["last4"])
+
+	// the errors of Stripe embed the objects they are about
+	err := fmt.Errorf("paymentintent.New: %w", &stripe.Error{Msg: "Your card was declined.", PaymentIntent: pi})
+	got = record(t, context.Background(), "charge failed", Err(err))
+	require.NotContains(t, got[ErrorKey], "pi_123_secret_abc")
+	require.NotContains(t, got[ErrorKey], "jenny@example.com")
+	require.NotContains(t, got, RequestIDKey)
+
+	got = record(t, context.Background(), "declined", Err(&stripe.Error{Msg: "declined", PaymentIntent: pi}))
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(got[ErrorKey].(string)), &decoded))
+	intent := decoded["payment_intent"].(map[string]interface{})
+	require.Equal(t, Redacted, intent["client_secret"])
+	require.Equal(t, Redacted, intent["payment_method"].(map[string]interface{})["billing_details"].(map[string]interface{})["address"])
+}
+
+func TestWithAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil))).
+		With("email", "jenny@example.com").
+		WithGroup("customer").
+		With(slog.Group("shipping", "name", "Jenny", "address", "510 Townsend St"))
+	logger.Info("saved")
+
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Equal(t, Redacted, got["email"])
+	shipping := got["customer"].(map[string]interface{})["shipping"].(map[string]interface{})
+	require.Equal(t, "Jenny", shipping["name"])
+	require.Equal(t, Redacted, shipping["address"])
+}
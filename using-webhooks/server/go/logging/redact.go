@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces the redacted values.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are the parts of the attribute and JSON keys whose values
+// are redacted whole, matched against the lowercased key without
+// underscores: client_secret, receipt_email, billing_details.address,
+// card.fingerprint...
+var sensitiveKeys = []string{"secret", "password", "token", "apikey", "email", "address", "fingerprint", "phone"}
+
+// sensitivePatterns are the values redacted from every string, messages
+// and errors included.
+var sensitivePatterns = []*regexp.Regexp{
+	// client secrets of payment and setup intents
+	regexp.MustCompile(`\b(pi|seti)_[A-Za-z0-9]+_secret_[A-Za-z0-9]+`),
+	// API keys and webhook secrets
+	regexp.MustCompile(`\b(sk|rk|whsec)_[A-Za-z0-9_]+`),
+	regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+}
+
+// sensitiveKey reports whether the values of key are redacted whole.
+func sensitiveKey(key string) bool {
+	key = strings.ReplaceAll(strings.ToLower(key), "_", "")
+	for _, part := range sensitiveKeys {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactString returns s without the client secrets, API keys and emails
+// it contains.
+func RedactString(s string) string {
+	for _, pattern := range sensitivePatterns {
+		s = pattern.ReplaceAllString(s, Redacted)
+	}
+	return s
+}
+
+// redactText redacts s. The errors returned by Stripe are JSON objects,
+// which may embed the object they are about, redacted like other values.
+func redactText(s string) string {
+	var decoded map[string]interface{}
+	if !strings.HasPrefix(s, "{") || json.Unmarshal([]byte(s), &decoded) != nil {
+		return RedactString(s)
+	}
+	b, err := json.Marshal(redactJSON(decoded))
+	if err != nil {
+		return Redacted
+	}
+	return string(b)
+}
+
+// Redact returns a without sensitive values: the value of a sensitive key
+// is replaced whole, strings are stripped of client secrets, API keys and
+// emails, and other values, Stripe objects for instance, are logged as
+// their JSON encoding with the values of the sensitive keys replaced.
+func Redact(a slog.Attr) slog.Attr {
+	if sensitiveKey(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return slog.Attr{Key: a.Key, Value: redactValue(a.Value)}
+}
+
+func redactValue(v slog.Value) slog.Value {
+	v = v.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.StringValue(RedactString(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]slog.Attr, 0, len(attrs))
+		for _, a := range attrs {
+			redacted = append(redacted, Redact(a))
+		}
+		return slog.GroupValue(redacted...)
+	case slog.KindAny:
+		return redactAny(v.Any())
+	}
+	return v
+}
+
+func redactAny(v interface{}) slog.Value {
+	switch v := v.(type) {
+	case nil:
+		return slog.AnyValue(nil)
+	case error:
+		return slog.StringValue(redactText(v.Error()))
+	case fmt.Stringer:
+		return slog.StringValue(redactText(v.String()))
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return slog.StringValue(RedactString(fmt.Sprint(v)))
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return slog.StringValue(Redacted)
+	}
+	return slog.AnyValue(redactJSON(decoded))
+}
+
+// redactJSON redacts the decoded JSON value v in place.
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if sensitiveKey(key) && value != nil {
+				v[key] = Redacted
+				continue
+			}
+			v[key] = redactJSON(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+	case string:
+		return RedactString(v)
+	}
+	return v
+}
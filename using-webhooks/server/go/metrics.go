@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/metrics"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// maxOutcomeBody is the size of the response bodies read for their outcome,
+// the error responses and the statuses of the payments are smaller.
+const maxOutcomeBody = 4 << 10
+
+// outcomeHeld is the outcome of the requests awaiting an approval.
+const outcomeHeld = "held"
+
+// withMetrics counts the requests served by mux by endpoint, the pattern
+// they matched, and outcome, see requestOutcome.
+func (s *Server) withMetrics(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &outcomeRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(rec, r)
+		// the mux sets the pattern of the request it routed
+		endpoint := r.Pattern
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+		s.metrics.ObserveRequest(endpoint, requestOutcome(rec.status, rec.body.Bytes(), rec.truncated))
+	})
+}
+
+// requestOutcome tells how a request went from its response, replayed ones
+// included: requires_action or needs_new_payment_method when the payment
+// needs the customer, held when it awaits an approval, succeeded for the
+// other successes, the code of the card errors, authentication_required
+// when the bank declined an off-session payment asking for
+// authentication, and the type of the other errors.
+func requestOutcome(status int, body []byte, truncated bool) string {
+	if status >= http.StatusBadRequest {
+		var resp ErrorResponse
+		if truncated || json.Unmarshal(body, &resp) != nil {
+			return errorType(status)
+		}
+		e := resp.Error
+		switch {
+		case e.Type == errorTypeCard && e.DeclineCode == string(stripe.DeclineCodeAuthenticationRequired):
+			return string(stripe.DeclineCodeAuthenticationRequired)
+		case e.Type == errorTypeCard && e.Code != "":
+			return e.Code
+		case e.Type != "":
+			return e.Type
+		}
+		return errorType(status)
+	}
+	if status == http.StatusAccepted {
+		return outcomeHeld
+	}
+
+	var payment struct {
+		Status string `json:"status"`
+	}
+	if !truncated && json.Unmarshal(body, &payment) == nil {
+		switch payment.Status {
+		case string(ChargeRequiresAction), string(stripe.PaymentIntentStatusRequiresConfirmation):
+			return string(ChargeRequiresAction)
+		case string(ChargeNeedsNewPaymentMethod):
+			return string(ChargeNeedsNewPaymentMethod)
+		}
+	}
+	return metrics.OutcomeSucceeded
+}
+
+// outcomeRecorder keeps the status and the start of the body of a response.
+type outcomeRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (rec *outcomeRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *outcomeRecorder) Write(b []byte) (int, error) {
+	if n := maxOutcomeBody - rec.body.Len(); len(b) > n {
+		rec.body.Write(b[:n])
+		rec.truncated = true
+	} else {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,105 @@
+// Package metrics exposes the Prometheus metrics of the server: the
+// outcomes of the requests to the payment endpoints, the results of the
+// processing of the webhook events and the latency of the Stripe API.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/events"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// The outcomes which are not a payment status or an error code.
+const (
+	// OutcomeSucceeded is the outcome of the successful requests.
+	OutcomeSucceeded = "succeeded"
+	// OutcomeFailed is the result of the webhook events whose handlers
+	// failed.
+	OutcomeFailed = "failed"
+	// OutcomeUnreachable is the outcome of the Stripe requests which got
+	// no response.
+	OutcomeUnreachable = "unreachable"
+)
+
+// Metrics holds the collectors of the server in a registry of its own, so
+// several servers can run in a process.
+type Metrics struct {
+	registry       *prometheus.Registry
+	requests       *prometheus.CounterVec
+	webhookEvents  *prometheus.CounterVec
+	stripeRequests *prometheus.HistogramVec
+}
+
+// New returns Metrics with no observations, the Go runtime and process
+// collectors included.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Requests served, by endpoint and outcome: succeeded, requires_action, the code of card errors like card_declined or authentication_required, or the type of other errors.",
+		}, []string{"endpoint", "outcome"}),
+		webhookEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_events_total",
+			Help: "Webhook event deliveries processed, by event type and result: handled, ignored, duplicate, skipped or failed.",
+		}, []string{"type", "result"}),
+		stripeRequests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "stripe_request_duration_seconds",
+			Help:    "Latency of the Stripe API requests, by operation and outcome: succeeded, the type of the Stripe error, or unreachable.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+		}, []string{"operation", "outcome"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.webhookEvents,
+		m.stripeRequests,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveRequest counts a request to endpoint which ended with outcome.
+func (m *Metrics) ObserveRequest(endpoint, outcome string) {
+	m.requests.WithLabelValues(endpoint, outcome).Inc()
+}
+
+// ObserveStripe records the duration of a Stripe request, it is a
+// gateway.ObserveFunc.
+func (m *Metrics) ObserveStripe(op string, d time.Duration, err error) {
+	outcome := OutcomeSucceeded
+	var stripeErr *stripe.Error
+	switch {
+	case errors.As(err, &stripeErr):
+		outcome = string(stripeErr.Type)
+	case err != nil:
+		outcome = OutcomeUnreachable
+	}
+	m.stripeRequests.WithLabelValues(op, outcome).Observe(d.Seconds())
+}
+
+// Webhooks is an events.Middleware counting the deliveries of the webhook
+// events by type and result.
+func (m *Metrics) Webhooks(next events.DispatchFunc) events.DispatchFunc {
+	return func(ctx context.Context, event *stripe.Event) (events.Result, error) {
+		result, err := next(ctx, event)
+		outcome := result.String()
+		if err != nil {
+			outcome = OutcomeFailed
+		}
+		m.webhookEvents.WithLabelValues(string(event.Type), outcome).Inc()
+		return result, err
+	}
+}
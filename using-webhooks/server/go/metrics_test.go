@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe/stripe-go/v80"
+)
+
+func TestRequestOutcome(t *testing.T) {
+	outcomeOf := func(err error) string {
+		w := httptest.NewRecorder()
+		writeFailure(w, "op", err)
+		return requestOutcome(w.Code, w.Body.Bytes(), false)
+	}
+	require.Equal(t, "card_declined", outcomeOf(&stripe.Error{
+		Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeCardDeclined, DeclineCode: stripe.DeclineCodeInsufficientFunds,
+	}))
+	require.Equal(t, "authentication_required", outcomeOf(&stripe.Error{
+		Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeCardDeclined, DeclineCode: stripe.DeclineCodeAuthenticationRequired,
+	}))
+	require.Equal(t, errorTypeInvalidState, outcomeOf(&stripe.Error{
+		Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodePaymentIntentUnexpectedState,
+	}))
+	require.Equal(t, errorTypeAPI, outcomeOf(errors.New("boom")))
+
+	require.Equal(t, "requires_action", requestOutcome(http.StatusOK, []byte(`{"status":"requires_action"}`), false))
+	require.Equal(t, "needs_new_payment_method", requestOutcome(http.StatusOK, []byte(`{"status":"needs_new_payment_method"}`), false))
+	require.Equal(t, "succeeded", requestOutcome(http.StatusOK, []byte(`{"status":"canceled"}`), false))
+	require.Equal(t, "succeeded", requestOutcome(http.StatusOK, []byte(`[]`), false))
+	require.Equal(t, "succeeded", requestOutcome(http.StatusOK, []byte(`{"status":"requires_`), true))
+	require.Equal(t, "held", requestOutcome(http.StatusAccepted, []byte(`{}`), false))
+	require.Equal(t, errorTypeInvalidRequest, requestOutcome(http.StatusNotFound, []byte("404 page not found\n"), false))
+}
+
+func TestMetrics(t *testing.T) {
+	s, fake := newTestServer(t, withOperators(0))
+	ctx := context.Background()
+	for userID, card := range map[string]gateway.Card{"user_1": gateway.CardRequiresAuthentication, "user_2": gateway.CardDeclined} {
+		customerID, err := s.customers.lookupOrCreate(ctx, userID)
+		require.NoError(t, err)
+		pm := fake.AddPaymentMethod(customerID, card)
+		fake.SetDefaultPaymentMethod(customerID, pm.ID)
+	}
+
+	for _, userID := range []string{"user_1", "user_2"} {
+		w := adminCharge(t, s, aliceToken, "key_"+userID, `{"userID":"`+userID+`","amount":310}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	w := adminCharge(t, s, aliceToken, "key_3", `{"userID":"user_1"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	postEvent(t, s, "evt_1", stripe.EventTypePaymentIntentSucceeded, &stripe.PaymentIntent{ID: "pi_1", Status: stripe.PaymentIntentStatusSucceeded})
+
+	// only served to the operators
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = adminRequest(t, s, viewerToken, http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	require.Contains(t, body, `http_requests_total{endpoint="/admin/payments/charge",outcome="requires_action"} 1`)
+	require.Contains(t, body, `http_requests_total{endpoint="/admin/payments/charge",outcome="needs_new_payment_method"} 1`)
+	require.Contains(t, body, `http_requests_total{endpoint="/admin/payments/charge",outcome="invalid_request_error"} 1`)
+	require.Contains(t, body, `http_requests_total{endpoint="/webhook",outcome="succeeded"} 1`)
+	require.Contains(t, body, `webhook_events_total{result="handled",type="payment_intent.succeeded"} 1`)
+	require.Contains(t, body, `stripe_request_duration_seconds_count{operation="paymentintent.New",outcome="card_error"}`)
+	require.Contains(t, body, `stripe_request_duration_seconds_count{operation="paymentintent.Confirm",outcome="succeeded"}`)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// SavedPaymentMethod is a payment method saved to the customer, as shown on
+// an account settings page.
+type SavedPaymentMethod struct {
+	ID             string `json:"id"`
+	Type           string `json:"type"`
+	Brand          string `json:"brand,omitempty"`
+	Last4          string `json:"last4,omitempty"`
+	ExpMonth       int64  `json:"expMonth,omitempty"`
+	ExpYear        int64  `json:"expYear,omitempty"`
+	AllowRedisplay string `json:"allowRedisplay"`
+	Default        bool   `json:"default"`
+}
+
+// PaymentMethodList is the saved payment methods of the customer, most
+// recent first.
+type PaymentMethodList struct {
+	DefaultPaymentMethodID string               `json:"defaultPaymentMethodID,omitempty"`
+	PaymentMethods         []SavedPaymentMethod `json:"paymentMethods"`
+}
+
+// PaymentMethodRequestParams represents the structure of the requests from
+// the client acting on one of the saved payment methods.
+type PaymentMethodRequestParams struct {
+	UserID          string `json:"userID"`
+	PaymentMethodID string `json:"paymentMethodID"`
+	AllowRedisplay  string `json:"allowRedisplay"`
+}
+
+func (req *PaymentMethodRequestParams) validate(v *validator) {
+	v.requiredID("paymentMethodID", req.PaymentMethodID)
+	v.oneOf("allowRedisplay", req.AllowRedisplay, allowRedisplayValues)
+}
+
+// errPaymentMethodNotFound is returned for payment methods which are not
+// saved to the customer, so users cannot tell the payment methods of others
+// from unknown ones.
+var errPaymentMethodNotFound = errors.New("payment method not found")
+
+// allowRedisplayValues are the values of allow_redisplay accepted by the
+// Stripe API.
+// https://docs.stripe.com/payments/save-customer-payment-methods#display-existing-saved-payment-methods
+var allowRedisplayValues = map[string]bool{
+	string(stripe.PaymentMethodAllowRedisplayAlways):      true,
+	string(stripe.PaymentMethodAllowRedisplayLimited):     true,
+	string(stripe.PaymentMethodAllowRedisplayUnspecified): true,
+}
+
+// customerPaymentMethod returns the payment method if it is saved to the
+// customer, errPaymentMethodNotFound otherwise.
+func (s *Server) customerPaymentMethod(ctx context.Context, customerID, paymentMethodID string) (*stripe.PaymentMethod, error) {
+	pm, err := s.gatewayFor(ctx).GetPaymentMethod(paymentMethodID, nil)
+	if isResourceMissing(err) {
+		return nil, errPaymentMethodNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("paymentmethod.Get: %w", err)
+	}
+	if pm.Customer == nil || pm.Customer.ID != customerID {
+		return nil, errPaymentMethodNotFound
+	}
+	return pm, nil
+}
+
+// defaultPaymentMethodID returns the ID of the default payment method of
+// the customer, set in invoice_settings.default_payment_method, or an empty
+// string.
+func (s *Server) defaultPaymentMethodID(ctx context.Context, customerID string) (string, error) {
+	c, err := s.gatewayFor(ctx).GetCustomer(customerID, nil)
+	if err != nil {
+		return "", fmt.Errorf("customer.Get: %w", err)
+	}
+	if c.InvoiceSettings == nil || c.InvoiceSettings.DefaultPaymentMethod == nil {
+		return "", nil
+	}
+	return c.InvoiceSettings.DefaultPaymentMethod.ID, nil
+}
+
+// handleListPaymentMethods lists the payment methods saved to the user and
+// tells which one is the default.
+func (s *Server) handleListPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	customerID, ok := s.requestCustomer(w, r, r.URL.Query().Get("userID"))
+	if !ok {
+		return
+	}
+
+	pms, err := s.gatewayFor(r.Context()).ListPaymentMethods(&stripe.CustomerListPaymentMethodsParams{Customer: stripe.String(customerID)})
+	if err != nil {
+		writeFailure(w, "customer.ListPaymentMethods", err)
+		return
+	}
+	defaultID, err := s.defaultPaymentMethodID(r.Context(), customerID)
+	if err != nil {
+		writeFailure(w, "defaultPaymentMethodID", err)
+		return
+	}
+
+	list := PaymentMethodList{
+		DefaultPaymentMethodID: defaultID,
+		PaymentMethods:         make([]SavedPaymentMethod, 0, len(pms)),
+	}
+	for _, pm := range pms {
+		s.recordPaymentMethod(r.Context(), pm)
+		list.PaymentMethods = append(list.PaymentMethods, newSavedPaymentMethod(pm, defaultID))
+	}
+	writeJSON(w, list)
+}
+
+// handleDetachPaymentMethod detaches one of the payment methods saved to
+// the user, it cannot be used for payments anymore. The default payment
+// method is reassigned when it is detached, as done by the
+// payment_method.detached webhook handler.
+func (s *Server) handleDetachPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	req, customerID, ok := s.decodePaymentMethodRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.customerPaymentMethod(r.Context(), customerID, req.PaymentMethodID); err != nil {
+		writePaymentMethodError(w, err)
+		return
+	}
+
+	pm, err := s.gatewayFor(r.Context()).DetachPaymentMethod(req.PaymentMethodID, nil)
+	if err != nil {
+		writeFailure(w, "paymentmethod.Detach", err)
+		return
+	}
+	if err := s.store.DeletePaymentMethod(r.Context(), pm.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		slog.ErrorContext(r.Context(), "store.DeletePaymentMethod failed", "payment_method_id", pm.ID, logging.Err(err))
+	}
+	if err := s.reassignDefaultPaymentMethod(r.Context(), customerID, pm.ID); err != nil {
+		slog.ErrorContext(r.Context(), "reassignDefaultPaymentMethod failed", logging.CustomerID(customerID), logging.Err(err))
+	}
+
+	writeJSON(w, struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}{
+		ID:     pm.ID,
+		Status: "detached",
+	})
+}
+
+// handleUpdatePaymentMethod sets allow_redisplay on one of the payment
+// methods saved to the user, so it is offered again in checkout, or not.
+func (s *Server) handleUpdatePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	req, customerID, ok := s.decodePaymentMethodRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.AllowRedisplay == "" {
+		writeFieldErrors(w, []FieldError{{Field: "allowRedisplay", Message: "is required"}})
+		return
+	}
+	if _, err := s.customerPaymentMethod(r.Context(), customerID, req.PaymentMethodID); err != nil {
+		writePaymentMethodError(w, err)
+		return
+	}
+
+	pm, err := s.gatewayFor(r.Context()).UpdatePaymentMethod(req.PaymentMethodID, &stripe.PaymentMethodParams{
+		AllowRedisplay: stripe.String(req.AllowRedisplay),
+	})
+	if err != nil {
+		writeFailure(w, "paymentmethod.Update", err)
+		return
+	}
+	s.recordPaymentMethod(r.Context(), pm)
+
+	defaultID, err := s.defaultPaymentMethodID(r.Context(), customerID)
+	if err != nil {
+		// only the default flag of the response is affected
+		slog.ErrorContext(r.Context(), "defaultPaymentMethodID failed", logging.CustomerID(customerID), logging.Err(err))
+	}
+	writeJSON(w, newSavedPaymentMethod(pm, defaultID))
+}
+
+// decodePaymentMethodRequest decodes the request and resolves the customer
+// of the user. The error response is written when it fails.
+func (s *Server) decodePaymentMethodRequest(w http.ResponseWriter, r *http.Request) (PaymentMethodRequestParams, string, bool) {
+	req := PaymentMethodRequestParams{}
+	if !decodeRequest(w, r, &req) {
+		return req, "", false
+	}
+	customerID, ok := s.requestCustomer(w, r, req.UserID)
+	return req, customerID, ok
+}
+
+// isResourceMissing reports whether err is the Stripe error for unknown IDs.
+func isResourceMissing(err error) bool {
+	var stripeErr *stripe.Error
+	return errors.As(err, &stripeErr) &&
+		(stripeErr.Code == stripe.ErrorCodeResourceMissing || stripeErr.HTTPStatusCode == http.StatusNotFound)
+}
+
+func writePaymentMethodError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPaymentMethodNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeFailure(w, "customerPaymentMethod", err)
+}
+
+func newSavedPaymentMethod(pm *stripe.PaymentMethod, defaultID string) SavedPaymentMethod {
+	rec := store.PaymentMethodFromStripe(pm)
+	return SavedPaymentMethod{
+		ID:             rec.ID,
+		Type:           rec.Type,
+		Brand:          rec.Brand,
+		Last4:          rec.Last4,
+		ExpMonth:       rec.ExpMonth,
+		ExpYear:        rec.ExpYear,
+		AllowRedisplay: rec.AllowRedisplay,
+		Default:        rec.ID == defaultID,
+	}
+}
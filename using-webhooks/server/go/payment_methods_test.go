@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// customerOf returns the Stripe Customer of the user.
+func customerOf(t *testing.T, s *Server, userID string) string {
+	customerID, err := s.customers.lookupOrCreate(context.Background(), userID)
+	require.NoError(t, err)
+	return customerID
+}
+
+func listPaymentMethods(t *testing.T, s *Server, userID string) PaymentMethodList {
+	r := httptest.NewRequest(http.MethodGet, "/payment-methods", nil)
+	w := httptest.NewRecorder()
+	s.handleListPaymentMethods(w, asCaller(r, userID))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list PaymentMethodList
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	return list
+}
+
+func TestPaymentMethods(t *testing.T) {
+	s, fake := newTestServer(t)
+	customerID := customerOf(t, s, "user_1")
+	first := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+	second := fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+	fake.SetDefaultPaymentMethod(customerID, first.ID)
+	other := fake.AddPaymentMethod(customerOf(t, s, "user_2"), gateway.CardSucceeds)
+
+	list := listPaymentMethods(t, s, "user_1")
+	require.Equal(t, first.ID, list.DefaultPaymentMethodID)
+	require.Equal(t, []SavedPaymentMethod{
+		{ID: second.ID, Type: "card", Brand: "visa", Last4: second.Card.Last4, ExpMonth: 12, ExpYear: 2034, AllowRedisplay: "always"},
+		{ID: first.ID, Type: "card", Brand: "visa", Last4: first.Card.Last4, ExpMonth: 12, ExpYear: 2034, AllowRedisplay: "always", Default: true},
+	}, list.PaymentMethods)
+
+	t.Run("toggles allow_redisplay", func(t *testing.T) {
+		w := postJSON(t, s.handleUpdatePaymentMethod, "user_1", `{"paymentMethodID": "`+second.ID+`", "allowRedisplay": "limited"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var pm SavedPaymentMethod
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pm))
+		require.Equal(t, "limited", pm.AllowRedisplay)
+
+		got, err := fake.GetPaymentMethod(second.ID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentMethodAllowRedisplayLimited, got.AllowRedisplay)
+
+		w = postJSON(t, s.handleUpdatePaymentMethod, "user_1", `{"paymentMethodID": "`+second.ID+`", "allowRedisplay": "never"}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("detaches", func(t *testing.T) {
+		w := postJSON(t, s.handleDetachPaymentMethod, "user_1", `{"paymentMethodID": "`+second.ID+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		list := listPaymentMethods(t, s, "user_1")
+		require.Len(t, list.PaymentMethods, 1)
+		require.Equal(t, first.ID, list.PaymentMethods[0].ID)
+
+		w = postJSON(t, s.handleDetachPaymentMethod, "user_1", `{"paymentMethodID": "`+second.ID+`"}`)
+		require.Equal(t, http.StatusNotFound, w.Code, "already detached")
+	})
+
+	t.Run("only acts on the payment methods of the user", func(t *testing.T) {
+		for _, body := range []string{
+			`{"paymentMethodID": "` + other.ID + `"}`,
+			`{"paymentMethodID": "pm_unknown"}`,
+		} {
+			w := postJSON(t, s.handleDetachPaymentMethod, "user_1", body)
+			require.Equal(t, http.StatusNotFound, w.Code, body)
+		}
+		w := postJSON(t, s.handleUpdatePaymentMethod, "user_1", `{"paymentMethodID": "`+other.ID+`", "allowRedisplay": "limited"}`)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		got, err := fake.GetPaymentMethod(other.ID, nil)
+		require.NoError(t, err)
+		require.NotNil(t, got.Customer)
+		require.Equal(t, stripe.PaymentMethodAllowRedisplayAlways, got.AllowRedisplay)
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/audit"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// RefundRequestParams represents the structure of the request from the
+// client. Amount defaults to everything not refunded yet.
+type RefundRequestParams struct {
+	PaymentIntentID string            `json:"paymentIntentID"`
+	Amount          *int64            `json:"amount"`
+	Reason          string            `json:"reason"`
+	Metadata        map[string]string `json:"metadata"`
+}
+
+func (req *RefundRequestParams) validate(v *validator) {
+	v.requiredID("paymentIntentID", req.PaymentIntentID)
+	v.positive("amount", req.Amount)
+	v.oneOf("reason", req.Reason, refundReasons)
+	v.metadata("metadata", req.Metadata)
+}
+
+// RefundRecord is a refund of a payment intent.
+type RefundRecord struct {
+	ID       string `json:"id"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+	Created  int64  `json:"created"`
+}
+
+// RefundList is the refunds of a payment intent with the amount they
+// returned so far.
+type RefundList struct {
+	PaymentIntentID string         `json:"paymentIntentID"`
+	Currency        string         `json:"currency"`
+	AmountReceived  int64          `json:"amountReceived"`
+	AmountRefunded  int64          `json:"amountRefunded"`
+	Refunds         []RefundRecord `json:"refunds"`
+}
+
+// refundReasons are the reasons accepted by the Stripe API.
+var refundReasons = map[string]bool{
+	string(stripe.RefundReasonDuplicate):           true,
+	string(stripe.RefundReasonFraudulent):          true,
+	string(stripe.RefundReasonRequestedByCustomer): true,
+}
+
+// errNotRefundable is returned when a payment intent has nothing left to
+// refund.
+var errNotRefundable = errors.New("payment intent cannot be refunded")
+
+// validateRefund returns the amount to refund from pi, of which refunded
+// was already refunded.
+func validateRefund(pi *stripe.PaymentIntent, refunded int64, req RefundRequestParams) (int64, error) {
+	if pi.AmountReceived == 0 {
+		return 0, fmt.Errorf("%w: nothing was captured, its status is %s", errNotRefundable, pi.Status)
+	}
+	remaining := pi.AmountReceived - refunded
+	if remaining <= 0 {
+		return 0, fmt.Errorf("%w: it is fully refunded", errNotRefundable)
+	}
+	if req.Amount == nil {
+		return remaining, nil
+	}
+	if *req.Amount > remaining {
+		return 0, fmt.Errorf("amount must be at most the amount not refunded yet %d", remaining)
+	}
+	return *req.Amount, nil
+}
+
+// handleRefund refunds all or part of the amount received by a payment
+// intent.
+// https://docs.stripe.com/refunds
+func (s *Server) handleRefund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	// Decode the incoming request
+	req := RefundRequestParams{}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	pi, ok := s.requestPaymentIntent(w, r, req.PaymentIntentID)
+	if !ok {
+		return
+	}
+	var refunded int64
+	rec, err := s.store.PaymentIntent(r.Context(), pi.ID)
+	switch {
+	case err == nil:
+		refunded = rec.AmountRefunded
+	case !errors.Is(err, store.ErrNotFound):
+		writeFailure(w, "store.PaymentIntent", err)
+		return
+	}
+	amount, err := validateRefund(pi, refunded, req)
+	if errors.Is(err, errNotRefundable) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the approved request refunds the amount approved
+	req.Amount = &amount
+	if s.holdForApproval(w, r, ActionRefund, req, pi.ID, amount, string(pi.Currency)) {
+		return
+	}
+
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(pi.ID),
+		Amount:        stripe.Int64(amount),
+		Metadata:      req.Metadata,
+	}
+	if req.Reason != "" {
+		params.Reason = stripe.String(req.Reason)
+	}
+	// without an Idempotency-Key, two requests reading the same refunded
+	// amount refund once
+	params.SetIdempotencyKey(fmt.Sprintf("refund-%s-%d-%d", pi.ID, refunded, amount))
+	setRequestIdempotencyKey(r.Context(), &params.Params, "refund")
+	refund, err := s.gatewayFor(r.Context()).NewRefund(params)
+	e := audit.Entry{
+		Action:          string(ActionRefund),
+		PaymentIntentID: pi.ID,
+		Amount:          amount,
+		Currency:        string(pi.Currency),
+	}
+	var resp *stripe.APIResponse
+	if refund != nil {
+		resp = refund.LastResponse
+	}
+	e.SetResult(resp, err)
+	s.auditAction(r.Context(), e)
+	if err != nil {
+		writeFailure(w, "refund.New", err)
+		return
+	}
+	if rec.ID == "" {
+		// the refunded amount is computed from the payment intent record
+		s.recordPaymentIntent(r.Context(), pi)
+	}
+	if err := s.store.SaveRefund(r.Context(), store.RefundFromStripe(refund)); err != nil {
+		slog.ErrorContext(r.Context(), "store.SaveRefund failed", logging.PaymentIntentID(pi.ID), "refund_id", refund.ID, logging.Err(err))
+	}
+
+	writeJSON(w, struct {
+		Refund         RefundRecord `json:"refund"`
+		AmountRefunded int64        `json:"amountRefunded"`
+	}{
+		Refund:         newRefundRecord(store.RefundFromStripe(refund)),
+		AmountRefunded: refunded + refund.Amount,
+	})
+}
+
+// handleListRefunds lists the recorded refunds of a payment intent.
+func (s *Server) handleListRefunds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	id := r.URL.Query().Get("paymentIntentID")
+	v := &validator{}
+	v.requiredID("paymentIntentID", id)
+	if len(v.errs) > 0 {
+		writeFieldErrors(w, v.errs)
+		return
+	}
+
+	pi, err := s.store.PaymentIntent(r.Context(), id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		writeFailure(w, "store.PaymentIntent", err)
+		return
+	}
+	// unknown payment intents have no customer and are answered alike
+	owned, err := s.ownsCustomer(r.Context(), pi.CustomerID)
+	if err != nil {
+		writeFailure(w, "ownsCustomer", err)
+		return
+	}
+	if !owned {
+		writeUnknownPaymentIntent(w)
+		return
+	}
+	refunds, err := s.store.Refunds(r.Context(), id)
+	if err != nil {
+		writeFailure(w, "store.Refunds", err)
+		return
+	}
+
+	list := RefundList{
+		PaymentIntentID: pi.ID,
+		Currency:        pi.Currency,
+		AmountReceived:  pi.AmountReceived,
+		AmountRefunded:  pi.AmountRefunded,
+		Refunds:         make([]RefundRecord, 0, len(refunds)),
+	}
+	for _, refund := range refunds {
+		list.Refunds = append(list.Refunds, newRefundRecord(refund))
+	}
+	writeJSON(w, list)
+}
+
+func newRefundRecord(r store.Refund) RefundRecord {
+	return RefundRecord{
+		ID:       r.ID,
+		Amount:   r.Amount,
+		Currency: r.Currency,
+		Status:   r.Status,
+		Reason:   r.Reason,
+		Created:  r.Created,
+	}
+}
+
+// onRefund records the refund carried by a refund.* event, unless the
+// store already holds a later status: the out-of-order event is then
+// handled without being recorded.
+func (s *Server) onRefund(ctx context.Context, event *stripe.Event, refund *stripe.Refund) error {
+	prev, err := s.store.Refund(ctx, refund.ID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("store.Refund: %w", err)
+	case refundStatusRank(string(refund.Status)) < refundStatusRank(prev.Status):
+		slog.InfoContext(ctx, "not recording an out-of-order refund", "refund_id", refund.ID, "recorded_status", prev.Status)
+		return nil
+	}
+	if err := s.store.SaveRefund(ctx, store.RefundFromStripe(refund)); err != nil {
+		return fmt.Errorf("store.SaveRefund: %w", err)
+	}
+	return nil
+}
+
+// refundStatusRank orders the refund statuses: a pending refund succeeds,
+// and a succeeded refund may still fail.
+func refundStatusRank(status string) int {
+	switch status {
+	case string(stripe.RefundStatusSucceeded):
+		return 1
+	case string(stripe.RefundStatusFailed), string(stripe.RefundStatusCanceled):
+		return 2
+	}
+	return 0
+}
+
+// onChargeRefunded records the refunds of the refunded charge. They are
+// listed from the API as the charge does not always include them.
+func (s *Server) onChargeRefunded(ctx context.Context, _ *stripe.Event, ch *stripe.Charge) error {
+	slog.InfoContext(ctx, "💸 charge refunded", "charge_id", ch.ID, "amount_refunded", ch.AmountRefunded, "amount", ch.Amount)
+	if ch.PaymentIntent == nil {
+		return nil
+	}
+	refunds, err := s.gatewayFor(ctx).ListRefunds(&stripe.RefundListParams{PaymentIntent: stripe.String(ch.PaymentIntent.ID)})
+	if err != nil {
+		return fmt.Errorf("refund.List: %w", err)
+	}
+	for _, refund := range refunds {
+		if err := s.store.SaveRefund(ctx, store.RefundFromStripe(refund)); err != nil {
+			return fmt.Errorf("store.SaveRefund: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/events"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// capturedOrder places an order of 1400 and captures it.
+func capturedOrder(t *testing.T, s *Server, fake *gateway.Fake) *stripe.PaymentIntent {
+	pi := authorizedOrder(t, s, fake)
+	_, code := capture(t, s, `{"paymentIntentID": "`+pi.ID+`"}`)
+	require.Equal(t, http.StatusOK, code)
+	return pi
+}
+
+func refund(t *testing.T, s *Server, body string) *httptest.ResponseRecorder {
+	return postJSON(t, s.handleRefund, "", body)
+}
+
+func listRefunds(t *testing.T, s *Server, id string) RefundList {
+	r := httptest.NewRequest(http.MethodGet, "/refunds?paymentIntentID="+id, nil)
+	w := httptest.NewRecorder()
+	s.handleListRefunds(w, asCaller(r, ""))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list RefundList
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	return list
+}
+
+func TestRefund(t *testing.T) {
+	t.Run("refunds everything when the amount is omitted", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		pi := capturedOrder(t, s, fake)
+
+		w := refund(t, s, `{"paymentIntentID": "`+pi.ID+`", "reason": "requested_by_customer", "metadata": {"ticket": "42"}}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Refund         RefundRecord `json:"refund"`
+			AmountRefunded int64        `json:"amountRefunded"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, int64(1400), resp.Refund.Amount)
+		require.Equal(t, "requested_by_customer", resp.Refund.Reason)
+		require.Equal(t, int64(1400), resp.AmountRefunded)
+
+		refunds, err := fake.ListRefunds(&stripe.RefundListParams{PaymentIntent: stripe.String(pi.ID)})
+		require.NoError(t, err)
+		require.Len(t, refunds, 1)
+		require.Equal(t, map[string]string{"ticket": "42"}, refunds[0].Metadata)
+
+		w = refund(t, s, `{"paymentIntentID": "`+pi.ID+`"}`)
+		require.Equal(t, http.StatusConflict, w.Code, "a refunded payment cannot be refunded again")
+	})
+
+	t.Run("refunds partially", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		pi := capturedOrder(t, s, fake)
+
+		for _, amount := range []string{"400", "600"} {
+			w := refund(t, s, `{"paymentIntentID": "`+pi.ID+`", "amount": `+amount+`}`)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+		w := refund(t, s, `{"paymentIntentID": "`+pi.ID+`", "amount": 401}`)
+		require.Equal(t, http.StatusBadRequest, w.Code, "only 400 is left to refund")
+
+		list := listRefunds(t, s, pi.ID)
+		require.Equal(t, int64(1400), list.AmountReceived)
+		require.Equal(t, int64(1000), list.AmountRefunded)
+		require.Len(t, list.Refunds, 2)
+		require.Equal(t, int64(400), list.Refunds[0].Amount)
+		require.Equal(t, int64(600), list.Refunds[1].Amount)
+	})
+
+	t.Run("rejects bad requests", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		captured := capturedOrder(t, s, fake)
+		authorized := authorizedOrder(t, s, fake)
+
+		for body, want := range map[string]int{
+			`not json`:        http.StatusBadRequest,
+			`{"amount": 100}`: http.StatusBadRequest,
+			`{"paymentIntentID": "` + captured.ID + `", "amount": 0}`:         http.StatusBadRequest,
+			`{"paymentIntentID": "` + captured.ID + `", "reason": "changed"}`: http.StatusBadRequest,
+			`{"paymentIntentID": "` + authorized.ID + `", "amount": 100}`:     http.StatusConflict,
+		} {
+			w := refund(t, s, body)
+			require.Equal(t, want, w.Code, body)
+		}
+	})
+
+	t.Run("webhooks keep the refunded amount", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		pi := capturedOrder(t, s, fake)
+
+		// refunded from the Dashboard
+		re, err := fake.NewRefund(&stripe.RefundParams{PaymentIntent: stripe.String(pi.ID), Amount: stripe.Int64(500)})
+		require.NoError(t, err)
+		postEvent(t, s, "evt_1", stripe.EventTypeChargeRefunded, map[string]interface{}{
+			"id": "ch_1", "object": "charge", "amount": 1400, "amount_refunded": 500, "payment_intent": pi.ID,
+		})
+		require.Equal(t, int64(500), listRefunds(t, s, pi.ID).AmountRefunded)
+
+		re.Status = stripe.RefundStatusFailed
+		postEvent(t, s, "evt_2", stripe.EventTypeRefundUpdated, re)
+		list := listRefunds(t, s, pi.ID)
+		require.Zero(t, list.AmountRefunded)
+		require.Equal(t, "failed", list.Refunds[0].Status)
+
+		// a late pending update does not revive the refund
+		re.Status = stripe.RefundStatusPending
+		postEvent(t, s, "evt_3", stripe.EventTypeRefundUpdated, re)
+		require.Equal(t, events.Handled.String(), inboxEvent(t, s, "evt_3").Result)
+		require.Zero(t, listRefunds(t, s, pi.ID).AmountRefunded)
+	})
+}
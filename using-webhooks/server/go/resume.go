@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/holds"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// replacesMetadataKey is the payment intent metadata key holding the ID of
+// the payment intent it replaces. The replaced intent is canceled by the
+// payment_intent.created webhook handler.
+const replacesMetadataKey = "replaces_payment_intent"
+
+// resumeLookback is how many of the most recent payment intents of the
+// customer are considered when resuming a checkout.
+const resumeLookback = 10
+
+// isResumable reports whether the customer can still finish the payment
+// intent: pay with a payment method, authenticate or confirm. Verification
+// holds only check the card and are never resumed as a payment.
+func isResumable(pi *stripe.PaymentIntent) bool {
+	if pi.Metadata[holds.PurposeMetadataKey] == store.HoldVerification {
+		return false
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod,
+		stripe.PaymentIntentStatusRequiresAction,
+		stripe.PaymentIntentStatusRequiresConfirmation:
+		return true
+	}
+	return false
+}
+
+// needsReplacement reports whether the resumable payment intent has to be
+// replaced by a fresh one instead of being reused. Intents waiting for
+// authentication or confirmation are always reused. Intents waiting for a
+// payment method are reused when they were set up like the fresh payment,
+// holds placed with manual capture are replaced.
+func needsReplacement(pi *stripe.PaymentIntent) bool {
+	if pi.Status != stripe.PaymentIntentStatusRequiresPaymentMethod {
+		return false
+	}
+	return pi.CaptureMethod != stripe.PaymentIntentCaptureMethodAutomatic ||
+		pi.SetupFutureUsage != stripe.PaymentIntentSetupFutureUsageOffSession
+}
+
+// resumablePaymentIntent returns the most recent payment intent of the
+// customer which can be resumed, or nil if there is none.
+func (s *Server) resumablePaymentIntent(ctx context.Context, customerID string) (*stripe.PaymentIntent, error) {
+	params := &stripe.PaymentIntentListParams{Customer: stripe.String(customerID)}
+	params.Limit = stripe.Int64(resumeLookback)
+	pis, err := s.gatewayFor(ctx).ListPaymentIntents(params)
+	if err != nil {
+		return nil, fmt.Errorf("paymentintent.List: %w", err)
+	}
+	for _, pi := range pis {
+		if isResumable(pi) {
+			return pi, nil
+		}
+	}
+	return nil, nil
+}
+
+// replacePaymentIntent creates the fresh payment intent replacing pi. The
+// idempotency key makes a retried request return the same replacement, the
+// replaced intent is canceled once the creation of the replacement is
+// reported by webhook, see onPaymentIntentCreated.
+func (s *Server) replacePaymentIntent(ctx context.Context, pi *stripe.PaymentIntent) (*stripe.PaymentIntent, error) {
+	params := copyIntentForFreshPayment(pi)
+	params.SetIdempotencyKey("replace-" + pi.ID)
+	replacement, err := s.gatewayFor(ctx).NewPaymentIntent(params)
+	if err != nil {
+		return nil, fmt.Errorf("paymentintent.New: %w", err)
+	}
+	return replacement, nil
+}
+
+// ResolvePayRequestParams represents the structure of the request from the
+// client.
+type ResolvePayRequestParams struct {
+	UserID string `json:"userID"`
+}
+
+func (req *ResolvePayRequestParams) validate(v *validator) {}
+
+// handleResolveLastPaymentIntent resumes the checkout of the user: the most
+// recent payment intent still waiting for the customer is returned so the
+// client can finish it, replaced by a fresh payment intent when it cannot
+// be reused.
+func (s *Server) handleResolveLastPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	// Decode the incoming request
+	req := ResolvePayRequestParams{}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	customerID, ok := s.requestCustomer(w, r, req.UserID)
+	if !ok {
+		return
+	}
+
+	pi, err := s.resumablePaymentIntent(r.Context(), customerID)
+	if err != nil {
+		writeFailure(w, "resumablePaymentIntent", err)
+		return
+	}
+	if pi == nil {
+		writeError(w, http.StatusNotFound, "no payment to resume")
+		return
+	}
+	s.recordPaymentIntent(r.Context(), pi)
+
+	replaces := ""
+	if needsReplacement(pi) {
+		replaces = pi.ID
+		pi, err = s.replacePaymentIntent(r.Context(), pi)
+		if err != nil {
+			writeFailure(w, "replacePaymentIntent", err)
+			return
+		}
+		s.recordPaymentIntent(r.Context(), pi)
+	}
+
+	writeJSON(w, struct {
+		Amount       int64  `json:"amount"`
+		PublicKey    string `json:"publicKey"`
+		ClientSecret string `json:"clientSecret"`
+		ID           string `json:"id"`
+		Status       string `json:"status"`
+		Replaces     string `json:"replaces,omitempty"`
+	}{
+		Amount:       pi.Amount,
+		PublicKey:    s.cfg.PublishableKey,
+		ClientSecret: pi.ClientSecret,
+		ID:           pi.ID,
+		Status:       string(pi.Status),
+		Replaces:     replaces,
+	})
+}
+
+// onPaymentIntentCreated cancels the payment intent replaced by the created
+// one. Failures are retried by the inbox, canceling twice is harmless.
+func (s *Server) onPaymentIntentCreated(ctx context.Context, _ *stripe.Event, pi *stripe.PaymentIntent) error {
+	replacedID := pi.Metadata[replacesMetadataKey]
+	if replacedID == "" {
+		return nil
+	}
+	replaced, err := s.gatewayFor(ctx).GetPaymentIntent(replacedID, nil)
+	if err != nil {
+		return fmt.Errorf("paymentintent.Get: %w", err)
+	}
+	if !isResumable(replaced) {
+		// canceled already, or paid before the replacement was used
+		slog.InfoContext(ctx, "replaced payment intent not canceled", logging.PaymentIntentID(replaced.ID),
+			"replacement_id", pi.ID, "status", replaced.Status)
+		return nil
+	}
+	params := &stripe.PaymentIntentCancelParams{
+		CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonDuplicate)),
+	}
+	params.SetIdempotencyKey(gateway.CancelIdempotencyKey(replaced.ID, *params.CancellationReason))
+	canceled, err := s.gatewayFor(ctx).CancelPaymentIntent(replaced.ID, params)
+	if err != nil {
+		return fmt.Errorf("paymentintent.Cancel: %w", err)
+	}
+	s.recordPaymentIntent(ctx, canceled)
+	return s.holds.Settled(ctx, canceled)
+}
+
+// copyIntentForFreshPayment returns the parameters of a payment intent
+// charging the same amount as pi, captured automatically and saving the
+// payment method for later. Its metadata only links it to pi: the metadata
+// of pi describes pi itself, such as its hold purpose or the trace of its
+// creation.
+func copyIntentForFreshPayment(pi *stripe.PaymentIntent) *stripe.PaymentIntentParams {
+	receiptEmail := pi.ReceiptEmail
+	var receiptEmailRef *string
+	if receiptEmail != "" {
+		receiptEmailRef = &receiptEmail
+	}
+	var applicationFeeAmount *int64
+	if pi.ApplicationFeeAmount > 0 {
+		applicationFeeAmount = stripe.Int64(pi.ApplicationFeeAmount)
+	}
+	return &stripe.PaymentIntentParams{
+		Amount:               stripe.Int64(pi.Amount),
+		ApplicationFeeAmount: applicationFeeAmount,
+		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			AllowRedirects: stripe.String(string(stripe.PaymentIntentAutomaticPaymentMethodsAllowRedirectsNever)),
+			Enabled:        stripe.Bool(true),
+		},
+		CaptureMethod:             stripe.String(string(stripe.PaymentIntentCaptureMethodAutomatic)),
+		Currency:                  stripe.String(string(pi.Currency)),
+		Customer:                  stripe.String(pi.Customer.ID),
+		Description:               stripe.String(pi.Description),
+		Metadata:                  map[string]string{replacesMetadataKey: pi.ID},
+		ReceiptEmail:              receiptEmailRef,
+		SetupFutureUsage:          stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
+		StatementDescriptor:       stripe.String(pi.StatementDescriptor),
+		StatementDescriptorSuffix: stripe.String(pi.StatementDescriptorSuffix),
+		ErrorOnRequiresAction:     stripe.Bool(false),
+	}
+}
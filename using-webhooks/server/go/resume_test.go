@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/holds"
+	"github.com/stripe/stripe-go/v80"
+)
+
+type resumeResponse struct {
+	ID           string `json:"id"`
+	ClientSecret string `json:"clientSecret"`
+	Amount       int64  `json:"amount"`
+	Status       string `json:"status"`
+	Replaces     string `json:"replaces"`
+}
+
+func resume(t *testing.T, s *Server, userID string) (resumeResponse, int) {
+	w := postJSON(t, s.handleResolveLastPaymentIntent, userID, `{}`)
+	if w.Code != http.StatusOK {
+		return resumeResponse{}, w.Code
+	}
+	var resp resumeResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp, w.Code
+}
+
+// freshPayment creates an automatic payment intent saving the payment
+// method, as created by copyIntentForFreshPayment.
+func freshPayment(t *testing.T, fake *gateway.Fake, customerID string) *stripe.PaymentIntent {
+	pi, err := fake.NewPaymentIntent(&stripe.PaymentIntentParams{
+		Amount:           stripe.Int64(310),
+		Currency:         stripe.String("usd"),
+		Customer:         stripe.String(customerID),
+		SetupFutureUsage: stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
+	})
+	require.NoError(t, err)
+	return pi
+}
+
+func TestResume(t *testing.T) {
+	t.Run("nothing to resume", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		customerID := customerOf(t, s, "user_1")
+		pi := freshPayment(t, fake, customerID)
+		_, err := fake.CancelPaymentIntent(pi.ID, nil)
+		require.NoError(t, err)
+
+		_, code := resume(t, s, "user_1")
+		require.Equal(t, http.StatusNotFound, code)
+		_, code = resume(t, s, "")
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("reuses the most recent resumable intent", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		customerID := customerOf(t, s, "user_1")
+		pending := freshPayment(t, fake, customerID)
+		authenticating := freshPayment(t, fake, customerID)
+		pm := fake.AddPaymentMethod(customerID, gateway.CardRequiresAuthentication)
+		_, err := fake.ConfirmPaymentIntent(authenticating.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: stripe.String(pm.ID)})
+		require.NoError(t, err)
+		paid := freshPayment(t, fake, customerID)
+		pm = fake.AddPaymentMethod(customerID, gateway.CardSucceeds)
+		_, err = fake.ConfirmPaymentIntent(paid.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: stripe.String(pm.ID)})
+		require.NoError(t, err)
+
+		resp, code := resume(t, s, "user_1")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, authenticating.ID, resp.ID)
+		require.Equal(t, "requires_action", resp.Status)
+		require.Empty(t, resp.Replaces)
+
+		_, err = fake.CancelPaymentIntent(authenticating.ID, nil)
+		require.NoError(t, err)
+		resp, _ = resume(t, s, "user_1")
+		require.Equal(t, pending.ID, resp.ID)
+		require.Equal(t, pending.ClientSecret, resp.ClientSecret)
+		require.Empty(t, resp.Replaces)
+	})
+
+	t.Run("replaces holds and cancels them by webhook", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		w := postJSON(t, s.handleCreatePaymentIntent, "user_1", `{"currency": "usd", "items": [{"id": "photo-subscription"}]}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var hold intentResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &hold))
+
+		resp, code := resume(t, s, "user_1")
+		require.Equal(t, http.StatusOK, code)
+		require.NotEqual(t, hold.ID, resp.ID)
+		require.Equal(t, hold.ID, resp.Replaces)
+		require.Equal(t, int64(1400), resp.Amount)
+
+		replacement, err := fake.GetPaymentIntent(resp.ID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentCaptureMethodAutomatic, replacement.CaptureMethod)
+		require.Equal(t, hold.ID, replacement.Metadata[replacesMetadataKey])
+		require.NotContains(t, replacement.Metadata, holds.PurposeMetadataKey)
+
+		// a retried request gets the same replacement
+		again, _ := resume(t, s, "user_1")
+		require.Equal(t, resp.ID, again.ID)
+
+		// the hold is canceled once the replacement is reported
+		old, err := fake.GetPaymentIntent(hold.ID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusRequiresPaymentMethod, old.Status)
+		postEvent(t, s, "evt_1", stripe.EventTypePaymentIntentCreated, replacement)
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_1").Result)
+		old, err = fake.GetPaymentIntent(hold.ID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusCanceled, old.Status)
+		require.Equal(t, stripe.PaymentIntentCancellationReasonDuplicate, old.CancellationReason)
+
+		// redelivered by Stripe with another event ID
+		postEvent(t, s, "evt_2", stripe.EventTypePaymentIntentCreated, replacement)
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_2").Result)
+	})
+
+	t.Run("never resumes verification holds", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		w := postJSON(t, s.handleCreatePaymentIntent, "user_1", `{"currency": "usd"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var hold intentResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &hold))
+
+		_, code := resume(t, s, "user_1")
+		require.Equal(t, http.StatusNotFound, code)
+		pis, err := fake.ListPaymentIntents(&stripe.PaymentIntentListParams{Customer: stripe.String(customerOf(t, s, "user_1"))})
+		require.NoError(t, err)
+		require.Len(t, pis, 1)
+		require.Equal(t, hold.ID, pis[0].ID)
+	})
+}
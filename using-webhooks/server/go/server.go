@@ -2,46 +2,426 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-
-	"github.com/joho/godotenv"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/audit"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/catalog"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/config"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/events"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/holds"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/metrics"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/tracing"
 	"github.com/stripe/stripe-go/v80"
-	"github.com/stripe/stripe-go/v80/paymentintent"
-	"github.com/stripe/stripe-go/v80/setupintent"
-	"github.com/stripe/stripe-go/v80/webhook"
+	_ "modernc.org/sqlite"
 )
 
+// Config configures a Server. Zero values are replaced by the defaults
+// documented on each field.
+type Config struct {
+	// Addr is the address ListenAndServe listens on, localhost:4242 by default.
+	Addr string
+	// StaticDir is the directory of the client served at the root. Nothing
+	// is served there when empty.
+	StaticDir string
+
+	// SecretKey authenticates the default Stripe gateway.
+	SecretKey string
+	// PublishableKey is handed to the client to initialize Stripe.js.
+	PublishableKey string
+	// WebhookSecret verifies the signature of webhook events.
+	WebhookSecret string
+
+	// DefaultCurrency is used when the client does not send a currency,
+	// usd by default.
+	DefaultCurrency string
+	// StatementDescriptor is shown on the customer's statement, firebolt by
+	// default.
+	StatementDescriptor string
+	// HoldStatementDescriptorSuffix is appended to the statement descriptor
+	// of authorization holds, pre-auth by default.
+	HoldStatementDescriptorSuffix string
+	// ChargeStatementDescriptorSuffix is appended to the statement
+	// descriptor of off-session charges, invoice due by default.
+	ChargeStatementDescriptorSuffix string
+
+	// Gateway calls Stripe, a gateway.Stripe using SecretKey by default.
+	Gateway gateway.PaymentGateway
+	// Store records the Stripe objects seen by the server, an in-memory
+	// store by default.
+	Store store.Store
+	// Products prices the orders placed by the client, an empty catalog by
+	// default.
+	Products *catalog.Catalog
+	// Audit keeps the trail of the captures, cancellations, refunds and
+	// charges, in memory by default. The hold manager records its own
+	// actions there too unless Holds.Audit is set.
+	Audit audit.Sink
+	// Metrics collects the metrics served on /metrics, new ones by
+	// default.
+	Metrics *metrics.Metrics
+
+	// Webhooks configures the processing of the received webhook events.
+	Webhooks events.QueueOptions
+	// Holds configures the tracking of the authorization holds.
+	Holds holds.Options
+	// Authenticator finds the caller of the payment endpoints, users only
+	// act on their own Customer while the back office acts on behalf of
+	// every user. It is required: auth.UserHeader, trusting the X-User-ID
+	// header, must be chosen explicitly and only suits local development.
+	Authenticator auth.Authenticator
+	// Operators are the back-office users of the /admin endpoints. The
+	// endpoints are not served without operators.
+	Operators []Operator
+	// AdminToken authenticates an operator named admin with the
+	// finance-admin role, as a bearer token.
+	AdminToken string
+	// ApprovalThresholds are the amounts per currency, in the smallest
+	// currency unit, above which the captures, refunds and charges of an
+	// operator wait for the approval of a second operator. Every amount in
+	// the currencies without a threshold waits for it, and nothing does when
+	// there are no thresholds.
+	ApprovalThresholds map[string]int64
+}
+
+// Server serves the payment endpoints. Stripe is reached through the
+// configured gateway, so tests can replace it with gateway.Fake.
+type Server struct {
+	cfg           Config
+	gateway       gateway.PaymentGateway
+	store         store.Store
+	trail         audit.Sink
+	metrics       *metrics.Metrics
+	authenticator auth.Authenticator
+	customers     *customerRegistry
+	products      *catalog.Catalog
+	webhooks      *events.Dispatcher
+	inbox         *events.Queue
+	holds         *holds.Manager
+
+	// operators are the back-office users of the /admin endpoints.
+	operators []Operator
+
+	// defaultMu serializes the changes of the default payment methods, so
+	// concurrent webhook events promote a single one.
+	defaultMu sync.Mutex
+
+	// approvalsMu serializes the decisions on approvals and the requests
+	// they make, so an approved request is made once.
+	approvalsMu sync.Mutex
+
+	// inFlight holds the scoped idempotency keys of the requests being
+	// served, see idempotent.
+	inFlightMu sync.Mutex
+	inFlight   map[string]bool
+}
+
+// NewServer returns a Server configured by cfg.
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = "localhost:4242"
+	}
+	if cfg.DefaultCurrency == "" {
+		cfg.DefaultCurrency = string(stripe.CurrencyUSD)
+	}
+	if cfg.StatementDescriptor == "" {
+		cfg.StatementDescriptor = "firebolt"
+	}
+	if cfg.HoldStatementDescriptorSuffix == "" {
+		cfg.HoldStatementDescriptorSuffix = "pre-auth"
+	}
+	if cfg.ChargeStatementDescriptorSuffix == "" {
+		cfg.ChargeStatementDescriptorSuffix = "invoice due"
+	}
+	if cfg.Gateway == nil {
+		cfg.Gateway = gateway.NewStripe(cfg.SecretKey)
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.New()
+	}
+	// every Stripe request, the holds manager's included, is measured
+	cfg.Gateway = gateway.NewObserved(cfg.Gateway, cfg.Metrics.ObserveStripe)
+	if cfg.Store == nil {
+		cfg.Store = store.NewMemory()
+	}
+	if cfg.Audit == nil {
+		cfg.Audit = audit.NewMemory()
+	}
+	if cfg.Holds.Audit == nil {
+		cfg.Holds.Audit = cfg.Audit
+	}
+	if cfg.Authenticator == nil {
+		return nil, errors.New("server: no Authenticator configured")
+	}
+	if cfg.Products == nil {
+		products, err := catalog.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Products = products
+	}
+
+	s := &Server{
+		cfg:           cfg,
+		gateway:       cfg.Gateway,
+		store:         cfg.Store,
+		trail:         cfg.Audit,
+		metrics:       cfg.Metrics,
+		authenticator: cfg.Authenticator,
+		customers:     newCustomerRegistry(cfg.Gateway, cfg.Store),
+		products:      cfg.Products,
+		webhooks:      events.New(cfg.Store),
+		inFlight:      map[string]bool{},
+		operators:     cfg.Operators,
+	}
+	if cfg.AdminToken != "" {
+		s.operators = append(s.operators, Operator{Name: "admin", Role: RoleFinanceAdmin, Token: cfg.AdminToken})
+	}
+	s.webhooks.Use(tracing.Webhooks)
+	s.webhooks.Use(cfg.Metrics.Webhooks)
+	s.inbox = events.NewQueue(cfg.Store, s.webhooks, cfg.Webhooks)
+	s.holds = holds.New(cfg.Gateway, cfg.Store, cfg.Holds)
+	s.registerWebhookHandlers()
+	return s, nil
+}
+
+// Webhooks returns the dispatcher of the webhook events received by the
+// server. Handlers registered with events.On run after the built-in ones.
+func (s *Server) Webhooks() *events.Dispatcher {
+	return s.webhooks
+}
+
+// Handler returns the handler serving the payment endpoints and, when
+// StaticDir is set, the client. Each request is identified by the
+// X-Request-ID header, traced and counted in the metrics served to the
+// operators on /metrics. Use http.StripPrefix to mount it under a
+// path prefix of another mux.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if s.cfg.StaticDir != "" {
+		mux.Handle("/", http.FileServer(http.Dir(s.cfg.StaticDir)))
+	}
+	mux.HandleFunc("/create-payment-intent", s.authenticate(s.idempotent(s.handleCreatePaymentIntent)))
+	mux.HandleFunc("/resolve-last-payment-intent", s.authenticate(s.idempotent(s.handleResolveLastPaymentIntent)))
+	mux.HandleFunc("/create-setup-intent", s.authenticate(s.idempotent(s.handleCreateSetupIntent)))
+	mux.HandleFunc("/refunds", s.authenticate(s.handleListRefunds))
+	mux.HandleFunc("/confirm-payment-intent", s.authenticate(s.handleConfirmPaymentIntent))
+	mux.HandleFunc("/payment-methods", s.authenticate(s.handleListPaymentMethods))
+	mux.HandleFunc("/detach-payment-method", s.authenticate(s.idempotent(s.handleDetachPaymentMethod)))
+	mux.HandleFunc("/update-payment-method", s.authenticate(s.idempotent(s.handleUpdatePaymentMethod)))
+	mux.HandleFunc("/default-payment-method", s.authenticate(s.idempotent(s.handleDefaultPaymentMethod)))
+	mux.HandleFunc("/webhook", s.handleWebhook)
+	mux.HandleFunc("/config", s.handleConfig)
+	if len(s.operators) > 0 {
+		// payment volumes and decline rates are for the operators only
+		mux.HandleFunc("/metrics", s.requireRole(ActionView, s.metrics.Handler().ServeHTTP))
+		mux.HandleFunc("/admin/webhooks/dead-letters", s.requireRole(ActionView, s.handleDeadLetters))
+		mux.HandleFunc("/admin/webhooks/replay", s.requireRole(ActionReplay, s.handleReplayWebhook))
+		mux.HandleFunc("/admin/payments/capture", s.requireRole(ActionCapture, s.idempotent(s.handleCapturePaymentIntent)))
+		mux.HandleFunc("/admin/payments/cancel", s.requireRole(ActionCancel, s.idempotent(s.handleCancelPaymentIntent)))
+		mux.HandleFunc("/admin/payments/refund", s.requireRole(ActionRefund, s.idempotent(s.handleRefund)))
+		mux.HandleFunc("/admin/payments/refunds", s.requireRole(ActionView, s.handleListRefunds))
+		mux.HandleFunc("/admin/payments/charge", s.requireRole(ActionCharge, s.idempotent(s.handleChargeSavedPaymentMethod)))
+		mux.HandleFunc("/admin/audit", s.requireRole(ActionView, s.handleAudit))
+		mux.HandleFunc("/admin/approvals", s.requireRole(ActionView, s.handleApprovals))
+		// the permission of the approved action is checked by the handlers
+		mux.HandleFunc("/admin/approvals/approve", s.requireRole(ActionView, s.idempotent(s.handleApprove)))
+		mux.HandleFunc("/admin/approvals/reject", s.requireRole(ActionView, s.idempotent(s.handleReject)))
+	}
+	return withRequestID(withTracing(s.withMetrics(mux)))
+}
+
+// requestIDHeader carries the ID of a request, logged with everything the
+// request logs and returned in the response.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern matches the request IDs accepted from the clients, or
+// from a proxy in front of the server.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID identifies each request with the ID sent by the client, or
+// a new one when it sends none, and logs it with the records of the
+// request.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = "req_" + rand.Text()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// holdsCheckInterval is how often RunWorkers looks for expiring holds.
+const holdsCheckInterval = 15 * time.Minute
+
+// pruneInterval is how often RunWorkers deletes the expired responses to
+// idempotent requests.
+const pruneInterval = time.Hour
+
+// RunWorkers processes the received webhook events, watches the expiry of
+// the authorization holds and prunes the saved responses until ctx is done.
+// ListenAndServe runs it, a server mounted with Handler needs it running
+// alongside.
+func (s *Server) RunWorkers(ctx context.Context) error {
+	errs := make(chan error, 3)
+	go func() { errs <- s.inbox.Run(ctx) }()
+	go func() { errs <- s.holds.Run(ctx, holdsCheckInterval) }()
+	go func() { errs <- s.pruneIdempotentResponses(ctx, pruneInterval) }()
+	return errors.Join(<-errs, <-errs, <-errs)
+}
+
+// ListenAndServe serves Handler on the configured address and runs the
+// workers.
+func (s *Server) ListenAndServe() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := s.RunWorkers(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("RunWorkers failed", logging.Err(err))
+		}
+	}()
+
+	slog.Info("listening", "addr", s.cfg.Addr)
+	return http.ListenAndServe(s.cfg.Addr, s.Handler())
+}
+
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("godotenv.Load: %v", err)
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "optional JSON, YAML or .env file with the settings, overriding .env and overridden by the environment")
+	flag.Parse()
+
+	slog.SetDefault(slog.New(logging.NewHandler(slog.NewTextHandler(os.Stderr, nil))))
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fatal("invalid configuration", err)
+	}
+	if cfg.LogFormat == "json" {
+		slog.SetDefault(slog.New(logging.NewHandler(slog.NewJSONHandler(os.Stderr, nil))))
 	}
 
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracingEndpoint)
+	if err != nil {
+		fatal("tracing.Setup failed", err)
+	}
 
-	http.Handle("/", http.FileServer(http.Dir(os.Getenv("STATIC_DIR"))))
-	http.HandleFunc("/create-payment-intent", handleCreatePaymentIntent)
-	http.HandleFunc("/resolve-last-payment-intent", handleResolveLastPaymentIntent)
-	http.HandleFunc("/create-setup-intent", handleCreateSetupIntent)
-	http.HandleFunc("/capture-payment-intent", handleCapturePaymentIntent)
-	http.HandleFunc("/cancel-payment-intent", handleCancelPaymentIntent)
-	http.HandleFunc("/confirm-payment-intent", handleConfirmPaymentIntent)
-	http.HandleFunc("/webhook", handleWebhook)
-	http.HandleFunc("/config", handleConfig)
+	st, err := openStore(cfg.DatabaseDriver, cfg.DatabaseURL)
+	if err != nil {
+		fatal("openStore failed", err)
+	}
 
-	addr := "localhost:4242"
-	log.Printf("Listening on %s ...", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	products, err := catalog.Load(cfg.CatalogFile)
+	if err != nil {
+		fatal("catalog.Load failed", err)
+	}
+
+	trail, err := audit.NewFile(cfg.AuditLogFile)
+	if err != nil {
+		fatal("audit.NewFile failed", err)
+	}
+
+	s, err := NewServer(Config{
+		Addr:                            cfg.Addr,
+		StaticDir:                       cfg.StaticDir,
+		SecretKey:                       cfg.SecretKey,
+		PublishableKey:                  cfg.PublishableKey,
+		WebhookSecret:                   cfg.WebhookSecret,
+		DefaultCurrency:                 cfg.DefaultCurrency,
+		StatementDescriptor:             cfg.StatementDescriptor,
+		HoldStatementDescriptorSuffix:   cfg.HoldStatementDescriptorSuffix,
+		ChargeStatementDescriptorSuffix: cfg.ChargeStatementDescriptorSuffix,
+		Store:                           st,
+		Products:                        products,
+		Audit:                           trail,
+		Authenticator:                   newAuthenticator(cfg),
+		Operators:                       newOperators(cfg.Operators),
+		AdminToken:                      cfg.AdminToken,
+		ApprovalThresholds:              cfg.ApprovalThresholds,
+		Holds:                           holds.Options{Action: holds.ExpiryAction(cfg.HoldExpiryAction)},
+	})
+	if err != nil {
+		fatal("NewServer failed", err)
+	}
+	slog.Info("using Stripe", "mode", cfg.Mode())
+	err = s.ListenAndServe()
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("tracing shutdown failed", logging.Err(err))
+	}
+	fatal("ListenAndServe failed", err)
+}
+
+// fatal logs the error which stops the server and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
+
+// newAuthenticator accepts the API key of the back office and the session
+// tokens signed with the session secret, when set. The X-User-ID header is
+// only trusted when TRUST_USER_HEADER opts in, for local development:
+// config.Validate refuses a configuration without any credentials.
+func newAuthenticator(cfg *config.Config) auth.Authenticator {
+	var chain auth.Chain
+	if cfg.APIKey != "" {
+		chain = append(chain, auth.APIKeys{cfg.APIKey: "back-office"})
+	}
+	if cfg.SessionSecret != "" {
+		chain = append(chain, auth.Sessions{Secret: []byte(cfg.SessionSecret)})
+	}
+	if cfg.TrustUserHeader {
+		slog.Warn("TRUST_USER_HEADER is set, anyone can act as any user with the header", "header", auth.UserIDHeader)
+		chain = append(chain, auth.UserHeader{})
+	}
+	return chain
 }
 
-func handleConfig(w http.ResponseWriter, r *http.Request) {
+func newOperators(configured []config.Operator) []Operator {
+	operators := make([]Operator, 0, len(configured))
+	for _, op := range configured {
+		operators = append(operators, Operator{Name: op.Name, Role: Role(op.Role), Token: op.Token})
+	}
+	return operators
+}
+
+// openStore opens the store selected by driver. "memory" keeps everything
+// in process, any other value is used as a database/sql driver name with dsn
+// as its data source. SQLite in server.db is used when nothing is configured.
+func openStore(driver, dsn string) (store.Store, error) {
+	if driver == "memory" {
+		return store.NewMemory(), nil
+	}
+	if driver == "" {
+		driver = "sqlite"
+	}
+	if dsn == "" {
+		dsn = "server.db"
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sql.Open: %w", err)
+	}
+	return store.NewSQL(context.Background(), db)
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 		return
 	}
 	type Config struct {
@@ -49,346 +429,212 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	cfg := Config{
-		PublishableKey: os.Getenv("STRIPE_PUBLISHABLE_KEY"),
+		PublishableKey: s.cfg.PublishableKey,
 	}
 
 	writeJSON(w, cfg)
 }
 
 // PayItemParams represents a single item passed from the client.
-// In practice, the ID of the PayItemParams object would be some
-// ID or reference to an internal product that you can use to
-// determine the price. You need to implement calculateOrderAmount
-// or a similar function to actually calculate the amount here
+// The ID of the PayItemParams object is the ID of a product in the
+// catalog, calculateOrderAmount uses it to determine the price here
 // on the server. That way, the user cannot modify the amount that
 // is charged by changing the client.
 type PayItemParams struct {
-	ID string `json:"id"`
+	ID       string `json:"id"`
+	Quantity int64  `json:"quantity"`
 }
 
 // PayRequestParams represents the structure of the request from
 // the client.
 type PayRequestParams struct {
+	UserID   string          `json:"userID"`
 	Currency string          `json:"currency"`
 	Items    []PayItemParams `json:"items"`
 }
 
-func handleCreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
+func (req *PayRequestParams) validate(v *validator) {
+	v.currency("currency", req.Currency)
+	for i, item := range req.Items {
+		field := fmt.Sprintf("items[%d]", i)
+		v.check(item.ID != "", field+".id", "is required")
+		v.check(item.Quantity >= 0, field+".quantity", "must not be negative")
+		v.check(item.Quantity <= catalog.QuantityLimit, field+".quantity", "must not exceed %d", catalog.QuantityLimit)
+	}
+}
+
+// PaymentIntentRequestParams represents the requests acting on a payment
+// intent.
+type PaymentIntentRequestParams struct {
+	PaymentIntentID string `json:"paymentIntentID"`
+}
+
+func (req *PaymentIntentRequestParams) validate(v *validator) {
+	v.requiredID("paymentIntentID", req.PaymentIntentID)
+}
+
+func (s *Server) handleCreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 		return
 	}
 
 	// Decode the incoming request
 	req := PayRequestParams{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		if !errors.Is(err, io.EOF) {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("json.NewDecoder.Decode: %v", err)
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = s.cfg.DefaultCurrency
+	}
+
+	customerID, ok := s.requestCustomer(w, r, req.UserID)
+	if !ok {
+		return
+	}
+
+	// without items only the card is verified: authorize 1 USD to return it back after confirmation - https://docs.stripe.com/payments/place-a-hold-on-a-payment-method#authorize-only
+	amount := int64(100)
+	description := "Pre-authorize 1.00 USD to return it back after confirmation"
+	purpose := store.HoldVerification
+	if len(req.Items) > 0 {
+		var err error
+		amount, err = s.calculateOrderAmount(req.Items, req.Currency)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		req.Currency = "USD"
+		description = "Pre-authorize order amount to capture it on fulfillment"
+		purpose = store.HoldOrder
 	}
 
-	//customerParams := &stripe.CustomerParams{}
-	//c, err := customer.New(customerParams)
-	//if err != nil {
-	//	http.Error(w, err.Error(), http.StatusInternalServerError)
-	//	log.Printf("customer.New: %v", err)
-	//	return
-	//}
-
-	// authorize 1 USD to return it back after confirmation - https://docs.stripe.com/payments/place-a-hold-on-a-payment-method#authorize-only
 	paymentIntentParams := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(100),
-		Currency: stripe.String(req.Currency),
-		Customer: stripe.String("cus_R88nCQ6UTjjC2u"),
-		//Customer:                  stripe.String(c.ID),
+		Amount:                    stripe.Int64(amount),
+		Currency:                  stripe.String(req.Currency),
+		Customer:                  stripe.String(customerID),
 		CaptureMethod:             stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
 		SetupFutureUsage:          stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
-		StatementDescriptor:       stripe.String("firebolt"),
-		StatementDescriptorSuffix: stripe.String("pre-auth"),
-		Description:               stripe.String("Pre-authorize 1.00 USD to return it back after confirmation"),
+		StatementDescriptor:       stripe.String(s.cfg.StatementDescriptor),
+		StatementDescriptorSuffix: stripe.String(s.cfg.HoldStatementDescriptorSuffix),
+		Description:               stripe.String(description),
 		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
 			Enabled: stripe.Bool(true),
 		},
 	}
-
-	pi, err := paymentintent.New(paymentIntentParams)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("paymentintent.New: %v", err)
-		return
+	paymentIntentParams.AddMetadata(holds.PurposeMetadataKey, purpose)
+	setRequestIdempotencyKey(r.Context(), &paymentIntentParams.Params, "create")
+	if purpose == store.HoldOrder {
+		// orders may ship in several parts, each captured on its own
+		paymentIntentParams.PaymentMethodOptions = &stripe.PaymentIntentPaymentMethodOptionsParams{
+			Card: &stripe.PaymentIntentPaymentMethodOptionsCardParams{
+				RequestMulticapture: stripe.String(string(stripe.PaymentIntentPaymentMethodOptionsCardRequestMulticaptureIfAvailable)),
+			},
+		}
 	}
 
-	writeJSON(w, struct {
-		PublicKey    string `json:"publicKey"`
-		ClientSecret string `json:"clientSecret"`
-		ID           string `json:"id"`
-	}{
-		PublicKey:    os.Getenv("STRIPE_PUBLISHABLE_KEY"),
-		ClientSecret: pi.ClientSecret,
-		ID:           pi.ID,
-	})
-}
-func handleResolveLastPaymentIntent(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	pi, err := s.gatewayFor(r.Context()).NewPaymentIntent(paymentIntentParams)
+	if err != nil {
+		writeFailure(w, "paymentintent.New", err)
 		return
 	}
-
-	// PayRequestParams represents the structure of the request from
-	// the client.
-	type ResolvePayRequestParams struct {
-		CustomerID string `json:"customerID"`
-	}
-	// Decode the incoming request
-	req := ResolvePayRequestParams{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
-		return
+	s.recordPaymentIntent(r.Context(), pi)
+	if err := s.holds.Track(r.Context(), pi, purpose); err != nil {
+		slog.ErrorContext(r.Context(), "holds.Track failed", logging.PaymentIntentID(pi.ID), logging.Err(err))
 	}
 
-	listPaymentIntent := paymentintent.List(&stripe.PaymentIntentListParams{
-		Customer: stripe.String(req.CustomerID),
-	})
-	if err := listPaymentIntent.Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("paymentintent.List: %v", err)
-		return
-	}
-	//for listPaymentIntent.Next() {
-	//}
-
-	//// authorize 1 USD to return it back after confirmation - https://docs.stripe.com/payments/place-a-hold-on-a-payment-method#authorize-only
-	//paymentIntentParams := &stripe.PaymentIntentParams{
-	//	Amount:   stripe.Int64(100),
-	//	Currency: stripe.String(req.Currency),
-	//	//Customer: stripe.String("cus_R88nCQ6UTjjC2u"),
-	//	Customer:                  stripe.String(c.ID),
-	//	CaptureMethod:             stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
-	//	SetupFutureUsage:          stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
-	//	StatementDescriptor:       stripe.String("firebolt"),
-	//	StatementDescriptorSuffix: stripe.String("pre-auth"),
-	//	Description:               stripe.String("Pre-authorize 1.00 USD to return it back after confirmation"),
-	//	AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
-	//		Enabled: stripe.Bool(true),
-	//	},
-	//}
-	//
-	//pi, err := paymentintent.New(paymentIntentParams)
-	//if err != nil {
-	//	http.Error(w, err.Error(), http.StatusInternalServerError)
-	//	log.Printf("paymentintent.New: %v", err)
-	//	return
-	//}
-	if !listPaymentIntent.Next() {
-		http.Error(w, "No payment intent found", http.StatusInternalServerError)
-		log.Printf("paymentintent.List: No payment intent found")
-		return
-	}
-	pi := listPaymentIntent.PaymentIntent()
-	log.Printf("pi: %v\n", pi)
-	if pi.Status == stripe.PaymentIntentStatusRequiresPaymentMethod {
-		// should be in webhook handler
-		oldPiID := pi.ID
-		var err error
-		// new needed, so customer can select
-		pi, err = paymentintent.New(copyIntentForFreshPayment(pi))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("paymentintent.Update: %v", err)
-			return
-		}
-		_, err = paymentintent.Cancel(oldPiID, nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("paymentintent.Cancel: %v", err)
-		}
-	}
 	writeJSON(w, struct {
-		Amount       int64  `json:"amount"`
 		PublicKey    string `json:"publicKey"`
 		ClientSecret string `json:"clientSecret"`
 		ID           string `json:"id"`
 	}{
-		Amount:       pi.Amount,
-		PublicKey:    os.Getenv("STRIPE_PUBLISHABLE_KEY"),
+		PublicKey:    s.cfg.PublishableKey,
 		ClientSecret: pi.ClientSecret,
 		ID:           pi.ID,
 	})
 }
 
-func copyIntentForFreshPayment(pi *stripe.PaymentIntent) *stripe.PaymentIntentParams {
-
-	receiptEmail := pi.ReceiptEmail
-	var receiptEmailRef *string
-	if receiptEmail != "" {
-		receiptEmailRef = &receiptEmail
-	}
-	return &stripe.PaymentIntentParams{
-		Params:               stripe.Params{},
-		Amount:               stripe.Int64(pi.Amount),
-		ApplicationFeeAmount: stripe.Int64(pi.ApplicationFeeAmount),
-		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
-			AllowRedirects: stripe.String(string(stripe.PaymentIntentAutomaticPaymentMethodsAllowRedirectsNever)),
-			Enabled:        stripe.Bool(true),
-		},
-		CaptureMethod:              stripe.String(string(stripe.PaymentIntentCaptureMethodAutomatic)),
-		ClientSecret:               nil,
-		Confirm:                    nil,
-		ConfirmationMethod:         nil,
-		ConfirmationToken:          nil,
-		Currency:                   stripe.String(string(pi.Currency)),
-		Customer:                   stripe.String(pi.Customer.ID),
-		Description:                stripe.String(pi.Description),
-		Expand:                     nil,
-		Mandate:                    nil,
-		MandateData:                nil,
-		Metadata:                   pi.Metadata,
-		OnBehalfOf:                 nil,
-		PaymentMethod:              nil,
-		PaymentMethodConfiguration: nil,
-		PaymentMethodData:          nil,
-		PaymentMethodOptions:       nil,
-		PaymentMethodTypes:         nil,
-		RadarOptions:               nil,
-		ReceiptEmail:               receiptEmailRef,
-		ReturnURL:                  nil,
-		SetupFutureUsage:           stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
-		Shipping:                   nil,
-		StatementDescriptor:        stripe.String(pi.StatementDescriptor),
-		StatementDescriptorSuffix:  stripe.String(pi.StatementDescriptorSuffix),
-		TransferData:               nil,
-		TransferGroup:              nil,
-		ErrorOnRequiresAction:      stripe.Bool(false),
-		OffSession:                 nil,
-		UseStripeSDK:               nil,
+// calculateOrderAmount prices the items from the product catalog.
+func (s *Server) calculateOrderAmount(items []PayItemParams, currency string) (int64, error) {
+	orderItems := make([]catalog.Item, 0, len(items))
+	for _, item := range items {
+		orderItems = append(orderItems, catalog.Item{ProductID: item.ID, Quantity: item.Quantity})
 	}
+	return s.products.Amount(orderItems, currency)
 }
 
 // https://docs.stripe.com/financial-connections/ach-direct-debit-payments#getting-started
 // read about ACH Direct Debit Payments optimizations to check accounts balances before charge.
 // How to check permissions given in default flow?
-func handleCreateSetupIntent(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleCreateSetupIntent(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 		return
 	}
 
 	// Decode the incoming request
 	req := PayRequestParams{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	//customerParams := &stripe.CustomerParams{}
-	//c, err := customer.New(customerParams)
-	//if err != nil {
-	//	http.Error(w, err.Error(), http.StatusInternalServerError)
-	//	log.Printf("customer.New: %v", err)
-	//	return
-	//}
+	customerID, ok := s.requestCustomer(w, r, req.UserID)
+	if !ok {
+		return
+	}
 
 	setupIntentParams := &stripe.SetupIntentParams{
-		Customer: stripe.String("cus_R88nCQ6UTjjC2u"),
-		//Customer:    stripe.String(c.ID),
+		Customer:    stripe.String(customerID),
 		Description: stripe.String("Capture payment details for future use"),
 		AutomaticPaymentMethods: &stripe.SetupIntentAutomaticPaymentMethodsParams{
 			Enabled: stripe.Bool(true),
 		},
 	}
+	setRequestIdempotencyKey(r.Context(), &setupIntentParams.Params, "create")
 
-	pi, err := setupintent.New(setupIntentParams)
+	pi, err := s.gatewayFor(r.Context()).NewSetupIntent(setupIntentParams)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("paymentintent.New: %v", err)
+		writeFailure(w, "setupintent.New", err)
 		return
 	}
+	s.recordSetupIntent(r.Context(), pi)
 
 	writeJSON(w, struct {
 		PublicKey    string `json:"publicKey"`
 		ClientSecret string `json:"clientSecret"`
 		ID           string `json:"id"`
 	}{
-		PublicKey:    os.Getenv("STRIPE_PUBLISHABLE_KEY"),
+		PublicKey:    s.cfg.PublishableKey,
 		ClientSecret: pi.ClientSecret,
 		ID:           pi.ID,
 	})
 }
 
-// handleCapturePaymentIntent captures amount specified in payment intent by specified id.
-// https://docs.stripe.com/payments/place-a-hold-on-a-payment-method#capture-funds
-func handleCapturePaymentIntent(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		return
-	}
-	// CaptureRequestParams represents the structure of the request from
-	// the client.
-	type CaptureRequestParams struct {
-		PaymentIntentID string `json:"paymentIntentID"`
-		Amount          int64  `json:"amount"`
-	}
-
-	// Decode the incoming request
-	req := CaptureRequestParams{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
-		return
-	}
-
-	params := &stripe.PaymentIntentCaptureParams{
-		AmountToCapture: stripe.Int64(req.Amount),
-	}
-
-	pi, err := paymentintent.Capture(req.PaymentIntentID, params)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("paymentintent.Capture: %v", err)
-	}
-
-	writeJSON(w, pi)
-}
-
 // handleConfirmPaymentIntent captures amount specified in payment intent by specified id.
 // https://docs.stripe.com/payments/payment-intents/upgrade-to-handle-actions
-func handleConfirmPaymentIntent(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleConfirmPaymentIntent(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 		return
 	}
-	// CaptureRequestParams represents the structure of the request from
-	// the client.
-	type ConfirmRequestParams struct {
-		PaymentIntentID string `json:"paymentIntentID"`
-	}
 
 	// Decode the incoming request
-	req := ConfirmRequestParams{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	req := PaymentIntentRequestParams{}
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	pi, err := paymentintent.Get(req.PaymentIntentID, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("paymentintent.Get: %v", err)
+	pi, ok := s.requestPaymentIntent(w, r, req.PaymentIntentID)
+	if !ok {
 		return
 	}
+	s.recordPaymentIntent(r.Context(), pi)
 
 	writeJSON(w, struct {
 		PublicKey    string `json:"publicKey"`
 		ClientSecret string `json:"clientSecret"`
 		ID           string `json:"id"`
 	}{
-		PublicKey:    os.Getenv("STRIPE_PUBLISHABLE_KEY"),
+		PublicKey:    s.cfg.PublishableKey,
 		ClientSecret: pi.ClientSecret,
 		ID:           pi.ID,
 	})
@@ -396,112 +642,90 @@ func handleConfirmPaymentIntent(w http.ResponseWriter, r *http.Request) {
 
 // handleCancelPaymentIntent cancels amount specified in payment intent by specified id.
 // https://docs.stripe.com/refunds?dashboard-or-api=api#cancel-payment
-func handleCancelPaymentIntent(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleCancelPaymentIntent(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 		return
 	}
-	// CaptureRequestParams represents the structure of the request from
-	// the client.
-	type CancelRequestParams struct {
-		PaymentIntentID string `json:"paymentIntentID"`
-	}
 
 	// Decode the incoming request
-	req := CancelRequestParams{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
+	req := PaymentIntentRequestParams{}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	pi, ok := s.requestPaymentIntent(w, r, req.PaymentIntentID)
+	if !ok {
 		return
 	}
 
 	params := &stripe.PaymentIntentCancelParams{
 		CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonAbandoned)),
 	}
+	// canceling twice returns the first result instead of an error
+	params.SetIdempotencyKey(gateway.CancelIdempotencyKey(req.PaymentIntentID, *params.CancellationReason))
 
-	pi, err := paymentintent.Cancel(req.PaymentIntentID, params)
+	canceled, err := s.gatewayFor(r.Context()).CancelPaymentIntent(req.PaymentIntentID, params)
+	s.auditPaymentIntent(r.Context(), ActionCancel, pi, pi.Amount, canceled, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("paymentintent.Capture: %v", err)
-	}
-
-	writeJSON(w, pi)
-}
-
-func handleWebhook(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeFailure(w, "paymentintent.Cancel", err)
 		return
 	}
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Printf("ioutil.ReadAll: %v", err)
-		return
+	pi = canceled
+	s.recordPaymentIntent(r.Context(), pi)
+	if err := s.holds.Settled(r.Context(), pi); err != nil {
+		slog.ErrorContext(r.Context(), "holds.Settled failed", logging.PaymentIntentID(pi.ID), logging.Err(err))
 	}
 
-	event, err := webhook.ConstructEvent(b, r.Header.Get("Stripe-Signature"), os.Getenv("STRIPE_WEBHOOK_SECRET"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Printf("webhook.ConstructEvent: %v", err)
-		return
-	}
+	writeJSON(w, pi)
+}
 
-	if event.Type == "payment_method.attached" {
-		log.Printf("❗ PaymentMethod successfully attached to Customer: %s", event.Data.Raw)
-		return
+// recordPaymentIntent keeps the local copy of pi, just read from the API, up
+// to date. Failures are only logged, Stripe stays the source of truth.
+// Updated is left to the store: the server clock does not order the states
+// against the events of Stripe.
+func (s *Server) recordPaymentIntent(ctx context.Context, pi *stripe.PaymentIntent) {
+	rec := store.PaymentIntentFromStripe(pi)
+	if err := s.store.SavePaymentIntent(ctx, rec); err != nil {
+		slog.ErrorContext(ctx, "store.SavePaymentIntent failed", logging.PaymentIntentID(pi.ID), logging.Err(err))
 	}
+}
 
-	if event.Type == "payment_intent.succeeded" {
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Error parsing webhook JSON: %v\\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		if string(paymentIntent.SetupFutureUsage) == "" {
-			log.Printf("❗ Customer did not want to save the card.")
-		}
-
-		log.Printf("💰 Payment received!")
-		return
+// recordSetupIntent keeps the local copy of si up to date.
+func (s *Server) recordSetupIntent(ctx context.Context, si *stripe.SetupIntent) {
+	if err := s.store.SaveSetupIntent(ctx, store.SetupIntentFromStripe(si)); err != nil {
+		slog.ErrorContext(ctx, "store.SaveSetupIntent failed", "setup_intent_id", si.ID, logging.Err(err))
 	}
+}
 
-	if event.Type == "payment_intent.payment_failed" {
-		log.Printf("❌ Payment failed.")
-		return
-	}
-	if event.Type == "payment_intent.requires_action" {
-		log.Printf("💰 Payment requires action: %s", event.Data.Raw)
-		return
-	}
-	if event.Type == "payment_intent.amount_capturable_updated" {
-		log.Printf("💰 Payment captured amount updated: %s", event.Data.Raw)
-		return
+// recordPaymentMethod keeps the local copy of pm up to date.
+func (s *Server) recordPaymentMethod(ctx context.Context, pm *stripe.PaymentMethod) {
+	if err := s.store.SavePaymentMethod(ctx, store.PaymentMethodFromStripe(pm)); err != nil {
+		slog.ErrorContext(ctx, "store.SavePaymentMethod failed", "payment_method_id", pm.ID, logging.Err(err))
 	}
-	//if event.Type == "charge.succeeded" {
-	//	log.Printf("💰 Charge succeeded: %s", event.Data.Raw)
-	//	return
-	//}
-
-	writeJSON(w, struct {
-		Status string `json:"status"`
-	}{
-		Status: "success",
-	})
 }
 
 func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus writes v as the JSON body of a response with the status.
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(v); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("json.NewEncoder.Encode: %v", err)
+		writeFailure(w, "json.NewEncoder.Encode", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	if _, err := io.Copy(w, &buf); err != nil {
-		log.Printf("io.Copy: %v", err)
+		slog.Error("io.Copy failed", logging.Err(err))
 		return
 	}
 }
+
+// gatewayFor returns the gateway making the Stripe requests of ctx, traced
+// in its span.
+func (s *Server) gatewayFor(ctx context.Context) gateway.PaymentGateway {
+	return gateway.WithContext(ctx, s.gateway)
+}
@@ -1,25 +1,43 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/catalog"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
 	"github.com/stripe/stripe-go/v80"
 	"github.com/stripe/stripe-go/v80/customer"
 	"github.com/stripe/stripe-go/v80/paymentintent"
 	"github.com/stripe/stripe-go/v80/paymentmethod"
 )
 
-func Test_PayAgain(t *testing.T) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("godotenv.Load: %v", err)
+// setupStripe configures the key for the tests calling the Stripe API and
+// skips them when no key is available.
+func setupStripe(t *testing.T) {
+	_ = godotenv.Load()
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if stripe.Key == "" {
+		t.Skip("STRIPE_SECRET_KEY is not set")
 	}
+}
 
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+func Test_PayAgain(t *testing.T) {
+	setupStripe(t)
 
 	// The customer ID and payment method ID should be retrieved from your database
 	// where you stored them when the Setup Intent was confirmed.
@@ -67,11 +85,7 @@ func Test_PayAgain(t *testing.T) {
 
 // https://docs.stripe.com/payments/save-during-payment?platform=web#charge-saved-payment-method
 func Test_PayAgainWithFallbackToOnSession(t *testing.T) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("godotenv.Load: %v", err)
-	}
-
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	setupStripe(t)
 
 	// The customer ID and payment method ID should be retrieved from your database
 	// where you stored them when the Setup Intent was confirmed.
@@ -134,11 +148,7 @@ func Test_PayAgainWithFallbackToOnSession(t *testing.T) {
 
 // TODO need to run on every confirmation failure
 func Test_UpdatePaymentIntent(t *testing.T) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("godotenv.Load: %v", err)
-	}
-
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	setupStripe(t)
 
 	// The customer ID and payment method ID should be retrieved from your database
 	// where you stored them when the Setup Intent was confirmed.
@@ -175,11 +185,7 @@ func Test_UpdatePaymentIntent(t *testing.T) {
 }
 
 func Test_PayAgainWithSuccessfulPaymentMethod(t *testing.T) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("godotenv.Load: %v", err)
-	}
-
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	setupStripe(t)
 
 	// TODO refactor
 	// 1. select default payment method
@@ -269,11 +275,7 @@ func Test_PayAgainWithSuccessfulPaymentMethod(t *testing.T) {
 }
 
 func TestRedisplayCheck(t *testing.T) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("godotenv.Load: %v", err)
-	}
-
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	setupStripe(t)
 	//pm_1QAskkAJlbf9cOtYK9N9Gcqz
 
 	//paymentMethods := customer.ListPaymentMethods(&stripe.CustomerListPaymentMethodsParams{
@@ -292,3 +294,220 @@ func TestRedisplayCheck(t *testing.T) {
 	require.NoError(t, err)
 	t.Logf("PaymentMethod: %s, %s\n", pm.ID, pm.Type)
 }
+
+// newTestServer returns a Server backed by the fake gateway and an in-memory
+// store, so it runs without network access. The options adjust its
+// configuration.
+func newTestServer(t *testing.T, options ...func(*Config)) (*Server, *gateway.Fake) {
+	products, err := catalog.New([]catalog.Product{
+		{ID: "photo-subscription", Prices: map[string]int64{"usd": 1400, "eur": 1300}, TaxInclusive: true},
+	})
+	require.NoError(t, err)
+	fake := gateway.NewFake()
+	cfg := Config{
+		PublishableKey: "pk_test_fake",
+		WebhookSecret:  "whsec_fake",
+		Gateway:        fake,
+		Store:          store.NewMemory(),
+		Products:       products,
+		Authenticator:  auth.UserHeader{},
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+	return s, fake
+}
+
+// asCaller returns r made by the user, or by the back office when userID is
+// empty, as if it went through Server.authenticate.
+func asCaller(r *http.Request, userID string) *http.Request {
+	p := auth.Principal{UserID: userID}
+	if userID == "" {
+		p.KeyName = "test"
+	}
+	return r.WithContext(auth.NewContext(r.Context(), p))
+}
+
+// postJSON calls the handler with body on behalf of userID.
+func postJSON(t *testing.T, handler http.HandlerFunc, userID, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(w, asCaller(r, userID))
+	return w
+}
+
+type intentResponse struct {
+	PublicKey    string `json:"publicKey"`
+	ClientSecret string `json:"clientSecret"`
+	ID           string `json:"id"`
+}
+
+func TestCreatePaymentIntent(t *testing.T) {
+	s, fake := newTestServer(t)
+
+	w := postJSON(t, s.handleCreatePaymentIntent, "user_1", `{"currency": "usd", "items": [{"id": "photo-subscription", "quantity": 2}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp intentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, "pk_test_fake", resp.PublicKey)
+	require.NotEmpty(t, resp.ClientSecret)
+
+	pi, err := fake.GetPaymentIntent(resp.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2800), pi.Amount)
+	require.Equal(t, stripe.PaymentIntentCaptureMethodManual, pi.CaptureMethod)
+
+	c, err := fake.GetCustomer(pi.Customer.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "user_1", c.Metadata[userIDMetadataKey])
+
+	stored, err := s.store.PaymentIntent(context.Background(), resp.ID)
+	require.NoError(t, err)
+	require.Equal(t, string(stripe.PaymentIntentStatusRequiresPaymentMethod), stored.Status)
+
+	// the same user keeps the same customer
+	w = postJSON(t, s.handleCreatePaymentIntent, "user_1", `{"currency": "usd", "items": [{"id": "photo-subscription"}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	second, err := fake.GetPaymentIntent(resp.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, pi.Customer.ID, second.Customer.ID)
+}
+
+func TestCreatePaymentIntentRejectsBadRequests(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		userID string
+		body   string
+	}{
+		{name: "unknown item", userID: "user_1", body: `{"currency": "usd", "items": [{"id": "yacht"}]}`},
+		{name: "unsupported currency", userID: "user_1", body: `{"currency": "jpy", "items": [{"id": "photo-subscription"}]}`},
+		{name: "huge quantity", userID: "user_1", body: `{"currency": "usd", "items": [{"id": "photo-subscription", "quantity": 2305843009213693953}]}`},
+		{name: "missing user", body: `{"currency": "usd", "items": [{"id": "photo-subscription"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postJSON(t, s.handleCreatePaymentIntent, tt.userID, tt.body)
+			require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestCaptureAndCancelPaymentIntent(t *testing.T) {
+	s, fake := newTestServer(t)
+
+	create := func() *stripe.PaymentIntent {
+		w := postJSON(t, s.handleCreatePaymentIntent, "user_1", `{"currency": "usd", "items": [{"id": "photo-subscription"}]}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp intentResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		pi, err := fake.GetPaymentIntent(resp.ID, nil)
+		require.NoError(t, err)
+		// the client confirms the payment with a card
+		pm := fake.AddPaymentMethod(pi.Customer.ID, gateway.CardSucceeds)
+		pi, err = fake.ConfirmPaymentIntent(pi.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: stripe.String(pm.ID)})
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusRequiresCapture, pi.Status)
+		return pi
+	}
+
+	pi := create()
+	w := postJSON(t, s.handleCapturePaymentIntent, "", `{"paymentIntentID": "`+pi.ID+`", "amount": 1000}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	stored, err := s.store.PaymentIntent(context.Background(), pi.ID)
+	require.NoError(t, err)
+	require.Equal(t, string(stripe.PaymentIntentStatusSucceeded), stored.Status)
+	require.Equal(t, int64(1000), stored.AmountReceived)
+
+	pi = create()
+	w = postJSON(t, s.handleCancelPaymentIntent, "", `{"paymentIntentID": "`+pi.ID+`"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	stored, err = s.store.PaymentIntent(context.Background(), pi.ID)
+	require.NoError(t, err)
+	require.Equal(t, string(stripe.PaymentIntentStatusCanceled), stored.Status)
+
+	// a canceled intent cannot be captured
+	w = postJSON(t, s.handleCapturePaymentIntent, "", `{"paymentIntentID": "`+pi.ID+`", "amount": 1000}`)
+	require.NotEqual(t, http.StatusOK, w.Code)
+}
+
+func TestNewServerRequiresAuthenticator(t *testing.T) {
+	_, err := NewServer(Config{PublishableKey: "pk_test_fake", Gateway: gateway.NewFake()})
+	require.Error(t, err)
+}
+
+func TestHandlerUnderPrefix(t *testing.T) {
+	// two independent instances mounted under their own prefixes
+	first, _ := newTestServer(t)
+	second, err := NewServer(Config{PublishableKey: "pk_test_second", Gateway: gateway.NewFake(), Authenticator: auth.UserHeader{}})
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/payments/", http.StripPrefix("/payments", first.Handler()))
+	mux.Handle("/other/", http.StripPrefix("/other", second.Handler()))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for prefix, key := range map[string]string{"/payments": "pk_test_fake", "/other": "pk_test_second"} {
+		resp, err := http.Get(ts.URL + prefix + "/config")
+		require.NoError(t, err)
+		var cfg struct {
+			PublishableKey string `json:"publishableKey"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&cfg))
+		_ = resp.Body.Close()
+		require.Equal(t, key, cfg.PublishableKey)
+	}
+
+	r, err := http.NewRequest(http.MethodPost, ts.URL+"/payments/create-payment-intent",
+		strings.NewReader(`{"items": [{"id": "photo-subscription"}]}`))
+	require.NoError(t, err)
+	r.Header.Set(userIDHeader, "user_1")
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/create-payment-intent")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(logging.NewHandler(slog.NewJSONHandler(&logs, nil))))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	s, _ := newTestServer(t)
+
+	send := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"id": "evt_1"}`))
+		r.Header.Set("Stripe-Signature", "t=1,v1=forged")
+		if id != "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		return w
+	}
+
+	w := send("trace-1")
+	require.Equal(t, "trace-1", w.Header().Get(requestIDHeader))
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &record))
+	require.Equal(t, "webhook.ConstructEvent failed", record["msg"])
+	require.Equal(t, "trace-1", record[logging.RequestIDKey])
+
+	// malformed IDs are replaced
+	for _, id := range []string{"", "a b", strings.Repeat("x", 65)} {
+		w = send(id)
+		require.Regexp(t, `^req_[A-Z0-9]+$`, w.Header().Get(requestIDHeader))
+	}
+}
@@ -0,0 +1,389 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Memory is a Store that keeps everything in memory. It is meant for tests
+// and local development, all records are lost when the process exits.
+type Memory struct {
+	mu             sync.RWMutex
+	customers      map[string]Customer
+	paymentMethods map[string]PaymentMethod
+	paymentIntents map[string]PaymentIntent
+	setupIntents   map[string]SetupIntent
+	captures       map[string][]Capture
+	refunds        map[string]Refund
+	holds          map[string]Hold
+	events         map[string]struct{}
+	inbox          map[string]InboxEvent
+	responses      map[string]IdempotentResponse
+	approvals      map[string]Approval
+}
+
+// NewMemory returns an empty in-memory Store.
+func NewMemory() *Memory {
+	return &Memory{
+		customers:      map[string]Customer{},
+		paymentMethods: map[string]PaymentMethod{},
+		paymentIntents: map[string]PaymentIntent{},
+		setupIntents:   map[string]SetupIntent{},
+		captures:       map[string][]Capture{},
+		refunds:        map[string]Refund{},
+		holds:          map[string]Hold{},
+		events:         map[string]struct{}{},
+		inbox:          map[string]InboxEvent{},
+		responses:      map[string]IdempotentResponse{},
+		approvals:      map[string]Approval{},
+	}
+}
+
+func (m *Memory) SaveCustomer(_ context.Context, c Customer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.customers[c.ID] = c
+	return nil
+}
+
+func (m *Memory) Customer(_ context.Context, id string) (Customer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return Customer{}, ErrNotFound
+	}
+	return c, nil
+}
+
+func (m *Memory) CustomerByUserID(_ context.Context, userID string) (Customer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, c := range m.customers {
+		if c.UserID == userID {
+			return c, nil
+		}
+	}
+	return Customer{}, ErrNotFound
+}
+
+func (m *Memory) SavePaymentMethod(_ context.Context, pm PaymentMethod) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paymentMethods[pm.ID] = pm
+	return nil
+}
+
+func (m *Memory) DeletePaymentMethod(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.paymentMethods, id)
+	return nil
+}
+
+func (m *Memory) PaymentMethod(_ context.Context, id string) (PaymentMethod, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pm, ok := m.paymentMethods[id]
+	if !ok {
+		return PaymentMethod{}, ErrNotFound
+	}
+	return pm, nil
+}
+
+func (m *Memory) PaymentMethods(_ context.Context, customerID string) ([]PaymentMethod, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var pms []PaymentMethod
+	for _, pm := range m.paymentMethods {
+		if pm.CustomerID == customerID {
+			pms = append(pms, pm)
+		}
+	}
+	sort.Slice(pms, func(i, j int) bool {
+		if pms[i].Created != pms[j].Created {
+			return pms[i].Created > pms[j].Created
+		}
+		return pms[i].ID < pms[j].ID
+	})
+	return pms, nil
+}
+
+func (m *Memory) SavePaymentIntent(_ context.Context, pi PaymentIntent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if prev, ok := m.paymentIntents[pi.ID]; ok && prev.Updated > pi.Updated {
+		pi.Updated = prev.Updated
+	}
+	m.paymentIntents[pi.ID] = pi
+	return nil
+}
+
+func (m *Memory) PaymentIntent(_ context.Context, id string) (PaymentIntent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pi, ok := m.paymentIntents[id]
+	if !ok {
+		return PaymentIntent{}, ErrNotFound
+	}
+	pi.AmountRefunded = m.amountRefunded(id)
+	return pi, nil
+}
+
+func (m *Memory) PaymentIntents(_ context.Context, customerID string) ([]PaymentIntent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var pis []PaymentIntent
+	for _, pi := range m.paymentIntents {
+		if pi.CustomerID == customerID {
+			pi.AmountRefunded = m.amountRefunded(pi.ID)
+			pis = append(pis, pi)
+		}
+	}
+	sort.Slice(pis, func(i, j int) bool {
+		if pis[i].Created != pis[j].Created {
+			return pis[i].Created > pis[j].Created
+		}
+		return pis[i].ID > pis[j].ID
+	})
+	return pis, nil
+}
+
+func (m *Memory) AddCapture(_ context.Context, c Capture) (Capture, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.Seq = len(m.captures[c.PaymentIntentID]) + 1
+	m.captures[c.PaymentIntentID] = append(m.captures[c.PaymentIntentID], c)
+	return c, nil
+}
+
+func (m *Memory) Captures(_ context.Context, paymentIntentID string) ([]Capture, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Capture(nil), m.captures[paymentIntentID]...), nil
+}
+
+func (m *Memory) SaveRefund(_ context.Context, r Refund) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refunds[r.ID] = r
+	return nil
+}
+
+func (m *Memory) Refund(_ context.Context, id string) (Refund, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.refunds[id]
+	if !ok {
+		return Refund{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (m *Memory) Refunds(_ context.Context, paymentIntentID string) ([]Refund, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var rs []Refund
+	for _, r := range m.refunds {
+		if r.PaymentIntentID == paymentIntentID {
+			rs = append(rs, r)
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Created != rs[j].Created {
+			return rs[i].Created < rs[j].Created
+		}
+		return rs[i].ID < rs[j].ID
+	})
+	return rs, nil
+}
+
+// amountRefunded sums the refunds of the payment intent. Callers must hold
+// m.mu.
+func (m *Memory) amountRefunded(paymentIntentID string) int64 {
+	var amount int64
+	for _, r := range m.refunds {
+		if r.PaymentIntentID == paymentIntentID && r.counts() {
+			amount += r.Amount
+		}
+	}
+	return amount
+}
+
+func (m *Memory) SaveSetupIntent(_ context.Context, si SetupIntent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setupIntents[si.ID] = si
+	return nil
+}
+
+func (m *Memory) SetupIntent(_ context.Context, id string) (SetupIntent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	si, ok := m.setupIntents[id]
+	if !ok {
+		return SetupIntent{}, ErrNotFound
+	}
+	return si, nil
+}
+
+func (m *Memory) EventProcessed(_ context.Context, id string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.events[id]
+	return ok, nil
+}
+
+func (m *Memory) MarkEventProcessed(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events[id] = struct{}{}
+	return nil
+}
+
+func (m *Memory) AddInboxEvent(_ context.Context, e InboxEvent) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.inbox[e.ID]; ok {
+		return false, nil
+	}
+	m.inbox[e.ID] = e
+	return true, nil
+}
+
+func (m *Memory) SaveInboxEvent(_ context.Context, e InboxEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inbox[e.ID] = e
+	return nil
+}
+
+func (m *Memory) InboxEvent(_ context.Context, id string) (InboxEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.inbox[id]
+	if !ok {
+		return InboxEvent{}, ErrNotFound
+	}
+	return e, nil
+}
+
+func (m *Memory) InboxEvents(_ context.Context, filter InboxFilter) ([]InboxEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var es []InboxEvent
+	for _, e := range m.inbox {
+		if filter.matches(e) {
+			es = append(es, e)
+		}
+	}
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].Received != es[j].Received {
+			return es[i].Received < es[j].Received
+		}
+		return es[i].ID < es[j].ID
+	})
+	if filter.Limit > 0 && len(es) > filter.Limit {
+		es = es[:filter.Limit]
+	}
+	return es, nil
+}
+
+func (m *Memory) SaveHold(_ context.Context, h Hold) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.holds[h.PaymentIntentID] = h
+	return nil
+}
+
+func (m *Memory) Hold(_ context.Context, paymentIntentID string) (Hold, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	h, ok := m.holds[paymentIntentID]
+	if !ok {
+		return Hold{}, ErrNotFound
+	}
+	return h, nil
+}
+
+func (m *Memory) Holds(_ context.Context, filter HoldFilter) ([]Hold, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var hs []Hold
+	for _, h := range m.holds {
+		if filter.matches(h) {
+			hs = append(hs, h)
+		}
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		if hs[i].ExpiresAt != hs[j].ExpiresAt {
+			return hs[i].ExpiresAt < hs[j].ExpiresAt
+		}
+		return hs[i].PaymentIntentID < hs[j].PaymentIntentID
+	})
+	return hs, nil
+}
+
+func (m *Memory) SaveIdempotentResponse(_ context.Context, r IdempotentResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses[r.Key] = r
+	return nil
+}
+
+func (m *Memory) IdempotentResponse(_ context.Context, key string) (IdempotentResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.responses[key]
+	if !ok {
+		return IdempotentResponse{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (m *Memory) DeleteIdempotentResponses(_ context.Context, before int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, r := range m.responses {
+		if r.Created < before {
+			delete(m.responses, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) SaveApproval(_ context.Context, a Approval) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.approvals[a.ID] = a
+	return nil
+}
+
+func (m *Memory) Approval(_ context.Context, id string) (Approval, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.approvals[id]
+	if !ok {
+		return Approval{}, ErrNotFound
+	}
+	return a, nil
+}
+
+func (m *Memory) Approvals(_ context.Context, status string) ([]Approval, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var as []Approval
+	for _, a := range m.approvals {
+		if status == "" || a.Status == status {
+			as = append(as, a)
+		}
+	}
+	sort.Slice(as, func(i, j int) bool {
+		if as[i].Created != as[j].Created {
+			return as[i].Created < as[j].Created
+		}
+		return as[i].ID < as[j].ID
+	})
+	return as, nil
+}
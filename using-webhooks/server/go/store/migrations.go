@@ -0,0 +1,204 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migration changes the schema of the previous version into the next one.
+// It runs in the transaction recording the new version.
+type migration func(ctx context.Context, tx *sql.Tx) error
+
+// migrations are the versions of the schema used by SQL, version n being
+// migrations[n-1]. Released migrations are never changed, schema changes
+// are appended. The statements and the $n placeholders used by the queries
+// are understood by both SQLite and PostgreSQL.
+var migrations = []migration{
+	// 1: the Stripe objects seen by the server
+	exec(
+		`CREATE TABLE customers (
+			id      TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL UNIQUE
+		)`,
+		`CREATE TABLE payment_methods (
+			id              TEXT PRIMARY KEY,
+			customer_id     TEXT NOT NULL,
+			type            TEXT NOT NULL,
+			brand           TEXT NOT NULL,
+			last4           TEXT NOT NULL,
+			exp_month       BIGINT NOT NULL,
+			exp_year        BIGINT NOT NULL,
+			allow_redisplay TEXT NOT NULL,
+			created         BIGINT NOT NULL
+		)`,
+		`CREATE INDEX payment_methods_customer_id ON payment_methods (customer_id)`,
+		`CREATE TABLE payment_intents (
+			id                TEXT PRIMARY KEY,
+			customer_id       TEXT NOT NULL,
+			payment_method_id TEXT NOT NULL,
+			status            TEXT NOT NULL,
+			capture_method    TEXT NOT NULL,
+			currency          TEXT NOT NULL,
+			amount            BIGINT NOT NULL,
+			amount_capturable BIGINT NOT NULL,
+			amount_received   BIGINT NOT NULL,
+			created           BIGINT NOT NULL
+		)`,
+		`CREATE INDEX payment_intents_customer_id ON payment_intents (customer_id)`,
+		`CREATE TABLE setup_intents (
+			id                TEXT PRIMARY KEY,
+			customer_id       TEXT NOT NULL,
+			payment_method_id TEXT NOT NULL,
+			status            TEXT NOT NULL,
+			created           BIGINT NOT NULL
+		)`,
+	),
+	// 2: ordering of the payment intent states by event time
+	exec(`ALTER TABLE payment_intents ADD COLUMN updated BIGINT NOT NULL DEFAULT 0`),
+	// 3: deduplication of the webhook events
+	exec(`CREATE TABLE processed_events (
+		id TEXT PRIMARY KEY
+	)`),
+	// 4: the inbox of the webhook events
+	exec(
+		`CREATE TABLE inbox_events (
+			id           TEXT PRIMARY KEY,
+			type         TEXT NOT NULL,
+			payload      TEXT NOT NULL,
+			status       TEXT NOT NULL,
+			result       TEXT NOT NULL,
+			attempts     BIGINT NOT NULL,
+			next_attempt BIGINT NOT NULL,
+			last_error   TEXT NOT NULL,
+			received     BIGINT NOT NULL
+		)`,
+		`CREATE INDEX inbox_events_status ON inbox_events (status, next_attempt)`,
+	),
+	// 5: authorization holds
+	exec(
+		`CREATE TABLE holds (
+			payment_intent_id TEXT PRIMARY KEY,
+			customer_id       TEXT NOT NULL,
+			purpose           TEXT NOT NULL,
+			status            TEXT NOT NULL,
+			amount            BIGINT NOT NULL,
+			currency          TEXT NOT NULL,
+			created           BIGINT NOT NULL,
+			authorized_at     BIGINT NOT NULL,
+			expires_at        BIGINT NOT NULL,
+			warned            BOOLEAN NOT NULL
+		)`,
+		`CREATE INDEX holds_status ON holds (status, expires_at)`,
+	),
+	// 6: multicapture
+	exec(`CREATE TABLE captures (
+		payment_intent_id TEXT NOT NULL,
+		seq               BIGINT NOT NULL,
+		amount            BIGINT NOT NULL,
+		final             BOOLEAN NOT NULL,
+		created           BIGINT NOT NULL,
+		PRIMARY KEY (payment_intent_id, seq)
+	)`),
+	// 7: refunds
+	exec(
+		`CREATE TABLE refunds (
+			id                TEXT PRIMARY KEY,
+			payment_intent_id TEXT NOT NULL,
+			charge_id         TEXT NOT NULL,
+			amount            BIGINT NOT NULL,
+			currency          TEXT NOT NULL,
+			status            TEXT NOT NULL,
+			reason            TEXT NOT NULL,
+			created           BIGINT NOT NULL
+		)`,
+		`CREATE INDEX refunds_payment_intent_id ON refunds (payment_intent_id)`,
+	),
+	// 8: responses replayed to retried requests
+	exec(
+		`CREATE TABLE idempotent_responses (
+			key          TEXT PRIMARY KEY,
+			request_hash TEXT NOT NULL,
+			status       BIGINT NOT NULL,
+			content_type TEXT NOT NULL,
+			body         TEXT NOT NULL,
+			created      BIGINT NOT NULL
+		)`,
+		`CREATE INDEX idempotent_responses_created ON idempotent_responses (created)`,
+	),
+	// 9: approvals of the back-office actions
+	exec(
+		`CREATE TABLE approvals (
+			id                TEXT PRIMARY KEY,
+			action            TEXT NOT NULL,
+			payment_intent_id TEXT NOT NULL,
+			amount            BIGINT NOT NULL,
+			currency          TEXT NOT NULL,
+			body              TEXT NOT NULL,
+			requested_by      TEXT NOT NULL,
+			decided_by        TEXT NOT NULL,
+			status            TEXT NOT NULL,
+			created           BIGINT NOT NULL,
+			decided           BIGINT NOT NULL
+		)`,
+		`CREATE INDEX approvals_status ON approvals (status, created)`,
+	),
+	// 10: outcome of the approved requests
+	exec(
+		`ALTER TABLE approvals ADD COLUMN attempts BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE approvals ADD COLUMN result TEXT NOT NULL DEFAULT ''`,
+	),
+}
+
+// migrate applies the migrations db has not seen yet, each in its own
+// transaction, and records their version in schema_migrations.
+func migrate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("get schema version: %w", err)
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this server, which knows %d", current, len(migrations))
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		if err := applyMigration(ctx, db, version); err != nil {
+			return fmt.Errorf("migrate to version %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, version int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := migrations[version-1](ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// exec returns the migration running the statements in order.
+func exec(statements ...string) migration {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
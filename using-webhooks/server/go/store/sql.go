@@ -0,0 +1,621 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SQL is a Store backed by a SQL database. The driver is up to the caller,
+// any database/sql driver for SQLite or PostgreSQL works.
+type SQL struct {
+	db *sql.DB
+}
+
+// NewSQL brings the schema of db up to date, see migrate, and returns a
+// Store using db.
+func NewSQL(ctx context.Context, db *sql.DB) (*SQL, error) {
+	if err := migrate(ctx, db); err != nil {
+		return nil, err
+	}
+	return &SQL{db: db}, nil
+}
+
+func (s *SQL) SaveCustomer(ctx context.Context, c Customer) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO customers (id, user_id) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id`,
+		c.ID, c.UserID)
+	if err != nil {
+		return fmt.Errorf("save customer: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) Customer(ctx context.Context, id string) (Customer, error) {
+	return s.customer(ctx, `SELECT id, user_id FROM customers WHERE id = $1`, id)
+}
+
+func (s *SQL) CustomerByUserID(ctx context.Context, userID string) (Customer, error) {
+	return s.customer(ctx, `SELECT id, user_id FROM customers WHERE user_id = $1`, userID)
+}
+
+func (s *SQL) customer(ctx context.Context, query string, arg string) (Customer, error) {
+	var c Customer
+	err := s.db.QueryRowContext(ctx, query, arg).Scan(&c.ID, &c.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Customer{}, ErrNotFound
+	}
+	if err != nil {
+		return Customer{}, fmt.Errorf("get customer: %w", err)
+	}
+	return c, nil
+}
+
+const paymentMethodColumns = `id, customer_id, type, brand, last4, exp_month, exp_year, allow_redisplay, created`
+
+func scanPaymentMethod(row interface{ Scan(...interface{}) error }) (PaymentMethod, error) {
+	var pm PaymentMethod
+	err := row.Scan(&pm.ID, &pm.CustomerID, &pm.Type, &pm.Brand, &pm.Last4,
+		&pm.ExpMonth, &pm.ExpYear, &pm.AllowRedisplay, &pm.Created)
+	return pm, err
+}
+
+func (s *SQL) SavePaymentMethod(ctx context.Context, pm PaymentMethod) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO payment_methods (`+paymentMethodColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			customer_id = excluded.customer_id,
+			type = excluded.type,
+			brand = excluded.brand,
+			last4 = excluded.last4,
+			exp_month = excluded.exp_month,
+			exp_year = excluded.exp_year,
+			allow_redisplay = excluded.allow_redisplay,
+			created = excluded.created`,
+		pm.ID, pm.CustomerID, pm.Type, pm.Brand, pm.Last4,
+		pm.ExpMonth, pm.ExpYear, pm.AllowRedisplay, pm.Created)
+	if err != nil {
+		return fmt.Errorf("save payment method: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) DeletePaymentMethod(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM payment_methods WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("delete payment method: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) PaymentMethod(ctx context.Context, id string) (PaymentMethod, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+paymentMethodColumns+` FROM payment_methods WHERE id = $1`, id)
+	pm, err := scanPaymentMethod(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PaymentMethod{}, ErrNotFound
+	}
+	if err != nil {
+		return PaymentMethod{}, fmt.Errorf("get payment method: %w", err)
+	}
+	return pm, nil
+}
+
+func (s *SQL) PaymentMethods(ctx context.Context, customerID string) ([]PaymentMethod, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+paymentMethodColumns+` FROM payment_methods
+		WHERE customer_id = $1 ORDER BY created DESC, id ASC`, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("list payment methods: %w", err)
+	}
+	defer rows.Close()
+
+	var pms []PaymentMethod
+	for rows.Next() {
+		pm, err := scanPaymentMethod(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan payment method: %w", err)
+		}
+		pms = append(pms, pm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list payment methods: %w", err)
+	}
+	return pms, nil
+}
+
+const paymentIntentColumns = `id, customer_id, payment_method_id, status, capture_method, currency, amount, amount_capturable, amount_received, created, updated`
+
+// selectPaymentIntents selects the paymentIntentColumns followed by the
+// refunded amount.
+const selectPaymentIntents = `SELECT ` + paymentIntentColumns + `,
+		COALESCE((SELECT SUM(r.amount) FROM refunds r
+			WHERE r.payment_intent_id = payment_intents.id AND r.status NOT IN ('` + RefundFailed + `', '` + RefundCanceled + `')), 0)
+		FROM payment_intents`
+
+func scanPaymentIntent(row interface{ Scan(...interface{}) error }) (PaymentIntent, error) {
+	var pi PaymentIntent
+	err := row.Scan(&pi.ID, &pi.CustomerID, &pi.PaymentMethodID, &pi.Status, &pi.CaptureMethod,
+		&pi.Currency, &pi.Amount, &pi.AmountCapturable, &pi.AmountReceived, &pi.Created, &pi.Updated,
+		&pi.AmountRefunded)
+	return pi, err
+}
+
+func (s *SQL) SavePaymentIntent(ctx context.Context, pi PaymentIntent) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO payment_intents (`+paymentIntentColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (id) DO UPDATE SET
+			customer_id = excluded.customer_id,
+			payment_method_id = excluded.payment_method_id,
+			status = excluded.status,
+			capture_method = excluded.capture_method,
+			currency = excluded.currency,
+			amount = excluded.amount,
+			amount_capturable = excluded.amount_capturable,
+			amount_received = excluded.amount_received,
+			created = excluded.created,
+			updated = CASE WHEN excluded.updated > payment_intents.updated THEN excluded.updated ELSE payment_intents.updated END`,
+		pi.ID, pi.CustomerID, pi.PaymentMethodID, pi.Status, pi.CaptureMethod,
+		pi.Currency, pi.Amount, pi.AmountCapturable, pi.AmountReceived, pi.Created, pi.Updated)
+	if err != nil {
+		return fmt.Errorf("save payment intent: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) PaymentIntent(ctx context.Context, id string) (PaymentIntent, error) {
+	row := s.db.QueryRowContext(ctx, selectPaymentIntents+` WHERE id = $1`, id)
+	pi, err := scanPaymentIntent(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PaymentIntent{}, ErrNotFound
+	}
+	if err != nil {
+		return PaymentIntent{}, fmt.Errorf("get payment intent: %w", err)
+	}
+	return pi, nil
+}
+
+func (s *SQL) PaymentIntents(ctx context.Context, customerID string) ([]PaymentIntent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		`+selectPaymentIntents+`
+		WHERE customer_id = $1 ORDER BY created DESC, id DESC`, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("list payment intents: %w", err)
+	}
+	defer rows.Close()
+
+	var pis []PaymentIntent
+	for rows.Next() {
+		pi, err := scanPaymentIntent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan payment intent: %w", err)
+		}
+		pis = append(pis, pi)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list payment intents: %w", err)
+	}
+	return pis, nil
+}
+
+func (s *SQL) AddCapture(ctx context.Context, c Capture) (Capture, error) {
+	// the seq is read and written by one statement, concurrent captures of
+	// a payment intent cannot take the same one
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO captures (payment_intent_id, seq, amount, final, created)
+		SELECT $1, COALESCE(MAX(seq), 0) + 1, $2, $3, $4 FROM captures
+		WHERE payment_intent_id = $1
+		RETURNING seq`,
+		c.PaymentIntentID, c.Amount, c.Final, c.Created).Scan(&c.Seq)
+	if err != nil {
+		return Capture{}, fmt.Errorf("add capture: %w", err)
+	}
+	return c, nil
+}
+
+func (s *SQL) Captures(ctx context.Context, paymentIntentID string) ([]Capture, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT payment_intent_id, seq, amount, final, created FROM captures
+		WHERE payment_intent_id = $1 ORDER BY seq ASC`, paymentIntentID)
+	if err != nil {
+		return nil, fmt.Errorf("list captures: %w", err)
+	}
+	defer rows.Close()
+
+	var cs []Capture
+	for rows.Next() {
+		var c Capture
+		if err := rows.Scan(&c.PaymentIntentID, &c.Seq, &c.Amount, &c.Final, &c.Created); err != nil {
+			return nil, fmt.Errorf("scan capture: %w", err)
+		}
+		cs = append(cs, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list captures: %w", err)
+	}
+	return cs, nil
+}
+
+const refundColumns = `id, payment_intent_id, charge_id, amount, currency, status, reason, created`
+
+func scanRefund(row interface{ Scan(...interface{}) error }) (Refund, error) {
+	var r Refund
+	err := row.Scan(&r.ID, &r.PaymentIntentID, &r.ChargeID, &r.Amount, &r.Currency, &r.Status, &r.Reason, &r.Created)
+	return r, err
+}
+
+func (s *SQL) SaveRefund(ctx context.Context, r Refund) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO refunds (`+refundColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			payment_intent_id = excluded.payment_intent_id,
+			charge_id = excluded.charge_id,
+			amount = excluded.amount,
+			currency = excluded.currency,
+			status = excluded.status,
+			reason = excluded.reason,
+			created = excluded.created`,
+		r.ID, r.PaymentIntentID, r.ChargeID, r.Amount, r.Currency, r.Status, r.Reason, r.Created)
+	if err != nil {
+		return fmt.Errorf("save refund: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) Refund(ctx context.Context, id string) (Refund, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+refundColumns+` FROM refunds WHERE id = $1`, id)
+	r, err := scanRefund(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Refund{}, ErrNotFound
+	}
+	if err != nil {
+		return Refund{}, fmt.Errorf("get refund: %w", err)
+	}
+	return r, nil
+}
+
+func (s *SQL) Refunds(ctx context.Context, paymentIntentID string) ([]Refund, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+refundColumns+` FROM refunds
+		WHERE payment_intent_id = $1 ORDER BY created ASC, id ASC`, paymentIntentID)
+	if err != nil {
+		return nil, fmt.Errorf("list refunds: %w", err)
+	}
+	defer rows.Close()
+
+	var rs []Refund
+	for rows.Next() {
+		r, err := scanRefund(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan refund: %w", err)
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list refunds: %w", err)
+	}
+	return rs, nil
+}
+
+func (s *SQL) SaveSetupIntent(ctx context.Context, si SetupIntent) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO setup_intents (id, customer_id, payment_method_id, status, created)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET
+			customer_id = excluded.customer_id,
+			payment_method_id = excluded.payment_method_id,
+			status = excluded.status,
+			created = excluded.created`,
+		si.ID, si.CustomerID, si.PaymentMethodID, si.Status, si.Created)
+	if err != nil {
+		return fmt.Errorf("save setup intent: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) SetupIntent(ctx context.Context, id string) (SetupIntent, error) {
+	var si SetupIntent
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, customer_id, payment_method_id, status, created
+		FROM setup_intents WHERE id = $1`, id).
+		Scan(&si.ID, &si.CustomerID, &si.PaymentMethodID, &si.Status, &si.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SetupIntent{}, ErrNotFound
+	}
+	if err != nil {
+		return SetupIntent{}, fmt.Errorf("get setup intent: %w", err)
+	}
+	return si, nil
+}
+
+const holdColumns = `payment_intent_id, customer_id, purpose, status, amount, currency, created, authorized_at, expires_at, warned`
+
+func scanHold(row interface{ Scan(...interface{}) error }) (Hold, error) {
+	var h Hold
+	err := row.Scan(&h.PaymentIntentID, &h.CustomerID, &h.Purpose, &h.Status, &h.Amount,
+		&h.Currency, &h.Created, &h.AuthorizedAt, &h.ExpiresAt, &h.Warned)
+	return h, err
+}
+
+func (s *SQL) SaveHold(ctx context.Context, h Hold) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO holds (`+holdColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (payment_intent_id) DO UPDATE SET
+			customer_id = excluded.customer_id,
+			purpose = excluded.purpose,
+			status = excluded.status,
+			amount = excluded.amount,
+			currency = excluded.currency,
+			created = excluded.created,
+			authorized_at = excluded.authorized_at,
+			expires_at = excluded.expires_at,
+			warned = excluded.warned`,
+		h.PaymentIntentID, h.CustomerID, h.Purpose, h.Status, h.Amount,
+		h.Currency, h.Created, h.AuthorizedAt, h.ExpiresAt, h.Warned)
+	if err != nil {
+		return fmt.Errorf("save hold: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) Hold(ctx context.Context, paymentIntentID string) (Hold, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE payment_intent_id = $1`, paymentIntentID)
+	h, err := scanHold(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Hold{}, ErrNotFound
+	}
+	if err != nil {
+		return Hold{}, fmt.Errorf("get hold: %w", err)
+	}
+	return h, nil
+}
+
+func (s *SQL) Holds(ctx context.Context, filter HoldFilter) ([]Hold, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+holdColumns+` FROM holds
+		WHERE ($1 = '' OR status = $1) AND ($2 = '' OR purpose = $2) AND ($3 = 0 OR expires_at <= $3)
+		ORDER BY expires_at ASC, payment_intent_id ASC`,
+		filter.Status, filter.Purpose, filter.ExpiresBy)
+	if err != nil {
+		return nil, fmt.Errorf("list holds: %w", err)
+	}
+	defer rows.Close()
+
+	var hs []Hold
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan hold: %w", err)
+		}
+		hs = append(hs, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list holds: %w", err)
+	}
+	return hs, nil
+}
+
+func (s *SQL) EventProcessed(ctx context.Context, id string) (bool, error) {
+	var found string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM processed_events WHERE id = $1`, id).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("get processed event: %w", err)
+	}
+	return true, nil
+}
+
+func (s *SQL) MarkEventProcessed(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO processed_events (id) VALUES ($1) ON CONFLICT (id) DO NOTHING`, id)
+	if err != nil {
+		return fmt.Errorf("mark event processed: %w", err)
+	}
+	return nil
+}
+
+const inboxEventColumns = `id, type, payload, status, result, attempts, next_attempt, last_error, received`
+
+func (s *SQL) AddInboxEvent(ctx context.Context, e InboxEvent) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO inbox_events (`+inboxEventColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO NOTHING`,
+		e.ID, e.Type, string(e.Payload), e.Status, e.Result, e.Attempts, e.NextAttempt, e.LastError, e.Received)
+	if err != nil {
+		return false, fmt.Errorf("add inbox event: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("add inbox event: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (s *SQL) SaveInboxEvent(ctx context.Context, e InboxEvent) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO inbox_events (`+inboxEventColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			type = excluded.type,
+			payload = excluded.payload,
+			status = excluded.status,
+			result = excluded.result,
+			attempts = excluded.attempts,
+			next_attempt = excluded.next_attempt,
+			last_error = excluded.last_error,
+			received = excluded.received`,
+		e.ID, e.Type, string(e.Payload), e.Status, e.Result, e.Attempts, e.NextAttempt, e.LastError, e.Received)
+	if err != nil {
+		return fmt.Errorf("save inbox event: %w", err)
+	}
+	return nil
+}
+
+func scanInboxEvent(row interface{ Scan(...interface{}) error }) (InboxEvent, error) {
+	var e InboxEvent
+	var payload string
+	err := row.Scan(&e.ID, &e.Type, &payload, &e.Status, &e.Result, &e.Attempts, &e.NextAttempt, &e.LastError, &e.Received)
+	e.Payload = []byte(payload)
+	return e, err
+}
+
+func (s *SQL) InboxEvent(ctx context.Context, id string) (InboxEvent, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+inboxEventColumns+` FROM inbox_events WHERE id = $1`, id)
+	e, err := scanInboxEvent(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return InboxEvent{}, ErrNotFound
+	}
+	if err != nil {
+		return InboxEvent{}, fmt.Errorf("get inbox event: %w", err)
+	}
+	return e, nil
+}
+
+func (s *SQL) InboxEvents(ctx context.Context, filter InboxFilter) ([]InboxEvent, error) {
+	query := `
+		SELECT ` + inboxEventColumns + ` FROM inbox_events
+		WHERE ($1 = '' OR status = $1) AND ($2 = 0 OR next_attempt <= $2)
+		ORDER BY received ASC, id ASC`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, filter.Status, filter.DueBy)
+	if err != nil {
+		return nil, fmt.Errorf("list inbox events: %w", err)
+	}
+	defer rows.Close()
+
+	var es []InboxEvent
+	for rows.Next() {
+		e, err := scanInboxEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan inbox event: %w", err)
+		}
+		es = append(es, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list inbox events: %w", err)
+	}
+	return es, nil
+}
+
+func (s *SQL) SaveIdempotentResponse(ctx context.Context, r IdempotentResponse) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO idempotent_responses (key, request_hash, status, content_type, body, created)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET
+			request_hash = excluded.request_hash,
+			status = excluded.status,
+			content_type = excluded.content_type,
+			body = excluded.body,
+			created = excluded.created`,
+		r.Key, r.RequestHash, r.Status, r.ContentType, string(r.Body), r.Created)
+	if err != nil {
+		return fmt.Errorf("save idempotent response: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) IdempotentResponse(ctx context.Context, key string) (IdempotentResponse, error) {
+	var r IdempotentResponse
+	var body string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT key, request_hash, status, content_type, body, created
+		FROM idempotent_responses WHERE key = $1`, key).
+		Scan(&r.Key, &r.RequestHash, &r.Status, &r.ContentType, &body, &r.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return IdempotentResponse{}, ErrNotFound
+	}
+	if err != nil {
+		return IdempotentResponse{}, fmt.Errorf("get idempotent response: %w", err)
+	}
+	r.Body = []byte(body)
+	return r, nil
+}
+
+func (s *SQL) DeleteIdempotentResponses(ctx context.Context, before int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotent_responses WHERE created < $1`, before)
+	if err != nil {
+		return fmt.Errorf("delete idempotent responses: %w", err)
+	}
+	return nil
+}
+
+func (s *SQL) SaveApproval(ctx context.Context, a Approval) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO approvals (id, action, payment_intent_id, amount, currency, body, requested_by, decided_by, status, created, decided, attempts, result)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (id) DO UPDATE SET
+			action = excluded.action,
+			payment_intent_id = excluded.payment_intent_id,
+			amount = excluded.amount,
+			currency = excluded.currency,
+			body = excluded.body,
+			requested_by = excluded.requested_by,
+			decided_by = excluded.decided_by,
+			status = excluded.status,
+			created = excluded.created,
+			decided = excluded.decided,
+			attempts = excluded.attempts,
+			result = excluded.result`,
+		a.ID, a.Action, a.PaymentIntentID, a.Amount, a.Currency, string(a.Body), a.RequestedBy, a.DecidedBy, a.Status, a.Created, a.Decided,
+		a.Attempts, string(a.Result))
+	if err != nil {
+		return fmt.Errorf("save approval: %w", err)
+	}
+	return nil
+}
+
+const approvalColumns = `id, action, payment_intent_id, amount, currency, body, requested_by, decided_by, status, created, decided, attempts, result`
+
+func scanApproval(row interface{ Scan(...interface{}) error }) (Approval, error) {
+	var a Approval
+	var body, result string
+	err := row.Scan(&a.ID, &a.Action, &a.PaymentIntentID, &a.Amount, &a.Currency, &body,
+		&a.RequestedBy, &a.DecidedBy, &a.Status, &a.Created, &a.Decided, &a.Attempts, &result)
+	a.Body = []byte(body)
+	if result != "" {
+		a.Result = []byte(result)
+	}
+	return a, err
+}
+
+func (s *SQL) Approval(ctx context.Context, id string) (Approval, error) {
+	a, err := scanApproval(s.db.QueryRowContext(ctx, `SELECT `+approvalColumns+` FROM approvals WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Approval{}, ErrNotFound
+	}
+	if err != nil {
+		return Approval{}, fmt.Errorf("get approval: %w", err)
+	}
+	return a, nil
+}
+
+func (s *SQL) Approvals(ctx context.Context, status string) ([]Approval, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+approvalColumns+` FROM approvals
+		WHERE $1 = '' OR status = $1 ORDER BY created ASC, id ASC`, status)
+	if err != nil {
+		return nil, fmt.Errorf("list approvals: %w", err)
+	}
+	defer rows.Close()
+
+	var as []Approval
+	for rows.Next() {
+		a, err := scanApproval(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan approval: %w", err)
+		}
+		as = append(as, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list approvals: %w", err)
+	}
+	return as, nil
+}
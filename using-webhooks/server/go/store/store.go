@@ -0,0 +1,377 @@
+// Package store keeps a local copy of the Stripe objects the server works
+// with, so handlers can answer from local state instead of calling Stripe
+// on every request.
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/stripe/stripe-go/v80"
+)
+
+// ErrNotFound is returned when the requested record is not in the store.
+var ErrNotFound = errors.New("store: not found")
+
+// Store records customers, saved payment methods, payment intents with their
+// captures and refunds, setup intents, authorization holds, the inbox of
+// received webhook events, the events already processed, the responses to
+// idempotent requests and the back-office requests awaiting approval. Save
+// methods insert the record or replace the stored one with the same ID.
+type Store interface {
+	SaveCustomer(ctx context.Context, c Customer) error
+	Customer(ctx context.Context, id string) (Customer, error)
+	CustomerByUserID(ctx context.Context, userID string) (Customer, error)
+
+	SavePaymentMethod(ctx context.Context, pm PaymentMethod) error
+	DeletePaymentMethod(ctx context.Context, id string) error
+	PaymentMethod(ctx context.Context, id string) (PaymentMethod, error)
+	// PaymentMethods lists the payment methods saved to the customer.
+	PaymentMethods(ctx context.Context, customerID string) ([]PaymentMethod, error)
+
+	SavePaymentIntent(ctx context.Context, pi PaymentIntent) error
+	PaymentIntent(ctx context.Context, id string) (PaymentIntent, error)
+	// PaymentIntents lists the payment intents of the customer, most recent first.
+	PaymentIntents(ctx context.Context, customerID string) ([]PaymentIntent, error)
+
+	// AddCapture records a capture after the last one of its payment
+	// intent and returns it with its Seq, the Seq of c is ignored.
+	AddCapture(ctx context.Context, c Capture) (Capture, error)
+	// Captures lists the captures of the payment intent in Seq order.
+	Captures(ctx context.Context, paymentIntentID string) ([]Capture, error)
+
+	SaveRefund(ctx context.Context, r Refund) error
+	Refund(ctx context.Context, id string) (Refund, error)
+	// Refunds lists the refunds of the payment intent, oldest first.
+	Refunds(ctx context.Context, paymentIntentID string) ([]Refund, error)
+
+	SaveSetupIntent(ctx context.Context, si SetupIntent) error
+	SetupIntent(ctx context.Context, id string) (SetupIntent, error)
+
+	SaveHold(ctx context.Context, h Hold) error
+	Hold(ctx context.Context, paymentIntentID string) (Hold, error)
+	// Holds lists the holds matching filter, the ones expiring first first.
+	Holds(ctx context.Context, filter HoldFilter) ([]Hold, error)
+
+	// EventProcessed reports whether MarkEventProcessed was called for the
+	// webhook event.
+	EventProcessed(ctx context.Context, id string) (bool, error)
+	MarkEventProcessed(ctx context.Context, id string) error
+
+	// AddInboxEvent inserts e unless an event with the same ID is already
+	// in the inbox, and reports whether it was inserted.
+	AddInboxEvent(ctx context.Context, e InboxEvent) (bool, error)
+	SaveInboxEvent(ctx context.Context, e InboxEvent) error
+	InboxEvent(ctx context.Context, id string) (InboxEvent, error)
+	// InboxEvents lists the inbox events matching filter, oldest first.
+	InboxEvents(ctx context.Context, filter InboxFilter) ([]InboxEvent, error)
+
+	SaveIdempotentResponse(ctx context.Context, r IdempotentResponse) error
+	IdempotentResponse(ctx context.Context, key string) (IdempotentResponse, error)
+	// DeleteIdempotentResponses deletes the responses created before the
+	// Unix time.
+	DeleteIdempotentResponses(ctx context.Context, before int64) error
+
+	SaveApproval(ctx context.Context, a Approval) error
+	Approval(ctx context.Context, id string) (Approval, error)
+	// Approvals lists the approvals with the status, or all of them when
+	// empty, oldest first.
+	Approvals(ctx context.Context, status string) ([]Approval, error)
+}
+
+// Customer links a user of the application to a Stripe Customer.
+type Customer struct {
+	ID     string
+	UserID string
+}
+
+// PaymentMethod is a payment method saved to a customer.
+type PaymentMethod struct {
+	ID             string
+	CustomerID     string
+	Type           string
+	Brand          string
+	Last4          string
+	ExpMonth       int64
+	ExpYear        int64
+	AllowRedisplay string
+	Created        int64
+}
+
+// PaymentIntent is the last known state of a Stripe PaymentIntent.
+type PaymentIntent struct {
+	ID               string
+	CustomerID       string
+	PaymentMethodID  string
+	Status           string
+	CaptureMethod    string
+	Currency         string
+	Amount           int64
+	AmountCapturable int64
+	AmountReceived   int64
+	// AmountRefunded is the sum of the recorded refunds of the payment
+	// intent which did not fail and were not canceled. It is computed when
+	// the payment intent is read, SavePaymentIntent ignores it.
+	AmountRefunded int64
+	Created        int64
+	// Updated is the creation time, in Unix time, of the most recent webhook
+	// event recorded for the payment intent. It only moves forward:
+	// SavePaymentIntent keeps the recorded value when pi.Updated is older,
+	// states read from the API are saved with a zero Updated.
+	Updated int64
+}
+
+// Capture is an amount captured from a payment intent. A payment intent
+// authorized with multicapture is captured several times, the last capture
+// being final.
+type Capture struct {
+	PaymentIntentID string
+	Seq             int
+	Amount          int64
+	Final           bool
+	Created         int64
+}
+
+// Refund statuses which do not count towards the refunded amount.
+const (
+	RefundFailed   = "failed"
+	RefundCanceled = "canceled"
+)
+
+// Refund is the last known state of a Stripe Refund of a payment intent.
+type Refund struct {
+	ID              string
+	PaymentIntentID string
+	ChargeID        string
+	Amount          int64
+	Currency        string
+	Status          string
+	Reason          string
+	Created         int64
+}
+
+func (r Refund) counts() bool {
+	return r.Status != RefundFailed && r.Status != RefundCanceled
+}
+
+// IdempotentResponse is the response to a request made with an idempotency
+// key, replayed when the request is sent again with the same key.
+type IdempotentResponse struct {
+	Key string
+	// RequestHash identifies the request, a key cannot be reused for
+	// another request.
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+	Created     int64
+}
+
+// SetupIntent is the last known state of a Stripe SetupIntent.
+type SetupIntent struct {
+	ID              string
+	CustomerID      string
+	PaymentMethodID string
+	Status          string
+	Created         int64
+}
+
+// Hold purposes.
+const (
+	// HoldVerification holds only verify the card and are released once
+	// authorized.
+	HoldVerification = "verification"
+	// HoldOrder holds reserve the amount of an order until it is captured
+	// on fulfillment.
+	HoldOrder = "order"
+)
+
+// Hold statuses.
+const (
+	HoldPending    = "pending"
+	HoldAuthorized = "authorized"
+	HoldCaptured   = "captured"
+	HoldCanceled   = "canceled"
+)
+
+// Hold is an authorization placed with a manual-capture payment intent.
+type Hold struct {
+	PaymentIntentID string
+	CustomerID      string
+	Purpose         string
+	Status          string
+	Amount          int64
+	Currency        string
+	Created         int64
+	// AuthorizedAt is the Unix time the card was authorized, zero until then.
+	AuthorizedAt int64
+	// ExpiresAt is the Unix time the authorization lapses, zero until the
+	// card is authorized.
+	ExpiresAt int64
+	// Warned is set once the expiry warning was issued.
+	Warned bool
+}
+
+// HoldFilter selects holds. Zero fields match every hold.
+type HoldFilter struct {
+	Status  string
+	Purpose string
+	// ExpiresBy keeps the holds expiring at or before this Unix time.
+	ExpiresBy int64
+}
+
+func (f HoldFilter) matches(h Hold) bool {
+	return (f.Status == "" || h.Status == f.Status) &&
+		(f.Purpose == "" || h.Purpose == f.Purpose) &&
+		(f.ExpiresBy == 0 || h.ExpiresAt <= f.ExpiresBy)
+}
+
+// Inbox event statuses.
+const (
+	InboxPending    = "pending"
+	InboxProcessing = "processing"
+	InboxDone       = "done"
+	InboxDead       = "dead"
+)
+
+// InboxEvent is a webhook event waiting to be processed, or processed.
+type InboxEvent struct {
+	ID      string
+	Type    string
+	Payload []byte
+	Status  string
+	// Result tells what processing the event did, see events.Result.
+	Result   string
+	Attempts int
+	// NextAttempt is the Unix time before which a pending event is not
+	// processed.
+	NextAttempt int64
+	LastError   string
+	Received    int64
+}
+
+// InboxFilter selects inbox events. Zero fields match every event.
+type InboxFilter struct {
+	Status string
+	// DueBy keeps the events whose NextAttempt is at or before this Unix time.
+	DueBy int64
+	Limit int
+}
+
+func (f InboxFilter) matches(e InboxEvent) bool {
+	return (f.Status == "" || e.Status == f.Status) && (f.DueBy == 0 || e.NextAttempt <= f.DueBy)
+}
+
+// Approval statuses.
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+	// ApprovalFailed approvals were approved but their request failed, they
+	// can be approved again or rejected.
+	ApprovalFailed = "failed"
+)
+
+// Approval is a back-office request above the approval threshold, held
+// until a second operator approves or rejects it.
+type Approval struct {
+	ID     string
+	Action string
+	// PaymentIntentID is the payment intent acted on, empty for charges.
+	PaymentIntentID string
+	Amount          int64
+	Currency        string
+	// Body is the request made once approved.
+	Body        []byte
+	RequestedBy string
+	DecidedBy   string
+	Status      string
+	Created     int64
+	// Decided is the Unix time the approval was approved or rejected.
+	Decided int64
+	// Attempts counts the failed requests Stripe answered, each attempt
+	// calls Stripe with an idempotency key of its own.
+	Attempts int
+	// Result is the response to the last request made.
+	Result []byte
+}
+
+// PaymentMethodFromStripe converts a Stripe PaymentMethod into its stored form.
+func PaymentMethodFromStripe(pm *stripe.PaymentMethod) PaymentMethod {
+	rec := PaymentMethod{
+		ID:             pm.ID,
+		Type:           string(pm.Type),
+		AllowRedisplay: string(pm.AllowRedisplay),
+		Created:        pm.Created,
+	}
+	if pm.Customer != nil {
+		rec.CustomerID = pm.Customer.ID
+	}
+	if pm.Card != nil {
+		rec.Brand = string(pm.Card.Brand)
+		rec.Last4 = pm.Card.Last4
+		rec.ExpMonth = int64(pm.Card.ExpMonth)
+		rec.ExpYear = int64(pm.Card.ExpYear)
+	}
+	if pm.USBankAccount != nil {
+		rec.Brand = pm.USBankAccount.BankName
+		rec.Last4 = pm.USBankAccount.Last4
+	}
+	return rec
+}
+
+// PaymentIntentFromStripe converts a Stripe PaymentIntent into its stored form.
+func PaymentIntentFromStripe(pi *stripe.PaymentIntent) PaymentIntent {
+	rec := PaymentIntent{
+		ID:               pi.ID,
+		Status:           string(pi.Status),
+		CaptureMethod:    string(pi.CaptureMethod),
+		Currency:         string(pi.Currency),
+		Amount:           pi.Amount,
+		AmountCapturable: pi.AmountCapturable,
+		AmountReceived:   pi.AmountReceived,
+		Created:          pi.Created,
+	}
+	if pi.Customer != nil {
+		rec.CustomerID = pi.Customer.ID
+	}
+	if pi.PaymentMethod != nil {
+		rec.PaymentMethodID = pi.PaymentMethod.ID
+	}
+	return rec
+}
+
+// RefundFromStripe converts a Stripe Refund into its stored form.
+func RefundFromStripe(r *stripe.Refund) Refund {
+	rec := Refund{
+		ID:       r.ID,
+		Amount:   r.Amount,
+		Currency: string(r.Currency),
+		Status:   string(r.Status),
+		Reason:   string(r.Reason),
+		Created:  r.Created,
+	}
+	if r.PaymentIntent != nil {
+		rec.PaymentIntentID = r.PaymentIntent.ID
+	}
+	if r.Charge != nil {
+		rec.ChargeID = r.Charge.ID
+	}
+	return rec
+}
+
+// SetupIntentFromStripe converts a Stripe SetupIntent into its stored form.
+func SetupIntentFromStripe(si *stripe.SetupIntent) SetupIntent {
+	rec := SetupIntent{
+		ID:      si.ID,
+		Status:  string(si.Status),
+		Created: si.Created,
+	}
+	if si.Customer != nil {
+		rec.CustomerID = si.Customer.ID
+	}
+	if si.PaymentMethod != nil {
+		rec.PaymentMethodID = si.PaymentMethod.ID
+	}
+	return rec
+}
@@ -0,0 +1,409 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func newSQLiteStore(t *testing.T) Store {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	// every connection to ":memory:" opens a separate database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	s, err := NewSQL(context.Background(), db)
+	require.NoError(t, err)
+	return s
+}
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return NewMemory() },
+		"sqlite": newSQLiteStore,
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			t.Run("customers", func(t *testing.T) { testCustomers(t, newStore(t)) })
+			t.Run("payment methods", func(t *testing.T) { testPaymentMethods(t, newStore(t)) })
+			t.Run("payment intents", func(t *testing.T) { testPaymentIntents(t, newStore(t)) })
+			t.Run("captures", func(t *testing.T) { testCaptures(t, newStore(t)) })
+			t.Run("refunds", func(t *testing.T) { testRefunds(t, newStore(t)) })
+			t.Run("setup intents", func(t *testing.T) { testSetupIntents(t, newStore(t)) })
+			t.Run("holds", func(t *testing.T) { testHolds(t, newStore(t)) })
+			t.Run("processed events", func(t *testing.T) { testProcessedEvents(t, newStore(t)) })
+			t.Run("inbox", func(t *testing.T) { testInbox(t, newStore(t)) })
+			t.Run("idempotent responses", func(t *testing.T) { testIdempotentResponses(t, newStore(t)) })
+			t.Run("approvals", func(t *testing.T) { testApprovals(t, newStore(t)) })
+		})
+	}
+}
+
+func testCustomers(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	_, err := s.CustomerByUserID(ctx, "user_1")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, s.SaveCustomer(ctx, Customer{ID: "cus_1", UserID: "user_1"}))
+	require.NoError(t, s.SaveCustomer(ctx, Customer{ID: "cus_2", UserID: "user_2"}))
+
+	c, err := s.CustomerByUserID(ctx, "user_2")
+	require.NoError(t, err)
+	require.Equal(t, Customer{ID: "cus_2", UserID: "user_2"}, c)
+
+	c, err = s.Customer(ctx, "cus_1")
+	require.NoError(t, err)
+	require.Equal(t, "user_1", c.UserID)
+
+	_, err = s.Customer(ctx, "cus_3")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func testPaymentMethods(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	older := PaymentMethod{ID: "pm_1", CustomerID: "cus_1", Type: "card", Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030, AllowRedisplay: "always", Created: 100}
+	newer := PaymentMethod{ID: "pm_2", CustomerID: "cus_1", Type: "card", Brand: "mastercard", Last4: "4444", ExpMonth: 1, ExpYear: 2031, AllowRedisplay: "limited", Created: 200}
+	other := PaymentMethod{ID: "pm_3", CustomerID: "cus_2", Type: "us_bank_account", Last4: "6789", Created: 300}
+	for _, pm := range []PaymentMethod{older, newer, other} {
+		require.NoError(t, s.SavePaymentMethod(ctx, pm))
+	}
+
+	pms, err := s.PaymentMethods(ctx, "cus_1")
+	require.NoError(t, err)
+	require.Equal(t, []PaymentMethod{newer, older}, pms)
+
+	older.AllowRedisplay = "unspecified"
+	require.NoError(t, s.SavePaymentMethod(ctx, older))
+	pm, err := s.PaymentMethod(ctx, "pm_1")
+	require.NoError(t, err)
+	require.Equal(t, older, pm)
+
+	require.NoError(t, s.DeletePaymentMethod(ctx, "pm_2"))
+	_, err = s.PaymentMethod(ctx, "pm_2")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	pms, err = s.PaymentMethods(ctx, "cus_1")
+	require.NoError(t, err)
+	require.Equal(t, []PaymentMethod{older}, pms)
+}
+
+func testPaymentIntents(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	first := PaymentIntent{ID: "pi_1", CustomerID: "cus_1", Status: "requires_payment_method", CaptureMethod: "manual", Currency: "usd", Amount: 100, Created: 100}
+	second := PaymentIntent{ID: "pi_2", CustomerID: "cus_1", Status: "succeeded", CaptureMethod: "automatic", Currency: "usd", Amount: 310, AmountReceived: 310, Created: 200}
+	require.NoError(t, s.SavePaymentIntent(ctx, first))
+	require.NoError(t, s.SavePaymentIntent(ctx, second))
+
+	first.Status = "requires_capture"
+	first.PaymentMethodID = "pm_1"
+	first.AmountCapturable = 100
+	first.Updated = 150
+	require.NoError(t, s.SavePaymentIntent(ctx, first))
+
+	pi, err := s.PaymentIntent(ctx, "pi_1")
+	require.NoError(t, err)
+	require.Equal(t, first, pi)
+
+	// a state read from the API keeps the time of the last event
+	first.Status = "canceled"
+	first.Updated = 0
+	require.NoError(t, s.SavePaymentIntent(ctx, first))
+	first.Updated = 150
+
+	pi, err = s.PaymentIntent(ctx, "pi_1")
+	require.NoError(t, err)
+	require.Equal(t, first, pi)
+
+	pis, err := s.PaymentIntents(ctx, "cus_1")
+	require.NoError(t, err)
+	require.Equal(t, []PaymentIntent{second, first}, pis)
+
+	pis, err = s.PaymentIntents(ctx, "cus_2")
+	require.NoError(t, err)
+	require.Empty(t, pis)
+
+	_, err = s.PaymentIntent(ctx, "pi_3")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func testSetupIntents(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	si := SetupIntent{ID: "seti_1", CustomerID: "cus_1", Status: "requires_payment_method", Created: 100}
+	require.NoError(t, s.SaveSetupIntent(ctx, si))
+
+	si.Status = "succeeded"
+	si.PaymentMethodID = "pm_1"
+	require.NoError(t, s.SaveSetupIntent(ctx, si))
+
+	got, err := s.SetupIntent(ctx, "seti_1")
+	require.NoError(t, err)
+	require.Equal(t, si, got)
+
+	_, err = s.SetupIntent(ctx, "seti_2")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func testProcessedEvents(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	processed, err := s.EventProcessed(ctx, "evt_1")
+	require.NoError(t, err)
+	require.False(t, processed)
+
+	require.NoError(t, s.MarkEventProcessed(ctx, "evt_1"))
+	require.NoError(t, s.MarkEventProcessed(ctx, "evt_1"))
+
+	processed, err = s.EventProcessed(ctx, "evt_1")
+	require.NoError(t, err)
+	require.True(t, processed)
+
+	processed, err = s.EventProcessed(ctx, "evt_2")
+	require.NoError(t, err)
+	require.False(t, processed)
+}
+
+func testInbox(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	first := InboxEvent{ID: "evt_1", Type: "payment_intent.succeeded", Payload: []byte(`{"id":"evt_1"}`), Status: InboxPending, NextAttempt: 100, Received: 100}
+	second := InboxEvent{ID: "evt_2", Type: "charge.refunded", Payload: []byte(`{"id":"evt_2"}`), Status: InboxPending, NextAttempt: 300, Received: 200}
+	for _, e := range []InboxEvent{first, second} {
+		added, err := s.AddInboxEvent(ctx, e)
+		require.NoError(t, err)
+		require.True(t, added)
+	}
+	added, err := s.AddInboxEvent(ctx, InboxEvent{ID: "evt_1", Type: "other", Status: InboxPending})
+	require.NoError(t, err)
+	require.False(t, added, "an event already in the inbox is not replaced")
+
+	got, err := s.InboxEvent(ctx, "evt_1")
+	require.NoError(t, err)
+	require.Equal(t, first, got)
+
+	due, err := s.InboxEvents(ctx, InboxFilter{Status: InboxPending, DueBy: 150})
+	require.NoError(t, err)
+	require.Equal(t, []InboxEvent{first}, due)
+
+	all, err := s.InboxEvents(ctx, InboxFilter{})
+	require.NoError(t, err)
+	require.Equal(t, []InboxEvent{first, second}, all)
+
+	limited, err := s.InboxEvents(ctx, InboxFilter{Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, []InboxEvent{first}, limited)
+
+	second.Status = InboxDead
+	second.Attempts = 8
+	second.LastError = "boom"
+	require.NoError(t, s.SaveInboxEvent(ctx, second))
+	dead, err := s.InboxEvents(ctx, InboxFilter{Status: InboxDead})
+	require.NoError(t, err)
+	require.Equal(t, []InboxEvent{second}, dead)
+
+	_, err = s.InboxEvent(ctx, "evt_3")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func testHolds(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	verification := Hold{PaymentIntentID: "pi_1", CustomerID: "cus_1", Purpose: HoldVerification, Status: HoldPending, Amount: 100, Currency: "usd", Created: 100}
+	order := Hold{PaymentIntentID: "pi_2", CustomerID: "cus_1", Purpose: HoldOrder, Status: HoldPending, Amount: 1400, Currency: "usd", Created: 200}
+	require.NoError(t, s.SaveHold(ctx, verification))
+	require.NoError(t, s.SaveHold(ctx, order))
+
+	order.Status = HoldAuthorized
+	order.AuthorizedAt = 300
+	order.ExpiresAt = 900
+	order.Warned = true
+	require.NoError(t, s.SaveHold(ctx, order))
+
+	got, err := s.Hold(ctx, "pi_2")
+	require.NoError(t, err)
+	require.Equal(t, order, got)
+
+	authorized, err := s.Holds(ctx, HoldFilter{Status: HoldAuthorized, ExpiresBy: 1000})
+	require.NoError(t, err)
+	require.Equal(t, []Hold{order}, authorized)
+
+	none, err := s.Holds(ctx, HoldFilter{Status: HoldAuthorized, ExpiresBy: 800})
+	require.NoError(t, err)
+	require.Empty(t, none)
+
+	verifications, err := s.Holds(ctx, HoldFilter{Purpose: HoldVerification})
+	require.NoError(t, err)
+	require.Equal(t, []Hold{verification}, verifications)
+
+	_, err = s.Hold(ctx, "pi_3")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func testCaptures(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	first := Capture{PaymentIntentID: "pi_1", Seq: 1, Amount: 1000, Created: 100}
+	other := Capture{PaymentIntentID: "pi_2", Seq: 1, Amount: 310, Final: true, Created: 150}
+	second := Capture{PaymentIntentID: "pi_1", Seq: 2, Amount: 400, Final: true, Created: 200}
+	for _, c := range []Capture{first, other, second} {
+		// the store numbers the captures, whatever the caller sent
+		sent := c
+		sent.Seq = 7
+		added, err := s.AddCapture(ctx, sent)
+		require.NoError(t, err)
+		require.Equal(t, c, added)
+	}
+
+	got, err := s.Captures(ctx, "pi_1")
+	require.NoError(t, err)
+	require.Equal(t, []Capture{first, second}, got)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.AddCapture(ctx, Capture{PaymentIntentID: "pi_4", Amount: 100, Created: 300})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	concurrent, err := s.Captures(ctx, "pi_4")
+	require.NoError(t, err)
+	require.Len(t, concurrent, 10)
+	for i, c := range concurrent {
+		require.Equal(t, i+1, c.Seq)
+	}
+
+	none, err := s.Captures(ctx, "pi_3")
+	require.NoError(t, err)
+	require.Empty(t, none)
+}
+
+func testRefunds(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	pi := PaymentIntent{ID: "pi_1", CustomerID: "cus_1", Status: "succeeded", CaptureMethod: "automatic", Currency: "usd", Amount: 1400, AmountReceived: 1400, Created: 100}
+	require.NoError(t, s.SavePaymentIntent(ctx, pi))
+
+	first := Refund{ID: "re_1", PaymentIntentID: "pi_1", ChargeID: "ch_1", Amount: 400, Currency: "usd", Status: "pending", Reason: "requested_by_customer", Created: 200}
+	second := Refund{ID: "re_2", PaymentIntentID: "pi_1", ChargeID: "ch_1", Amount: 300, Currency: "usd", Status: "succeeded", Created: 300}
+	other := Refund{ID: "re_3", PaymentIntentID: "pi_2", Amount: 310, Currency: "usd", Status: "succeeded", Created: 250}
+	for _, r := range []Refund{second, first, other} {
+		require.NoError(t, s.SaveRefund(ctx, r))
+	}
+
+	got, err := s.Refunds(ctx, "pi_1")
+	require.NoError(t, err)
+	require.Equal(t, []Refund{first, second}, got)
+
+	rec, err := s.PaymentIntent(ctx, "pi_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(700), rec.AmountRefunded)
+
+	// failed refunds do not count, saving the payment intent keeps the sum
+	first.Status = RefundFailed
+	require.NoError(t, s.SaveRefund(ctx, first))
+	pi.Updated = 400
+	require.NoError(t, s.SavePaymentIntent(ctx, pi))
+	pis, err := s.PaymentIntents(ctx, "cus_1")
+	require.NoError(t, err)
+	require.Len(t, pis, 1)
+	require.Equal(t, int64(300), pis[0].AmountRefunded)
+
+	r, err := s.Refund(ctx, "re_1")
+	require.NoError(t, err)
+	require.Equal(t, first, r)
+
+	_, err = s.Refund(ctx, "re_4")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func testIdempotentResponses(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	old := IdempotentResponse{Key: "key_1", RequestHash: "hash_1", Status: 200, ContentType: "application/json", Body: []byte(`{"id":"pi_1"}`), Created: 100}
+	recent := IdempotentResponse{Key: "key_2", RequestHash: "hash_2", Status: 400, ContentType: "text/plain; charset=utf-8", Body: []byte("bad request\n"), Created: 200}
+	require.NoError(t, s.SaveIdempotentResponse(ctx, old))
+	require.NoError(t, s.SaveIdempotentResponse(ctx, recent))
+
+	got, err := s.IdempotentResponse(ctx, "key_1")
+	require.NoError(t, err)
+	require.Equal(t, old, got)
+
+	require.NoError(t, s.DeleteIdempotentResponses(ctx, 200))
+	_, err = s.IdempotentResponse(ctx, "key_1")
+	require.ErrorIs(t, err, ErrNotFound)
+	got, err = s.IdempotentResponse(ctx, "key_2")
+	require.NoError(t, err)
+	require.Equal(t, recent, got)
+}
+
+func testApprovals(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	refund := Approval{
+		ID: "apr_1", Action: "refund", PaymentIntentID: "pi_1", Amount: 50000, Currency: "usd",
+		Body: []byte(`{"paymentIntentID":"pi_1"}`), RequestedBy: "alice", Status: ApprovalPending, Created: 100,
+	}
+	charge := Approval{
+		ID: "apr_2", Action: "charge", Amount: 90000, Currency: "eur",
+		Body: []byte(`{"userID":"user_1","amount":90000}`), RequestedBy: "bob", Status: ApprovalPending, Created: 200,
+	}
+	require.NoError(t, s.SaveApproval(ctx, charge))
+	require.NoError(t, s.SaveApproval(ctx, refund))
+
+	got, err := s.Approval(ctx, "apr_1")
+	require.NoError(t, err)
+	require.Equal(t, refund, got)
+	_, err = s.Approval(ctx, "apr_3")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	refund.Status, refund.DecidedBy, refund.Decided = ApprovalFailed, "bob", 300
+	refund.Attempts, refund.Result = 1, []byte(`{"error":{"type":"card_error"}}`)
+	require.NoError(t, s.SaveApproval(ctx, refund))
+	got, err = s.Approval(ctx, "apr_1")
+	require.NoError(t, err)
+	require.Equal(t, refund, got)
+	refund.Status, refund.Attempts, refund.Result = ApprovalApproved, 1, []byte(`{"id":"re_1"}`)
+	require.NoError(t, s.SaveApproval(ctx, refund))
+
+	pending, err := s.Approvals(ctx, ApprovalPending)
+	require.NoError(t, err)
+	require.Equal(t, []Approval{charge}, pending)
+	all, err := s.Approvals(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []Approval{refund, charge}, all)
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	// the migrations are applied once
+	for i := 0; i < 2; i++ {
+		_, err = NewSQL(ctx, db)
+		require.NoError(t, err)
+	}
+	var versions, latest int
+	require.NoError(t, db.QueryRowContext(ctx, `SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&versions, &latest))
+	require.Equal(t, len(migrations), versions)
+	require.Equal(t, len(migrations), latest)
+
+	// a database migrated by a newer server is left alone
+	_, err = db.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, len(migrations)+1)
+	require.NoError(t, err)
+	_, err = NewSQL(ctx, db)
+	require.Error(t, err)
+}
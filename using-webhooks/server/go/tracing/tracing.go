@@ -0,0 +1,140 @@
+// Package tracing sets up the OpenTelemetry traces of the server. The spans
+// of a request, of the Stripe requests it makes and of the webhook events
+// about the intents it created are linked through the W3C trace context,
+// carried in the metadata of the intents.
+package tracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe/stripe-go/v80"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name is the name of the tracers of the server.
+const Name = "github.com/stripe-samples/saving-card-after-payment/server/go"
+
+// MetadataKey is the metadata key of the intents holding the trace context
+// of the request which created them, as a W3C traceparent.
+const MetadataKey = "traceparent"
+
+// CorrelationMetadataKey is the metadata key of the intents created with an
+// idempotency key, holding the correlation ID of the key in place of the
+// trace context, see CorrelationID.
+const CorrelationMetadataKey = "correlation_id"
+
+// The attributes of the spans which are not covered by the semantic
+// conventions.
+const (
+	RequestIDKey       = attribute.Key("request.id")
+	StripeOperationKey = attribute.Key("stripe.operation")
+	StripeRequestIDKey = attribute.Key("stripe.request_id")
+	StripeErrorCodeKey = attribute.Key("stripe.error_code")
+	EventIDKey         = attribute.Key("stripe.event.id")
+	EventTypeKey       = attribute.Key("stripe.event.type")
+	EventResultKey     = attribute.Key("stripe.event.result")
+	CorrelationIDKey   = attribute.Key("stripe.correlation_id")
+)
+
+// defaultServiceName names the service unless OTEL_SERVICE_NAME is set.
+const defaultServiceName = "saving-card-after-payment"
+
+// propagator reads and writes the W3C trace context.
+var propagator = propagation.TraceContext{}
+
+// Setup installs the propagation of the W3C trace context and, when
+// endpoint is set, a tracer provider exporting the spans over OTLP/HTTP to
+// endpoint, like http://localhost:4318. The spans are not recorded
+// otherwise. The returned function flushes the spans and stops the
+// export.
+func Setup(ctx context.Context, endpoint string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagator)
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: exporter: %w", err)
+	}
+	resource, err := sdkresource.New(ctx,
+		sdkresource.WithAttributes(attribute.String("service.name", defaultServiceName)),
+		sdkresource.WithFromEnv(),
+		sdkresource.WithTelemetrySDK(),
+	)
+	if err != nil && !errors.Is(err, sdkresource.ErrPartialResource) {
+		return nil, fmt.Errorf("tracing: resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of the server, from the installed provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// Extract returns a copy of ctx carrying the trace context sent in the
+// headers of a request, to continue the trace of the caller.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Traceparent returns the W3C traceparent of the span of ctx, or an empty
+// string when ctx has no sampled span.
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(MetadataKey)
+}
+
+// CorrelationID returns the ID tagging the spans of the requests made with
+// the idempotency key and of the webhook events about the intent they
+// created. Unlike the trace context it is the same for every retry of the
+// request, as Stripe requires of the parameters sent with a key.
+func CorrelationID(idempotencyKey string) string {
+	sum := sha256.Sum256([]byte(idempotencyKey))
+	return hex.EncodeToString(sum[:16])
+}
+
+// LinkTo returns the link to the span whose W3C traceparent is given,
+// reporting false when traceparent is not a valid one.
+func LinkTo(traceparent string) (trace.Link, bool) {
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{MetadataKey: traceparent})
+	sc := trace.SpanContextFromContext(ctx)
+	return trace.Link{SpanContext: sc}, sc.IsValid()
+}
+
+// SetError marks span failed with err. The errors returned by Stripe are
+// described by their type and code, and the ID of the request, their
+// message may quote the details of the customer. Other errors are redacted
+// like the logs.
+func SetError(span trace.Span, err error) {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		span.SetStatus(codes.Error, logging.RedactString(err.Error()))
+		return
+	}
+	span.SetAttributes(StripeErrorCodeKey.String(string(stripeErr.Code)))
+	if stripeErr.RequestID != "" {
+		span.SetAttributes(StripeRequestIDKey.String(stripeErr.RequestID))
+	}
+	span.SetStatus(codes.Error, fmt.Sprintf("%s %s", stripeErr.Type, stripeErr.Code))
+}
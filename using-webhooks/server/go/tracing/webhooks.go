@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/events"
+	"github.com/stripe/stripe-go/v80"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EventOrigin returns the link to the span of the request which created the
+// intent event is about, read from the metadata of the intent. It reports
+// false for the events about other objects, or about intents created
+// elsewhere.
+func EventOrigin(event *stripe.Event) (trace.Link, bool) {
+	traceparent := eventMetadata(event, MetadataKey)
+	if traceparent == "" {
+		return trace.Link{}, false
+	}
+	return LinkTo(traceparent)
+}
+
+// EventCorrelationID returns the correlation ID of the intent event is
+// about, see CorrelationID, or an empty string when the intent was created
+// without an idempotency key.
+func EventCorrelationID(event *stripe.Event) string {
+	return eventMetadata(event, CorrelationMetadataKey)
+}
+
+// eventMetadata returns the metadata value of the object event is about.
+func eventMetadata(event *stripe.Event, key string) string {
+	if event.Data == nil {
+		return ""
+	}
+	metadata, _ := event.Data.Object["metadata"].(map[string]interface{})
+	value, _ := metadata[key].(string)
+	return value
+}
+
+// Webhooks is an events.Middleware tracing the processing of every webhook
+// event in a span of its own, linked to its origin, see EventOrigin, or
+// tagged with its correlation ID, see EventCorrelationID. The
+// events are processed after they were acknowledged to Stripe, so the span
+// is the root of a new trace.
+func Webhooks(next events.DispatchFunc) events.DispatchFunc {
+	return func(ctx context.Context, event *stripe.Event) (events.Result, error) {
+		opts := []trace.SpanStartOption{
+			trace.WithNewRoot(),
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(EventIDKey.String(event.ID), EventTypeKey.String(string(event.Type))),
+		}
+		if link, ok := EventOrigin(event); ok {
+			opts = append(opts, trace.WithLinks(link))
+		}
+		if id := EventCorrelationID(event); id != "" {
+			opts = append(opts, trace.WithAttributes(CorrelationIDKey.String(id)))
+		}
+		ctx, span := Tracer().Start(ctx, "webhook "+string(event.Type), opts...)
+		defer span.End()
+
+		result, err := next(ctx, event)
+		span.SetAttributes(EventResultKey.String(result.String()))
+		if err != nil {
+			SetError(span, err)
+		}
+		return result, err
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/auth"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/tracing"
+	"github.com/stripe/stripe-go/v80"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider recording the ended spans for the
+// duration of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return recorder
+}
+
+// spanNamed returns the ended span with the given name.
+func spanNamed(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	require.FailNow(t, "no span named "+name)
+	return nil
+}
+
+func attributeOf(span sdktrace.ReadOnlySpan, key string) string {
+	for _, a := range span.Attributes() {
+		if string(a.Key) == key {
+			return a.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracing(t *testing.T) {
+	recorder := recordSpans(t)
+	s, fake := newTestServer(t)
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	r := httptest.NewRequest(http.MethodPost, "/create-payment-intent", strings.NewReader(`{"currency": "usd", "items": [{"id": "photo-subscription"}]}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(auth.UserIDHeader, "user_1")
+	r.Header.Set("traceparent", traceparent)
+	r.Header.Set(requestIDHeader, "req-checkout-1")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp intentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	// the request continues the trace of the client
+	handler := spanNamed(t, recorder, "POST /create-payment-intent")
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", handler.SpanContext().TraceID().String())
+	require.Equal(t, "req-checkout-1", attributeOf(handler, string(tracing.RequestIDKey)))
+	require.Equal(t, "200", attributeOf(handler, "http.response.status_code"))
+
+	// the Stripe requests are its children, tagged with the Stripe request ID
+	create := spanNamed(t, recorder, "stripe paymentintent.New")
+	require.Equal(t, handler.SpanContext().SpanID(), create.Parent().SpanID())
+	require.NotEmpty(t, attributeOf(create, string(tracing.StripeRequestIDKey)))
+
+	// the intent carries the trace context to the webhook events
+	pi, err := fake.GetPaymentIntent(resp.ID, nil)
+	require.NoError(t, err)
+	origin, ok := tracing.LinkTo(pi.Metadata[tracing.MetadataKey])
+	require.True(t, ok)
+	require.Equal(t, handler.SpanContext().SpanID(), origin.SpanContext.SpanID())
+
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	postEventAt(t, s, "evt_1", stripe.EventTypePaymentIntentSucceeded, time.Now().Add(time.Minute).Unix(), pi)
+
+	delivery := spanNamed(t, recorder, "POST /webhook")
+	require.Len(t, delivery.Links(), 1)
+	require.Equal(t, handler.SpanContext().TraceID(), delivery.Links()[0].SpanContext.TraceID())
+
+	processing := spanNamed(t, recorder, "webhook payment_intent.succeeded")
+	require.NotEqual(t, handler.SpanContext().TraceID(), processing.SpanContext().TraceID())
+	require.Len(t, processing.Links(), 1)
+	require.Equal(t, handler.SpanContext().SpanID(), processing.Links()[0].SpanContext.SpanID())
+	require.Equal(t, "handled", attributeOf(processing, string(tracing.EventResultKey)))
+}
+
+func TestTracingWithIdempotencyKey(t *testing.T) {
+	recorder := recordSpans(t)
+	s, fake := newTestServer(t)
+
+	w := postIdempotent(t, s, "/create-payment-intent", "key_1", `{"currency": "usd"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp intentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	// the intent carries the correlation ID of the key, the same for
+	// every retry, instead of the trace context
+	pi, err := fake.GetPaymentIntent(resp.ID, nil)
+	require.NoError(t, err)
+	require.NotContains(t, pi.Metadata, tracing.MetadataKey)
+	id := pi.Metadata[tracing.CorrelationMetadataKey]
+	require.NotEmpty(t, id)
+	require.Equal(t, id, attributeOf(spanNamed(t, recorder, "stripe paymentintent.New"), string(tracing.CorrelationIDKey)))
+
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	postEventAt(t, s, "evt_1", stripe.EventTypePaymentIntentSucceeded, time.Now().Add(time.Minute).Unix(), pi)
+	require.Equal(t, id, attributeOf(spanNamed(t, recorder, "POST /webhook"), string(tracing.CorrelationIDKey)))
+	require.Equal(t, id, attributeOf(spanNamed(t, recorder, "webhook payment_intent.succeeded"), string(tracing.CorrelationIDKey)))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// maxBodyBytes limits the size of the JSON request bodies.
+const maxBodyBytes = 64 << 10
+
+// Limits of the Stripe metadata.
+// https://docs.stripe.com/metadata#data
+const (
+	maxMetadataKeys        = 50
+	maxMetadataKeyLength   = 40
+	maxMetadataValueLength = 500
+)
+
+// idPrefixes are the prefixes of the Stripe object IDs, by the name of the
+// request fields holding them.
+var idPrefixes = map[string]string{
+	"paymentIntentID": "pi_",
+	"setupIntentID":   "seti_",
+	"customerID":      "cus_",
+	"paymentMethodID": "pm_",
+	"eventID":         "evt_",
+	"approvalID":      "apr_",
+}
+
+// idPattern is what follows the prefix of a Stripe object ID.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,250}$`)
+
+// isoCurrencies are the ISO 4217 codes of the currencies in circulation,
+// without the fund codes and the precious metals.
+var isoCurrencies = func() map[string]bool {
+	codes := map[string]bool{}
+	for _, code := range strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND
+		BOB BRL BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF
+		DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD
+		HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW
+		KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR
+		MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN
+		PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SLL SOS SRD SSP
+		STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS
+		VES VND VUV WST XAF XCD XCG XOF XPF YER ZAR ZMW ZWG`) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validator collects the field errors of a request.
+type validator struct {
+	errs []FieldError
+}
+
+// validatable is implemented by the requests decoded by decodeRequest, they
+// report the problems of their fields to the validator.
+type validatable interface {
+	validate(v *validator)
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) check(ok bool, field, format string, args ...interface{}) {
+	if !ok {
+		v.add(field, format, args...)
+	}
+}
+
+// requiredID checks the Stripe object ID held by the field.
+func (v *validator) requiredID(field, id string) {
+	if id == "" {
+		v.add(field, "is required")
+		return
+	}
+	v.id(field, id)
+}
+
+// id checks the Stripe object ID held by the field, if any.
+func (v *validator) id(field, id string) {
+	if id == "" {
+		return
+	}
+	prefix := idPrefixes[field]
+	rest, ok := strings.CutPrefix(id, prefix)
+	v.check(ok && idPattern.MatchString(rest), field, "must be an ID starting with %s", prefix)
+}
+
+// currency checks the currency code held by the field, if any.
+func (v *validator) currency(field, code string) {
+	v.check(code == "" || isoCurrencies[strings.ToUpper(code)], field, "must be an ISO 4217 currency code")
+}
+
+// positive checks the amount held by the field, if any.
+func (v *validator) positive(field string, amount *int64) {
+	v.check(amount == nil || *amount > 0, field, "must be positive")
+}
+
+// oneOf checks that the field holds one of the allowed values, if any.
+func (v *validator) oneOf(field, value string, allowed map[string]bool) {
+	if value == "" || allowed[value] {
+		return
+	}
+	v.add(field, "must be one of %s", strings.Join(slices.Sorted(maps.Keys(allowed)), ", "))
+}
+
+// metadata checks the metadata held by the field against the Stripe limits.
+func (v *validator) metadata(field string, metadata map[string]string) {
+	v.check(len(metadata) <= maxMetadataKeys, field, "must have at most %d keys", maxMetadataKeys)
+	for key, value := range metadata {
+		v.check(key != "" && len(key) <= maxMetadataKeyLength, field+"."+key, "keys must have 1 to %d characters", maxMetadataKeyLength)
+		v.check(len(value) <= maxMetadataValueLength, field+"."+key, "must have at most %d characters", maxMetadataValueLength)
+	}
+}
+
+// decodeRequest decodes the JSON body of the request into req and validates
+// it. An empty body decodes as an empty object, unknown fields are rejected.
+// The error response is written when it fails.
+func decodeRequest(w http.ResponseWriter, r *http.Request, req validatable) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(req)
+	if err == nil && dec.More() {
+		err = errors.New("trailing data")
+	}
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+	case errors.As(err, &maxBytesErr):
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes", maxBytesErr.Limit))
+		return false
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		writeFieldErrors(w, []FieldError{{Field: typeErr.Field, Message: "must be " + jsonType(typeErr.Type)}})
+		return false
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		writeFieldErrors(w, []FieldError{{Field: field, Message: "is not a known field"}})
+		return false
+	default:
+		writeError(w, http.StatusBadRequest, "request body must be a JSON object")
+		return false
+	}
+
+	v := &validator{}
+	req.validate(v)
+	if len(v.errs) > 0 {
+		writeFieldErrors(w, v.errs)
+		return false
+	}
+	return true
+}
+
+// writeFieldErrors writes the response to a request with invalid fields.
+func writeFieldErrors(w http.ResponseWriter, errs []FieldError) {
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Field+" "+e.Message)
+	}
+	writeAPIError(w, http.StatusBadRequest, APIError{
+		Type:    errorTypeInvalidRequest,
+		Code:    "invalid_fields",
+		Message: strings.Join(messages, "; "),
+		Param:   errs[0].Field,
+		Fields:  errs,
+	})
+}
+
+// jsonType names the JSON type decoded into t.
+func jsonType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestValidation(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		fields  []FieldError
+	}{
+		{
+			name:    "unknown field",
+			handler: s.handleCapturePaymentIntent,
+			body:    `{"paymentIntentID": "pi_1", "amount_to_capture": 100}`,
+			fields:  []FieldError{{Field: "amount_to_capture", Message: "is not a known field"}},
+		},
+		{
+			name:    "wrong type",
+			handler: s.handleCapturePaymentIntent,
+			body:    `{"paymentIntentID": "pi_1", "amount": "100"}`,
+			fields:  []FieldError{{Field: "amount", Message: "must be an integer"}},
+		},
+		{
+			name:    "missing ID",
+			handler: s.handleCancelPaymentIntent,
+			body:    `{}`,
+			fields:  []FieldError{{Field: "paymentIntentID", Message: "is required"}},
+		},
+		{
+			name:    "ID of another object",
+			handler: s.handleRefund,
+			body:    `{"paymentIntentID": "ch_1"}`,
+			fields:  []FieldError{{Field: "paymentIntentID", Message: "must be an ID starting with pi_"}},
+		},
+		{
+			name:    "every problem",
+			handler: s.handleRefund,
+			body:    `{"paymentIntentID": "pi_1", "amount": -5, "reason": "changed_mind"}`,
+			fields: []FieldError{
+				{Field: "amount", Message: "must be positive"},
+				{Field: "reason", Message: "must be one of duplicate, fraudulent, requested_by_customer"},
+			},
+		},
+		{
+			name:    "currency",
+			handler: s.handleChargeSavedPaymentMethod,
+			body:    `{"amount": 100, "currency": "dollars"}`,
+			fields:  []FieldError{{Field: "currency", Message: "must be an ISO 4217 currency code"}},
+		},
+		{
+			name:    "zero amount",
+			handler: s.handleChargeSavedPaymentMethod,
+			body:    `{"amount": 0}`,
+			fields:  []FieldError{{Field: "amount", Message: "must be positive"}},
+		},
+		{
+			name:    "item",
+			handler: s.handleCreatePaymentIntent,
+			body:    `{"items": [{"id": "photo-subscription"}, {"quantity": -1}]}`,
+			fields: []FieldError{
+				{Field: "items[1].id", Message: "is required"},
+				{Field: "items[1].quantity", Message: "must not be negative"},
+			},
+		},
+		{
+			name:    "payment method",
+			handler: s.handleUpdatePaymentMethod,
+			body:    `{"paymentMethodID": "pm_1", "allowRedisplay": "never"}`,
+			fields:  []FieldError{{Field: "allowRedisplay", Message: "must be one of always, limited, unspecified"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postJSON(t, tt.handler, "user_1", tt.body)
+			require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+			e := errorOf(t, w)
+			require.Equal(t, "invalid_request_error", e.Type)
+			require.Equal(t, "invalid_fields", e.Code)
+			require.Equal(t, tt.fields[0].Field, e.Param)
+			require.Equal(t, tt.fields, e.Fields)
+		})
+	}
+}
+
+func TestRequestBodies(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	// an empty body is an empty request
+	w := postJSON(t, s.handleCreatePaymentIntent, "user_1", ``)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = postJSON(t, s.handleCreatePaymentIntent, "user_1", `[]`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "request body must be a JSON object", errorOf(t, w).Message)
+
+	w = postJSON(t, s.handleCreatePaymentIntent, "user_1", `{} {}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postJSON(t, s.handleRefund, "", `{"paymentIntentID": "pi_1", "metadata": {"note": "`+strings.Repeat("a", maxBodyBytes)+`"}}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	require.Equal(t, "invalid_request_error", errorOf(t, w).Type)
+
+	w = postJSON(t, s.handleRefund, "", `{"paymentIntentID": "pi_1", "metadata": {"note": "`+strings.Repeat("a", maxMetadataValueLength+1)+`"}}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, []FieldError{{Field: "metadata.note", Message: "must have at most 500 characters"}}, errorOf(t, w).Fields)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/stripe-samples/saving-card-after-payment/server/go/events"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/logging"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/tracing"
+	"github.com/stripe/stripe-go/v80"
+	"github.com/stripe/stripe-go/v80/webhook"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxWebhookBodyBytes bounds the size of a webhook request body.
+const maxWebhookBodyBytes = 1 << 20
+
+// registerWebhookHandlers registers the built-in handlers. The local copies
+// of the Stripe objects are recorded first, the handlers of specific event
+// types then see the up to date store.
+func (s *Server) registerWebhookHandlers() {
+	events.On(s.webhooks, "payment_intent.*", s.onPaymentIntent)
+	events.On(s.webhooks, "setup_intent.*", s.onSetupIntent)
+	events.On(s.webhooks, stripe.EventTypePaymentMethodAttached, s.onPaymentMethodAttached)
+	events.On(s.webhooks, stripe.EventTypePaymentMethodUpdated, s.onPaymentMethodUpdated)
+	events.On(s.webhooks, stripe.EventTypePaymentMethodAutomaticallyUpdated, s.onPaymentMethodUpdated)
+	events.On(s.webhooks, stripe.EventTypePaymentMethodDetached, s.onPaymentMethodDetached)
+	events.On(s.webhooks, "refund.*", s.onRefund)
+	events.On(s.webhooks, stripe.EventTypeChargeRefundUpdated, s.onRefund)
+
+	events.On(s.webhooks, stripe.EventTypePaymentIntentCreated, s.onPaymentIntentCreated)
+	events.On(s.webhooks, stripe.EventTypePaymentIntentSucceeded, s.onPaymentIntentSucceeded)
+	events.On(s.webhooks, stripe.EventTypePaymentIntentPaymentFailed, s.onPaymentIntentPaymentFailed)
+	events.On(s.webhooks, stripe.EventTypePaymentIntentRequiresAction, s.onPaymentIntentRequiresAction)
+	events.On(s.webhooks, stripe.EventTypePaymentIntentAmountCapturableUpdated, s.onPaymentIntentAmountCapturableUpdated)
+	events.On(s.webhooks, stripe.EventTypePaymentIntentCanceled, s.onPaymentIntentCanceled)
+	events.On(s.webhooks, stripe.EventTypeSetupIntentSucceeded, s.onSetupIntentSucceeded)
+	events.On(s.webhooks, stripe.EventTypeChargeRefunded, s.onChargeRefunded)
+}
+
+// handleWebhook verifies the event and adds it to the inbox, it is
+// processed asynchronously by RunWorkers. The response tells Stripe
+// whether to deliver the event again:
+//
+//   - 200 when the event is queued, or was already received;
+//   - 400 when the request is not a valid event for this endpoint (bad
+//     signature, unreadable body), redelivering it cannot succeed;
+//   - 500 when the inbox is unavailable, Stripe retries the delivery later.
+//
+// Events failing to be processed are retried by the inbox, not by Stripe.
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		slog.WarnContext(r.Context(), "io.ReadAll failed", logging.Err(err))
+		return
+	}
+
+	event, err := webhook.ConstructEvent(b, r.Header.Get("Stripe-Signature"), s.cfg.WebhookSecret)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		slog.WarnContext(r.Context(), "webhook.ConstructEvent failed", logging.Err(err))
+		return
+	}
+
+	// the delivery is linked to the request which created the intent
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(tracing.EventIDKey.String(event.ID), tracing.EventTypeKey.String(string(event.Type)))
+	if link, ok := tracing.EventOrigin(&event); ok {
+		span.AddLink(link)
+	}
+	if id := tracing.EventCorrelationID(&event); id != "" {
+		span.SetAttributes(tracing.CorrelationIDKey.String(id))
+	}
+
+	added, err := s.inbox.Enqueue(r.Context(), &event, b)
+	if err != nil {
+		writeFailure(w, "inbox.Enqueue", err)
+		return
+	}
+
+	status := "queued"
+	if !added {
+		status = events.Duplicate.String()
+	}
+	writeJSON(w, struct {
+		Status string `json:"status"`
+	}{
+		Status: status,
+	})
+}
+
+// onPaymentIntent records the payment intent carried by the event, unless
+// the store already holds a more recent state. An out-of-order event only
+// leaves the store untouched, the other handlers of the event still run:
+// the side effects they trigger, like releasing a verification hold, do not
+// depend on the order of the events.
+func (s *Server) onPaymentIntent(ctx context.Context, event *stripe.Event, pi *stripe.PaymentIntent) error {
+	prev, err := s.store.PaymentIntent(ctx, pi.ID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("store.PaymentIntent: %w", err)
+	case outOfOrder(prev, pi, event.Created):
+		slog.InfoContext(ctx, "not recording an out-of-order event", logging.PaymentIntentID(pi.ID), "recorded_status", prev.Status)
+		return nil
+	}
+
+	rec := store.PaymentIntentFromStripe(pi)
+	rec.Updated = event.Created
+	if err := s.store.SavePaymentIntent(ctx, rec); err != nil {
+		return fmt.Errorf("store.SavePaymentIntent: %w", err)
+	}
+	return nil
+}
+
+// outOfOrder reports whether pi, carried by an event created at the given
+// time, is older than the recorded state prev. prev.Updated is the creation
+// time of the last recorded event, states read from the API do not move it.
+// Events created in the same second are ordered by status, a final status
+// never goes back.
+func outOfOrder(prev store.PaymentIntent, pi *stripe.PaymentIntent, created int64) bool {
+	if created < prev.Updated {
+		return true
+	}
+	return isFinalPaymentIntentStatus(prev.Status) && !isFinalPaymentIntentStatus(string(pi.Status))
+}
+
+func isFinalPaymentIntentStatus(status string) bool {
+	return status == string(stripe.PaymentIntentStatusSucceeded) || status == string(stripe.PaymentIntentStatusCanceled)
+}
+
+func (s *Server) onSetupIntent(ctx context.Context, _ *stripe.Event, si *stripe.SetupIntent) error {
+	s.recordSetupIntent(ctx, si)
+	return nil
+}
+
+// onPaymentMethodAttached records the payment method, which becomes the
+// default one of a customer without default.
+func (s *Server) onPaymentMethodAttached(ctx context.Context, _ *stripe.Event, pm *stripe.PaymentMethod) error {
+	s.recordPaymentMethod(ctx, pm)
+	slog.InfoContext(ctx, "❗ payment method attached to a customer", "payment_method_id", pm.ID)
+	if pm.Customer == nil {
+		return nil
+	}
+	return s.promoteDefaultPaymentMethod(ctx, pm.Customer.ID, pm.ID)
+}
+
+func (s *Server) onPaymentMethodUpdated(ctx context.Context, _ *stripe.Event, pm *stripe.PaymentMethod) error {
+	s.recordPaymentMethod(ctx, pm)
+	return nil
+}
+
+// onPaymentMethodDetached forgets the payment method. When it was the
+// default one of its customer, another saved payment method replaces it.
+func (s *Server) onPaymentMethodDetached(ctx context.Context, event *stripe.Event, pm *stripe.PaymentMethod) error {
+	customerID := s.detachedCustomerID(ctx, event, pm)
+	if err := s.store.DeletePaymentMethod(ctx, pm.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("store.DeletePaymentMethod: %w", err)
+	}
+	if customerID == "" {
+		return nil
+	}
+	return s.reassignDefaultPaymentMethod(ctx, customerID, pm.ID)
+}
+
+func (s *Server) onPaymentIntentSucceeded(ctx context.Context, _ *stripe.Event, pi *stripe.PaymentIntent) error {
+	if string(pi.SetupFutureUsage) == "" {
+		slog.InfoContext(ctx, "❗ customer did not want to save the card", logging.PaymentIntentID(pi.ID))
+	}
+	slog.InfoContext(ctx, "💰 payment received", logging.PaymentIntentID(pi.ID))
+	return s.holds.Settled(ctx, pi)
+}
+
+func (s *Server) onPaymentIntentCanceled(ctx context.Context, _ *stripe.Event, pi *stripe.PaymentIntent) error {
+	return s.holds.Settled(ctx, pi)
+}
+
+func (s *Server) onPaymentIntentPaymentFailed(ctx context.Context, _ *stripe.Event, pi *stripe.PaymentIntent) error {
+	slog.InfoContext(ctx, "❌ payment failed", logging.PaymentIntentID(pi.ID))
+	return nil
+}
+
+func (s *Server) onPaymentIntentRequiresAction(ctx context.Context, _ *stripe.Event, pi *stripe.PaymentIntent) error {
+	slog.InfoContext(ctx, "💰 payment requires action", logging.PaymentIntentID(pi.ID))
+	return nil
+}
+
+// onPaymentIntentAmountCapturableUpdated is sent once the card of a hold is
+// authorized. Verification holds are released by the hold manager.
+func (s *Server) onPaymentIntentAmountCapturableUpdated(ctx context.Context, event *stripe.Event, pi *stripe.PaymentIntent) error {
+	slog.InfoContext(ctx, "💰 capturable amount updated", logging.PaymentIntentID(pi.ID), "amount_capturable", pi.AmountCapturable)
+	return s.holds.Authorized(ctx, pi, time.Unix(event.Created, 0))
+}
+
+// onSetupIntentSucceeded makes the saved payment method the default one of
+// a customer without default.
+func (s *Server) onSetupIntentSucceeded(ctx context.Context, _ *stripe.Event, si *stripe.SetupIntent) error {
+	slog.InfoContext(ctx, "❗ setup intent succeeded, the payment method is saved", "setup_intent_id", si.ID)
+	if si.Customer == nil || si.PaymentMethod == nil {
+		return nil
+	}
+	return s.promoteDefaultPaymentMethod(ctx, si.Customer.ID, si.PaymentMethod.ID)
+}
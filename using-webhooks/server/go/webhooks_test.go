@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/events"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/gateway"
+	"github.com/stripe-samples/saving-card-after-payment/server/go/store"
+	"github.com/stripe/stripe-go/v80"
+	"github.com/stripe/stripe-go/v80/webhook"
+)
+
+// postEvent delivers an event of the given type about object to the webhook
+// endpoint of s, signed with its webhook secret, and processes the due
+// events of the inbox.
+func postEvent(t *testing.T, s *Server, id string, eventType stripe.EventType, object interface{}) *httptest.ResponseRecorder {
+	return postEventAt(t, s, id, eventType, 1700000000, object)
+}
+
+// postEventAt is postEvent for an event created at the given Unix time.
+func postEventAt(t *testing.T, s *Server, id string, eventType stripe.EventType, created int64, object interface{}) *httptest.ResponseRecorder {
+	raw, err := json.Marshal(object)
+	require.NoError(t, err)
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          id,
+		"object":      "event",
+		"type":        eventType,
+		"api_version": stripe.APIVersion,
+		"created":     created,
+		"data":        map[string]json.RawMessage{"object": raw},
+	})
+	require.NoError(t, err)
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: s.cfg.WebhookSecret})
+
+	r := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(signed.Payload))
+	r.Header.Set("Stripe-Signature", signed.Header)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+
+	_, err = s.inbox.ProcessDue(context.Background())
+	require.NoError(t, err)
+	return w
+}
+
+// inboxEvent returns the inbox record of the event.
+func inboxEvent(t *testing.T, s *Server, id string) store.InboxEvent {
+	e, err := s.store.InboxEvent(context.Background(), id)
+	require.NoError(t, err)
+	return e
+}
+
+func webhookStatus(t *testing.T, w *httptest.ResponseRecorder) string {
+	var resp struct {
+		Status string `json:"status"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Status
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("records payment intents and answers success", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		w := postEvent(t, s, "evt_1", stripe.EventTypePaymentIntentSucceeded, map[string]interface{}{
+			"id": "pi_1", "object": "payment_intent", "status": "succeeded", "amount": 1400, "amount_received": 1400, "currency": "usd",
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "queued", webhookStatus(t, w))
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_1").Result)
+
+		pi, err := s.store.PaymentIntent(ctx, "pi_1")
+		require.NoError(t, err)
+		require.Equal(t, "succeeded", pi.Status)
+		require.Equal(t, int64(1400), pi.AmountReceived)
+	})
+
+	t.Run("records and deletes payment methods", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		pm := map[string]interface{}{
+			"id": "pm_1", "object": "payment_method", "type": "card", "customer": "cus_1",
+			"card": map[string]interface{}{"brand": "visa", "last4": "4242", "exp_month": 12, "exp_year": 2030},
+		}
+		w := postEvent(t, s, "evt_1", stripe.EventTypePaymentMethodAttached, pm)
+		require.Equal(t, http.StatusOK, w.Code)
+		saved, err := s.store.PaymentMethod(ctx, "pm_1")
+		require.NoError(t, err)
+		require.Equal(t, "4242", saved.Last4)
+
+		w = postEvent(t, s, "evt_2", stripe.EventTypePaymentMethodDetached, pm)
+		require.Equal(t, http.StatusOK, w.Code)
+		_, err = s.store.PaymentMethod(ctx, "pm_1")
+		require.ErrorIs(t, err, store.ErrNotFound)
+	})
+
+	t.Run("ignores events without handler", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		w := postEvent(t, s, "evt_1", stripe.EventTypeCustomerCreated, map[string]interface{}{"id": "cus_1", "object": "customer"})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "ignored", inboxEvent(t, s, "evt_1").Result)
+	})
+
+	t.Run("acknowledges duplicates without running handlers again", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		calls := 0
+		events.On(s.Webhooks(), stripe.EventTypeChargeRefunded, func(context.Context, *stripe.Event, *stripe.Charge) error {
+			calls++
+			return nil
+		})
+		charge := map[string]interface{}{"id": "ch_1", "object": "charge"}
+		w := postEvent(t, s, "evt_1", stripe.EventTypeChargeRefunded, charge)
+		require.Equal(t, "queued", webhookStatus(t, w))
+		w = postEvent(t, s, "evt_1", stripe.EventTypeChargeRefunded, charge)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "duplicate", webhookStatus(t, w))
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("does not record payment intent events older than the recorded state", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		postEventAt(t, s, "evt_2", stripe.EventTypePaymentIntentSucceeded, 1700000010, map[string]interface{}{
+			"id": "pi_1", "object": "payment_intent", "status": "succeeded", "amount": 1400, "amount_received": 1400,
+		})
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_2").Result)
+
+		// created earlier than the recorded state
+		postEventAt(t, s, "evt_1", stripe.EventTypePaymentIntentRequiresAction, 1700000005, map[string]interface{}{
+			"id": "pi_1", "object": "payment_intent", "status": "requires_action", "amount": 1400,
+		})
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_1").Result)
+
+		// created in the same second, a succeeded intent does not go back
+		postEventAt(t, s, "evt_3", stripe.EventTypePaymentIntentPaymentFailed, 1700000010, map[string]interface{}{
+			"id": "pi_1", "object": "payment_intent", "status": "requires_payment_method", "amount": 1400,
+		})
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_3").Result)
+
+		pi, err := s.store.PaymentIntent(ctx, "pi_1")
+		require.NoError(t, err)
+		require.Equal(t, "succeeded", pi.Status)
+		require.Equal(t, int64(1700000010), pi.Updated)
+	})
+
+	t.Run("releases verification holds once the card is authorized", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		w := postJSON(t, s.handleCreatePaymentIntent, "user_1", `{}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp intentResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+		hold, err := s.store.Hold(ctx, resp.ID)
+		require.NoError(t, err)
+		require.Equal(t, store.HoldVerification, hold.Purpose)
+		require.Equal(t, store.HoldPending, hold.Status)
+
+		pi, err := fake.GetPaymentIntent(resp.ID, nil)
+		require.NoError(t, err)
+		pm := fake.AddPaymentMethod(pi.Customer.ID, gateway.CardSucceeds)
+		pi, err = fake.ConfirmPaymentIntent(pi.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: stripe.String(pm.ID)})
+		require.NoError(t, err)
+
+		postEventAt(t, s, "evt_1", stripe.EventTypePaymentIntentAmountCapturableUpdated, time.Now().Unix()+1, pi)
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_1").Result)
+
+		pi, err = fake.GetPaymentIntent(resp.ID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusCanceled, pi.Status)
+		hold, err = s.store.Hold(ctx, resp.ID)
+		require.NoError(t, err)
+		require.Equal(t, store.HoldCanceled, hold.Status)
+	})
+
+	t.Run("releases verification holds on events older than an API read", func(t *testing.T) {
+		s, fake := newTestServer(t)
+		w := postJSON(t, s.handleCreatePaymentIntent, "user_1", `{}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp intentResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+		pi, err := fake.GetPaymentIntent(resp.ID, nil)
+		require.NoError(t, err)
+		pm := fake.AddPaymentMethod(pi.Customer.ID, gateway.CardSucceeds)
+		pi, err = fake.ConfirmPaymentIntent(pi.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: stripe.String(pm.ID)})
+		require.NoError(t, err)
+
+		// the confirmed intent is read before the event arrives
+		w = postJSON(t, s.handleConfirmPaymentIntent, "user_1", `{"paymentIntentID": "`+pi.ID+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		postEventAt(t, s, "evt_1", stripe.EventTypePaymentIntentAmountCapturableUpdated, time.Now().Unix()-1, pi)
+		require.Equal(t, "handled", inboxEvent(t, s, "evt_1").Result)
+
+		pi, err = fake.GetPaymentIntent(resp.ID, nil)
+		require.NoError(t, err)
+		require.Equal(t, stripe.PaymentIntentStatusCanceled, pi.Status)
+		hold, err := s.store.Hold(ctx, resp.ID)
+		require.NoError(t, err)
+		require.Equal(t, store.HoldCanceled, hold.Status)
+	})
+
+	t.Run("rejects bad signatures", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		r := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader([]byte(`{"id":"evt_1"}`)))
+		r.Header.Set("Stripe-Signature", "t=1,v1=deadbeef")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("moves undecodable payloads to the dead-letter list", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		w := postEvent(t, s, "evt_1", stripe.EventTypePaymentIntentSucceeded, map[string]interface{}{"id": "pi_1", "amount": "a lot"})
+		require.Equal(t, http.StatusOK, w.Code)
+		e := inboxEvent(t, s, "evt_1")
+		require.Equal(t, store.InboxDead, e.Status)
+		require.Equal(t, 1, e.Attempts)
+	})
+
+	t.Run("retries failed events and replays dead letters", func(t *testing.T) {
+		now := time.Unix(1700000000, 0)
+		s, _ := newTestServer(t, func(cfg *Config) {
+			cfg.AdminToken = "admin-token-for-tests"
+			cfg.Webhooks.MaxAttempts = 2
+			cfg.Webhooks.Now = func() time.Time { return now }
+		})
+		fail := true
+		calls := 0
+		events.On(s.Webhooks(), stripe.EventTypeChargeRefunded, func(context.Context, *stripe.Event, *stripe.Charge) error {
+			calls++
+			if fail {
+				return errors.New("database unavailable")
+			}
+			return nil
+		})
+
+		w := postEvent(t, s, "evt_1", stripe.EventTypeChargeRefunded, map[string]interface{}{"id": "ch_1", "object": "charge"})
+		require.Equal(t, http.StatusOK, w.Code, "the event is acknowledged before it is processed")
+		e := inboxEvent(t, s, "evt_1")
+		require.Equal(t, store.InboxPending, e.Status)
+		require.Equal(t, "database unavailable", e.LastError)
+		require.Equal(t, now.Add(time.Second).Unix(), e.NextAttempt)
+
+		// not due yet
+		n, err := s.inbox.ProcessDue(ctx)
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		now = now.Add(time.Second)
+		_, err = s.inbox.ProcessDue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, store.InboxDead, inboxEvent(t, s, "evt_1").Status)
+		require.Equal(t, 2, calls)
+
+		admin := func(method, path, body, token string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, path, strings.NewReader(body))
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			return w
+		}
+		require.Equal(t, http.StatusUnauthorized, admin(http.MethodGet, "/admin/webhooks/dead-letters", "", "").Code)
+		require.Equal(t, http.StatusUnauthorized, admin(http.MethodGet, "/admin/webhooks/dead-letters", "", "wrong").Code)
+
+		w = admin(http.MethodGet, "/admin/webhooks/dead-letters", "", "admin-token-for-tests")
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			DeadLetters []DeadLetter `json:"deadLetters"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.DeadLetters, 1)
+		require.Equal(t, "evt_1", resp.DeadLetters[0].ID)
+		require.Equal(t, 2, resp.DeadLetters[0].Attempts)
+
+		fail = false
+		w = admin(http.MethodPost, "/admin/webhooks/replay", `{"eventID": "evt_1"}`, "admin-token-for-tests")
+		require.Equal(t, http.StatusOK, w.Code)
+		_, err = s.inbox.ProcessDue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, store.InboxDone, inboxEvent(t, s, "evt_1").Status)
+
+		w = admin(http.MethodPost, "/admin/webhooks/replay", `{"eventID": "evt_1"}`, "admin-token-for-tests")
+		require.Equal(t, http.StatusConflict, w.Code)
+		w = admin(http.MethodPost, "/admin/webhooks/replay", `{"eventID": "evt_2"}`, "admin-token-for-tests")
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("does not serve the admin endpoints without a token", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		r := httptest.NewRequest(http.MethodGet, "/admin/webhooks/dead-letters", nil)
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}